@@ -3,13 +3,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"godb/internal/cli"
+	"godb/internal/logging"
+	"godb/internal/schema"
+	"godb/internal/store"
 	"io"
-	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,6 +22,8 @@ import (
 	"golang.org/x/term"
 )
 
+var serverLog = logging.New("server")
+
 func cleanInput(text string) []string {
 	return strings.Fields(strings.ToLower(text))
 }
@@ -30,7 +37,7 @@ func ProcessCommand(input string, config *cli.DatabaseConfig, w io.Writer) error
 	if !ok {
 		return fmt.Errorf("unknown command")
 	}
-	return cmd.Callback(config, cleanLine[1:], w)
+	return cmd.Run(config, cleanLine[1:], w)
 }
 
 // RunREPL runs the interactive prompt.
@@ -39,7 +46,7 @@ func ProcessCommand(input string, config *cli.DatabaseConfig, w io.Writer) error
 func RunREPL(config *cli.DatabaseConfig) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for {
-		fmt.Printf("Go-DB [%s]> ", config.TableS.Schema().TableName)
+		fmt.Printf("Go-DB [%s]> ", config.ActiveTableName())
 		scanner.Scan()
 		err := ProcessCommand(scanner.Text(), config, os.Stdout)
 		if err != nil {
@@ -50,18 +57,38 @@ func RunREPL(config *cli.DatabaseConfig) {
 
 func handleTCPConnection(conn net.Conn, baseConfig *cli.DatabaseConfig) {
 	defer conn.Close()
-	log.Printf("Client connected: %s", conn.RemoteAddr().String())
+	serverLog.Info("client connected: %s", conn.RemoteAddr().String())
+
+	// queries run under a context that ends when the client goes away
+	connCtx, cancel := context.WithCancel(baseConfig.Context())
+	defer cancel()
 
 	sessionConfig := baseConfig.Clone()
+	sessionConfig.SetQueryContext(connCtx)
 
 	writer := bufio.NewWriter(conn)
 	scanner := bufio.NewScanner(conn)
 
-	fmt.Fprintf(writer, "Go-DB [%s]> ", sessionConfig.TableS.Schema().TableName)
+	// read on a separate goroutine so a broken connection is noticed mid-command
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		// EOF may be a half-close with the last command still to answer, so
+		// that's left to the deferred cancel once the loop below has drained;
+		// a read error means the client is gone
+		if err := scanner.Err(); err != nil {
+			serverLog.Warn("scanner error: %v", err)
+			cancel()
+		}
+	}()
+
+	fmt.Fprintf(writer, "Go-DB [%s]> ", sessionConfig.ActiveTableName())
 	_ = writer.Flush()
-	for scanner.Scan() {
-		input := scanner.Text()
-		log.Printf("Received: %s", input)
+	for input := range lines {
+		serverLog.Debug("received: %s", input)
 
 		err := ProcessCommand(input, sessionConfig, conn)
 		if err != nil {
@@ -69,18 +96,110 @@ func handleTCPConnection(conn net.Conn, baseConfig *cli.DatabaseConfig) {
 		}
 
 		// send prompt for next command
-		fmt.Fprintf(writer, "\nGo-DB [%s]> ", sessionConfig.TableS.Schema().TableName)
+		fmt.Fprintf(writer, "\nGo-DB [%s]> ", sessionConfig.ActiveTableName())
 		writer.Flush()
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Scanner error: %v", err)
+	serverLog.Info("client disconnected: %s", conn.RemoteAddr().String())
+}
+
+// serveTCP accepts connections on listener until ctx is cancelled.
+func serveTCP(ctx context.Context, listener net.Listener, config *cli.DatabaseConfig) {
+	defer listener.Close()
+
+	serverLog.Info("TCP server listening on %v", listener.Addr().String())
+
+	// channel for accepted connections
+	connChan := make(chan net.Conn)
+
+	// goroutine that accepts connections
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// listener closed, stop accepting
+				close(connChan)
+				return
+			}
+			connChan <- conn
+		}
+	}()
+
+	// main loop: select between context and connections
+	for {
+		select {
+		case <-ctx.Done():
+			// context cancelled, close listener and exit
+			listener.Close()
+			return
+		case conn, ok := <-connChan:
+			if !ok {
+				// channel closed (listener error), exit
+				return
+			}
+			go handleTCPConnection(conn, config)
+		}
 	}
-	log.Printf("Client disconnected: %s", conn.RemoteAddr().String())
 }
 
+// isFlagSet reports whether name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// defaultTable is the table a new session starts on. It's created with
+// defaultSchema if it doesn't exist; an existing one is opened as it is.
+const defaultTable = "table.db"
+
+var defaultSchema = schema.Schema{
+	TableName: "table",
+	Fields: []schema.Field{
+		{Name: "id", Type: schema.IntType},
+		{Name: "name", Type: schema.StringType},
+		{Name: "age", Type: schema.IntType},
+	},
+}
+
+func openDefaultTable(ctx context.Context, wg *sync.WaitGroup) (*store.BTreeStore, error) {
+	ts, err := cli.GetOrOpenTable(defaultTable, ctx, wg)
+	if errors.Is(err, os.ErrNotExist) {
+		return cli.CreateTable(defaultTable, defaultSchema, ctx, wg)
+	}
+	return ts, err
+}
+
+// defaultPort is used when neither -port nor GODB_PORT is set.
+const defaultPort = 42069
+
 func main() {
-	log.SetOutput(os.Stderr)
+	port := flag.Int("port", defaultPort, "TCP port to listen on (env GODB_PORT)")
+	flag.Parse()
+	if env := os.Getenv("GODB_PORT"); env != "" && !isFlagSet("port") {
+		p, err := strconv.Atoi(env)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid GODB_PORT: %v\n", err)
+			os.Exit(1)
+		}
+		*port = p
+	}
+	if *port < 1 || *port > 65535 {
+		fmt.Fprintf(os.Stderr, "invalid port %d\n", *port)
+		os.Exit(1)
+	}
+
+	// e.g. GODB_LOG=debug or GODB_LOG=info,pager=debug
+	if spec := os.Getenv("GODB_LOG"); spec != "" {
+		if err := logging.Configure(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid GODB_LOG: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	// create root context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -92,9 +211,10 @@ func main() {
 
 	var wg sync.WaitGroup
 
-	ts, err := cli.GetOrOpenTable("table.db", ctx, &wg)
+	ts, err := openDefaultTable(ctx, &wg)
 	if err != nil {
-		log.Fatal(err)
+		serverLog.Error("failed to open default table: %v", err)
+		os.Exit(1)
 	}
 
 	config := cli.NewDatabaseConfig(ts, ctx, &wg)
@@ -108,54 +228,29 @@ func main() {
 		os.Exit(0)
 	}()
 
-	go func() {
-		listener, err := net.Listen("tcp", ":42069")
-		if err != nil {
-			log.Printf("TCP server failed: %v", err)
-		}
-		defer listener.Close()
-
-		log.Printf("TCP server listening on %v\n", listener.Addr().String())
-
-		// channel for accepted connections
-		connChan := make(chan net.Conn)
-
-		// goroutine that accepts connections
-		go func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					// listener closed, stop accepting
-					close(connChan)
-					return
-				}
-				connChan <- conn
-			}
-		}()
-
-		// main loop: select between context and connections
-		for {
-			select {
-			case <-ctx.Done():
-				// context cancelled, close listener and exit
-				listener.Close()
-				return
-			case conn, ok := <-connChan:
-				if !ok {
-					// channel closed (listener error), exit
-					return
-				}
-				go handleTCPConnection(conn, config)
-			}
+	// without a terminal the TCP server is all there is, so failing to bind is fatal
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	addr := ":" + strconv.Itoa(*port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		serverLog.Error("TCP server can't listen on %s: %v (set -port or GODB_PORT)", addr, err)
+		if !interactive {
+			cancel()
+			wg.Wait()
+			os.Exit(1)
 		}
-	}()
+	} else {
+		go serveTCP(ctx, listener, config)
+	}
 
 	// Only run REPL if stdin is a TTY (interactive terminal)
 	// Use term.IsTerminal to properly detect terminals vs redirected/piped stdin
-	if term.IsTerminal(int(os.Stdin.Fd())) {
-		RunREPL(config)
+	if interactive {
+		// the REPL is a session like any other, so its use/create don't
+		// change the table new TCP sessions start on
+		RunREPL(config.Clone())
 	} else {
-		log.Println("Running in background mode (no REPL), TCP server only")
+		serverLog.Info("running in background mode (no REPL), TCP server only")
 		// Block forever, letting TCP server and signal handler run
 		select {}
 	}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"godb/internal/cli"
+	"godb/internal/schema"
+	"godb/internal/store"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHalfClosedClientGetsItsLastAnswer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	sch := schema.Schema{
+		TableName: "people",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "name", Type: schema.StringType},
+		},
+	}
+	ts, err := cli.CreateTable("people.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+		ts.Close()
+	}()
+	const rows = 2000
+	for i := 1; i <= rows; i++ {
+		if _, err := ts.Insert(schema.Record{"id": int32(i), "name": fmt.Sprintf("person_%d", i)}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		handleTCPConnection(conn, cli.NewDatabaseConfig(ts, ctx, wg))
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// send one command and say we're done writing, as `echo select | nc -N` does
+	if _, err := io.WriteString(conn, "select\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	<-done
+	if strings.Contains(string(out), "error:") {
+		t.Fatalf("select failed after the half-close: %s", out[strings.Index(string(out), "error:"):])
+	}
+	if !strings.Contains(string(out), fmt.Sprintf("person_%d ", rows)) {
+		t.Errorf("select output is missing the last row (%d bytes)", len(out))
+	}
+}
+
+func TestDefaultTableOpensWithItsOwnSchema(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// a table.db left by an earlier run, with columns the default lacks
+	sch := defaultSchema
+	sch.Fields = append(slices.Clone(sch.Fields), schema.Field{Name: "email", Type: schema.StringType})
+	existing, err := store.CreateWithOptions(defaultTable, sch, store.StoreOptions{}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := existing.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := openDefaultTable(ctx, wg)
+	if err != nil {
+		t.Fatalf("openDefaultTable refused the existing table: %v", err)
+	}
+	defer ts.Close()
+	if !ts.Schema().HasField("email") {
+		t.Errorf("opened with schema %v, want the file's own", ts.Schema().Fields)
+	}
+}
@@ -1,21 +1,63 @@
 package btree
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"godb/internal/logging"
 	"godb/internal/pager"
 	"godb/internal/schema"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sync/atomic"
 )
 
 type BTree struct {
 	pc *pager.PageCache
+
+	maxRecordSize  atomic.Int64 // 0 means pager.MaxRecordSize
+	maxDepth       atomic.Int64 // 0 means DefaultMaxDepth
+	allowNonFinite atomic.Bool  // let NaN and ±Inf floats through SerializeRecord
+
+	overflowHint pager.PageID // overflow page last written to, 0 for none; see storeOverflow
+
+	// keys written since TrackChanges, nil when not tracking
+	changed map[uint64]bool
+	// told the keys each write touches; see OnChange
+	onChange func(keys ...uint64)
+
+	format atomic.Pointer[recordFormat]
+}
+
+// recordFormat is the schema and codec records are encoded with, built
+// from the header once instead of on every insert and read. The header's
+// codec flags are fixed at create; only SetTableName changes the schema.
+type recordFormat struct {
+	schema schema.Schema
+	codec  schema.Codec
+	err    error // building the codec failed, e.g. an unknown codec type
 }
 
 func NewBTree(dm *pager.DiskManager, header *pager.TableHeader) *BTree {
 	npc := pager.NewPageCache(dm, header)
-	return &BTree{
+	bt := &BTree{
 		pc: npc,
 	}
+	bt.refreshFormat()
+	return bt
+}
+
+// refreshFormat rebuilds the cached record format from the header.
+func (bt *BTree) refreshFormat() {
+	codec, err := bt.recordCodec()
+	bt.format.Store(&recordFormat{schema: bt.pc.GetHeader().Schema, codec: codec, err: err})
+}
+
+func (bt *BTree) SetLogger(l logging.Logger) {
+	bt.pc.SetLogger(l)
 }
 
 func (bt *BTree) allocatePage() pager.PageID {
@@ -46,9 +88,59 @@ func (bt *BTree) writeNode(node *BNode) error {
 	return bt.pc.MakeDirty(node.PageID)
 }
 
+// ErrCorruptTree reports a child pointer that can't lead to a tree page.
+var ErrCorruptTree = errors.New("corrupt tree")
+
+// DefaultMaxDepth is how many levels a descent goes before giving up with
+// ErrTreeTooDeep. A 4KB-page tree of any real size is a handful of levels,
+// so only a cycle of child pointers gets near it.
+const DefaultMaxDepth = 100
+
+// ErrTreeTooDeep reports a descent that passed the depth limit without
+// reaching a leaf, most likely because child pointers form a cycle. It
+// comes wrapped with ErrCorruptTree.
+var ErrTreeTooDeep = errors.New("tree deeper than the depth limit")
+
+// SetMaxDepth changes how many levels a descent may go, DefaultMaxDepth
+// by default; 0 restores the default.
+func (bt *BTree) SetMaxDepth(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max depth must not be negative, got %d", n)
+	}
+	bt.maxDepth.Store(int64(n))
+	return nil
+}
+
+func (bt *BTree) depthLimit() int {
+	if n := bt.maxDepth.Load(); n > 0 {
+		return int(n)
+	}
+	return DefaultMaxDepth
+}
+
+func (bt *BTree) tooDeep(from pager.PageID) error {
+	return fmt.Errorf("descent from page %d went %d levels without reaching a leaf: %w: %w", from, bt.depthLimit(), ErrTreeTooDeep, ErrCorruptTree)
+}
+
+// checkChild rejects descending from parent into page 0. That's the table
+// header, so a zero child means a node was left half-updated (e.g. an unset
+// RightmostChild); following it would read the header as a node.
+func checkChild(parent, child pager.PageID) error {
+	if child == 0 {
+		return fmt.Errorf("internal page %d has a child pointer to page 0: %w", parent, ErrCorruptTree)
+	}
+	return nil
+}
+
 func (bt *BTree) findLeaf(key uint64, breadcrumbs *BTStack) (pager.PageID, error) {
 	currentPageID := bt.pc.GetRootPageID()
-	for {
+	if currentPageID == 0 {
+		return 0, fmt.Errorf("root page is 0: %w", ErrCorruptTree)
+	}
+	for depth := 0; ; depth++ {
+		if depth == bt.depthLimit() {
+			return 0, bt.tooDeep(bt.pc.GetRootPageID())
+		}
 		node, err := bt.loadNode(currentPageID)
 		if err != nil {
 			return 0, fmt.Errorf("failed to load page %d: %w", currentPageID, err)
@@ -60,12 +152,40 @@ func (bt *BTree) findLeaf(key uint64, breadcrumbs *BTStack) (pager.PageID, error
 		}
 
 		childPageID, insertionIndex := node.SearchInternal(key)
+		if err := checkChild(currentPageID, childPageID); err != nil {
+			return 0, err
+		}
 		breadcrumbs.push(currentPageID, insertionIndex)
 		currentPageID = childPageID
 	}
 	return currentPageID, nil
 }
 
+// PathTo returns the pages a lookup of key reads, from the root down to the
+// leaf that holds key, or would if it were inserted.
+func (bt *BTree) PathTo(key uint64) ([]pager.PageID, error) {
+	breadcrumbs := &BTStack{}
+	leafID, err := bt.findLeaf(key, breadcrumbs)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]pager.PageID, 0, breadcrumbs.Length()+1)
+	for _, bc := range breadcrumbs.Crumbs {
+		path = append(path, bc.PageID)
+	}
+	return append(path, leafID), nil
+}
+
+// PageSummary returns a page's type and the number of keys on it.
+func (bt *BTree) PageSummary(id pager.PageID) (pager.PageType, int, error) {
+	node, err := bt.loadNode(id)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to load page %d: %w", id, err)
+	}
+	defer bt.pc.UnPin(node.PageID)
+	return node.PageType, int(node.NumSlots), nil
+}
+
 func (bt *BTree) handleRootSplit(promotedKey uint64, leftChildID, rightChildID pager.PageID) error {
 	// allocate a page for the new root node
 	newRootID := bt.allocatePage()
@@ -91,6 +211,27 @@ func (bt *BTree) handleRootSplit(promotedKey uint64, leftChildID, rightChildID p
 	return bt.writeNode(newRoot)
 }
 
+// insertSeparator adds promotedKey to an internal node after the child
+// leftPageID split, leaving rightPageID the new right half: keys below
+// promotedKey go left, and whatever pointed at leftPageID now points right.
+func insertSeparator(node *BNode, promotedKey uint64, leftPageID, rightPageID pager.PageID) error {
+	// [promotedKey, leftPageID] means keys < promotedKey go to leftPageID
+	internalRecord := pager.SerializeInternalRecord(promotedKey, leftPageID)
+	insertIndex, err := node.InsertRecordSorted(internalRecord)
+	if err != nil {
+		return err
+	}
+	if insertIndex+1 < int(node.NumSlots) {
+		// update the next record to point to the right child
+		oldKey, _ := pager.DeserializeInternalRecord(node.Records[insertIndex+1])
+		node.Records[insertIndex+1] = pager.SerializeInternalRecord(oldKey, rightPageID)
+	} else {
+		// inserted as last key - update the RightmostChild
+		node.RightmostChild = rightPageID
+	}
+	return nil
+}
+
 func (bt *BTree) propogateSplit(promotedKey uint64, rightPageID, leftPageID pager.PageID, breadcrumbs *BTStack, sequential bool) error {
 	// leftPageID and rightPageID represent the two children from the most recent split
 	// promotedKey is the separator between them
@@ -103,21 +244,9 @@ func (bt *BTree) propogateSplit(promotedKey uint64, rightPageID, leftPageID page
 		}
 		defer bt.pc.UnPin(parent.PageID)
 
-		// insert the promoted key into the parent
-		// [promotedKey, leftPageID] means keys < promotedKey go to leftPageID
-		internalRecord := pager.SerializeInternalRecord(promotedKey, leftPageID)
-		insertIndex, err := parent.InsertRecordSorted(internalRecord)
-
+		err = insertSeparator(parent, promotedKey, leftPageID, rightPageID)
 		if err == nil {
 			// success - write the parent node
-			if insertIndex+1 < int(parent.NumSlots) {
-				// update the next record to point to the right child
-				oldKey, _ := pager.DeserializeInternalRecord(parent.Records[insertIndex+1])
-				parent.Records[insertIndex+1] = pager.SerializeInternalRecord(oldKey, rightPageID)
-			} else {
-				// inserted as last key - update the RightmostChild
-				parent.RightmostChild = rightPageID
-			}
 			return bt.writeNode(parent)
 		}
 
@@ -134,6 +263,16 @@ func (bt *BTree) propogateSplit(promotedKey uint64, rightPageID, leftPageID page
 		}
 		defer bt.pc.UnPin(rightNode.PageID)
 
+		// the separator that didn't fit still has to go in, into whichever
+		// half now holds the pointer to the child that split
+		half := parent
+		if promotedKey > newPromotedKey {
+			half = rightNode
+		}
+		if err := insertSeparator(half, promotedKey, leftPageID, rightPageID); err != nil {
+			return fmt.Errorf("failed to insert separator %d after splitting page %d: %w", promotedKey, parent.PageID, err)
+		}
+
 		// write both halves of parent split and increment NextPageID
 		if err := bt.writeNode(parent); err != nil {
 			return err
@@ -154,12 +293,21 @@ func (bt *BTree) propogateSplit(promotedKey uint64, rightPageID, leftPageID page
 	return bt.handleRootSplit(promotedKey, leftPageID, rightPageID)
 }
 
-func (bt *BTree) Insert(key uint64, data []byte) error {
+func (bt *BTree) Insert(key uint64, data []byte) (err error) {
+	bt.noteChange(key)
 	breadcrumbs := &BTStack{}
 	defer func() {
 		bt.pc.FlushHeader()
+		if err == nil {
+			err = bt.flushWrites()
+		}
 	}()
 
+	if err := bt.checkRecordSize(key, data); err != nil {
+		return err
+	}
+	data = bt.encodeLeaf(data)
+
 	// traverse to leaf, collecting breadcrumbs
 	leafPageID, err := bt.findLeaf(key, breadcrumbs)
 	if err != nil {
@@ -172,9 +320,15 @@ func (bt *BTree) Insert(key uint64, data []byte) error {
 	}
 	defer bt.pc.UnPin(leaf.PageID)
 	if _, present := leaf.Search(key); present {
-		return fmt.Errorf("key %d already exists", key)
+		return fmt.Errorf("key %d: %w", key, ErrDuplicateKey)
+	}
+	// past the leaf's last key, e.g. ascending ids: append without searching
+	sequential := leaf.NumSlots > 0 && key > leaf.GetKey(int(leaf.NumSlots)-1)
+	if sequential {
+		_, err = leaf.InsertRecord(data)
+	} else {
+		_, err = leaf.InsertRecordSorted(data)
 	}
-	_, err = leaf.InsertRecordSorted(data)
 
 	if err == nil {
 		// happy path
@@ -189,9 +343,6 @@ func (bt *BTree) Insert(key uint64, data []byte) error {
 	// page was full, time to split
 	nextPage := bt.allocatePage()
 
-	// check to see if insertion is sequential
-	sequential := len(leaf.Records) > 0 && key > leaf.GetKey(int(leaf.NumSlots)-1)
-
 	rightNode, promotedKey, err := leaf.splitNode(nextPage, sequential)
 	if err != nil {
 		return err
@@ -230,13 +381,13 @@ func (bt *BTree) Insert(key uint64, data []byte) error {
 }
 
 func (bt *BTree) Search(key uint64) ([]byte, bool, error) {
-	// safety net
-	maxDepth := 100
-
 	currentPageID := bt.pc.GetRootPageID()
+	if currentPageID == 0 {
+		return nil, false, fmt.Errorf("root page is 0: %w", ErrCorruptTree)
+	}
 
 	// traverse down to leaf
-	for depth := 0; depth < maxDepth; depth++ {
+	for depth := 0; depth < bt.depthLimit(); depth++ {
 		node, err := bt.loadNode(currentPageID)
 		if err != nil {
 			return nil, false, fmt.Errorf("failed to load page %d: %w", currentPageID, err)
@@ -252,33 +403,111 @@ func (bt *BTree) Search(key uint64) ([]byte, bool, error) {
 
 			// get the data record
 			data, err := node.GetRecord(slotIndex)
+			if err == nil {
+				data, err = bt.resolve(key, data)
+			}
+			bt.pc.UnPin(node.PageID)
 			if err != nil {
-				bt.pc.UnPin(node.PageID)
 				return nil, false, err
 			}
-			bt.pc.UnPin(node.PageID)
 			return data, true, nil
 		}
 
 		// internal node - find child
 		childPageID, _ := node.SearchInternal(key)
 		bt.pc.UnPin(node.PageID)
+		if err := checkChild(currentPageID, childPageID); err != nil {
+			return nil, false, err
+		}
 		currentPageID = childPageID
 	}
-	return nil, false, nil // key not found in 100 rounds
+	return nil, false, bt.tooDeep(bt.pc.GetRootPageID())
+}
+
+var ErrDuplicateKey = errors.New("key already exists")
+
+// ErrRecordTooLarge is returned for a record over the tree's size limit,
+// which is at most pager.MaxRecordSize - past that no page could hold it.
+var ErrRecordTooLarge = errors.New("record too large")
+
+// SetMaxRecordSize lowers the record size limit below what a page can hold;
+// 0 restores the default, pager.MaxRecordSize.
+func (bt *BTree) SetMaxRecordSize(n int) error {
+	if n < 0 || n > pager.MaxRecordSize {
+		return fmt.Errorf("record size limit %d outside 0..%d", n, pager.MaxRecordSize)
+	}
+	bt.maxRecordSize.Store(int64(n))
+	return nil
+}
+
+func (bt *BTree) MaxRecordSize() int {
+	limit := pager.MaxRecordSize
+	if bt.forwarding() {
+		limit-- // the tag byte
+	}
+	if n := bt.maxRecordSize.Load(); n > 0 {
+		return min(int(n), limit)
+	}
+	return limit
+}
+
+func (bt *BTree) checkRecordSize(key uint64, data []byte) error {
+	if limit := bt.MaxRecordSize(); len(data) > limit {
+		return fmt.Errorf("record for key %d is %d bytes, limit is %d: %w", key, len(data), limit, ErrRecordTooLarge)
+	}
+	return nil
+}
+
+// SetAllowNonFinite lets SerializeRecord accept NaN and ±Inf float values,
+// which it rejects with schema.ErrNonFiniteFloat by default.
+func (bt *BTree) SetAllowNonFinite(allow bool) {
+	bt.allowNonFinite.Store(allow)
 }
 
+// ErrStopScan can be returned from a RangeScanFunc callback to end the scan early without error.
+var ErrStopScan = errors.New("stop scan")
+
 func (bt *BTree) RangeScan(startKey, endKey uint64) ([][]byte, error) {
+	var results [][]byte
+	err := bt.RangeScanFunc(startKey, endKey, func(key uint64, data []byte) error {
+		results = append(results, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// RangeScanFunc calls fn for every record with a key in [startKey, endKey], in key order.
+// The leaf holding the record stays pinned for the duration of the call.
+func (bt *BTree) RangeScanFunc(startKey, endKey uint64, fn func(key uint64, data []byte) error) error {
+	return bt.RangeScanFuncCtx(context.Background(), startKey, endKey, fn)
+}
+
+// RangeScanFuncCtx is RangeScanFunc that checks ctx before each leaf and
+// returns ctx.Err() once it's cancelled.
+func (bt *BTree) RangeScanFuncCtx(ctx context.Context, startKey, endKey uint64, fn func(key uint64, data []byte) error) error {
+	return bt.RangeScanExCtx(ctx, startKey, endKey, true, true, fn)
+}
+
+// RangeScanExCtx is RangeScanFuncCtx with each end of the range inclusive or
+// exclusive, e.g. (startKey, endKey] for keyset pagination. A range that holds
+// no keys, such as (5, 5], calls fn zero times.
+func (bt *BTree) RangeScanExCtx(ctx context.Context, startKey, endKey uint64, includeStart, includeEnd bool, fn func(key uint64, data []byte) error) error {
 	// start at the leaf containing startKey
 	leafPageID, err := bt.findLeaf(startKey, &BTStack{})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var results [][]byte
 	visited := make(map[pager.PageID]bool) // cycle detection
 
 	for leafPageID != 0 { // 0 = end of the line
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Check for cycles
 		if visited[leafPageID] {
 			// Build chain for debugging
@@ -290,31 +519,165 @@ func (bt *BTree) RangeScan(startKey, endKey uint64) ([][]byte, error) {
 				current = n.NextLeaf
 				bt.pc.UnPin(n.PageID)
 			}
-			return nil, fmt.Errorf("cycle detected in leaf chain at page %d. Chain: %s", leafPageID, chain)
+			return fmt.Errorf("cycle detected in leaf chain at page %d. Chain: %s", leafPageID, chain)
 		}
 		visited[leafPageID] = true
 
 		leaf, err := bt.loadNode(leafPageID)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load page %d: %w", leafPageID, err)
+			return fmt.Errorf("failed to load page %d: %w", leafPageID, err)
 		}
 
 		for i := 0; i < int(leaf.NumSlots); i++ {
 			key := leaf.GetKey(i)
-			if key >= startKey && key <= endKey {
+			afterStart := key > startKey || (includeStart && key == startKey)
+			beforeEnd := key < endKey || (includeEnd && key == endKey)
+			if afterStart && beforeEnd {
 				data, _ := leaf.GetRecord(i)
-				results = append(results, data)
-			} else if key > endKey {
+				data, err := bt.resolve(key, data)
+				if err == nil {
+					err = fn(key, data)
+				}
+				if err != nil {
+					bt.pc.UnPin(leaf.PageID)
+					if errors.Is(err, ErrStopScan) {
+						return nil
+					}
+					return err
+				}
+			} else if !beforeEnd {
 				bt.pc.UnPin(leafPageID)
-				return results, nil
+				return nil
 			}
 		}
 		bt.pc.UnPin(leaf.PageID)
 		leafPageID = leaf.NextLeaf
 	}
+	return nil
+}
+
+// SeekAndScan positions at the first key >= key (forward) or the last key <= key
+// (backward) and returns up to limit records in that direction.
+func (bt *BTree) SeekAndScan(key uint64, forward bool, limit int) ([][]byte, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	breadcrumbs := &BTStack{}
+	leafPageID, err := bt.findLeaf(key, breadcrumbs)
+	if err != nil {
+		return nil, err
+	}
+
+	var results [][]byte
+	first := true
+	for leafPageID != 0 && len(results) < limit {
+		leaf, err := bt.loadNode(leafPageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load page %d: %w", leafPageID, err)
+		}
+
+		if forward {
+			i := 0
+			if first {
+				i = leaf.LowerBound(key)
+			}
+			for ; i < int(leaf.NumSlots) && len(results) < limit; i++ {
+				data, _ := leaf.GetRecord(i)
+				data, err := bt.resolve(leaf.GetKey(i), data)
+				if err != nil {
+					bt.pc.UnPin(leaf.PageID)
+					return nil, err
+				}
+				results = append(results, data)
+			}
+			leafPageID = leaf.NextLeaf
+		} else {
+			i := int(leaf.NumSlots) - 1
+			if first {
+				// last slot with a key <= target
+				i = leaf.LowerBound(key)
+				if i == int(leaf.NumSlots) || leaf.GetKey(i) != key {
+					i--
+				}
+			}
+			for ; i >= 0 && len(results) < limit; i-- {
+				data, _ := leaf.GetRecord(i)
+				data, err := bt.resolve(leaf.GetKey(i), data)
+				if err != nil {
+					bt.pc.UnPin(leaf.PageID)
+					return nil, err
+				}
+				results = append(results, data)
+			}
+			leafPageID, err = bt.prevLeaf(breadcrumbs)
+			if err != nil {
+				bt.pc.UnPin(leaf.PageID)
+				return nil, err
+			}
+		}
+		bt.pc.UnPin(leaf.PageID)
+		first = false
+	}
 	return results, nil
 }
 
+// prevLeaf moves breadcrumbs to the leaf left of the one they currently lead
+// to and returns its page ID, or 0 from the leftmost leaf. Leaves only link
+// forward, so this climbs to the nearest ancestor with a child to the left and
+// descends its rightmost path.
+func (bt *BTree) prevLeaf(breadcrumbs *BTStack) (pager.PageID, error) {
+	for !breadcrumbs.isEmpty() {
+		crumb, _ := breadcrumbs.pop()
+		parent, err := bt.loadNode(crumb.PageID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load page %d: %w", crumb.PageID, err)
+		}
+
+		childIndex := crumb.Index
+		if childIndex == -1 { // followed RightmostChild
+			childIndex = int(parent.NumSlots)
+		}
+		if childIndex == 0 {
+			bt.pc.UnPin(parent.PageID)
+			continue
+		}
+
+		record, err := parent.GetRecord(childIndex - 1)
+		bt.pc.UnPin(parent.PageID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read child %d of page %d: %w", childIndex-1, crumb.PageID, err)
+		}
+		_, childPageID := pager.DeserializeInternalRecord(record)
+		if err := checkChild(crumb.PageID, childPageID); err != nil {
+			return 0, err
+		}
+		breadcrumbs.push(crumb.PageID, childIndex-1)
+
+		// rightmost path down to a leaf
+		for depth := breadcrumbs.Length(); ; depth++ {
+			if depth >= bt.depthLimit() {
+				return 0, bt.tooDeep(crumb.PageID)
+			}
+			node, err := bt.loadNode(childPageID)
+			if err != nil {
+				return 0, fmt.Errorf("failed to load page %d: %w", childPageID, err)
+			}
+			if node.IsLeaf() {
+				bt.pc.UnPin(node.PageID)
+				return childPageID, nil
+			}
+			breadcrumbs.push(childPageID, -1)
+			next := node.RightmostChild
+			bt.pc.UnPin(node.PageID)
+			if err := checkChild(childPageID, next); err != nil {
+				return 0, err
+			}
+			childPageID = next
+		}
+	}
+	return 0, nil
+}
+
 func (bt *BTree) findLeftSibling(parent *BNode, childIndex int) (pager.PageID, int, bool) {
 	if childIndex == 0 {
 		return 0, -1, false // no left sibling
@@ -586,133 +949,835 @@ func (bt *BTree) handleUnderflow(pageID pager.PageID, breadcrumbs *BTStack) erro
 }
 
 func (bt *BTree) Delete(key uint64) error {
+	_, found, err := bt.DeleteReturning(key, nil)
+	if err == nil && !found {
+		return fmt.Errorf("key %d was not found", key)
+	}
+	return err
+}
+
+// DeleteReturning is Delete in the same descent as the lookup, returning the
+// removed record. found is false, and nothing changes, if key isn't there.
+// beforeRemove, if set, runs once the record is found and before anything
+// changes, e.g. to log the delete; an error from it aborts the delete.
+func (bt *BTree) DeleteReturning(key uint64, beforeRemove func() error) (data []byte, found bool, err error) {
+	bt.noteChange(key)
 	breadcrumbs := &BTStack{}
 	defer func() {
 		bt.pc.FlushHeader()
+		if err == nil {
+			err = bt.flushWrites()
+		}
 	}()
 	// traverse to leaf, collecting breadcrumbs
 	leafPageID, err := bt.findLeaf(key, breadcrumbs)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 	leaf, err := bt.loadNode(leafPageID)
 	if err != nil {
-		return fmt.Errorf("failed to load page %d: %w", leafPageID, err)
+		return nil, false, fmt.Errorf("failed to load page %d: %w", leafPageID, err)
 	}
 	defer bt.pc.UnPin(leaf.PageID)
 	idx, present := leaf.Search(key)
 	if !present {
-		return fmt.Errorf("key %d was not found", key)
+		return nil, false, nil
+	}
+	// the record's bytes live in the page, which the delete rewrites
+	data, err = bt.resolve(key, leaf.Records[idx])
+	if err != nil {
+		return nil, false, err
+	}
+	data = slices.Clone(data)
+	if beforeRemove != nil {
+		if err := beforeRemove(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := bt.releaseRecord(leaf, idx); err != nil {
+		return nil, false, err
 	}
 	err = leaf.DeleteRecord(idx)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// It was working when I commented out the merge. I think the node needs to write before starting the merge
 	if err := bt.writeNode(leaf); err != nil {
-		return fmt.Errorf("delete: failed to write page %d: %w", leaf.PageID, err)
+		return nil, false, fmt.Errorf("delete: failed to write page %d: %w", leaf.PageID, err)
 	}
 
 	// check if nodes need to merge
 	if leaf.IsUnderfull() {
-		return bt.handleUnderflow(leafPageID, breadcrumbs)
-	}
-	return bt.writeNode(leaf)
-}
-
-func (bt *BTree) Stats() string {
-	root, err := bt.loadNode(bt.pc.GetRootPageID())
-	if err != nil {
-		return fmt.Sprintf("error loading node %d", bt.pc.GetRootPageID())
-	}
-	defer bt.pc.UnPin(root.PageID)
-	depth := bt.GetDepth()
-	return fmt.Sprintf("Root: page %d, Type: %v, NextPageID: %d, NumPages: %d, Tree Depth: %d",
-		bt.pc.GetRootPageID(), root.PageType, bt.pc.GetHeader().NextPageID, bt.pc.GetHeader().NumPages, depth)
-}
-
-func (bt *BTree) Vacuum() error {
-	pages, rootID, err := bt.BulkLoad()
-	if err != nil {
-		return err
+		return data, true, bt.handleUnderflow(leafPageID, breadcrumbs)
 	}
-	return bt.pc.ReplaceTreeFromPages(pages, rootID)
-}
-
-func (bt *BTree) ExtractPrimaryKey(record schema.Record) (uint64, error) {
-	return bt.pc.GetHeader().Schema.ExtractPrimaryKey(record)
-}
-
-func (bt *BTree) SerializeRecord(record schema.Record) ([]byte, error) {
-	return bt.pc.GetHeader().Schema.SerializeRecord(record)
-}
-
-func (bt *BTree) DeserializeRecord(data []byte) (uint64, schema.Record, error) {
-	return bt.pc.GetHeader().Schema.DeserializeRecord(data)
+	return data, true, bt.writeNode(leaf)
 }
 
-func (bt *BTree) GetSchema() schema.Schema {
-	return bt.pc.GetHeader().Schema
-}
+// DeleteBatch removes every key in keys, all of which must be present. The
+// records come out of their leaves first, in key order, and only then are
+// the leaves left underfull rebalanced, so a run of keys in one leaf costs a
+// single borrow or merge cascade rather than one per key.
+func (bt *BTree) DeleteBatch(keys []uint64) (err error) {
+	bt.noteChange(keys...)
+	defer func() {
+		bt.pc.FlushHeader()
+		if err == nil {
+			err = bt.flushWrites()
+		}
+	}()
 
-func (bt *BTree) Close() error {
-	return bt.pc.Close()
-}
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
 
-func (bt *BTree) buildLeafLayer() ([]*pager.SlottedPage, error) {
-	// find the left most leaf node to start scan
-	oldLeftLeaf, err := bt.findLeaf(0, &BTStack{})
-	if err != nil {
-		return nil, err
+	// group keys by leaf before changing anything, so a missing key fails
+	// the batch without deleting the others
+	type leafBatch struct {
+		pageID pager.PageID
+		keys   []uint64
+	}
+	var batches []leafBatch
+	for _, key := range sorted {
+		leafPageID, err := bt.findLeaf(key, &BTStack{})
+		if err != nil {
+			return err
+		}
+		leaf, err := bt.loadNode(leafPageID)
+		if err != nil {
+			return fmt.Errorf("failed to load page %d: %w", leafPageID, err)
+		}
+		_, present := leaf.Search(key)
+		bt.pc.UnPin(leaf.PageID)
+		if !present {
+			return fmt.Errorf("key %d was not found", key)
+		}
+		if n := len(batches); n > 0 && batches[n-1].pageID == leafPageID {
+			batches[n-1].keys = append(batches[n-1].keys, key)
+		} else {
+			batches = append(batches, leafBatch{pageID: leafPageID, keys: []uint64{key}})
+		}
 	}
 
-	// build out a leaf slice and initialize a first page
-	leaves := []*pager.SlottedPage{}
-	newLeafIndex := pager.PageID(1)
-	newLeaf := pager.NewSlottedPage(newLeafIndex, pager.LEAF)
-
-	// follow leaf links to scan left to right
-	currPageID := oldLeftLeaf
-	for currPageID != 0 { // 0 means no sibling to the right, we're done
-		currentLeaf, err := bt.loadNode(currPageID)
+	// remove the records, leaving underfull leaves for the pass below
+	for _, b := range batches {
+		leaf, err := bt.loadNode(b.pageID)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load page %d: %w", currPageID, err)
+			return fmt.Errorf("failed to load page %d: %w", b.pageID, err)
 		}
-		// iterate over leaf records
-		for i := 0; i < int(currentLeaf.NumSlots); i++ {
-			record, err := currentLeaf.GetRecord(i)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get record %d from currentLeaf: %w", i, err)
+		for _, key := range b.keys {
+			idx, _ := leaf.Search(key)
+			if err := bt.releaseRecord(leaf, idx); err != nil {
+				bt.pc.UnPin(leaf.PageID)
+				return err
 			}
-			// insert record into the newly created leaf node
-			_, err = newLeaf.InsertRecordSorted(record)
-			if err != nil && errors.Is(err, pager.ErrPageFull) {
-				// if the page was full, add it to the return slice, allocate a new leaf node
-				// and insert into that one
-				leaves = append(leaves, newLeaf)
-				newLeafIndex++
-				newLeaf = pager.NewSlottedPage(pager.PageID(newLeafIndex), pager.LEAF)
-				_, err = newLeaf.InsertRecordSorted(record)
-				if err != nil {
-					return nil, fmt.Errorf("failed to insert record from page %d into newLeaf (after page full): %w", currentLeaf.PageID, err)
-				}
-			} else if err != nil {
-				return nil, fmt.Errorf("failed to insert record from page %d into newLeaf: %w", currentLeaf.PageID, err)
+			if err := leaf.DeleteRecord(idx); err != nil {
+				bt.pc.UnPin(leaf.PageID)
+				return err
 			}
 		}
-		bt.pc.UnPin(currentLeaf.PageID)
-		// move to next leaf node in original tree
-		currPageID = currentLeaf.NextLeaf
-	}
-
-	// Don't forget the last leaf!
-	if newLeaf.NumSlots > 0 {
-		leaves = append(leaves, newLeaf)
+		err = bt.writeNode(leaf)
+		bt.pc.UnPin(leaf.PageID)
+		if err != nil {
+			return fmt.Errorf("delete batch: failed to write page %d: %w", b.pageID, err)
+		}
 	}
 
-	// link the leaves
-	for i := 0; i < len(leaves)-1; i++ {
+	// condense bottom-up once per affected leaf. An earlier merge may have
+	// folded a leaf into its sibling, so descend again by key to find the
+	// page that now holds the range.
+	for _, b := range batches {
+		breadcrumbs := &BTStack{}
+		leafPageID, err := bt.findLeaf(b.keys[0], breadcrumbs)
+		if err != nil {
+			return err
+		}
+		leaf, err := bt.loadNode(leafPageID)
+		if err != nil {
+			return fmt.Errorf("failed to load page %d: %w", leafPageID, err)
+		}
+		underfull := leaf.IsUnderfull()
+		bt.pc.UnPin(leaf.PageID)
+		if !underfull {
+			continue
+		}
+		if err := bt.handleUnderflow(leafPageID, breadcrumbs); err != nil {
+			return fmt.Errorf("delete batch: failed to rebalance page %d: %w", leafPageID, err)
+		}
+	}
+	return nil
+}
+
+// Warmup loads every internal page breadth-first, then up to maxLeaves leaves
+// from the left end of the leaf chain, leaving them cached but unpinned.
+// Loading stops at the cache capacity so warming can't evict what it just read.
+// Returns the number of pages loaded.
+func (bt *BTree) Warmup(maxLeaves int) (int, error) {
+	budget := bt.pc.Capacity()
+	depth := bt.GetDepth()
+	loaded := 0
+
+	type queued struct {
+		id    pager.PageID
+		level int
+	}
+	queue := []queued{{id: bt.pc.GetRootPageID(), level: 1}}
+
+	for len(queue) > 0 && loaded < budget {
+		next := queue[0]
+		queue = queue[1:]
+
+		node, err := bt.loadNode(next.id)
+		if err != nil {
+			return loaded, fmt.Errorf("warmup: failed to load page %d: %w", next.id, err)
+		}
+		loaded++
+		if node.IsLeaf() || next.level+1 >= depth {
+			// children are leaves, handled below
+			bt.pc.UnPin(node.PageID)
+			continue
+		}
+
+		for _, rec := range node.Records {
+			if len(rec) < pager.InternalRecordSize {
+				continue // tombstone
+			}
+			_, child := pager.DeserializeInternalRecord(rec)
+			queue = append(queue, queued{id: child, level: next.level + 1})
+		}
+		if node.RightmostChild != 0 {
+			queue = append(queue, queued{id: node.RightmostChild, level: next.level + 1})
+		}
+		bt.pc.UnPin(node.PageID)
+	}
+
+	if depth == 1 || maxLeaves <= 0 {
+		return loaded, nil
+	}
+
+	leafID, err := bt.findLeaf(0, &BTStack{})
+	if err != nil {
+		return loaded, fmt.Errorf("warmup: failed to find first leaf: %w", err)
+	}
+	for leaves := 0; leafID != 0 && leaves < maxLeaves && loaded < budget; leaves++ {
+		leaf, err := bt.loadNode(leafID)
+		if err != nil {
+			return loaded, fmt.Errorf("warmup: failed to load leaf %d: %w", leafID, err)
+		}
+		loaded++
+		leafID = leaf.NextLeaf
+		bt.pc.UnPin(leaf.PageID)
+	}
+	return loaded, nil
+}
+
+// fanoutSamples is how many root-to-leaf paths Fanout follows, spread evenly
+// across the key space.
+const fanoutSamples = 64
+
+// Fanout estimates the tree's effective order from fanoutSamples paths down
+// from the root: the mean number of children of the internal pages they
+// pass, and the most records held by one of the leaves they reach. It
+// reads at most fanoutSamples pages per level. A tree that is only a root
+// leaf has no internal pages and reports 0 children.
+func (bt *BTree) Fanout() (avgInternalChildren float64, maxLeafRecords int, err error) {
+	internals, children := 0, 0
+	seen := make(map[pager.PageID]bool)
+	for i := range fanoutSamples {
+		// pos is how far across the current subtree the path goes, 0 to 1
+		pos := (float64(i) + 0.5) / fanoutSamples
+		id := bt.pc.GetRootPageID()
+		for range bt.GetDepth() - 1 {
+			node, err := bt.loadNode(id)
+			if err != nil {
+				return 0, 0, fmt.Errorf("fanout: failed to load page %d: %w", id, err)
+			}
+			if node.IsLeaf() {
+				bt.pc.UnPin(node.PageID)
+				return 0, 0, fmt.Errorf("fanout: leaf %d above the leaf level: %w", id, ErrCorruptTree)
+			}
+			n := int(node.NumSlots) + 1
+			if !seen[id] {
+				seen[id] = true
+				internals++
+				children += n
+			}
+			child := min(int(pos*float64(n)), n-1)
+			pos = pos*float64(n) - float64(child)
+			if child < len(node.Records) {
+				_, id = pager.DeserializeInternalRecord(node.Records[child])
+			} else {
+				id = node.RightmostChild
+			}
+			bt.pc.UnPin(node.PageID)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		_, n, err := bt.PageSummary(id)
+		if err != nil {
+			return 0, 0, fmt.Errorf("fanout: %w", err)
+		}
+		maxLeafRecords = max(maxLeafRecords, n)
+	}
+	if internals > 0 {
+		avgInternalChildren = float64(children) / float64(internals)
+	}
+	return avgInternalChildren, maxLeafRecords, nil
+}
+
+// CompactPage rewrites one page with its live records packed together and
+// returns the number of bytes of contiguous free space gained.
+func (bt *BTree) CompactPage(id pager.PageID) (int, error) {
+	h := bt.pc.GetHeader()
+	if id == 0 || id >= h.NextPageID {
+		return 0, fmt.Errorf("page %d out of range (data pages are 1-%d)", id, h.NextPageID-1)
+	}
+	if h.IsFree(id) {
+		return 0, fmt.Errorf("page %d is on the free list", id)
+	}
+
+	node, err := bt.loadNode(id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load page %d: %w", id, err)
+	}
+	defer bt.pc.UnPin(node.PageID)
+	if node.PageType != pager.LEAF && node.PageType != pager.INTERNAL && node.PageType != pager.OVERFLOW {
+		return 0, fmt.Errorf("page %d is not a data page (type %d)", id, node.PageType)
+	}
+
+	before := node.FreeSpacePtr
+	if err := node.Compact(); err != nil {
+		return 0, fmt.Errorf("failed to compact page %d: %w", id, err)
+	}
+	if err := bt.writeNode(node); err != nil {
+		return 0, err
+	}
+	return int(node.FreeSpacePtr) - int(before), nil
+}
+
+// Count walks the leaf chain and returns the number of live records.
+func (bt *BTree) Count() (int, error) {
+	count := 0
+	err := bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Verify walks the whole tree and returns an ErrCorruptTree for the first
+// broken invariant: page ids outside the file or reached twice, keys out of
+// order or outside their parent's separators, leaves at different depths,
+// a leaf chain that doesn't visit the leaves in key order, or a free list
+// entry that is out of range, repeated or still in the tree.
+func (bt *BTree) Verify() error {
+	root := bt.pc.GetRootPageID()
+	next := bt.pc.GetHeader().NextPageID
+	if root == 0 || root >= next {
+		return fmt.Errorf("root page %d outside 1..%d: %w", root, next-1, ErrCorruptTree)
+	}
+
+	v := &verifier{bt: bt, next: next, seen: make(map[pager.PageID]bool), overflow: make(map[pager.PageID]bool), leafDepth: -1}
+	if err := v.walk(root, 0, 0, math.MaxUint64, false); err != nil {
+		return err
+	}
+	for id := range v.overflow {
+		if v.seen[id] {
+			return fmt.Errorf("overflow page %d is also in the tree: %w", id, ErrCorruptTree)
+		}
+	}
+
+	for i, id := range v.leaves {
+		want := pager.PageID(0)
+		if i+1 < len(v.leaves) {
+			want = v.leaves[i+1]
+		}
+		if v.nextLeaf[i] != want {
+			return fmt.Errorf("leaf %d links to %d, expected %d: %w", id, v.nextLeaf[i], want, ErrCorruptTree)
+		}
+	}
+
+	free := make(map[pager.PageID]bool)
+	for _, id := range bt.FreePages() {
+		switch {
+		case id == 0 || id >= next:
+			return fmt.Errorf("free page %d outside 1..%d: %w", id, next-1, ErrCorruptTree)
+		case free[id]:
+			return fmt.Errorf("free page %d listed twice: %w", id, ErrCorruptTree)
+		case v.seen[id]:
+			return fmt.Errorf("free page %d is still in the tree: %w", id, ErrCorruptTree)
+		case v.overflow[id]:
+			return fmt.Errorf("free page %d still holds forwarded records: %w", id, ErrCorruptTree)
+		}
+		free[id] = true
+	}
+	return nil
+}
+
+type verifier struct {
+	bt        *BTree
+	next      pager.PageID
+	seen      map[pager.PageID]bool
+	overflow  map[pager.PageID]bool // pages forward stubs lead to
+	leafDepth int
+	leaves    []pager.PageID // in key order
+	nextLeaf  []pager.PageID // NextLeaf of each entry in leaves
+}
+
+// walk checks the subtree at id, whose keys must be in [lo, hi) - or
+// [lo, max] when hi is unbounded.
+func (v *verifier) walk(id pager.PageID, depth int, lo, hi uint64, bounded bool) error {
+	if id == 0 || id >= v.next {
+		return fmt.Errorf("page %d outside 1..%d: %w", id, v.next-1, ErrCorruptTree)
+	}
+	if v.seen[id] {
+		return fmt.Errorf("page %d reached twice: %w", id, ErrCorruptTree)
+	}
+	v.seen[id] = true
+
+	node, err := v.bt.loadNode(id)
+	if err != nil {
+		return fmt.Errorf("failed to load page %d: %w", id, err)
+	}
+	defer v.bt.pc.UnPin(id)
+
+	var prev uint64
+	for i := 0; i < int(node.NumSlots); i++ {
+		key, err := node.KeyAt(i)
+		if err != nil {
+			return fmt.Errorf("page %d: %w: %w", id, err, ErrCorruptTree)
+		}
+		if i > 0 && key <= prev {
+			return fmt.Errorf("page %d: key %d at slot %d not above %d: %w", id, key, i, prev, ErrCorruptTree)
+		}
+		prev = key
+		if key < lo || (bounded && key >= hi) {
+			return fmt.Errorf("page %d: key %d outside its parent's range: %w", id, key, ErrCorruptTree)
+		}
+	}
+
+	if node.IsLeaf() {
+		if v.leafDepth == -1 {
+			v.leafDepth = depth
+		} else if depth != v.leafDepth {
+			return fmt.Errorf("leaf %d at depth %d, expected %d: %w", id, depth, v.leafDepth, ErrCorruptTree)
+		}
+		v.leaves = append(v.leaves, id)
+		v.nextLeaf = append(v.nextLeaf, node.NextLeaf)
+		return v.checkForwards(node)
+	}
+
+	childLo := lo
+	for i := 0; i < int(node.NumSlots); i++ {
+		if len(node.Records[i]) < pager.InternalRecordSize {
+			return fmt.Errorf("page %d: internal record %d too short: %w", id, i, ErrCorruptTree)
+		}
+		sep, child := pager.DeserializeInternalRecord(node.Records[i])
+		if err := v.walk(child, depth+1, childLo, sep, true); err != nil {
+			return err
+		}
+		childLo = sep
+	}
+	return v.walk(node.RightmostChild, depth+1, childLo, hi, bounded)
+}
+
+// checkForwards follows each forward stub in leaf to its overflow page.
+func (v *verifier) checkForwards(leaf *BNode) error {
+	if !v.bt.forwarding() {
+		return nil
+	}
+	for i := 0; i < int(leaf.NumSlots); i++ {
+		target, forwarded, err := forwardTarget(leaf.Records[i])
+		if err != nil {
+			return fmt.Errorf("page %d slot %d: %w", leaf.PageID, i, err)
+		}
+		if !forwarded {
+			continue
+		}
+		if target == 0 || target >= v.next {
+			return fmt.Errorf("page %d: key %d forwards to page %d outside 1..%d: %w", leaf.PageID, leaf.GetKey(i), target, v.next-1, ErrCorruptTree)
+		}
+		if _, err := v.bt.resolve(leaf.GetKey(i), leaf.Records[i]); err != nil {
+			return fmt.Errorf("page %d: %w", leaf.PageID, err)
+		}
+		v.overflow[target] = true
+	}
+	return nil
+}
+
+func (bt *BTree) Stats() string {
+	root, err := bt.loadNode(bt.pc.GetRootPageID())
+	if err != nil {
+		return fmt.Sprintf("error loading node %d", bt.pc.GetRootPageID())
+	}
+	defer bt.pc.UnPin(root.PageID)
+	depth := bt.GetDepth()
+	return fmt.Sprintf("Root: page %d, Type: %v, NextPageID: %d, NumPages: %d, Tree Depth: %d",
+		bt.pc.GetRootPageID(), root.PageType, bt.pc.GetHeader().NextPageID, bt.pc.GetHeader().NumPages, depth)
+}
+
+func (bt *BTree) CacheStats() pager.CacheStats {
+	return bt.pc.Stats()
+}
+
+// SetVacuumTempDir sets where Vacuum writes the rebuilt tree before swapping
+// it in; see PageCache.SetTempDir.
+func (bt *BTree) SetVacuumTempDir(dir string) {
+	bt.pc.SetTempDir(dir)
+}
+
+// SetGrowChunk sets how many pages the table file is pre-grown by; see
+// PageCache.SetGrowChunk.
+func (bt *BTree) SetGrowChunk(pages int) {
+	bt.pc.SetGrowChunk(pages)
+}
+
+// SetSyncEnabled turns fsync of the table file on or off; see
+// pager.DiskManager.SetSyncEnabled.
+func (bt *BTree) SetSyncEnabled(on bool) {
+	bt.pc.SetSyncEnabled(on)
+}
+
+// FileName returns the table file's path; see pager.PageCache.FileName.
+func (bt *BTree) FileName() string {
+	return bt.pc.FileName()
+}
+
+// SetCacheMaxBytes sets the page cache's byte budget; see
+// PageCache.SetMaxBytes.
+func (bt *BTree) SetCacheMaxBytes(n int64) {
+	bt.pc.SetMaxBytes(n)
+}
+
+// SetPinnedPolicy sets what fetching a page does when the cache is full of
+// pinned pages; see pager.PinnedPolicy.
+func (bt *BTree) SetPinnedPolicy(p pager.PinnedPolicy) {
+	bt.pc.SetPinnedPolicy(p)
+}
+
+// TrackChanges starts recording the keys Insert, Update and Delete write,
+// until TakeChanges returns them. Vacuum uses it to find the writes its
+// rebuild missed.
+func (bt *BTree) TrackChanges() {
+	bt.changed = make(map[uint64]bool)
+}
+
+// TakeChanges stops tracking and returns the keys written since
+// TrackChanges, sorted.
+func (bt *BTree) TakeChanges() []uint64 {
+	keys := slices.Sorted(maps.Keys(bt.changed))
+	bt.changed = nil
+	return keys
+}
+
+// OnChange has fn told the keys each Insert, Update and Delete writes, as
+// the write starts, e.g. to keep something derived from the records up to
+// date. nil stops it. Bulk loads and ReplaceTree don't call it.
+func (bt *BTree) OnChange(fn func(keys ...uint64)) {
+	bt.onChange = fn
+}
+
+func (bt *BTree) noteChange(keys ...uint64) {
+	if bt.onChange != nil {
+		bt.onChange(keys...)
+	}
+	if bt.changed == nil {
+		return
+	}
+	for _, key := range keys {
+		bt.changed[key] = true
+	}
+}
+
+func (bt *BTree) Vacuum() error {
+	pages, rootID, err := bt.BulkLoad()
+	if err != nil {
+		return err
+	}
+	return bt.pc.ReplaceTreeFromPages(pages, rootID)
+}
+
+func (bt *BTree) ExtractPrimaryKey(record schema.Record) (uint64, error) {
+	return bt.format.Load().schema.ExtractPrimaryKey(record)
+}
+
+// recordCodec builds the codec described by the table header.
+func (bt *BTree) recordCodec() (schema.Codec, error) {
+	h := bt.pc.GetHeader()
+	codec, err := schema.CodecFor(h.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if h.OmitKey {
+		if codec, err = schema.WithoutKeyColumn(codec); err != nil {
+			return nil, err
+		}
+	}
+	if h.Compression {
+		codec = schema.CompressedCodec{Inner: codec}
+	}
+	if h.Versioned {
+		// outermost, so the version can be read without inflating the body
+		codec = schema.VersionedCodec{Inner: codec}
+	}
+	return codec, nil
+}
+
+// SerializeRecord encodes record with the table's codec, rejecting it with
+// ErrRecordTooLarge before it can reach the WAL if the tree couldn't hold it,
+// and with schema.ErrNonFiniteFloat if it holds a NaN or infinite float.
+func (bt *BTree) SerializeRecord(record schema.Record) ([]byte, error) {
+	f := bt.format.Load()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if err := f.schema.ValidateWith(record, schema.ValueOptions{AllowNonFinite: bt.allowNonFinite.Load()}); err != nil {
+		return nil, err
+	}
+	data, err := f.codec.Encode(f.schema, record)
+	if err != nil {
+		return nil, err
+	}
+	if err := bt.checkRecordSize(binary.LittleEndian.Uint64(data[:8]), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (bt *BTree) DeserializeRecord(data []byte) (uint64, schema.Record, error) {
+	f := bt.format.Load()
+	if f.err != nil {
+		return 0, nil, f.err
+	}
+	return f.codec.Decode(f.schema, data)
+}
+
+func (bt *BTree) IsWALOnly() bool {
+	return bt.pc.GetHeader().WALOnly
+}
+
+func (bt *BTree) IsCompressed() bool {
+	return bt.pc.GetHeader().Compression
+}
+
+// flushWrites writes the pages the last mutation dirtied and fsyncs the file,
+// for tables created with FlushWrites. Other tables leave them to eviction
+// and checkpoints.
+func (bt *BTree) flushWrites() error {
+	if !bt.pc.GetHeader().FlushWrites {
+		return nil
+	}
+	for _, id := range bt.pc.DirtyPages() {
+		if err := bt.pc.FlushPage(id); err != nil {
+			return err
+		}
+	}
+	if err := bt.pc.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync: %w", err)
+	}
+	return nil
+}
+
+func (bt *BTree) FlushesWrites() bool {
+	return bt.pc.GetHeader().FlushWrites
+}
+
+func (bt *BTree) OmitsKey() bool {
+	return bt.pc.GetHeader().OmitKey
+}
+
+func (bt *BTree) IsVersioned() bool {
+	return bt.pc.GetHeader().Versioned
+}
+
+// KeyRange returns the table's declared key bounds; ok is false when any key goes.
+func (bt *BTree) KeyRange() (minKey, maxKey uint64, ok bool) {
+	h := bt.pc.GetHeader()
+	return h.MinKey, h.MaxKey, h.KeyRange
+}
+
+func (bt *BTree) NumPages() uint32 {
+	return uint32(bt.pc.GetHeader().NextPageID - 1)
+}
+
+func (bt *BTree) GetCodec() schema.CodecType {
+	return bt.pc.GetHeader().Codec
+}
+
+// SetTableName updates the schema's table name and writes the header.
+func (bt *BTree) SetTableName(name string) error {
+	h := bt.pc.GetHeader()
+	h.Schema.TableName = name
+	h.SchemaHash = h.Schema.Hash()
+	bt.refreshFormat()
+	return bt.pc.FlushHeader()
+}
+
+// Options returns a copy of the settings stored in the header.
+func (bt *BTree) Options() map[string]string {
+	return maps.Clone(bt.pc.GetHeader().Options)
+}
+
+// SetOption stores a setting in the header and writes it. If the write
+// fails, the header is left as it was.
+func (bt *BTree) SetOption(name, value string) error {
+	h := bt.pc.GetHeader()
+	if h.Options == nil {
+		h.Options = make(map[string]string)
+	}
+	prev, had := h.Options[name]
+	h.Options[name] = value
+	if err := bt.pc.FlushHeader(); err != nil {
+		if had {
+			h.Options[name] = prev
+		} else {
+			delete(h.Options, name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (bt *BTree) SchemaHash() uint64 {
+	return bt.pc.GetHeader().SchemaHash
+}
+
+func (bt *BTree) TableID() pager.TableID {
+	return bt.pc.GetHeader().TableID
+}
+
+func (bt *BTree) GetSchema() schema.Schema {
+	return bt.format.Load().schema
+}
+
+// CopyTo writes the table file's header and allocated pages to w, as last
+// flushed to disk.
+func (bt *BTree) CopyTo(w io.Writer) (int64, error) {
+	return bt.pc.CopyTo(w)
+}
+
+// Reload rereads the table file from disk, dropping every cached page, to
+// follow a table another process writes. Nothing may be dirty.
+func (bt *BTree) Reload() error {
+	if err := bt.pc.Reload(); err != nil {
+		return err
+	}
+	bt.overflowHint = 0
+	bt.refreshFormat()
+	return nil
+}
+
+func (bt *BTree) Close() error {
+	return bt.pc.Close()
+}
+
+// leafCursor walks a tree's records in key order along the leaf chain. It
+// copies out one leaf's records at a time, so no page stays pinned between
+// calls to next.
+type leafCursor struct {
+	bt      *BTree
+	nextID  pager.PageID
+	records [][]byte
+	pos     int
+}
+
+func (bt *BTree) newLeafCursor() (*leafCursor, error) {
+	first, err := bt.findLeaf(0, &BTStack{})
+	if err != nil {
+		return nil, err
+	}
+	return &leafCursor{bt: bt, nextID: first}, nil
+}
+
+// next returns the next record, or ok false once the chain is exhausted.
+func (c *leafCursor) next() (data []byte, ok bool, err error) {
+	for c.pos == len(c.records) {
+		if c.nextID == 0 { // 0 means no sibling to the right, we're done
+			return nil, false, nil
+		}
+		leaf, err := c.bt.loadNode(c.nextID)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load page %d: %w", c.nextID, err)
+		}
+		c.records = c.records[:0]
+		c.pos = 0
+		for i := 0; i < int(leaf.NumSlots); i++ {
+			record, err := leaf.GetRecord(i)
+			if err != nil {
+				c.bt.pc.UnPin(leaf.PageID)
+				return nil, false, fmt.Errorf("failed to get record %d from page %d: %w", i, leaf.PageID, err)
+			}
+			if c.bt.forwarding() {
+				// forwarded records come back inline
+				data, err := c.bt.resolve(leaf.GetKey(i), record)
+				if err != nil {
+					c.bt.pc.UnPin(leaf.PageID)
+					return nil, false, err
+				}
+				c.records = append(c.records, c.bt.encodeLeaf(data))
+				continue
+			}
+			c.records = append(c.records, slices.Clone(record))
+		}
+		c.bt.pc.UnPin(leaf.PageID)
+		c.nextID = leaf.NextLeaf
+	}
+	data = c.records[c.pos]
+	c.pos++
+	return data, true, nil
+}
+
+func (bt *BTree) buildLeafLayer() ([]*pager.SlottedPage, error) {
+	cursor, err := bt.newLeafCursor()
+	if err != nil {
+		return nil, err
+	}
+	return buildLeaves(cursor.next)
+}
+
+// buildLeaves packs the records from next, which must come in key order,
+// into fresh linked leaves numbered from page 1.
+func buildLeaves(next func() ([]byte, bool, error)) ([]*pager.SlottedPage, error) {
+	// build out a leaf slice and initialize a first page
+	leaves := []*pager.SlottedPage{}
+	newLeafIndex := pager.PageID(1)
+	newLeaf := pager.NewSlottedPage(newLeafIndex, pager.LEAF)
+
+	for {
+		record, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		// insert record into the newly created leaf node
+		_, err = newLeaf.InsertRecordSorted(record)
+		if err != nil && errors.Is(err, pager.ErrPageFull) {
+			// if the page was full, add it to the return slice, allocate a new leaf node
+			// and insert into that one
+			leaves = append(leaves, newLeaf)
+			newLeafIndex++
+			newLeaf = pager.NewSlottedPage(pager.PageID(newLeafIndex), pager.LEAF)
+			_, err = newLeaf.InsertRecordSorted(record)
+			if err != nil {
+				return nil, fmt.Errorf("failed to insert record into newLeaf (after page full): %w", err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to insert record into newLeaf: %w", err)
+		}
+	}
+
+	// Don't forget the last leaf!
+	if newLeaf.NumSlots > 0 {
+		leaves = append(leaves, newLeaf)
+	}
+
+	// link the leaves
+	for i := 0; i < len(leaves)-1; i++ {
 		leaves[i].NextLeaf = leaves[i+1].PageID
 	}
 	if len(leaves) > 0 {
@@ -721,10 +1786,14 @@ func (bt *BTree) buildLeafLayer() ([]*pager.SlottedPage, error) {
 	return leaves, nil
 }
 
-func buildInternalLayer(children []*pager.SlottedPage) ([]*pager.SlottedPage, error) {
+// buildInternalLayer builds the parents of children, which hold the keys
+// from mins[i] up in key order, and returns them with their own smallest
+// keys. A parent that fills takes the child that didn't fit as its
+// RightmostChild; the next parent starts from the child after it.
+func buildInternalLayer(children []*pager.SlottedPage, mins []uint64) ([]*pager.SlottedPage, []uint64, error) {
 	if len(children) == 1 {
 		// this is the root node
-		return children, nil
+		return children, mins, nil
 	}
 	nextPageID := pager.PageID(1)
 	if len(children) > 0 {
@@ -732,33 +1801,46 @@ func buildInternalLayer(children []*pager.SlottedPage) ([]*pager.SlottedPage, er
 	}
 
 	parents := []*pager.SlottedPage{}
+	parentMins := []uint64{mins[0]}
 	currentParent := pager.NewSlottedPage(nextPageID, pager.INTERNAL)
 
 	for i := 0; i < len(children)-1; i++ {
-		separatorKey := children[i+1].GetKey(0) // first key of right child
-		childPageID := children[i].PageID
-
-		record := pager.SerializeInternalRecord(separatorKey, childPageID)
-		_, err := currentParent.InsertRecordSorted(record)
-
-		if err != nil && errors.Is(err, pager.ErrPageFull) {
+		// a separator is the smallest key of the child to its right, which
+		// for an internal child is below its first separator
+		record := pager.SerializeInternalRecord(mins[i+1], children[i].PageID)
+		_, err := currentParent.InsertRecord(record)
+		if errors.Is(err, pager.ErrPageFull) {
+			currentParent.RightmostChild = children[i].PageID
 			parents = append(parents, currentParent)
 			nextPageID++
 			currentParent = pager.NewSlottedPage(nextPageID, pager.INTERNAL)
-			_, err := currentParent.InsertRecordSorted(record)
-			if err != nil {
-				return nil, fmt.Errorf("failed to insert record from page %d into currentParent (after page full): %w", childPageID, err)
-			}
-		} else if err != nil {
-			return nil, fmt.Errorf("failed to insert record from page %d into currentParent: %w", childPageID, err)
+			parentMins = append(parentMins, mins[i+1])
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to insert record from page %d into currentParent: %w", children[i].PageID, err)
 		}
 	}
 
 	// last child becomes RightmostChild of parent
-	currentParent.RightmostChild = children[len(children)-1].PageID
+	last := len(children) - 1
+	if currentParent.NumSlots == 0 && len(parents) > 0 {
+		// only the last child is left for this parent: move the full
+		// parent's rightmost child over too, so no parent is keyless
+		prev := parents[len(parents)-1]
+		if err := prev.DeleteRecord(int(prev.NumSlots) - 1); err != nil {
+			return nil, nil, err
+		}
+		prev.RightmostChild = children[last-2].PageID
+		if _, err := currentParent.InsertRecord(pager.SerializeInternalRecord(mins[last], children[last-1].PageID)); err != nil {
+			return nil, nil, err
+		}
+		parentMins[len(parentMins)-1] = mins[last-1]
+	}
+	currentParent.RightmostChild = children[last].PageID
 	parents = append(parents, currentParent)
 
-	return parents, nil
+	return parents, parentMins, nil
 }
 
 func (bt *BTree) BulkLoad() ([]*pager.SlottedPage, pager.PageID, error) {
@@ -767,6 +1849,97 @@ func (bt *BTree) BulkLoad() ([]*pager.SlottedPage, pager.PageID, error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	return buildTree(leaves)
+}
+
+// MergeBulkLoad builds a fresh tree holding the records of both a and b,
+// which must share a record format. A key present in both fails with
+// ErrDuplicateKey. Neither tree is changed.
+func MergeBulkLoad(a, b *BTree) ([]*pager.SlottedPage, pager.PageID, error) {
+	ca, err := a.newLeafCursor()
+	if err != nil {
+		return nil, 0, err
+	}
+	cb, err := b.newLeafCursor()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ra, okA, err := ca.next()
+	if err != nil {
+		return nil, 0, err
+	}
+	rb, okB, err := cb.next()
+	if err != nil {
+		return nil, 0, err
+	}
+	merged := func() ([]byte, bool, error) {
+		var out []byte
+		switch {
+		case !okA && !okB:
+			return nil, false, nil
+		case okA && okB && recordKey(ra) == recordKey(rb):
+			return nil, false, fmt.Errorf("key %d is in both trees: %w", recordKey(ra), ErrDuplicateKey)
+		case !okB || (okA && recordKey(ra) < recordKey(rb)):
+			out = ra
+			ra, okA, err = ca.next()
+		default:
+			out = rb
+			rb, okB, err = cb.next()
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return out, true, nil
+	}
+
+	leaves, err := buildLeaves(merged)
+	if err != nil {
+		return nil, 0, err
+	}
+	return buildTree(leaves)
+}
+
+// LoadSorted replaces the tree with one holding records, serialized and in
+// ascending key order, packing leaves and building the internal layers as
+// BulkLoad does, then writing the file in one pass.
+func (bt *BTree) LoadSorted(records [][]byte) error {
+	i := 0
+	next := func() ([]byte, bool, error) {
+		if i == len(records) {
+			return nil, false, nil
+		}
+		data := records[i]
+		if i > 0 && recordKey(data) <= recordKey(records[i-1]) {
+			return nil, false, fmt.Errorf("key %d follows %d: records must be in ascending key order", recordKey(data), recordKey(records[i-1]))
+		}
+		i++
+		return bt.encodeLeaf(data), true, nil
+	}
+
+	leaves, err := buildLeaves(next)
+	if err != nil {
+		return err
+	}
+	pages, rootID, err := buildTree(leaves)
+	if err != nil {
+		return err
+	}
+	return bt.ReplaceTree(pages, rootID)
+}
+
+// recordKey reads the 8-byte key prefix every leaf record starts with.
+func recordKey(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[:8])
+}
+
+// buildTree stacks internal layers on top of leaves up to a single root.
+// Returns every page, leaves first, and the root's page ID.
+func buildTree(leaves []*pager.SlottedPage) ([]*pager.SlottedPage, pager.PageID, error) {
+	if len(leaves) == 0 {
+		// empty table: the root is a single empty leaf
+		leaves = []*pager.SlottedPage{pager.NewSlottedPage(1, pager.LEAF)}
+	}
 
 	// Track all pages to write
 	allPages := []*pager.SlottedPage{}
@@ -774,8 +1947,13 @@ func (bt *BTree) BulkLoad() ([]*pager.SlottedPage, pager.PageID, error) {
 
 	// phase 2: build internal layers recursively
 	currentLayer := leaves
+	mins := make([]uint64, len(leaves))
+	for i, leaf := range leaves {
+		mins[i] = leaf.GetKey(0)
+	}
+	var err error
 	for len(currentLayer) > 1 {
-		currentLayer, err = buildInternalLayer(currentLayer)
+		currentLayer, mins, err = buildInternalLayer(currentLayer, mins)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -787,12 +1965,59 @@ func (bt *BTree) BulkLoad() ([]*pager.SlottedPage, pager.PageID, error) {
 	return allPages, root.PageID, nil
 }
 
+// ReplaceTree swaps the tree for pages rooted at rootID, as built by
+// MergeBulkLoad, keeping the table's header.
+func (bt *BTree) ReplaceTree(pages []*pager.SlottedPage, rootID pager.PageID) error {
+	return bt.pc.ReplaceTreeFromPages(pages, rootID)
+}
+
+// VacuumEstimate reports the file size now and what it would be after a
+// vacuum, by building the compacted pages in memory and discarding them.
+func (bt *BTree) VacuumEstimate() (currentBytes, estimatedBytes uint64, err error) {
+	currentBytes = uint64(bt.pc.GetHeader().NextPageID) * pager.PAGE_SIZE
+	pages, _, err := bt.BulkLoad()
+	if err != nil {
+		return 0, 0, fmt.Errorf("vacuum estimate: %w", err)
+	}
+	// +1 for the header page
+	estimatedBytes = uint64(len(pages)+1) * pager.PAGE_SIZE
+	return currentBytes, estimatedBytes, nil
+}
+
+func (bt *BTree) FreePages() []pager.PageID {
+	return bt.pc.GetHeader().FreePages()
+}
+
 func (bt *BTree) GetWalMetadata() (rootPageID, nextPageID uint32) {
 	h := bt.pc.GetHeader()
 	return uint32(h.RootPageID), uint32(h.NextPageID)
 }
 
-func (bt *BTree) Checkpoint() error {
+// CheckpointLSN is the last WAL record known to be in the pages, 0 for none.
+func (bt *BTree) CheckpointLSN() uint64 {
+	return bt.pc.GetHeader().CheckpointLSN
+}
+
+// SetCheckpointLSN changes the watermark in memory only. It reaches disk
+// with the next header write, so set it before the Checkpoint that makes it true.
+func (bt *BTree) SetCheckpointLSN(lsn uint64) {
+	bt.pc.GetHeader().CheckpointLSN = lsn
+}
+
+func (bt *BTree) FlushHeader() error {
+	return bt.pc.FlushHeader()
+}
+
+// SyncHeader writes the header and fsyncs the file.
+func (bt *BTree) SyncHeader() error {
+	if err := bt.pc.FlushHeader(); err != nil {
+		return err
+	}
+	return bt.pc.Sync()
+}
+
+// Checkpoint flushes all cached pages and the header, returning the page count written.
+func (bt *BTree) Checkpoint() (int, error) {
 	return bt.pc.FlushAll()
 }
 
@@ -805,7 +2030,8 @@ func (bt *BTree) borrowFromRightLeaf(leftNode, rightNode, parent *BNode, separat
 	if rightNode.NumSlots == 0 {
 		return fmt.Errorf("right sibling has no records to lend")
 	}
-	borrowedRecord := rightNode.Records[0]
+	// a copy, so the record shares no bytes with the page it came from
+	borrowedRecord := slices.Clone(rightNode.Records[0])
 
 	// 2. remove from right leaf
 	if err := rightNode.DeleteRecord(0); err != nil {
@@ -900,7 +2126,7 @@ func (bt *BTree) borrowFromLeftLeaf(leftNode, rightNode, parent *BNode, separato
 	if leftNode.NumSlots == 0 {
 		return fmt.Errorf("left sibling has no records to lend")
 	}
-	borrowedRecord := leftNode.Records[len(leftNode.Records)-1]
+	borrowedRecord := slices.Clone(leftNode.Records[len(leftNode.Records)-1])
 
 	// 2. remove from left leaf
 	if err := leftNode.DeleteRecord(len(leftNode.Records) - 1); err != nil {
@@ -1,9 +1,18 @@
 package btree
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"godb/internal/pager"
 	"godb/internal/schema"
+	"math"
+	"math/rand"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -416,3 +425,1068 @@ func TestRangeScan(t *testing.T) {
 
 	t.Logf("Range scan found %d records from %d to %d", len(results), key0, keyLast)
 }
+
+func TestJSONCodecRoundTrip(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_btree_json_*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	sch := createTestSchema()
+	h := createTestHeader(sch)
+	h.Codec = schema.JSONCodecType
+	dm := createTestDiskManager(tmpFile, h)
+	dm.WriteSlottedPage(pager.NewSlottedPage(1, pager.LEAF))
+	bt := NewBTree(&dm, &h)
+
+	rec := schema.Record{
+		"id":          int32(42),
+		"description": "json widget",
+		"qty":         int32(7),
+		"price":       12.5,
+	}
+	data, err := bt.SerializeRecord(rec)
+	if err != nil {
+		t.Fatalf("SerializeRecord failed: %v", err)
+	}
+	if err := bt.Insert(42, data); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	found, ok, err := bt.Search(42)
+	if err != nil || !ok {
+		t.Fatalf("Search failed: found=%v err=%v", ok, err)
+	}
+	key, got, err := bt.DeserializeRecord(found)
+	if err != nil {
+		t.Fatalf("DeserializeRecord failed: %v", err)
+	}
+	if key != 42 {
+		t.Errorf("Expected key 42, got %d", key)
+	}
+	for name, want := range rec {
+		if got[name] != want {
+			t.Errorf("Field %s: expected %v (%T), got %v (%T)", name, want, want, got[name], got[name])
+		}
+	}
+}
+
+func TestCompressedRecordRoundTrip(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_btree_compress_*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	sch := createTestSchema()
+	h := createTestHeader(sch)
+	h.Compression = true
+	dm := createTestDiskManager(tmpFile, h)
+	dm.WriteSlottedPage(pager.NewSlottedPage(1, pager.LEAF))
+	bt := NewBTree(&dm, &h)
+
+	long := strings.Repeat("a very repetitive product description ", 40)
+	for i, desc := range []string{"short", long} {
+		key := uint64(i + 1)
+		rec := schema.Record{
+			"id":          int32(key),
+			"description": desc,
+			"qty":         int32(3),
+			"price":       9.99,
+		}
+		data, err := bt.SerializeRecord(rec)
+		if err != nil {
+			t.Fatalf("SerializeRecord failed: %v", err)
+		}
+		if desc == long && len(data) >= len(long) {
+			t.Errorf("Expected long record to compress, got %d bytes for %d byte string", len(data), len(long))
+		}
+		if err := bt.Insert(key, data); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+
+		found, ok, err := bt.Search(key)
+		if err != nil || !ok {
+			t.Fatalf("Search failed: found=%v err=%v", ok, err)
+		}
+		gotKey, got, err := bt.DeserializeRecord(found)
+		if err != nil {
+			t.Fatalf("DeserializeRecord failed: %v", err)
+		}
+		if gotKey != key {
+			t.Errorf("Expected key %d, got %d", key, gotKey)
+		}
+		if got["description"] != desc {
+			t.Errorf("Description mismatch for key %d", key)
+		}
+	}
+}
+
+func TestOmitKeyRecordRoundTrip(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_btree_omitkey_*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	sch := createTestSchema()
+	h := createTestHeader(sch)
+	h.OmitKey = true
+	dm := createTestDiskManager(tmpFile, h)
+	dm.WriteSlottedPage(pager.NewSlottedPage(1, pager.LEAF))
+	bt := NewBTree(&dm, &h)
+
+	rec := schema.Record{
+		"id":          int32(7),
+		"description": "widget",
+		"qty":         int32(3),
+		"price":       9.99,
+	}
+	full, err := sch.SerializeRecord(rec)
+	if err != nil {
+		t.Fatalf("SerializeRecord failed: %v", err)
+	}
+	data, err := bt.SerializeRecord(rec)
+	if err != nil {
+		t.Fatalf("SerializeRecord failed: %v", err)
+	}
+	if len(full)-len(data) != 4 {
+		t.Errorf("Expected the int key column to save 4 bytes, got %d vs %d", len(data), len(full))
+	}
+
+	if err := bt.Insert(7, data); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	found, ok, err := bt.Search(7)
+	if err != nil || !ok {
+		t.Fatalf("Search failed: found=%v err=%v", ok, err)
+	}
+	gotKey, got, err := bt.DeserializeRecord(found)
+	if err != nil {
+		t.Fatalf("DeserializeRecord failed: %v", err)
+	}
+	if gotKey != 7 || got["id"] != int32(7) {
+		t.Errorf("Expected key 7 rebuilt from the prefix, got key=%d id=%v", gotKey, got["id"])
+	}
+	if got["description"] != "widget" || got["qty"] != int32(3) || got["price"] != 9.99 {
+		t.Errorf("Field mismatch after round trip: %v", got)
+	}
+}
+
+func TestWarmupLoadsInternalPages(t *testing.T) {
+	bt, tmpFile, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 300; i++ {
+		rec := schema.Record{
+			"id":          int32(i),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i) * 1.5,
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+	if _, err := bt.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	firstLeaf, err := bt.findLeaf(0, &BTStack{})
+	if err != nil {
+		t.Fatalf("findLeaf failed: %v", err)
+	}
+
+	// reopen over the same file with a cold cache
+	dm := &pager.DiskManager{}
+	dm.SetFile(tmpFile)
+	if err := dm.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	cold := NewBTree(dm, dm.GetHeader())
+	rootID := cold.pc.GetRootPageID()
+	if cold.pc.Contains(rootID) {
+		t.Fatal("Expected cold cache to be empty")
+	}
+
+	loaded, err := cold.Warmup(2)
+	if err != nil {
+		t.Fatalf("Warmup failed: %v", err)
+	}
+	if !cold.pc.Contains(rootID) {
+		t.Error("Expected root page to be cached after warmup")
+	}
+	if !cold.pc.Contains(firstLeaf) {
+		t.Error("Expected first leaf to be cached after warmup")
+	}
+	// root plus two leaves at minimum
+	if loaded < 3 {
+		t.Errorf("Expected at least 3 pages loaded, got %d", loaded)
+	}
+}
+
+func TestRangeScanFuncCtxCancelled(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 200; i++ {
+		rec := schema.Record{
+			"id":          int32(i),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i),
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	// cancel after the first record; the scan should stop at the next leaf
+	ctx, cancel := context.WithCancel(context.Background())
+	seen := 0
+	err := bt.RangeScanFuncCtx(ctx, 0, math.MaxUint64, func(key uint64, data []byte) error {
+		seen++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if seen >= 200 {
+		t.Errorf("Expected scan to stop early, saw all %d records", seen)
+	}
+}
+
+func TestSeekAndScan(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 300; i++ {
+		rec := schema.Record{
+			"id":          int32(i * 10),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i) * 1.5,
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(i*10), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", i*10, err)
+		}
+	}
+	if bt.GetDepth() < 2 {
+		t.Fatalf("expected a multi-level tree, depth %d", bt.GetDepth())
+	}
+
+	keysOf := func(results [][]byte) []uint64 {
+		keys := make([]uint64, len(results))
+		for i, data := range results {
+			keys[i], _, _ = sch.DeserializeRecord(data)
+		}
+		return keys
+	}
+
+	tests := []struct {
+		name    string
+		key     uint64
+		forward bool
+		limit   int
+		first   uint64
+		last    uint64
+		count   int
+	}{
+		{"forward exact", 200, true, 3, 200, 220, 3},
+		{"forward between keys", 205, true, 5, 210, 250, 5},
+		{"forward past end", 2995, true, 10, 3000, 3000, 1},
+		{"forward whole tree", 0, true, 1000, 10, 3000, 300},
+		{"backward exact", 200, false, 3, 200, 180, 3},
+		{"backward between keys", 205, false, 5, 200, 160, 5},
+		{"backward whole tree", math.MaxUint64, false, 1000, 3000, 10, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := bt.SeekAndScan(tt.key, tt.forward, tt.limit)
+			if err != nil {
+				t.Fatalf("SeekAndScan failed: %v", err)
+			}
+			keys := keysOf(results)
+			if len(keys) != tt.count {
+				t.Fatalf("expected %d records, got %d", tt.count, len(keys))
+			}
+			if keys[0] != tt.first || keys[len(keys)-1] != tt.last {
+				t.Errorf("expected %d..%d, got %d..%d", tt.first, tt.last, keys[0], keys[len(keys)-1])
+			}
+			for i := 1; i < len(keys); i++ {
+				if (tt.forward && keys[i] != keys[i-1]+10) || (!tt.forward && keys[i] != keys[i-1]-10) {
+					t.Fatalf("keys out of order at %d: %d then %d", i, keys[i-1], keys[i])
+				}
+			}
+		})
+	}
+
+	results, err := bt.SeekAndScan(5, false, 10)
+	if err != nil || len(results) != 0 {
+		t.Errorf("backward from before the first key: got %d records, err %v", len(results), err)
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	const n = 1000
+	for i := 1; i <= n; i++ {
+		rec := schema.Record{
+			"id":          int32(i),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i),
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	// a missing key fails the whole batch
+	if err := bt.DeleteBatch([]uint64{5, n + 1}); err == nil {
+		t.Fatal("Expected an error for a missing key")
+	}
+	if _, found, _ := bt.Search(5); !found {
+		t.Fatal("Failed batch deleted key 5")
+	}
+
+	// a dense range plus every third key elsewhere, unsorted and with a duplicate
+	var keys []uint64
+	deleted := make(map[uint64]bool)
+	for i := uint64(n); i >= 1; i-- {
+		if (i >= 200 && i < 700) || i%3 == 0 {
+			keys = append(keys, i)
+			deleted[i] = true
+		}
+	}
+	keys = append(keys, 300)
+	if err := bt.DeleteBatch(keys); err != nil {
+		t.Fatalf("DeleteBatch failed: %v", err)
+	}
+
+	for i := uint64(1); i <= n; i++ {
+		_, found, err := bt.Search(i)
+		if err != nil {
+			t.Fatalf("Search %d failed: %v", i, err)
+		}
+		if found == deleted[i] {
+			t.Errorf("Key %d: found=%v, deleted=%v", i, found, deleted[i])
+		}
+	}
+
+	// the leaf chain still visits every survivor in order
+	results, err := bt.RangeScan(0, n)
+	if err != nil {
+		t.Fatalf("RangeScan failed: %v", err)
+	}
+	if want := n - len(deleted); len(results) != want {
+		t.Errorf("Expected %d records on the leaf chain, got %d", want, len(results))
+	}
+	var prev uint64
+	for _, data := range results {
+		key, _, _ := sch.DeserializeRecord(data)
+		if key <= prev || deleted[key] {
+			t.Fatalf("Leaf chain out of order or holding deleted key %d after %d", key, prev)
+		}
+		prev = key
+	}
+
+	// every leaf sits at the same depth
+	depths := make(map[int]bool)
+	var walk func(id pager.PageID, depth int)
+	walk = func(id pager.PageID, depth int) {
+		node, err := bt.loadNode(id)
+		if err != nil {
+			t.Fatalf("loadNode %d failed: %v", id, err)
+		}
+		defer bt.pc.UnPin(id)
+		if node.IsLeaf() {
+			depths[depth] = true
+			return
+		}
+		for _, rec := range node.Records {
+			_, child := pager.DeserializeInternalRecord(rec)
+			walk(child, depth+1)
+		}
+		walk(node.RightmostChild, depth+1)
+	}
+	walk(bt.pc.GetRootPageID(), 1)
+	if len(depths) != 1 {
+		t.Errorf("Expected all leaves at one depth, got depths %v", depths)
+	}
+}
+
+func TestDescentIntoPageZeroFails(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 100; i++ {
+		rec := schema.Record{
+			"id":          int32(i),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i),
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	// simulate a merge that left the root's RightmostChild unset
+	root, err := bt.loadNode(bt.pc.GetRootPageID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.IsLeaf() {
+		t.Fatal("Expected an internal root after 100 inserts")
+	}
+	root.RightmostChild = 0
+	bt.writeNode(root)
+	bt.pc.UnPin(root.PageID)
+
+	if _, _, err := bt.Search(100); !errors.Is(err, ErrCorruptTree) {
+		t.Errorf("Search: expected ErrCorruptTree, got %v", err)
+	}
+	if err := bt.Insert(1000, []byte("0123456789")); !errors.Is(err, ErrCorruptTree) {
+		t.Errorf("Insert: expected ErrCorruptTree, got %v", err)
+	}
+	if err := bt.Delete(100); !errors.Is(err, ErrCorruptTree) {
+		t.Errorf("Delete: expected ErrCorruptTree, got %v", err)
+	}
+
+	// keys routed through intact children still work
+	if _, found, err := bt.Search(1); err != nil || !found {
+		t.Errorf("Search(1): found=%v err=%v", found, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	rng := rand.New(rand.NewSource(7))
+	keys := rng.Perm(2000)
+	for _, k := range keys {
+		rec := schema.Record{
+			"id":          int32(k + 1),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(k),
+			"price":       float64(k),
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(k+1), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", k+1, err)
+		}
+	}
+	for _, k := range keys[:1200] {
+		if err := bt.Delete(uint64(k + 1)); err != nil {
+			t.Fatalf("Delete %d failed: %v", k+1, err)
+		}
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatalf("Verify of a healthy tree failed: %v", err)
+	}
+
+	// cut the leaf chain after the first leaf
+	leafID, err := bt.findLeaf(0, &BTStack{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := bt.loadNode(leafID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.NextLeaf == 0 {
+		t.Fatal("Expected more than one leaf")
+	}
+	leaf.NextLeaf = 0
+	if err := bt.writeNode(leaf); err != nil {
+		t.Fatal(err)
+	}
+	bt.pc.UnPin(leafID)
+
+	if err := bt.Verify(); !errors.Is(err, ErrCorruptTree) {
+		t.Errorf("Expected ErrCorruptTree for a broken leaf chain, got %v", err)
+	}
+}
+
+func TestInsertRejectsRecordTooLarge(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	record := func(key uint64, size int) []byte {
+		data := make([]byte, size)
+		binary.LittleEndian.PutUint64(data, key)
+		return data
+	}
+
+	err := bt.Insert(1, record(1, pager.MaxRecordSize+1))
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("Expected ErrRecordTooLarge, got %v", err)
+	}
+	if !strings.Contains(err.Error(), strconv.Itoa(pager.MaxRecordSize)) {
+		t.Errorf("Expected the limit in the error, got %v", err)
+	}
+	// exactly the limit fits an empty page
+	if err := bt.Insert(1, record(1, pager.MaxRecordSize)); err != nil {
+		t.Fatalf("Insert at the limit failed: %v", err)
+	}
+
+	if err := bt.SetMaxRecordSize(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Insert(2, record(2, 101)); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Expected ErrRecordTooLarge under a lowered limit, got %v", err)
+	}
+	if err := bt.SetMaxRecordSize(pager.MaxRecordSize + 1); err == nil {
+		t.Error("Expected a limit above the page size to be rejected")
+	}
+}
+
+func TestUpdateForwardsGrowingRecord(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_btree_forward_*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	sch := createTestSchema()
+	h := createTestHeader(sch)
+	h.Forwarding = true
+	dm := createTestDiskManager(tmpFile, h)
+	dm.WriteSlottedPage(pager.NewSlottedPage(1, pager.LEAF))
+	bt := NewBTree(&dm, &h)
+
+	record := func(id int32, descLen int) []byte {
+		t.Helper()
+		data, err := bt.SerializeRecord(schema.Record{
+			"id": id, "description": strings.Repeat("d", descLen), "qty": int32(1), "price": 1.5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	// twelve 300-byte records nearly fill the root leaf
+	for id := int32(1); id <= 12; id++ {
+		if err := bt.Insert(uint64(id), record(id, 280)); err != nil {
+			t.Fatalf("Insert(%d) failed: %v", id, err)
+		}
+	}
+	searchDesc := func(key uint64) int {
+		t.Helper()
+		data, found, err := bt.Search(key)
+		if err != nil || !found {
+			t.Fatalf("Search(%d): found=%v err=%v", key, found, err)
+		}
+		_, rec, err := bt.DeserializeRecord(data)
+		if err != nil {
+			t.Fatalf("DeserializeRecord(%d) failed: %v", key, err)
+		}
+		return len(rec["description"].(string))
+	}
+
+	// growing key 5 past the leaf's free space forwards it instead of splitting
+	if err := bt.Update(5, record(5, 1500)); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if depth := bt.GetDepth(); depth != 1 {
+		t.Errorf("Expected the leaf not to split, depth is %d", depth)
+	}
+	if got := searchDesc(5); got != 1500 {
+		t.Errorf("Expected the forwarded record's 1500-byte description, got %d", got)
+	}
+	var keys []uint64
+	err = bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		if _, _, err := bt.DeserializeRecord(data); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || len(keys) != 12 {
+		t.Fatalf("RangeScan returned %v, err %v", keys, err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	overflowID := pager.PageID(bt.NumPages())
+
+	// shrinking it again brings it back inline and frees the overflow page
+	if err := bt.Update(5, record(5, 10)); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if got := searchDesc(5); got != 10 {
+		t.Errorf("Expected the 10-byte description back inline, got %d", got)
+	}
+	if free := bt.FreePages(); len(free) != 1 || free[0] != overflowID {
+		t.Errorf("Expected overflow page %d to be freed, free list is %v", overflowID, free)
+	}
+
+	// deleting a forwarded record frees its overflow copy too
+	if err := bt.Update(7, record(7, 1500)); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := bt.Update(9, record(9, 1500)); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := bt.Delete(7); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, found, err := bt.Search(7); err != nil || found {
+		t.Errorf("Expected key 7 gone, found=%v err=%v", found, err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	// vacuum resolves the remaining forward into the rebuilt leaves
+	if err := bt.Vacuum(); err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	if got := searchDesc(9); got != 1500 {
+		t.Errorf("Expected key 9's 1500-byte description after vacuum, got %d", got)
+	}
+	leafID, err := bt.findLeaf(0, &BTStack{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for leafID != 0 {
+		leaf, err := bt.loadNode(leafID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, rec := range leaf.Records {
+			if _, forwarded, _ := forwardTarget(rec); forwarded {
+				t.Errorf("Key %d still forwarded after vacuum", leaf.GetKey(i))
+			}
+		}
+		bt.pc.UnPin(leaf.PageID)
+		leafID = leaf.NextLeaf
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatalf("Verify after vacuum failed: %v", err)
+	}
+}
+
+func TestBuildTreeFindsEveryKey(t *testing.T) {
+	// how many separators fit in one internal page
+	perParent := 0
+	for p := pager.NewSlottedPage(1, pager.INTERNAL); ; perParent++ {
+		if _, err := p.InsertRecord(pager.SerializeInternalRecord(uint64(perParent), 1)); err != nil {
+			break
+		}
+	}
+
+	sch := createTestSchema()
+	// a parent holds perParent separators plus its rightmost child
+	for _, n := range []int{1, 2, 3, perParent, perParent + 1, perParent + 2, 2*perParent + 2, (perParent+1)*(perParent+1) + 1} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			bt, _, cleanup := createTestBTree(t)
+			defer cleanup()
+
+			// two records per leaf, keys 10, 11, 20, 21, ...
+			leaves := make([]*pager.SlottedPage, n)
+			for i := range leaves {
+				leaves[i] = pager.NewSlottedPage(pager.PageID(i+1), pager.LEAF)
+				for _, k := range []int{10 * (i + 1), 10*(i+1) + 1} {
+					data, err := sch.SerializeRecord(schema.Record{"id": int32(k), "description": "d", "qty": int32(k), "price": float64(k)})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := leaves[i].InsertRecord(data); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if i > 0 {
+					leaves[i-1].NextLeaf = leaves[i].PageID
+				}
+			}
+
+			pages, rootID, err := buildTree(leaves)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bt.ReplaceTree(pages, rootID); err != nil {
+				t.Fatal(err)
+			}
+			for i := range n {
+				for _, k := range []uint64{uint64(10 * (i + 1)), uint64(10*(i+1) + 1)} {
+					if _, found, err := bt.Search(k); err != nil || !found {
+						t.Fatalf("Search(%d) after bulk load: found=%v err=%v", k, found, err)
+					}
+				}
+			}
+			if err := bt.Verify(); err != nil {
+				t.Fatalf("Verify after bulk load: %v", err)
+			}
+		})
+	}
+}
+
+func TestBorrowedRecordSharesNoBytesWithSource(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 100; i++ {
+		data, _ := sch.SerializeRecord(schema.Record{
+			"id":          int32(i),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i),
+		})
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parent, err := bt.loadNode(bt.pc.GetRootPageID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bt.pc.UnPin(parent.PageID)
+	if parent.IsLeaf() {
+		t.Fatal("Expected the root to have split")
+	}
+	_, leftID := pager.DeserializeInternalRecord(parent.Records[0])
+	left, err := bt.loadNode(leftID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bt.pc.UnPin(left.PageID)
+	rightID := parent.RightmostChild
+	if parent.NumSlots > 1 {
+		_, rightID = pager.DeserializeInternalRecord(parent.Records[1])
+	}
+	right, err := bt.loadNode(rightID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bt.pc.UnPin(right.PageID)
+
+	source := right.Records[0]
+	want := slices.Clone(source)
+	if err := bt.borrowFromRightLeaf(left, right, parent, 0); err != nil {
+		t.Fatal(err)
+	}
+	// scribble over the bytes the source page held the record in
+	clear(source)
+
+	got := left.Records[left.NumSlots-1]
+	if !slices.Equal(got, want) {
+		t.Errorf("Borrowed record changed with its source page: got %x, want %x", got[:8], want[:8])
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatalf("Verify after borrow: %v", err)
+	}
+}
+
+func TestPathToEndsAtKeysLeaf(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 300; i++ {
+		data, _ := sch.SerializeRecord(schema.Record{
+			"id":          int32(i),
+			"description": "this_is_a_much_longer_product_description_to_fill_pages",
+			"qty":         int32(i),
+			"price":       float64(i),
+		})
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []uint64{1, 150, 300, 1000} {
+		path, err := bt.PathTo(key)
+		if err != nil {
+			t.Fatalf("PathTo(%d): %v", key, err)
+		}
+		if len(path) != bt.GetDepth() {
+			t.Fatalf("PathTo(%d) has %d pages, want depth %d", key, len(path), bt.GetDepth())
+		}
+		if path[0] != bt.pc.GetRootPageID() {
+			t.Errorf("PathTo(%d) starts at page %d, not the root", key, path[0])
+		}
+		for i, id := range path {
+			pageType, keys, err := bt.PageSummary(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantType := pager.INTERNAL
+			if i == len(path)-1 {
+				wantType = pager.LEAF
+			}
+			if pageType != wantType || keys == 0 {
+				t.Errorf("PathTo(%d) step %d: page %d is %s with %d keys", key, i, id, pageType, keys)
+			}
+		}
+
+		leaf, err := bt.loadNode(path[len(path)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, found := leaf.Search(key)
+		bt.pc.UnPin(leaf.PageID)
+		if found != (key <= 300) {
+			t.Errorf("Key %d found=%v in the leaf PathTo ends at", key, found)
+		}
+	}
+}
+
+func TestFanoutMatchesTreeShape(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	children, leafRecords, err := bt.Fanout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children != 0 || leafRecords != 0 {
+		t.Errorf("Empty tree: got %.1f children, %d leaf records", children, leafRecords)
+	}
+
+	sch := createTestSchema()
+	const n = 2000
+	for i := 1; i <= n; i++ {
+		data, _ := sch.SerializeRecord(schema.Record{
+			"id":          int32(i),
+			"description": "fanout",
+			"qty":         int32(i),
+			"price":       float64(i),
+		})
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bt.GetDepth() != 2 {
+		t.Fatalf("Expected a root over leaves, got depth %d", bt.GetDepth())
+	}
+
+	children, leafRecords, err = bt.Fanout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := bt.loadNode(bt.pc.GetRootPageID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChildren := float64(root.NumSlots) + 1
+	bt.pc.UnPin(root.PageID)
+	if wantChildren > fanoutSamples {
+		t.Fatalf("%v leaves is more than Fanout reads", wantChildren)
+	}
+
+	// few enough leaves that Fanout's paths reach them all
+	wantLeaf := 0
+	id, err := bt.findLeaf(0, &BTStack{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id != 0 {
+		leaf, err := bt.loadNode(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantLeaf = max(wantLeaf, int(leaf.NumSlots))
+		id = leaf.NextLeaf
+		bt.pc.UnPin(leaf.PageID)
+	}
+	if children != wantChildren || leafRecords != wantLeaf {
+		t.Errorf("Fanout = %.1f children, %d leaf records; want %.1f, %d", children, leafRecords, wantChildren, wantLeaf)
+	}
+}
+
+func TestPrefixScanMatchesDecimalPrefixes(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	const n = 3000
+	for i := 0; i <= n; i++ {
+		data, _ := sch.SerializeRecord(schema.Record{
+			"id":          int32(i),
+			"description": "prefix",
+			"qty":         int32(i),
+			"price":       float64(i),
+		})
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, prefix := range []string{"12", "3", "0", "2999", "05", "4000", ""} {
+		var want []uint64
+		for i := 0; i <= n; i++ {
+			if strings.HasPrefix(strconv.Itoa(i), prefix) {
+				want = append(want, uint64(i))
+			}
+		}
+		results, err := bt.PrefixScan(prefix)
+		if err != nil {
+			t.Fatalf("PrefixScan(%q) failed: %v", prefix, err)
+		}
+		var got []uint64
+		for _, data := range results {
+			got = append(got, recordKey(data))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("PrefixScan(%q) = %v, want %v", prefix, got, want)
+		}
+	}
+
+	if _, err := bt.PrefixScan("1a"); err == nil {
+		t.Error("Expected a non-numeric prefix to fail")
+	}
+	if ranges, _ := prefixRanges("18446744073709551615"); len(ranges) != 1 || ranges[0] != [2]uint64{math.MaxUint64, math.MaxUint64} {
+		t.Errorf("prefixRanges(max key) = %v", ranges)
+	}
+}
+
+func TestCyclicChildPointerFailsLoudly(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	const n = 2000
+	for i := 1; i <= n; i++ {
+		data, _ := sch.SerializeRecord(schema.Record{
+			"id":          int32(i),
+			"description": "cycle",
+			"qty":         int32(i),
+			"price":       float64(i),
+		})
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bt.SetMaxDepth(10); err != nil {
+		t.Fatal(err)
+	}
+
+	// point the root's last child back at the root
+	rootID := bt.pc.GetRootPageID()
+	root, err := bt.loadNode(rootID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.IsLeaf() {
+		t.Fatal("Expected the root to be internal")
+	}
+	root.RightmostChild = rootID
+	if err := bt.writeNode(root); err != nil {
+		t.Fatal(err)
+	}
+	bt.pc.UnPin(rootID)
+
+	if _, found, err := bt.Search(n); found || !errors.Is(err, ErrTreeTooDeep) || !errors.Is(err, ErrCorruptTree) {
+		t.Errorf("Search through the cycle: found=%v err=%v, want ErrTreeTooDeep", found, err)
+	}
+	if err := bt.Delete(n); !errors.Is(err, ErrTreeTooDeep) {
+		t.Errorf("Delete through the cycle: got %v, want ErrTreeTooDeep", err)
+	}
+	// keys left of the cycle are still reachable
+	if _, found, err := bt.Search(1); !found || err != nil {
+		t.Errorf("Search(1) = %v, %v", found, err)
+	}
+}
+
+func TestInternalSplitKeepsEveryChildReachable(t *testing.T) {
+	bt, _, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	// ascending inserts until the root has split as an internal node, and
+	// on past it so later leaf splits land in both of its halves
+	sch := createTestSchema()
+	n := 0
+	for extra := 0; extra < 5000; n++ {
+		rec := schema.Record{
+			"id":          int32(n),
+			"description": "x",
+			"qty":         int32(n),
+			"price":       float64(n),
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(n), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", n, err)
+		}
+		if bt.GetDepth() >= 3 {
+			extra++
+		}
+	}
+
+	if err := bt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if _, found, err := bt.Search(uint64(i)); err != nil || !found {
+			t.Fatalf("Search(%d) = found %v, err %v after %d inserts", i, found, err, n)
+		}
+	}
+}
+
+func TestOpenFromReaderAt(t *testing.T) {
+	bt, tmpFile, cleanup := createTestBTree(t)
+	defer cleanup()
+
+	sch := createTestSchema()
+	for i := 1; i <= 500; i++ {
+		rec := schema.Record{
+			"id":          int32(i),
+			"description": "bundled",
+			"qty":         int32(i),
+			"price":       float64(i),
+		}
+		data, _ := sch.SerializeRecord(rec)
+		if err := bt.Insert(uint64(i), data); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+	if err := bt.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	raw, err := os.ReadFile(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the table as bytes in memory, as if read out of an archive
+	dm := pager.NewDiskManager(pager.ReaderStorage(bytes.NewReader(raw), int64(len(raw))))
+	if err := dm.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	ro := NewBTree(&dm, dm.GetHeader())
+
+	data, found, err := ro.Search(250)
+	if err != nil || !found {
+		t.Fatalf("Search(250) = found %v, err %v", found, err)
+	}
+	if _, rec, err := sch.DeserializeRecord(data); err != nil || rec["description"] != "bundled" {
+		t.Errorf("Search(250) record = %v (err=%v)", rec, err)
+	}
+	if results, err := ro.RangeScan(1, 500); err != nil || len(results) != 500 {
+		t.Errorf("RangeScan returned %d records (err=%v), want 500", len(results), err)
+	}
+	if err := ro.SyncHeader(); !errors.Is(err, pager.ErrReadOnly) {
+		t.Errorf("SyncHeader on read-only storage = %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,258 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/pager"
+	"slices"
+)
+
+// Forwarding tables (TableHeader.Forwarding) end every leaf record with a
+// tag byte. An inline record is [data][0]. A forward stub is
+// [key:8][page:4][1], left behind when an update outgrew its leaf: the
+// record itself moved to that OVERFLOW page, stored inline and found there
+// by key. Overflow pages never hold stubs, so a read is at most one hop
+// from its data. Vacuum brings every record back inline.
+
+const (
+	tagInline  byte = 0
+	tagForward byte = 1
+)
+
+func (bt *BTree) forwarding() bool {
+	return bt.pc.GetHeader().Forwarding
+}
+
+// IsForwarding reports whether growing updates may forward records to
+// overflow pages.
+func (bt *BTree) IsForwarding() bool {
+	return bt.forwarding()
+}
+
+// encodeLeaf returns data as stored in a leaf: tagged inline on forwarding
+// tables, unchanged otherwise.
+func (bt *BTree) encodeLeaf(data []byte) []byte {
+	if !bt.forwarding() {
+		return data
+	}
+	return append(slices.Clone(data), tagInline)
+}
+
+func forwardStub(key uint64, pageID pager.PageID) []byte {
+	return append(pager.SerializeInternalRecord(key, pageID), tagForward)
+}
+
+// forwardTarget returns the overflow page a stored leaf record forwards
+// to, or ok false for an inline record. Only meaningful on forwarding tables.
+func forwardTarget(stored []byte) (pageID pager.PageID, ok bool, err error) {
+	if len(stored) == 0 {
+		return 0, false, fmt.Errorf("empty leaf record: %w", ErrCorruptTree)
+	}
+	switch stored[len(stored)-1] {
+	case tagInline:
+		return 0, false, nil
+	case tagForward:
+		if len(stored) != pager.InternalRecordSize+1 {
+			return 0, false, fmt.Errorf("forward stub of %d bytes: %w", len(stored), ErrCorruptTree)
+		}
+		_, pageID = pager.DeserializeInternalRecord(stored[:pager.InternalRecordSize])
+		return pageID, true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown record tag %d: %w", stored[len(stored)-1], ErrCorruptTree)
+	}
+}
+
+// resolve turns a record as stored in a leaf into its data, following a
+// forward stub to its overflow page.
+func (bt *BTree) resolve(key uint64, stored []byte) ([]byte, error) {
+	if !bt.forwarding() {
+		return stored, nil
+	}
+	pageID, forwarded, err := forwardTarget(stored)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %w", key, err)
+	}
+	if !forwarded {
+		return stored[:len(stored)-1], nil
+	}
+
+	page, err := bt.loadNode(pageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load overflow page %d: %w", pageID, err)
+	}
+	defer bt.pc.UnPin(page.PageID)
+	if page.PageType != pager.OVERFLOW {
+		return nil, fmt.Errorf("key %d forwards to page %d, not an overflow page: %w", key, pageID, ErrCorruptTree)
+	}
+	idx, found := page.Search(key)
+	if !found {
+		return nil, fmt.Errorf("key %d missing from overflow page %d: %w", key, pageID, ErrCorruptTree)
+	}
+	data, err := page.GetRecord(idx)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || data[len(data)-1] != tagInline {
+		return nil, fmt.Errorf("key %d: overflow page %d holds another stub: %w", key, pageID, ErrCorruptTree)
+	}
+	return data[:len(data)-1], nil
+}
+
+// Update replaces key's record with data. On a forwarding table a record
+// that no longer fits its leaf moves to an overflow page, leaving a stub,
+// rather than splitting the leaf. Elsewhere it is Delete then Insert.
+func (bt *BTree) Update(key uint64, data []byte) (err error) {
+	bt.noteChange(key)
+	if !bt.forwarding() {
+		if err := bt.Delete(key); err != nil {
+			return err
+		}
+		return bt.Insert(key, data)
+	}
+
+	defer func() {
+		bt.pc.FlushHeader()
+		if err == nil {
+			err = bt.flushWrites()
+		}
+	}()
+	if err := bt.checkRecordSize(key, data); err != nil {
+		return err
+	}
+
+	leafPageID, err := bt.findLeaf(key, &BTStack{})
+	if err != nil {
+		return err
+	}
+	leaf, err := bt.loadNode(leafPageID)
+	if err != nil {
+		return fmt.Errorf("failed to load page %d: %w", leafPageID, err)
+	}
+	defer bt.pc.UnPin(leaf.PageID)
+	idx, present := leaf.Search(key)
+	if !present {
+		return fmt.Errorf("key %d was not found", key)
+	}
+	// the old copy goes first, so the new one can't meet it on an overflow page
+	if err := bt.releaseRecord(leaf, idx); err != nil {
+		return err
+	}
+	if err := leaf.DeleteRecord(idx); err != nil {
+		return err
+	}
+
+	stored := bt.encodeLeaf(data)
+	_, err = leaf.InsertRecordSorted(stored)
+	if err == nil {
+		return bt.writeNode(leaf)
+	}
+	if !errors.Is(err, pager.ErrPageFull) {
+		return err
+	}
+
+	overflowID, err := bt.storeOverflow(key, stored)
+	if err != nil {
+		return err
+	}
+	_, err = leaf.InsertRecordSorted(forwardStub(key, overflowID))
+	if err == nil {
+		return bt.writeNode(leaf)
+	}
+	if !errors.Is(err, pager.ErrPageFull) {
+		return err
+	}
+
+	// the old record was smaller than a stub and the leaf is packed: split
+	if err := bt.dropOverflow(key, overflowID); err != nil {
+		return err
+	}
+	if err := bt.writeNode(leaf); err != nil {
+		return err
+	}
+	return bt.Insert(key, data)
+}
+
+// releaseRecord removes the overflow copy of the record in slot idx, if it
+// was forwarded, ahead of the slot itself being deleted.
+func (bt *BTree) releaseRecord(leaf *BNode, idx int) error {
+	if !bt.forwarding() {
+		return nil
+	}
+	key := leaf.GetKey(idx)
+	pageID, forwarded, err := forwardTarget(leaf.Records[idx])
+	if err != nil {
+		return fmt.Errorf("key %d: %w", key, err)
+	}
+	if !forwarded {
+		return nil
+	}
+	return bt.dropOverflow(key, pageID)
+}
+
+// storeOverflow writes a stored inline record to an overflow page with room
+// for it and returns the page. It tries the page it last wrote to before
+// allocating; that hint isn't persisted, so space left on overflow pages by
+// earlier sessions waits for a vacuum.
+func (bt *BTree) storeOverflow(key uint64, stored []byte) (pager.PageID, error) {
+	if id := bt.overflowHint; id != 0 {
+		page, err := bt.loadNode(id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load overflow page %d: %w", id, err)
+		}
+		// the hint may have been freed and reused since
+		if page.PageType == pager.OVERFLOW && !bt.pc.GetHeader().IsFree(id) {
+			_, err = page.InsertRecordSorted(stored)
+			if err == nil {
+				err = bt.writeNode(page)
+				bt.pc.UnPin(page.PageID)
+				return id, err
+			}
+			if !errors.Is(err, pager.ErrPageFull) {
+				bt.pc.UnPin(page.PageID)
+				return 0, err
+			}
+		}
+		bt.pc.UnPin(page.PageID)
+	}
+
+	page := &BNode{SlottedPage: pager.NewSlottedPage(bt.allocatePage(), pager.OVERFLOW)}
+	if _, err := page.InsertRecordSorted(stored); err != nil {
+		return 0, fmt.Errorf("key %d: failed to write overflow page %d: %w", key, page.PageID, err)
+	}
+	if err := bt.writeNode(page); err != nil {
+		return 0, err
+	}
+	bt.pc.UnPin(page.PageID)
+	bt.overflowHint = page.PageID
+	return page.PageID, nil
+}
+
+// dropOverflow deletes key's record from an overflow page, freeing the page
+// once it is empty.
+func (bt *BTree) dropOverflow(key uint64, pageID pager.PageID) error {
+	page, err := bt.loadNode(pageID)
+	if err != nil {
+		return fmt.Errorf("failed to load overflow page %d: %w", pageID, err)
+	}
+	defer bt.pc.UnPin(page.PageID)
+	if page.PageType != pager.OVERFLOW {
+		return fmt.Errorf("key %d forwards to page %d, not an overflow page: %w", key, pageID, ErrCorruptTree)
+	}
+	idx, found := page.Search(key)
+	if !found {
+		return fmt.Errorf("key %d missing from overflow page %d: %w", key, pageID, ErrCorruptTree)
+	}
+	if err := page.DeleteRecord(idx); err != nil {
+		return err
+	}
+	if err := bt.writeNode(page); err != nil {
+		return err
+	}
+	if page.NumSlots == 0 {
+		bt.pc.FreePage(pageID)
+		if bt.overflowHint == pageID {
+			bt.overflowHint = 0
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// Keys are integers, so a prefix scan matches keys by their decimal form:
+// prefix "12" matches 12, 120-129, 1200-1299 and so on up the key space.
+// Those are one contiguous key range per length, scanned in turn, each
+// from a seek to its first key and stopping at the first key past it.
+
+// PrefixScan returns the records whose keys, written in decimal, start with
+// prefix, in key order. An empty prefix matches every key.
+func (bt *BTree) PrefixScan(prefix string) ([][]byte, error) {
+	var results [][]byte
+	err := bt.PrefixScanFunc(prefix, func(key uint64, data []byte) error {
+		results = append(results, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// PrefixScanFunc is PrefixScan calling fn for each record instead of
+// collecting them. An error from fn ends the scan and is returned.
+func (bt *BTree) PrefixScanFunc(prefix string, fn func(key uint64, data []byte) error) error {
+	ranges, err := prefixRanges(prefix)
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if err := bt.RangeScanFunc(r[0], r[1], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixRanges lists, in ascending order, the key ranges [lo, hi] of keys
+// whose decimal form starts with prefix.
+func prefixRanges(prefix string) ([][2]uint64, error) {
+	if prefix == "" {
+		return [][2]uint64{{0, math.MaxUint64}}, nil
+	}
+	v, err := strconv.ParseUint(prefix, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, nil // longer than any key
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key prefix %q is not a decimal number", prefix)
+	}
+	if v == 0 {
+		// no key but 0 itself is written with a leading zero
+		if prefix == "0" {
+			return [][2]uint64{{0, 0}}, nil
+		}
+		return nil, nil
+	}
+	if prefix[0] == '0' {
+		return nil, nil
+	}
+
+	var ranges [][2]uint64
+	for width := uint64(1); ; {
+		over, lo := bits.Mul64(v, width)
+		if over != 0 {
+			break
+		}
+		hi, carry := bits.Add64(lo, width-1, 0)
+		if carry != 0 {
+			hi = math.MaxUint64
+		}
+		ranges = append(ranges, [2]uint64{lo, hi})
+		if hi == math.MaxUint64 {
+			break
+		}
+		if over, width = bits.Mul64(width, 10); over != 0 {
+			break
+		}
+	}
+	return ranges, nil
+}
@@ -1,22 +1,31 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"godb/internal/logging"
 	"godb/internal/pager"
 	"godb/internal/schema"
 	"godb/internal/store"
 	"io"
-	"log"
+	"maps"
 	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"unicode/utf8"
 )
 
+var cliLog = logging.New("cli")
+
 var (
 	tableCacheMu sync.RWMutex
 	tableCache   = make(map[string]*store.BTreeStore)
@@ -24,29 +33,48 @@ var (
 
 func GetOrOpenTable(filename string, ctx context.Context, wg *sync.WaitGroup) (*store.BTreeStore, error) {
 	tableCacheMu.Lock()
-	defer tableCacheMu.Unlock()
-
 	if bts, ok := tableCache[filename]; ok {
+		tableCacheMu.Unlock()
 		return bts, nil
 	}
 
-	bts, err := store.NewBTreeStore(filename, ctx, wg)
+	bts, err := store.Open(filename, ctx, wg)
 	if err != nil {
+		tableCacheMu.Unlock()
 		return nil, err
 	}
 	tableCache[filename] = bts
+	tableCacheMu.Unlock()
+
+	// warm up outside the cache lock so a big table doesn't stall every other open
+	if err := bts.Warmup(); err != nil {
+		// only a performance hint, the table is still usable
+		cliLog.Warn("warmup failed for %s: %v", filename, err)
+	}
 	return bts, nil
 }
 
+// ErrTableOpen is returned for creating a table that is already open.
+var ErrTableOpen = errors.New("table already open")
+
+// CreateTable creates a table with the default options and registers it
+// in the table cache, so it is checkpointed and closed on exit.
 func CreateTable(filename string, sch schema.Schema, ctx context.Context, wg *sync.WaitGroup) (*store.BTreeStore, error) {
+	return CreateTableWithOptions(filename, sch, store.StoreOptions{}, ctx, wg)
+}
+
+// CreateTableWithOptions is CreateTable with opts. It fails with
+// ErrTableOpen if the table is open, rather than opening a second store
+// over its file.
+func CreateTableWithOptions(filename string, sch schema.Schema, opts store.StoreOptions, ctx context.Context, wg *sync.WaitGroup) (*store.BTreeStore, error) {
 	tableCacheMu.Lock()
 	defer tableCacheMu.Unlock()
 
 	if _, ok := tableCache[filename]; ok {
-		return nil, fmt.Errorf("table already open: %s", filename)
+		return nil, fmt.Errorf("%w: %s", ErrTableOpen, filename)
 	}
 
-	ts, err := store.CreateBTreeStore(filename, sch, ctx, wg)
+	ts, err := store.CreateWithOptions(filename, sch, opts, ctx, wg)
 	if err != nil {
 		return nil, err
 	}
@@ -55,36 +83,155 @@ func CreateTable(filename string, sch schema.Schema, ctx context.Context, wg *sy
 	return ts, nil
 }
 
+// TableInfo describes a table as recorded in its header.
+type TableInfo struct {
+	Name     string
+	Fields   []schema.Field
+	NumPages uint32
+}
+
+// ListTables reads the header of every .db file in dir, sorted by name. It
+// doesn't open the tables: no WAL is created or replayed and no checkpointer
+// starts, so open tables report their state as of the last header write.
+func ListTables(dir string) ([]TableInfo, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	var tables []TableInfo
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".db") {
+			continue
+		}
+		header, err := pager.ReadTableHeader(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file.Name(), err)
+		}
+		tables = append(tables, TableInfo{
+			Name:     strings.TrimSuffix(file.Name(), ".db"),
+			Fields:   header.Schema.Fields,
+			NumPages: header.NumPages,
+		})
+	}
+	return tables, nil
+}
+
 type DatabaseConfig struct {
 	TableS *store.BTreeStore
 
 	inTransaction bool
 	txnBuffer     []pager.WALRecord
 
-	ctx context.Context
-	wg  *sync.WaitGroup
+	floatPrec int // digits after the decimal point for float columns
+	colWidth  int // fixed width of every printed column, 0 to size them automatically
+
+	ctx      context.Context // server lifetime; owns table checkpointers
+	queryCtx context.Context // cancels in-flight scans, e.g. when a client disconnects
+	wg       *sync.WaitGroup
 }
 
 func NewDatabaseConfig(bts *store.BTreeStore, ctx context.Context, wg *sync.WaitGroup) *DatabaseConfig {
 	return &DatabaseConfig{
-		TableS: bts,
-		ctx:    ctx,
-		wg:     wg,
+		TableS:    bts,
+		floatPrec: defaultFloatPrec,
+		ctx:       ctx,
+		wg:        wg,
 	}
 }
 
+// Clone makes a session config starting on the same table. Sessions share
+// tables, not state: use and create reassign only the clone's TableS, and
+// the clone starts with no transaction and no query context of its own.
 func (dbc *DatabaseConfig) Clone() *DatabaseConfig {
 	return &DatabaseConfig{
-		TableS: dbc.TableS,
-		ctx:    dbc.ctx,
-		wg:     dbc.wg,
+		TableS:    dbc.TableS,
+		floatPrec: dbc.floatPrec,
+		colWidth:  dbc.colWidth,
+		ctx:       dbc.ctx,
+		wg:        dbc.wg,
+	}
+}
+
+// Context is the server-lifetime context the config was created with.
+func (dbc *DatabaseConfig) Context() context.Context {
+	return dbc.ctx
+}
+
+// SetQueryContext ties this session's scans to ctx; they return ctx.Err() once it's done.
+func (dbc *DatabaseConfig) SetQueryContext(ctx context.Context) {
+	dbc.queryCtx = ctx
+}
+
+func (dbc *DatabaseConfig) queryContext() context.Context {
+	if dbc.queryCtx != nil {
+		return dbc.queryCtx
+	}
+	if dbc.ctx != nil {
+		return dbc.ctx
+	}
+	return context.Background()
+}
+
+// ActiveTableName is the name of the session's table, or "none" before CREATE/USE.
+func (dbc *DatabaseConfig) ActiveTableName() string {
+	if dbc.TableS == nil {
+		return "none"
+	}
+	return dbc.TableS.Schema().TableName
+}
+
+var ErrNoTable = errors.New("no table selected; use CREATE or USE first")
+
+// ErrWrongArity is returned by insert and update when the number of values
+// doesn't match the table's fields.
+var ErrWrongArity = errors.New("wrong number of values")
+
+// FieldError is a value that failed to parse as its field's type.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (fe *FieldError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %v", fe.Field, fe.Err)
+}
+
+func (fe *FieldError) Unwrap() error {
+	return fe.Err
+}
+
+// parseRecord turns one value per field, in schema order, into a record.
+func parseRecord(sch schema.Schema, params []string) (schema.Record, error) {
+	// system fields are filled in by the store
+	fields := sch.UserFields()
+	if len(params) != len(fields) {
+		return nil, fmt.Errorf("need %d parameters for fields %v, got %d: %w", len(fields), schema.Schema{Fields: fields}.GetFieldNames(), len(params), ErrWrongArity)
+	}
+	record := make(schema.Record)
+	for i, field := range fields {
+		value, err := schema.ParseValue(params[i], field.Type)
+		if err != nil {
+			return nil, &FieldError{Field: field.Name, Err: err}
+		}
+		record[field.Name] = value
 	}
+	return record, nil
 }
 
 type CliCommand struct {
 	Name        string
 	Description string
 	Callback    func(*DatabaseConfig, []string, io.Writer) error
+	NoTable     bool // command works without an active table
+}
+
+// Run invokes the command, refusing table commands when no table is active.
+func (cmd CliCommand) Run(config *DatabaseConfig, params []string, w io.Writer) error {
+	if !cmd.NoTable && config.TableS == nil {
+		return ErrNoTable
+	}
+	return cmd.Callback(config, params, w)
 }
 
 var CommandRegistry map[string]CliCommand
@@ -95,26 +242,48 @@ func init() {
 			Name:        ".help",
 			Description: "Show all available commands",
 			Callback:    commandHelp,
+			NoTable:     true,
 		},
 		".exit": {
 			Name:        ".exit",
 			Description: "Exit the database",
 			Callback:    commandExit,
+			NoTable:     true,
+		},
+		"ping": {
+			Name:        "ping",
+			Description: "Liveness check - replies pong without touching any table",
+			Callback:    commandPing,
+			NoTable:     true,
 		},
 		"create": {
 			Name:        "create",
-			Description: "Create new table - usage: create <table> <field:type> ... (first field is primary key)",
+			Description: "Create new table - usage: create <table> <field:type[<op><value>][!unique][@index]> ... [codec binary|json] [compress] [walonly] [omitkey] [flushwrites] [versioned] [retainlog] [keyrange <min> <max>] [forwarding] [createdat] (first field is primary key)",
 			Callback:    commandCreate,
+			NoTable:     true,
 		},
 		"use": {
 			Name:        "use",
 			Description: "Switch active table - usage: use <table>",
 			Callback:    commandUse,
+			NoTable:     true,
 		},
 		"show": {
 			Name:        "show",
-			Description: "List all tables",
+			Description: "List all tables with their fields and page counts",
 			Callback:    commandShow,
+			NoTable:     true,
+		},
+		".tables": {
+			Name:        ".tables",
+			Description: "List open tables with record counts and pending WAL state",
+			Callback:    commandTables,
+			NoTable:     true,
+		},
+		"rename": {
+			Name:        "rename",
+			Description: "Rename active table - usage: rename <new name>",
+			Callback:    commandRename,
 		},
 		"describe": {
 			Name:        "describe",
@@ -123,17 +292,27 @@ func init() {
 		},
 		"insert": {
 			Name:        "insert",
-			Description: "Insert record - usage: insert <val1> <val2> ... (must match schema)",
+			Description: "Insert record - usage: insert [ignore|replace] <val1> <val2> ... (must match schema)",
 			Callback:    commandInsert,
 		},
 		"select": {
 			Name:        "select",
-			Description: "Query records - usage: select | select <id> | select <start> <end>",
+			Description: "Query records - usage: select | select tolerant | select <id> | select [(]<start> <end>[)] | select where <field> <op> <value> [order by <field> [asc|desc]] | select sum|avg|min|max <field> | select next|prev <id> | select prefix <digits>",
 			Callback:    commandSelect,
 		},
+		"histogram": {
+			Name:        "histogram",
+			Description: "Chart how keys spread over the key range - usage: histogram [buckets] (default 10)",
+			Callback:    commandHistogram,
+		},
+		"explain": {
+			Name:        "explain",
+			Description: "Show how a query would run, without running it - usage: explain select where <field> <op> <value>",
+			Callback:    commandExplain,
+		},
 		"update": {
 			Name:        "update",
-			Description: "Update record - usage: update <val1> <val2> ... (primary key must exist)",
+			Description: "Update record - usage: update [ifversion <n>] <val1> <val2> ... (primary key must exist)",
 			Callback:    commandUpdate,
 		},
 		"delete": {
@@ -148,17 +327,85 @@ func init() {
 		},
 		"stats": {
 			Name:        "stats",
-			Description: "Show B+ tree statistics (root page, type, page count)",
+			Description: "Show B+ tree statistics (root page, type, page count) - usage: stats [fanout | cache [json]]",
 			Callback:    commandStats,
 		},
+		"path": {
+			Name:        "path",
+			Description: "Show the pages a lookup reads from the root to a key's leaf - usage: path <id>",
+			Callback:    commandPath,
+		},
+		"freelist": {
+			Name:        "freelist",
+			Description: "List pages on the free list awaiting reuse",
+			Callback:    commandFreelist,
+		},
 		"drop": {
 			Name:        "drop",
 			Description: "Delete the underlying table - usage: drop | <tablename>",
 			Callback:    commandDrop,
+			NoTable:     true,
+		},
+		"floatprec": {
+			Name:        "floatprec",
+			Description: "Show or set digits shown after the decimal point for floats - usage: floatprec [n]",
+			Callback:    commandFloatPrec,
+			NoTable:     true,
+		},
+		"colwidth": {
+			Name:        "colwidth",
+			Description: "Show or set the width of printed columns - usage: colwidth [n|auto]",
+			Callback:    commandColWidth,
+			NoTable:     true,
+		},
+		"set": {
+			Name:        "set",
+			Description: "Change and persist a table option - usage: set <option> <value> (set alone lists options)",
+			Callback:    commandSet,
+		},
+		"get": {
+			Name:        "get",
+			Description: "Show table options set on the active table - usage: get [option]",
+			Callback:    commandGet,
+		},
+		"checkpoint": {
+			Name:        "checkpoint",
+			Description: "Flush all pages to disk and truncate the WAL now",
+			Callback:    commandCheckpoint,
+		},
+		"synchdr": {
+			Name:        "synchdr",
+			Description: "Write the table header and fsync it, without a checkpoint",
+			Callback:    commandSyncHeader,
+		},
+		"history": {
+			Name:        "history",
+			Description: "Show every insert and delete in write order (tables created with retainlog)",
+			Callback:    commandHistory,
+		},
+		"verify": {
+			Name:        "verify",
+			Description: "Check the tree, header and WAL of the active table for consistency",
+			Callback:    commandVerify,
+		},
+		"backup": {
+			Name:        "backup",
+			Description: "Stream a copy of the table file: a \"backup <n> bytes\" line, then the raw bytes",
+			Callback:    commandBackup,
+		},
+		"wal": {
+			Name:        "wal",
+			Description: "Show WAL records that would be replayed after a crash",
+			Callback:    commandWAL,
+		},
+		"compact": {
+			Name:        "compact",
+			Description: "Compact a single page in place - usage: compact <page id>",
+			Callback:    commandCompact,
 		},
 		"vacuum": {
 			Name:        "vacuum",
-			Description: "Systematic compaction and orphan page reaping",
+			Description: "Systematic compaction and orphan page reaping - usage: vacuum [estimate]",
 			Callback:    commandVacuum,
 		},
 		"recover": {
@@ -184,6 +431,11 @@ func init() {
 	}
 }
 
+func commandPing(config *DatabaseConfig, params []string, w io.Writer) error {
+	fmt.Fprintln(w, "pong")
+	return nil
+}
+
 func commandBegin(config *DatabaseConfig, params []string, w io.Writer) error {
 	fmt.Fprintln(w, "Transaction initiated")
 	config.inTransaction = true
@@ -212,7 +464,151 @@ func commandRecover(config *DatabaseConfig, params []string, w io.Writer) error
 	return config.TableS.Recover()
 }
 
+func commandSet(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) == 0 {
+		fmt.Fprintln(w, "Table options:")
+		for _, line := range store.OptionNames() {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+		return nil
+	}
+	if len(params) != 2 {
+		return errors.New("set - usage: set <option> <value>")
+	}
+	if err := config.TableS.SetOption(params[0], params[1]); err != nil {
+		return fmt.Errorf("set - %w", err)
+	}
+	fmt.Fprintf(w, "%s = %s\n", params[0], params[1])
+	return nil
+}
+
+func commandGet(config *DatabaseConfig, params []string, w io.Writer) error {
+	switch len(params) {
+	case 0:
+		opts := config.TableS.Options()
+		if len(opts) == 0 {
+			fmt.Fprintln(w, "No table options set")
+			return nil
+		}
+		for _, name := range slices.Sorted(maps.Keys(opts)) {
+			fmt.Fprintf(w, "%s = %s\n", name, opts[name])
+		}
+		return nil
+	case 1:
+		value, ok, err := config.TableS.Option(params[0])
+		if err != nil {
+			return fmt.Errorf("get - %w", err)
+		}
+		if !ok {
+			fmt.Fprintf(w, "%s is not set\n", params[0])
+			return nil
+		}
+		fmt.Fprintf(w, "%s = %s\n", params[0], value)
+		return nil
+	default:
+		return errors.New("get - usage: get [option]")
+	}
+}
+
+func commandCheckpoint(config *DatabaseConfig, params []string, w io.Writer) error {
+	stats, err := config.TableS.CheckpointWithStats()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Checkpoint complete: %d pages flushed, WAL size %d bytes\n", stats.PagesFlushed, stats.WALSize)
+	if stats.WALCompacted > 0 {
+		fmt.Fprintf(w, "WAL compacted: %d superseded records dropped\n", stats.WALCompacted)
+	}
+	return nil
+}
+
+func commandSyncHeader(config *DatabaseConfig, params []string, w io.Writer) error {
+	if err := config.TableS.SyncHeader(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "Header synced")
+	return nil
+}
+
+func commandHistory(config *DatabaseConfig, params []string, w io.Writer) error {
+	err := config.TableS.ScanByLSN(func(rec pager.WALRecord) error {
+		switch rec.Action {
+		case pager.INSERT:
+			fmt.Fprintf(w, "  lsn %-8d %-10s key %d (%d bytes)\n", rec.Lsn, rec.Action, rec.Key, rec.RecordLength)
+		default:
+			fmt.Fprintf(w, "  lsn %-8d %-10s key %d\n", rec.Lsn, rec.Action, rec.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("history - %w", err)
+	}
+	return nil
+}
+
+func commandVerify(config *DatabaseConfig, params []string, w io.Writer) error {
+	if err := config.TableS.ConsistencyCheck(); err != nil {
+		return fmt.Errorf("verify - %w", err)
+	}
+	fmt.Fprintln(w, "Verify OK: tree, header and WAL are consistent")
+	return nil
+}
+
+// commandBackup sends the whole copy in one write after its length line, so
+// a client reads the line, then exactly that many bytes into a new .db file.
+func commandBackup(config *DatabaseConfig, params []string, w io.Writer) error {
+	err := config.TableS.Backup(w, func(size int64) error {
+		_, err := fmt.Fprintf(w, "backup %d bytes\n", size)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("backup - %w", err)
+	}
+	return nil
+}
+
+func commandWAL(config *DatabaseConfig, params []string, w io.Writer) error {
+	records, err := config.TableS.PendingWAL()
+	if err != nil {
+		return fmt.Errorf("wal - %w", err)
+	}
+	fmt.Fprintf(w, "%d pending WAL records for table %s\n", len(records), config.TableS.Schema().TableName)
+	for _, rec := range records {
+		switch rec.Action {
+		case pager.INSERT, pager.UPDATE:
+			fmt.Fprintf(w, "  lsn %-8d %-10s key %d (%d bytes)\n", rec.Lsn, rec.Action, rec.Key, rec.RecordLength)
+		case pager.DELETE:
+			fmt.Fprintf(w, "  lsn %-8d %-10s key %d\n", rec.Lsn, rec.Action, rec.Key)
+		default:
+			fmt.Fprintf(w, "  lsn %-8d %-10s root %d, next page %d\n", rec.Lsn, rec.Action, rec.RootPageID, rec.NextPageID)
+		}
+	}
+	return nil
+}
+
+func commandCompact(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) != 1 {
+		return errors.New("usage: compact <page id>")
+	}
+	id, err := strconv.ParseUint(params[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("compact - invalid page id '%s': %w", params[0], err)
+	}
+	gained, err := config.TableS.CompactPage(pager.PageID(id))
+	if err != nil {
+		return fmt.Errorf("compact - %w", err)
+	}
+	fmt.Fprintf(w, "Compacted page %d: %d bytes of free space gained\n", id, gained)
+	return nil
+}
+
 func commandVacuum(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) == 1 && params[0] == "estimate" {
+		return vacuumEstimate(config, w)
+	}
+	if len(params) != 0 {
+		return errors.New("usage: vacuum [estimate]")
+	}
 	fmt.Fprintf(w, "Vacuuming up table %s...\n", config.TableS.Schema().TableName)
 
 	err := config.TableS.Vacuum() // save error for future use so you can always refresh the table cache
@@ -240,6 +636,25 @@ func commandVacuum(config *DatabaseConfig, params []string, w io.Writer) error {
 	return nil
 }
 
+func vacuumEstimate(config *DatabaseConfig, w io.Writer) error {
+	current, estimated, err := config.TableS.VacuumEstimate()
+	if err != nil {
+		return fmt.Errorf("vacuum estimate failed: %w", err)
+	}
+	var saved uint64
+	if current > estimated {
+		saved = current - estimated
+	}
+	pct := 0.0
+	if current > 0 {
+		pct = float64(saved) / float64(current) * 100
+	}
+	fmt.Fprintf(w, "Current size:   %d bytes (%d pages)\n", current, current/pager.PAGE_SIZE)
+	fmt.Fprintf(w, "After vacuum:   %d bytes (%d pages)\n", estimated, estimated/pager.PAGE_SIZE)
+	fmt.Fprintf(w, "Reclaimable:    %d bytes (%.1f%%)\n", saved, pct)
+	return nil
+}
+
 func fieldString(typ schema.FieldType) (string, error) {
 	switch typ {
 	case schema.IntType:
@@ -252,6 +667,8 @@ func fieldString(typ schema.FieldType) (string, error) {
 		return "bool", nil
 	case schema.DateType:
 		return "date", nil
+	case schema.BigIntType:
+		return "bigint", nil
 	default:
 		return "", fmt.Errorf("type not found: %v", typ)
 	}
@@ -263,12 +680,27 @@ func commandDrop(config *DatabaseConfig, params []string, w io.Writer) error {
 		return fmt.Errorf("need at least one parameter, actual: %d", len(params))
 	}
 	tName := params[0]
+	// tables made before names were validated must still be droppable,
+	// but only from the working directory
+	if filepath.Base(tName) != tName {
+		return fmt.Errorf("drop: table name %q is a path", tName)
+	}
 	fName := tName + ".db"
 	fmt.Fprintf(w, "Dropping table %s...\n", tName)
 	err := os.Remove(fName)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to delete table file '%s': %w", fName, err)
 	}
+	walName := tName + ".wal"
+	err = os.Remove(walName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete WAL file '%s': %w", walName, err)
+	}
+	logName := tName + ".log"
+	err = os.Remove(logName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete retained log '%s': %w", logName, err)
+	}
 
 	tableCacheMu.Lock()
 	delete(tableCache, fName)
@@ -278,6 +710,32 @@ func commandDrop(config *DatabaseConfig, params []string, w io.Writer) error {
 	return nil
 }
 
+func commandRename(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) != 1 {
+		return errors.New("usage: rename <new name>")
+	}
+	newName := params[0]
+	if err := schema.ValidateName(newName); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	oldName := config.TableS.Schema().TableName
+
+	// hold the cache lock so no one opens the new name while files move
+	tableCacheMu.Lock()
+	defer tableCacheMu.Unlock()
+	if _, ok := tableCache[newName+".db"]; ok {
+		return fmt.Errorf("rename: table %s is already open", newName)
+	}
+	if err := config.TableS.Rename(newName); err != nil {
+		return err
+	}
+	delete(tableCache, oldName+".db")
+	tableCache[newName+".db"] = config.TableS
+
+	fmt.Fprintf(w, "Renamed table %s to %s\n", oldName, newName)
+	return nil
+}
+
 func commandDescribe(config *DatabaseConfig, params []string, w io.Writer) error {
 	var pKeyHuh string
 	sch := config.TableS.Schema()
@@ -291,17 +749,121 @@ func commandDescribe(config *DatabaseConfig, params []string, w io.Writer) error
 		}
 		if i == 0 {
 			pKeyHuh = " - PRIMARY KEY"
+		} else if rec.Unique {
+			pKeyHuh = " - UNIQUE"
 		} else {
 			pKeyHuh = ""
 		}
+		if rec.Check != nil {
+			pKeyHuh += fmt.Sprintf(" - CHECK %s %s", fName, rec.Check)
+		}
+		if rec.System {
+			pKeyHuh += " - SYSTEM"
+		}
+		if rec.Indexed {
+			pKeyHuh += " - INDEXED"
+		}
 		fmt.Fprintf(w, "   %s (%s)%s\n", fName, fType, pKeyHuh)
 	}
+	fmt.Fprintf(w, "Codec: %s\n", config.TableS.Codec())
+	fmt.Fprintf(w, "Schema hash: %016x\n", config.TableS.SchemaHash())
+	if config.TableS.IsCompressed() {
+		fmt.Fprintln(w, "Compression: on")
+	}
+	if config.TableS.OmitsKey() {
+		fmt.Fprintln(w, "Key column: prefix only (not repeated in record body)")
+	}
+	if config.TableS.FlushesWrites() {
+		fmt.Fprintln(w, "Writes: pages flushed on every insert/delete")
+	}
+	if config.TableS.IsVersioned() {
+		fmt.Fprintln(w, "Versioning: row version bumped on every update")
+	}
+	if config.TableS.RetainsLog() {
+		fmt.Fprintf(w, "History: retained in %s.log\n", config.TableS.Schema().TableName)
+	}
+	if minKey, maxKey, ok := config.TableS.KeyRange(); ok {
+		fmt.Fprintf(w, "Key range: %d to %d\n", minKey, maxKey)
+	}
+	if config.TableS.ForwardsUpdates() {
+		fmt.Fprintln(w, "Updates: records that outgrow their leaf forward to overflow pages")
+	}
+	if config.TableS.IsWALOnly() {
+		fmt.Fprintln(w, "Mode: wal-only (tree built on first read)")
+	}
 	return nil
 }
 
 func commandStats(config *DatabaseConfig, params []string, w io.Writer) error {
-	stats := config.TableS.Stats()
-	fmt.Fprintln(w, stats)
+	if len(params) == 0 {
+		stats := config.TableS.Stats()
+		fmt.Fprintln(w, stats)
+		return nil
+	}
+	if len(params) == 1 && params[0] == "fanout" {
+		children, leafRecords, err := config.TableS.Fanout()
+		if err != nil {
+			return fmt.Errorf("stats - %w", err)
+		}
+		fmt.Fprintf(w, "Fanout: %.1f children per internal page, up to %d records per leaf (sampled)\n", children, leafRecords)
+		return nil
+	}
+	if params[0] != "cache" || len(params) > 2 || (len(params) == 2 && params[1] != "json") {
+		return errors.New("usage: stats [fanout | cache [json]]")
+	}
+
+	cs := config.TableS.CacheStats()
+	if len(params) == 2 {
+		// one line, for scripts polling the server
+		return json.NewEncoder(w).Encode(struct {
+			Size      int     `json:"size"`
+			Capacity  int     `json:"capacity"`
+			Bytes     int64   `json:"bytes"`
+			MaxBytes  int64   `json:"max_bytes"`
+			Hits      uint64  `json:"hits"`
+			Misses    uint64  `json:"misses"`
+			Evictions uint64  `json:"evictions"`
+			HitRatio  float64 `json:"hit_ratio"`
+		}{cs.Size, cs.Capacity, cs.Bytes, cs.MaxBytes, cs.Hits, cs.Misses, cs.Evictions, cs.HitRatio()})
+	}
+	fmt.Fprintf(w, "Cache: %d/%d pages, %d bytes\n", cs.Size, cs.Capacity, cs.Bytes)
+	if cs.MaxBytes > 0 {
+		fmt.Fprintf(w, "Byte budget: %d\n", cs.MaxBytes)
+	}
+	fmt.Fprintf(w, "Hits: %d, Misses: %d (hit ratio %.1f%%)\n", cs.Hits, cs.Misses, cs.HitRatio()*100)
+	fmt.Fprintf(w, "Evictions: %d\n", cs.Evictions)
+	return nil
+}
+
+func commandFreelist(config *DatabaseConfig, params []string, w io.Writer) error {
+	free := config.TableS.FreePages()
+	fmt.Fprintf(w, "Free pages: %d\n", len(free))
+	if len(free) == 0 {
+		return nil
+	}
+	ids := make([]string, len(free))
+	for i, id := range free {
+		ids[i] = strconv.Itoa(int(id))
+	}
+	fmt.Fprintln(w, strings.Join(ids, ", "))
+	return nil
+}
+
+func commandPath(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) != 1 {
+		return errors.New("path - usage: path <id>")
+	}
+	key, err := parseKey(params[0])
+	if err != nil {
+		return fmt.Errorf("invalid key '%s': %w", params[0], err)
+	}
+	path, err := config.TableS.PathTo(key)
+	if err != nil {
+		return err
+	}
+	for depth, step := range path {
+		fmt.Fprintf(w, "%s page %d (%s, %d keys)\n", strings.Repeat("  ", depth), step.PageID, step.Type, step.Keys)
+	}
 	return nil
 }
 
@@ -311,24 +873,114 @@ func commandCreate(config *DatabaseConfig, params []string, w io.Writer) error {
 	}
 
 	tName := params[0]
+	if err := schema.ValidateName(tName); err != nil {
+		return fmt.Errorf("create: table name: %w", err)
+	}
 	fName := tName + ".db"
 
 	fields := make([]schema.Field, 0, len(params)-1)
-	for _, paramPair := range params[1:] {
+	opts := store.StoreOptions{}
+	for i := 1; i < len(params); i++ {
+		paramPair := params[i]
+
+		// trailing table options: codec <binary|json>, compress, walonly, omitkey, flushwrites, versioned, retainlog,
+		// keyrange <min> <max>, forwarding, createdat
+		if paramPair == "compress" {
+			opts.Compress = true
+			continue
+		}
+		if paramPair == "walonly" {
+			opts.WALOnly = true
+			continue
+		}
+		if paramPair == "omitkey" {
+			opts.OmitKey = true
+			continue
+		}
+		if paramPair == "flushwrites" {
+			opts.FlushWrites = true
+			continue
+		}
+		if paramPair == "versioned" {
+			opts.Versioned = true
+			continue
+		}
+		if paramPair == "retainlog" {
+			opts.RetainLog = true
+			continue
+		}
+		if paramPair == "forwarding" {
+			opts.Forwarding = true
+			continue
+		}
+		if paramPair == "createdat" {
+			opts.CreatedAt = true
+			continue
+		}
+		if paramPair == "keyrange" {
+			if i+2 >= len(params) {
+				return errors.New("create: keyrange option requires a min and max key")
+			}
+			minKey, err := parseKey(params[i+1])
+			if err != nil {
+				return fmt.Errorf("create: invalid keyrange min '%s': %w", params[i+1], err)
+			}
+			maxKey, err := parseKey(params[i+2])
+			if err != nil {
+				return fmt.Errorf("create: invalid keyrange max '%s': %w", params[i+2], err)
+			}
+			opts.KeyRange, opts.MinKey, opts.MaxKey = true, minKey, maxKey
+			i += 2
+			continue
+		}
+		if paramPair == "codec" {
+			if i+1 >= len(params) {
+				return errors.New("create: codec option requires a value (binary or json)")
+			}
+			codec, err := schema.ParseCodecType(params[i+1])
+			if err != nil {
+				return fmt.Errorf("create: %w", err)
+			}
+			opts.Codec = codec
+			i++
+			continue
+		}
+
 		parts := strings.Split(paramPair, ":")
 		if len(parts) != 2 {
 			return errors.New("error parsing fieldnames and types")
 		}
 		fieldName := parts[0]
-		fieldType, err := schema.ParseFieldType(parts[1])
+		if err := schema.ValidateName(fieldName); err != nil {
+			return fmt.Errorf("create: field name: %w", err)
+		}
+
+		// optional suffixes: name:type[<op><literal>][!unique][@index],
+		// e.g. age:int>=0 or code:int>0!unique or email:string@index
+		spec, indexed := strings.CutSuffix(parts[1], "@index")
+		typeName, constraint := spec, ""
+		if i := strings.IndexAny(typeName, "<>=!"); i >= 0 {
+			typeName, constraint = typeName[:i], typeName[i:]
+		}
+		fieldType, err := schema.ParseFieldType(typeName)
 		if err != nil {
 			return fmt.Errorf("create: failed to parse field type '%s': %w", fieldName, err)
 		}
+		field := schema.Field{Name: fieldName, Type: fieldType, Indexed: indexed}
+		constraint, field.Unique = strings.CutSuffix(constraint, "!unique")
+		if strings.HasPrefix(constraint, "!") && !strings.HasPrefix(constraint, "!=") {
+			return fmt.Errorf("create: unknown constraint '%s' on field '%s'", constraint[1:], fieldName)
+		}
+		if constraint != "" {
+			if field.Check, err = schema.ParseCheck(constraint, fieldType); err != nil {
+				return fmt.Errorf("create: field '%s': %w", fieldName, err)
+			}
+		}
+		fields = append(fields, field)
+	}
 
-		fields = append(fields, schema.Field{
-			Name: fieldName,
-			Type: fieldType,
-		})
+	if len(fields) == 0 {
+		return errors.New("must provide at least a table name with a single field")
 	}
 
 	sch := schema.Schema{
@@ -336,16 +988,11 @@ func commandCreate(config *DatabaseConfig, params []string, w io.Writer) error {
 		Fields:    fields,
 	}
 
-	newTableStore, err := store.CreateBTreeStore(fName, sch, config.ctx, config.wg)
+	newTableStore, err := CreateTableWithOptions(fName, sch, opts, config.ctx, config.wg)
 	if err != nil {
 		return fmt.Errorf("create: failed to create a BTreeStore for '%s': %w", tName, err)
 	}
 
-	// add to cache to it gets checkpointed/closed on exit
-	tableCacheMu.Lock()
-	tableCache[fName] = newTableStore
-	tableCacheMu.Unlock()
-
 	config.TableS = newTableStore
 	fmt.Fprintf(w, "New table created: %s\n", newTableStore.Schema().TableName)
 	return nil
@@ -368,16 +1015,58 @@ func commandUse(config *DatabaseConfig, params []string, w io.Writer) error {
 }
 
 func commandShow(config *DatabaseConfig, params []string, w io.Writer) error {
-	files, err := os.ReadDir(".")
+	tables, err := ListTables(".")
 	if err != nil {
-		return fmt.Errorf("show: failed to list tables: %w", err)
+		return fmt.Errorf("show: %w", err)
 	}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".db") {
-			fmt.Fprintln(w, strings.TrimSuffix(file.Name(), ".db"))
+	for _, table := range tables {
+		fields := make([]string, len(table.Fields))
+		for i, field := range table.Fields {
+			fType, err := fieldString(field.Type)
+			if err != nil {
+				return fmt.Errorf("show: table %s field %s: %w", table.Name, field.Name, err)
+			}
+			fields[i] = field.Name + ":" + fType
 		}
+		fmt.Fprintf(w, "%-20s %4d pages  %s\n", table.Name, table.NumPages, strings.Join(fields, " "))
+	}
+	return nil
+}
+
+func commandTables(config *DatabaseConfig, params []string, w io.Writer) error {
+	// snapshot the cache so counting doesn't hold the lock
+	tableCacheMu.RLock()
+	names := make([]string, 0, len(tableCache))
+	tables := make(map[string]*store.BTreeStore, len(tableCache))
+	for fName, bts := range tableCache {
+		names = append(names, fName)
+		tables[fName] = bts
+	}
+	tableCacheMu.RUnlock()
+
+	if len(names) == 0 {
+		fmt.Fprintln(w, "No open tables")
+		return nil
+	}
+	sort.Strings(names)
 
+	fmt.Fprintf(w, "%-20s %10s %s\n", "table", "records", "wal")
+	for _, fName := range names {
+		bts := tables[fName]
+		count, err := bts.Count()
+		if err != nil {
+			return fmt.Errorf(".tables: failed to count %s: %w", fName, err)
+		}
+		pending, err := bts.HasPendingWAL()
+		if err != nil {
+			return fmt.Errorf(".tables: failed to stat WAL for %s: %w", fName, err)
+		}
+		walState := "clean"
+		if pending {
+			walState = "pending"
+		}
+		fmt.Fprintf(w, "%-20s %10d %s\n", bts.Schema().TableName, count, walState)
 	}
 	return nil
 }
@@ -387,8 +1076,8 @@ func commandHelp(config *DatabaseConfig, params []string, w io.Writer) error {
 	fmt.Fprintln(w, "Usage: ")
 	fmt.Fprintln(w)
 
-	for name, cmd := range CommandRegistry {
-		fmt.Fprintf(w, "%s: %s\n", name, cmd.Description)
+	for _, name := range slices.Sorted(maps.Keys(CommandRegistry)) {
+		fmt.Fprintf(w, "%s: %s\n", name, CommandRegistry[name].Description)
 	}
 	return nil
 }
@@ -403,16 +1092,37 @@ func commandExit(config *DatabaseConfig, params []string, w io.Writer) error {
 
 	// for local clients, close the entire db
 	defer os.Exit(0)
-	for _, v := range tableCache {
-		if err := v.Checkpoint(); err != nil {
-			log.Printf("Checkpoint failed on exit: %v\n", err)
+	return closeAllTables()
+}
+
+// closeAllTables checkpoints and closes every open table. The cache is
+// emptied under the lock and the stores closed outside it, so opens and
+// drops on other sessions never race the iteration or find a closed store.
+func closeAllTables() error {
+	tableCacheMu.Lock()
+	stores := make([]*store.BTreeStore, 0, len(tableCache))
+	for fName, bts := range tableCache {
+		stores = append(stores, bts)
+		delete(tableCache, fName)
+	}
+	tableCacheMu.Unlock()
+
+	var errs []error
+	for _, bts := range stores {
+		if err := bts.Checkpoint(); err != nil {
+			cliLog.Error("checkpoint failed on exit: %v", err)
 		}
-		err := v.Close()
-		if err != nil {
-			return fmt.Errorf("close: failed to close table '%s': %w", v.Schema().TableName, err)
+		if err := bts.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close: failed to close table '%s': %w", bts.Schema().TableName, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// parseKey parses a primary key argument; keys are uint64 throughout the
+// store, WAL and tree.
+func parseKey(s string) (uint64, error) {
+	return strconv.ParseUint(s, 10, 64)
 }
 
 func commandDelete(config *DatabaseConfig, params []string, w io.Writer) error {
@@ -421,51 +1131,65 @@ func commandDelete(config *DatabaseConfig, params []string, w io.Writer) error {
 		return errors.New("must provide a primary key for deletion")
 	}
 
-	key, err := strconv.Atoi(params[0])
+	key, err := parseKey(params[0])
 	if err != nil {
-		return fmt.Errorf("invalid primary key '%s' (must be integer): %w", params[0], err)
+		return fmt.Errorf("invalid primary key '%s' (must be a non-negative integer): %w", params[0], err)
 	}
 
 	if config.inTransaction {
-		wr, err := config.TableS.PrepareDelete(uint64(key))
+		wr, err := config.TableS.PrepareDelete(key)
 		if err != nil {
 			return fmt.Errorf("delete: failed to prepare delete transaction %d: %w", key, err)
 		}
 		config.txnBuffer = append(config.txnBuffer, wr)
 		return nil
 	} else {
-		record, err := config.TableS.Find(key)
-		if err != nil {
-			return fmt.Errorf("unable to find key: %d", key)
+		if config.TableS.IsWALOnly() {
+			n, err := config.TableS.Delete(key)
+			if err != nil {
+				return fmt.Errorf("delete failed for key %d: %w", key, err)
+			}
+			printAffected(w, n, "deleted")
+			return nil
 		}
-
-		fmt.Fprintf(w, "Deleting %+v from table %s\n", record, config.TableS.Schema().TableName)
-		if err := config.TableS.Delete(uint64(key)); err != nil {
+		record, err := config.TableS.DeleteReturning(key)
+		if errors.Is(err, store.ErrKeyNotFound) {
+			printAffected(w, 0, "deleted")
+			return nil
+		}
+		if err != nil {
 			return fmt.Errorf("delete failed for key %d: %w", key, err)
 		}
+		if err := printRecords(config, w, []schema.Record{record}, nil); err != nil {
+			return err
+		}
+		printAffected(w, 1, "deleted")
 		return nil
 	}
 
 }
 
 func commandUpdate(config *DatabaseConfig, params []string, w io.Writer) error {
-	// this is a naive implementation of UPDATE. It just DELETES then INSERTS.
-	// we can make a true mutable UPDATE later.
-	fieldCount := len(config.TableS.Schema().Fields)
-
-	if len(params) != fieldCount {
-		return fmt.Errorf("need %d parameters for fields: %v", fieldCount, config.TableS.Schema().GetFieldNames())
-	}
-
-	// parse record
-	record := make(schema.Record)
-	for i, field := range config.TableS.Schema().Fields {
-		// parse params[i] according to field.type
-		value, err := schema.ParseValue(params[i], field.Type)
+	// the store replaces the row in place (Update); inside a transaction the
+	// change is buffered as a DELETE then an INSERT of the new image
+
+	// optional version check on versioned tables: update ifversion <n> ...
+	var expected *uint64
+	if len(params) > 0 && params[0] == "ifversion" {
+		if len(params) < 2 {
+			return errors.New("update - ifversion needs a version number")
+		}
+		v, err := strconv.ParseUint(params[1], 10, 64)
 		if err != nil {
-			return fmt.Errorf("invalid value for %s: %v", field.Name, err)
+			return fmt.Errorf("update - invalid version '%s': %w", params[1], err)
 		}
-		record[field.Name] = value
+		expected = &v
+		params = params[2:]
+	}
+
+	record, err := parseRecord(config.TableS.Schema(), params)
+	if err != nil {
+		return fmt.Errorf("update - %w", err)
 	}
 
 	key, err := config.TableS.ExtractPrimaryKey(record)
@@ -474,131 +1198,681 @@ func commandUpdate(config *DatabaseConfig, params []string, w io.Writer) error {
 	}
 
 	if config.inTransaction {
-		wr, err := config.TableS.PrepareInsert(record)
-		if err != nil {
-			return fmt.Errorf("update - failed to prepare insert: %w", err)
+		if expected != nil {
+			// the check would run against the table as of now, not at commit
+			return errors.New("update - ifversion isn't supported inside a transaction")
 		}
-		config.txnBuffer = append(config.txnBuffer, wr)
-		wr, err = config.TableS.PrepareDelete(uint64(key))
+		del, err := config.TableS.PrepareDelete(uint64(key))
 		if err != nil {
 			return fmt.Errorf("update - failed to prepare delete: %w", err)
 		}
-		config.txnBuffer = append(config.txnBuffer, wr)
+		wr, err := config.TableS.PrepareUpdate(record)
+		if err != nil {
+			return fmt.Errorf("update - failed to prepare insert: %w", err)
+		}
+		config.txnBuffer = append(config.txnBuffer, del, wr)
 		return nil
 	} else {
-		fmt.Fprintf(w, "Updating %+v in table %s\n", record, config.TableS.Schema().TableName)
-
-		err := config.TableS.Delete(uint64(key))
+		var n int
+		if expected != nil {
+			n, err = config.TableS.UpdateIfVersion(record, *expected)
+		} else {
+			n, err = config.TableS.Update(record)
+		}
 		if err != nil {
-			return fmt.Errorf("update - failed to delete key %d: %w", key, err)
+			return fmt.Errorf("update - failed to update key %d: %w", key, err)
 		}
-		return config.TableS.Insert(record)
+		printAffected(w, n, "updated")
+		return nil
+	}
+}
+
+// printAffected reports a row count the way SQL shells do, e.g. "1 row deleted".
+func printAffected(w io.Writer, n int, verb string) {
+	if n == store.RowsUnknown {
+		// WAL-only: the key was logged without checking it exists
+		fmt.Fprintf(w, "Row %s if it existed\n", verb)
+		return
+	}
+	noun := "rows"
+	if n == 1 {
+		noun = "row"
 	}
+	fmt.Fprintf(w, "%d %s %s\n", n, noun, verb)
 }
 
 func commandInsert(config *DatabaseConfig, params []string, w io.Writer) error {
+	// optional conflict policy: insert ignore ... / insert replace ...
+	opts := store.InsertOptions{}
+	if len(params) > 0 {
+		switch params[0] {
+		case "ignore":
+			opts.OnConflict = store.ConflictIgnore
+			params = params[1:]
+		case "replace":
+			opts.OnConflict = store.ConflictReplace
+			params = params[1:]
+		}
+	}
 
-	fieldCount := len(config.TableS.Schema().Fields)
+	record, err := parseRecord(config.TableS.Schema(), params)
+	if err != nil {
+		return fmt.Errorf("insert - %w", err)
+	}
+	if config.inTransaction {
+		return bufferInsert(config, record, opts, w)
+	}
 
-	if len(params) != fieldCount {
-		return fmt.Errorf("need %d parameters for fields: %v", fieldCount, config.TableS.Schema().GetFieldNames())
+	result, err := config.TableS.InsertWithOptions(record, opts)
+	if err != nil {
+		return fmt.Errorf("insert - failed to insert: %w", err)
+	}
+	switch result {
+	case store.Ignored:
+		fmt.Fprintln(w, "0 rows inserted, key already exists")
+	case store.Replaced:
+		printAffected(w, result.RowsAffected(), "replaced")
+	default:
+		printAffected(w, result.RowsAffected(), "inserted")
 	}
+	return nil
+}
 
-	// parse record
-	record := make(schema.Record)
-	for i, field := range config.TableS.Schema().Fields {
-		// parse params[i] according to field.type
-		value, err := schema.ParseValue(params[i], field.Type)
-		if err != nil {
-			return fmt.Errorf("invalid value for %s: %v", field.Name, err)
-		}
-		record[field.Name] = value
+// bufferInsert queues an insert in the open transaction, resolving the
+// conflict policy against the table as it stands now.
+func bufferInsert(config *DatabaseConfig, record schema.Record, opts store.InsertOptions, w io.Writer) error {
+	wr, err := config.TableS.PrepareInsert(record)
+	if err != nil {
+		return fmt.Errorf("insert - failed to prepare insert: %w", err)
 	}
-	if config.inTransaction {
-		wr, err := config.TableS.PrepareInsert(record)
+
+	if opts.OnConflict != store.ConflictError {
+		exists, err := config.TableS.Exists(uint64(wr.Key))
 		if err != nil {
-			return fmt.Errorf("insert - failed to prepare insert: %w", err)
+			return fmt.Errorf("insert - failed to check key %d: %w", wr.Key, err)
 		}
-		config.txnBuffer = append(config.txnBuffer, wr)
-	} else {
-		if err := config.TableS.Insert(record); err != nil {
-			return fmt.Errorf("insert - failed to insert: %w", err)
+		if exists && opts.OnConflict == store.ConflictIgnore {
+			fmt.Fprintln(w, "Key already exists, insert ignored")
+			return nil
+		}
+		if exists && opts.OnConflict == store.ConflictReplace {
+			del, err := config.TableS.PrepareDelete(uint64(wr.Key))
+			if err != nil {
+				return fmt.Errorf("insert - failed to prepare replace: %w", err)
+			}
+			config.txnBuffer = append(config.txnBuffer, del)
 		}
 	}
 
+	config.txnBuffer = append(config.txnBuffer, wr)
 	return nil
 }
 
-func selectAll(config *DatabaseConfig, w io.Writer) error {
-	records, err := config.TableS.ScanAll()
-	if err != nil {
-		return fmt.Errorf("selectall - failed to scan all: %w", err)
+// selectChunkRows is how many rows a streamed select writes between flushes,
+// so remote clients start receiving output before the scan finishes. The
+// table isn't locked while a chunk is written.
+const selectChunkRows = 100
+
+const (
+	defaultFloatPrec = 2
+	maxFloatPrec     = 15
+)
+
+func commandFloatPrec(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) == 0 {
+		fmt.Fprintf(w, "floatprec: %d\n", config.floatPrec)
+		return nil
 	}
+	if len(params) != 1 {
+		return errors.New("usage: floatprec [n]")
+	}
+	prec, err := strconv.Atoi(params[0])
+	if err != nil || prec < 0 || prec > maxFloatPrec {
+		return fmt.Errorf("floatprec: precision must be an integer 0-%d, got '%s'", maxFloatPrec, params[0])
+	}
+	config.floatPrec = prec
+	fmt.Fprintf(w, "floatprec set to %d\n", prec)
+	return nil
+}
 
-	fieldNames := config.TableS.Schema().GetFieldNames()
-	widths := make([]int, len(fieldNames))
-	for i, field := range fieldNames {
-		widths[i] = len(field) * 4
+const (
+	minColWidth = 4
+	maxColWidth = 200
+	// maxAutoColWidth caps columns sized from their values; longer values
+	// are cut short
+	maxAutoColWidth = 40
+)
+
+func commandColWidth(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) == 0 {
+		if config.colWidth == 0 {
+			fmt.Fprintln(w, "colwidth: auto")
+		} else {
+			fmt.Fprintf(w, "colwidth: %d\n", config.colWidth)
+		}
+		return nil
+	}
+	if len(params) != 1 {
+		return errors.New("usage: colwidth [n|auto]")
+	}
+	if params[0] == "auto" {
+		config.colWidth = 0
+		fmt.Fprintln(w, "colwidth set to auto")
+		return nil
+	}
+	width, err := strconv.Atoi(params[0])
+	if err != nil || width < minColWidth || width > maxColWidth {
+		return fmt.Errorf("colwidth: width must be auto or an integer %d-%d, got '%s'", minColWidth, maxColWidth, params[0])
 	}
+	config.colWidth = width
+	fmt.Fprintf(w, "colwidth set to %d\n", width)
+	return nil
+}
+
+// formatValue renders a field value for display; storage is unaffected.
+func formatValue(config *DatabaseConfig, field schema.Field, val any) string {
+	if f, ok := val.(float64); ok && field.Type == schema.FloatType {
+		return strconv.FormatFloat(f, 'f', config.floatPrec, 64)
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// columnWidths sizes each column to fit its name and its widest value in
+// records, up to maxAutoColWidth. A streamed scan can't see its rows ahead
+// of time, so with no records the columns get a width by type instead. A
+// colwidth setting overrides both.
+func columnWidths(config *DatabaseConfig, records []schema.Record) []int {
+	sch := config.TableS.Schema()
+	widths := make([]int, len(sch.Fields))
+	for i, field := range sch.Fields {
+		if config.colWidth > 0 {
+			widths[i] = config.colWidth
+			continue
+		}
+		widths[i] = utf8.RuneCountInString(field.Name)
+		if records == nil {
+			widths[i] = max(widths[i], typeColWidth(config, field.Type))
+		}
+	}
+	if config.colWidth > 0 {
+		return widths
+	}
+	for _, record := range records {
+		for i, v := range sch.OrderedValues(record) {
+			widths[i] = max(widths[i], utf8.RuneCountInString(formatValue(config, sch.Fields[i], v)))
+		}
+	}
+	for i := range widths {
+		widths[i] = min(widths[i], maxAutoColWidth)
+	}
+	return widths
+}
+
+// typeColWidth is a column width that fits most values of a type.
+func typeColWidth(config *DatabaseConfig, t schema.FieldType) int {
+	switch t {
+	case schema.IntType:
+		return 11 // -2147483648
+	case schema.BigIntType, schema.DateType:
+		return 20
+	case schema.BoolType:
+		return 5
+	case schema.FloatType:
+		// room for a large integer part plus the configured decimals
+		return 10 + config.floatPrec
+	default:
+		return 16
+	}
+}
+
+// printHeader prints the column names, sized by columnWidths for records,
+// and returns the widths for printRow.
+func printHeader(config *DatabaseConfig, w io.Writer, records []schema.Record) []int {
+	fields := config.TableS.Schema().Fields
+	widths := columnWidths(config, records)
 	fmt.Fprint(w, "| ")
-	for i, field := range fieldNames {
-		fmt.Fprintf(w, "%-*s | ", widths[i], field)
+	total := 1
+	for i, field := range fields {
+		fmt.Fprintf(w, "%-*s | ", widths[i], fitColumn(field.Name, widths[i]))
+		total += widths[i] + 3
 	}
 	fmt.Fprintln(w)
-	fmt.Fprintln(w, strings.Repeat("-", len(fieldNames)*20))
+	fmt.Fprintln(w, strings.Repeat("-", total))
+	return widths
+}
 
-	for _, record := range records {
-		fmt.Fprint(w, "| ")
-		for i, field := range config.TableS.Schema().Fields {
-			val := fmt.Sprintf("%v", record[field.Name])
-			fmt.Fprintf(w, "%-*s | ", widths[i], val)
+func printRow(config *DatabaseConfig, w io.Writer, widths []int, record schema.Record) {
+	fmt.Fprint(w, "| ")
+	sch := config.TableS.Schema()
+	for i, v := range sch.OrderedValues(record) {
+		val := formatValue(config, sch.Fields[i], v)
+		fmt.Fprintf(w, "%-*s | ", widths[i], fitColumn(val, widths[i]))
+	}
+	fmt.Fprintln(w)
+}
+
+// fitColumn cuts s to width runes, marking the cut with a trailing "~", so
+// long values don't push the columns after them out of line.
+func fitColumn(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width-1]) + "~"
+}
+
+// streamRecords prints every record in kr as it is read from the tree
+// rather than collecting the whole result first.
+func streamRecords(config *DatabaseConfig, w io.Writer, kr keyRange) error {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	widths := printHeader(config, bw, nil)
+	return config.TableS.RangeScanChunks(config.queryContext(), kr.start, kr.end, kr.includeStart, kr.includeEnd, selectChunkRows, func(records []schema.Record) error {
+		for _, record := range records {
+			printRow(config, bw, widths, record)
 		}
-		fmt.Fprintln(w)
+		return bw.Flush()
+	})
+}
+
+func selectAll(config *DatabaseConfig, w io.Writer) error {
+	if err := streamRecords(config, w, keyRange{0, math.MaxUint64, true, true}); err != nil {
+		return fmt.Errorf("selectall - failed to scan all: %w", err)
 	}
+	return nil
+}
 
+// selectTolerant prints every readable record, skipping ones that fail to decode.
+func selectTolerant(config *DatabaseConfig, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	widths := printHeader(config, bw, nil)
+	rows := 0
+	skipped, err := config.TableS.ScanTolerant(func(record schema.Record) error {
+		printRow(config, bw, widths, record)
+		rows++
+		if rows%selectChunkRows == 0 {
+			return bw.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("select - tolerant scan failed after %d rows: %w", rows, err)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(bw, "Skipped %d unreadable records (see log)\n", skipped)
+	}
 	return nil
 }
 
 func rangeScan(config *DatabaseConfig, w io.Writer, params []string) error {
-	startKey, err := strconv.Atoi(params[0])
+	kr, err := parseKeyRange(params)
 	if err != nil {
-		return fmt.Errorf("rangescan - invalid start key '%s': %w", params[0], err)
+		return fmt.Errorf("rangescan - %w", err)
+	}
+
+	if err := streamRecords(config, w, kr); err != nil {
+		return fmt.Errorf("rangescan - failed to scan range %s: %w", kr, err)
+	}
+	return nil
+}
+
+// keyRange is a parsed "<start> <end>" pair. Either key may carry a bracket,
+// "(" or ")" for exclusive and "[" or "]" for inclusive; bare keys are inclusive.
+type keyRange struct {
+	start, end               uint64
+	includeStart, includeEnd bool
+}
+
+func (kr keyRange) String() string {
+	lo, hi := "[", "]"
+	if !kr.includeStart {
+		lo = "("
+	}
+	if !kr.includeEnd {
+		hi = ")"
+	}
+	return fmt.Sprintf("%s%d-%d%s", lo, kr.start, kr.end, hi)
+}
+
+func parseKeyRange(params []string) (keyRange, error) {
+	kr := keyRange{includeStart: true, includeEnd: true}
+
+	start := params[0]
+	switch {
+	case strings.HasPrefix(start, "("):
+		kr.includeStart = false
+		start = start[1:]
+	case strings.HasPrefix(start, "["):
+		start = start[1:]
+	}
+	end := params[1]
+	switch {
+	case strings.HasSuffix(end, ")"):
+		kr.includeEnd = false
+		end = end[:len(end)-1]
+	case strings.HasSuffix(end, "]"):
+		end = end[:len(end)-1]
+	}
+
+	var err error
+	if kr.start, err = parseKey(start); err != nil {
+		return keyRange{}, fmt.Errorf("invalid start key '%s': %w", params[0], err)
+	}
+	if kr.end, err = parseKey(end); err != nil {
+		return keyRange{}, fmt.Errorf("invalid end key '%s': %w", params[1], err)
+	}
+	return kr, nil
+}
+
+// orderBy is a parsed "order by <field> [asc|desc]" clause.
+type orderBy struct {
+	field string
+	desc  bool
+}
+
+// parseOrderBy splits a trailing order-by clause off the select params.
+func parseOrderBy(sch schema.Schema, params []string) ([]string, *orderBy, error) {
+	idx := -1
+	for i, p := range params {
+		if p == "order" {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return params, nil, nil
 	}
-	endKey, err := strconv.Atoi(params[1])
+
+	clause := params[idx:]
+	if len(clause) < 3 || clause[1] != "by" {
+		return nil, nil, errors.New("usage: order by <field> [asc|desc]")
+	}
+	if len(clause) > 4 {
+		return nil, nil, fmt.Errorf("unexpected tokens after order by: %v", clause[4:])
+	}
+
+	ob := &orderBy{field: clause[2]}
+	if !sch.HasField(ob.field) {
+		return nil, nil, fmt.Errorf("unknown field '%s' (fields: %v)", ob.field, sch.GetFieldNames())
+	}
+	if len(clause) == 4 {
+		switch clause[3] {
+		case "asc":
+		case "desc":
+			ob.desc = true
+		default:
+			return nil, nil, fmt.Errorf("invalid sort direction '%s' (use asc or desc)", clause[3])
+		}
+	}
+	return params[:idx], ob, nil
+}
+
+// selectOrdered buffers the whole range - sorting can't stream - then prints it.
+func selectOrdered(config *DatabaseConfig, w io.Writer, kr keyRange, ob *orderBy) error {
+	var records []schema.Record
+	err := config.TableS.RangeScanExFuncCtx(config.queryContext(), kr.start, kr.end, kr.includeStart, kr.includeEnd, func(record schema.Record) error {
+		records = append(records, record)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("rangescan - invalid end key '%s': %w", params[1], err)
+		return err
+	}
+	return printRecords(config, w, records, ob)
+}
+
+// printRecords prints records as a table, sorted by ob first if it's set.
+func printRecords(config *DatabaseConfig, w io.Writer, records []schema.Record, ob *orderBy) error {
+	if ob != nil {
+		if err := sortRecords(records, ob); err != nil {
+			return err
+		}
 	}
 
-	records, err := config.TableS.RangeScan(uint64(startKey), uint64(endKey))
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	widths := printHeader(config, bw, records)
+	for i, record := range records {
+		printRow(config, bw, widths, record)
+		if (i+1)%selectChunkRows == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortRecords(records []schema.Record, ob *orderBy) error {
+	var cmpErr error
+	sort.SliceStable(records, func(i, j int) bool {
+		c, err := schema.CompareValues(records[i][ob.field], records[j][ob.field])
+		if err != nil && cmpErr == nil {
+			cmpErr = err
+		}
+		if ob.desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	if cmpErr != nil {
+		return fmt.Errorf("failed to sort on %s: %w", ob.field, cmpErr)
+	}
+	return nil
+}
+
+// parseWhere parses "where <field> <op> <value>", typing value by the field.
+func parseWhere(sch schema.Schema, params []string) (string, string, any, error) {
+	if len(params) != 4 || params[0] != "where" {
+		return "", "", nil, errors.New("usage: where <field> <op> <value>")
+	}
+	field, op := params[1], params[2]
+	for _, f := range sch.Fields {
+		if f.Name == field {
+			value, err := schema.ParseValue(params[3], f.Type)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("invalid value for %s: %w", field, err)
+			}
+			return field, op, value, nil
+		}
+	}
+	return "", "", nil, fmt.Errorf("unknown field: %s", field)
+}
+
+func selectWhere(config *DatabaseConfig, w io.Writer, params []string, ob *orderBy) error {
+	field, op, value, err := parseWhere(config.TableS.Schema(), params)
+	if err != nil {
+		return err
+	}
+	records, _, err := config.TableS.Query(field, op, value)
 	if err != nil {
-		return fmt.Errorf("rangescan - failed to scan range %d-%d: %w", startKey, endKey, err)
+		return err
 	}
+	return printRecords(config, w, records, ob)
+}
 
-	fieldNames := config.TableS.Schema().GetFieldNames()
-	widths := make([]int, len(fieldNames))
-	for i, field := range fieldNames {
-		widths[i] = len(field) * 4
+func isAggregate(fn string) bool {
+	switch fn {
+	case "sum", "avg", "min", "max":
+		return true
 	}
-	fmt.Fprint(w, "| ")
-	for i, field := range fieldNames {
-		fmt.Fprintf(w, "%-*s | ", widths[i], field)
+	return false
+}
+
+// aggregator folds one int or float column into sum, avg, min or max as
+// records stream past. Ints sum exactly; avg is always a float.
+type aggregator struct {
+	fn    string
+	field schema.Field
+	rows  int
+
+	intSum, intMin, intMax       int64
+	floatSum, floatMin, floatMax float64
+}
+
+func newAggregator(fn string, field schema.Field) (*aggregator, error) {
+	switch field.Type {
+	case schema.IntType, schema.BigIntType, schema.FloatType:
+	default:
+		typ, _ := fieldString(field.Type)
+		return nil, fmt.Errorf("%s needs an int, bigint or float column; %s is %s", fn, field.Name, typ)
 	}
-	fmt.Fprintln(w)
-	fmt.Fprintln(w, strings.Repeat("-", len(fieldNames)*20))
+	return &aggregator{fn: fn, field: field}, nil
+}
 
-	for _, record := range records {
-		fmt.Fprint(w, "| ")
-		for i, field := range config.TableS.Schema().Fields {
-			val := fmt.Sprintf("%v", record[field.Name])
-			fmt.Fprintf(w, "%-*s | ", widths[i], val)
+func (a *aggregator) add(val any) error {
+	if a.field.Type == schema.FloatType {
+		f, ok := val.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected a float, got %T", a.field.Name, val)
+		}
+		if a.rows == 0 {
+			a.floatMin, a.floatMax = f, f
 		}
-		fmt.Fprintln(w)
+		a.floatSum += f
+		a.floatMin, a.floatMax = min(a.floatMin, f), max(a.floatMax, f)
+		a.rows++
+		return nil
+	}
+
+	var n int64
+	switch v := val.(type) {
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	default:
+		return fmt.Errorf("%s: expected an int, got %T", a.field.Name, val)
+	}
+	if a.rows == 0 {
+		a.intMin, a.intMax = n, n
+	}
+	sum := a.intSum + n
+	if (n > 0 && sum < a.intSum) || (n < 0 && sum > a.intSum) {
+		return fmt.Errorf("sum of %s overflows int64", a.field.Name)
+	}
+	a.intSum = sum
+	a.intMin, a.intMax = min(a.intMin, n), max(a.intMax, n)
+	a.rows++
+	return nil
+}
+
+// result formats the aggregate; ok is false when it's undefined, i.e. avg,
+// min or max of no rows. sum of no rows is 0.
+func (a *aggregator) result(config *DatabaseConfig) (string, bool) {
+	if a.rows == 0 && a.fn != "sum" {
+		return "NULL", false
+	}
+	isFloat := a.field.Type == schema.FloatType
+	prec := config.floatPrec
+	switch a.fn {
+	case "sum":
+		if isFloat {
+			return strconv.FormatFloat(a.floatSum, 'f', prec, 64), true
+		}
+		return strconv.FormatInt(a.intSum, 10), true
+	case "avg":
+		if isFloat {
+			return strconv.FormatFloat(a.floatSum/float64(a.rows), 'f', prec, 64), true
+		}
+		return strconv.FormatFloat(float64(a.intSum)/float64(a.rows), 'f', prec, 64), true
+	case "min":
+		if isFloat {
+			return strconv.FormatFloat(a.floatMin, 'f', prec, 64), true
+		}
+		return strconv.FormatInt(a.intMin, 10), true
+	default:
+		if isFloat {
+			return strconv.FormatFloat(a.floatMax, 'f', prec, 64), true
+		}
+		return strconv.FormatInt(a.intMax, 10), true
+	}
+}
+
+// selectAggregate prints "fn(field): value" from one scan of the table.
+func selectAggregate(config *DatabaseConfig, w io.Writer, fn, fieldName string) error {
+	var field schema.Field
+	found := false
+	for _, f := range config.TableS.Schema().Fields {
+		if f.Name == fieldName {
+			field, found = f, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown field: %s", fieldName)
+	}
+	agg, err := newAggregator(fn, field)
+	if err != nil {
+		return err
+	}
+
+	err = config.TableS.RangeScanExFuncCtx(config.queryContext(), 0, math.MaxUint64, true, true, func(record schema.Record) error {
+		return agg.add(record[field.Name])
+	})
+	if err != nil {
+		return fmt.Errorf("%s failed after %d rows: %w", fn, agg.rows, err)
 	}
 
+	result, ok := agg.result(config)
+	fmt.Fprintf(w, "%s(%s): %s\n", fn, field.Name, result)
+	if !ok {
+		fmt.Fprintf(w, "(%s is undefined for an empty table)\n", fn)
+	}
 	return nil
 }
 
 func commandSelect(config *DatabaseConfig, params []string, w io.Writer) error {
+	params, ob, err := parseOrderBy(config.TableS.Schema(), params)
+	if err != nil {
+		return fmt.Errorf("select - %w", err)
+	}
+	if len(params) == 1 && params[0] == "tolerant" && ob == nil {
+		return selectTolerant(config, w)
+	}
+	if len(params) == 2 && isAggregate(params[0]) && ob == nil {
+		if err := selectAggregate(config, w, params[0], params[1]); err != nil {
+			return fmt.Errorf("select - %w", err)
+		}
+		return nil
+	}
+	if len(params) == 2 && (params[0] == "next" || params[0] == "prev") && ob == nil {
+		if err := selectStep(config, w, params[0], params[1]); err != nil {
+			return fmt.Errorf("select - %w", err)
+		}
+		return nil
+	}
+	if len(params) == 2 && params[0] == "prefix" {
+		records, err := config.TableS.ScanPrefix(params[1])
+		if err != nil {
+			return fmt.Errorf("select - %w", err)
+		}
+		return printRecords(config, w, records, ob)
+	}
+	if len(params) > 0 && params[0] == "where" {
+		if err := selectWhere(config, w, params, ob); err != nil {
+			return fmt.Errorf("select - %w", err)
+		}
+		return nil
+	}
+	if ob != nil {
+		kr := keyRange{0, math.MaxUint64, true, true}
+		switch len(params) {
+		case 0:
+		case 2:
+			if kr, err = parseKeyRange(params); err != nil {
+				return fmt.Errorf("select - %w", err)
+			}
+		default:
+			return errors.New("select - order by needs no keys or a start and end key")
+		}
+		if err := selectOrdered(config, w, kr, ob); err != nil {
+			return fmt.Errorf("select - %w", err)
+		}
+		return nil
+	}
+
 	if len(params) == 0 {
 		return selectAll(config, w)
 	}
@@ -607,19 +1881,7 @@ func commandSelect(config *DatabaseConfig, params []string, w io.Writer) error {
 		return rangeScan(config, w, params)
 	}
 
-	fieldNames := config.TableS.Schema().GetFieldNames()
-	widths := make([]int, len(fieldNames))
-	for i, field := range fieldNames {
-		widths[i] = len(field) * 4
-	}
-	fmt.Fprint(w, "| ")
-	for i, field := range fieldNames {
-		fmt.Fprintf(w, "%-*s | ", widths[i], field)
-	}
-	fmt.Fprintln(w)
-	fmt.Fprintln(w, strings.Repeat("-", len(fieldNames)*20))
-
-	key, err := strconv.Atoi(params[0])
+	key, err := parseKey(params[0])
 	if err != nil {
 		return fmt.Errorf("select - invalid key '%s': %w", params[0], err)
 	}
@@ -627,16 +1889,106 @@ func commandSelect(config *DatabaseConfig, params []string, w io.Writer) error {
 	record, err := config.TableS.Find(key)
 	// save error handling for after table layout print
 
-	fmt.Fprint(w, "| ")
-	for i, field := range config.TableS.Schema().Fields {
-		val := fmt.Sprintf("%v", record[field.Name])
-		fmt.Fprintf(w, "%-*s | ", widths[i], val)
-	}
-	fmt.Fprintln(w)
+	widths := printHeader(config, w, []schema.Record{record})
+	printRow(config, w, widths, record)
 
 	if err != nil {
 		return fmt.Errorf("select - unable to find key %d: %w", key, err)
 	}
+	if config.TableS.IsVersioned() {
+		fmt.Fprintf(w, "Version: %d\n", record[schema.VersionField])
+	}
+	return nil
+}
+
+// selectStep prints the record just after (next) or before (prev) key, which
+// needn't exist itself.
+func selectStep(config *DatabaseConfig, w io.Writer, dir, param string) error {
+	key, err := parseKey(param)
+	if err != nil {
+		return fmt.Errorf("invalid key '%s': %w", param, err)
+	}
+	step, where := config.TableS.Next, "after"
+	if dir == "prev" {
+		step, where = config.TableS.Prev, "before"
+	}
+	record, found, err := step(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		fmt.Fprintf(w, "No record %s %d\n", where, key)
+		return nil
+	}
+	widths := printHeader(config, w, []schema.Record{record})
+	printRow(config, w, widths, record)
+	return nil
+}
+
+func commandExplain(config *DatabaseConfig, params []string, w io.Writer) error {
+	if len(params) == 0 || params[0] != "select" {
+		return errors.New("explain - usage: explain select where <field> <op> <value>")
+	}
+	field, op, value, err := parseWhere(config.TableS.Schema(), params[1:])
+	if err != nil {
+		return fmt.Errorf("explain - %w", err)
+	}
+	plan, err := config.TableS.Plan(field, op, value)
+	if err != nil {
+		return fmt.Errorf("explain - %w", err)
+	}
+	shape, err := config.TableS.Shape()
+	if err != nil {
+		return fmt.Errorf("explain - %w", err)
+	}
+
+	fmt.Fprintf(w, "Plan: %s\n", plan)
+	fmt.Fprintf(w, "Estimated pages read: %d (tree depth %d, ~%d leaves)\n", shape.EstimatePages(plan), shape.Depth, shape.Leaves)
+	return nil
+}
+
+const (
+	defaultHistogramBuckets = 10
+	histogramBarWidth       = 40
+)
+
+func commandHistogram(config *DatabaseConfig, params []string, w io.Writer) error {
+	buckets := defaultHistogramBuckets
+	if len(params) > 1 {
+		return errors.New("histogram - usage: histogram [buckets]")
+	}
+	if len(params) == 1 {
+		n, err := strconv.Atoi(params[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("histogram - invalid bucket count '%s'", params[0])
+		}
+		buckets = n
+	}
+
+	h, err := config.TableS.KeyDistribution(buckets)
+	if err != nil {
+		return fmt.Errorf("histogram - %w", err)
+	}
+	peak := slices.Max(h.Counts)
+	if peak == 0 {
+		fmt.Fprintln(w, "Table is empty")
+		return nil
+	}
+
+	labels := make([]string, len(h.Counts))
+	labelWidth := 0
+	for i := range h.Counts {
+		lo, hi := h.Bucket(i)
+		labels[i] = fmt.Sprintf("%d-%d", lo, hi)
+		labelWidth = max(labelWidth, len(labels[i]))
+	}
+	for i, count := range h.Counts {
+		bar := strings.Repeat("#", count*histogramBarWidth/peak)
+		if bar == "" && count > 0 {
+			bar = "."
+		}
+		fmt.Fprintf(w, "%-*s | %-*s %d\n", labelWidth, labels[i], histogramBarWidth, bar, count)
+	}
 	return nil
 }
 
@@ -650,31 +2002,32 @@ func commandCount(config *DatabaseConfig, params []string, w io.Writer) error {
 	}
 
 	if len(params) == 2 {
-		sk, err := strconv.Atoi(params[0])
+		startKey, err = parseKey(params[0])
 		if err != nil {
 			return fmt.Errorf("count - invalid start key '%s': %w", params[0], err)
 		}
-		ek, err := strconv.Atoi(params[1])
+		endKey, err = parseKey(params[1])
 		if err != nil {
 			return fmt.Errorf("count - invalid end key '%s': %w", params[1], err)
 		}
-		startKey = uint64(sk)
-		endKey = uint64(ek)
 	}
 
 	if len(params) == 1 {
-		sk, err := strconv.Atoi(params[0])
+		startKey, err = parseKey(params[0])
 		if err != nil {
 			return fmt.Errorf("count - invalid key '%s': %w", params[0], err)
 		}
-		startKey = uint64(sk)
-		endKey = uint64(sk)
+		endKey = startKey
 	}
-	records, err := config.TableS.RangeScan(startKey, endKey)
+	// counted as it streams, so no result cap applies
+	count := 0
+	err = config.TableS.RangeScanFuncCtx(config.queryContext(), startKey, endKey, func(schema.Record) error {
+		count++
+		return nil
+	})
 	if err != nil {
 		return fmt.Errorf("count - range scan failed: %w", err)
 	}
-	count := len(records)
 	fmt.Fprintf(w, "Count: %d\n", count)
 	return nil
 }
@@ -0,0 +1,806 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"godb/internal/schema"
+	"godb/internal/store"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCloseAllTablesWhileDroppingAndOpening(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	newSchema := func(name string) schema.Schema {
+		return schema.Schema{
+			TableName: name,
+			Fields: []schema.Field{
+				{Name: "id", Type: schema.IntType},
+				{Name: "name", Type: schema.StringType},
+			},
+		}
+	}
+
+	base, err := CreateTable("base.db", newSchema("base"), ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewDatabaseConfig(base, ctx, wg)
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := range 4 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				created := fmt.Sprintf("c%d_%d", i, n)
+				if _, err := CreateTable(created+".db", newSchema(created), ctx, wg); err != nil {
+					t.Errorf("create %s: %v", created, err)
+					return
+				}
+				// Open doesn't create missing tables, so make this one outside the cache
+				opened := fmt.Sprintf("o%d_%d", i, n)
+				bts, err := store.CreateWithOptions(opened+".db", newSchema(opened), store.StoreOptions{}, ctx, wg)
+				if err != nil {
+					t.Errorf("create %s: %v", opened, err)
+					return
+				}
+				if err := bts.Close(); err != nil {
+					t.Errorf("close %s: %v", opened, err)
+					return
+				}
+				if _, err := GetOrOpenTable(opened+".db", ctx, wg); err != nil {
+					t.Errorf("open %s: %v", opened, err)
+					return
+				}
+				for _, name := range []string{created, opened} {
+					if err := commandDrop(config, []string{name}, io.Discard); err != nil {
+						t.Errorf("drop %s: %v", name, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for range 50 {
+		if err := closeAllTables(); err != nil {
+			t.Errorf("closeAllTables: %v", err)
+		}
+	}
+	close(stop)
+	workers.Wait()
+
+	if err := closeAllTables(); err != nil {
+		t.Errorf("closeAllTables: %v", err)
+	}
+	tableCacheMu.RLock()
+	defer tableCacheMu.RUnlock()
+	if len(tableCache) != 0 {
+		t.Errorf("expected an empty table cache, %d tables left", len(tableCache))
+	}
+}
+
+func TestListTablesReadsHeadersOnly(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	sch := schema.Schema{
+		TableName: "people",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "name", Type: schema.StringType},
+		},
+	}
+	bts, err := store.Create("people.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	wg.Wait()
+	if err := bts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a checkpointed table needs no WAL; listing must not recreate it
+	if err := os.Remove("people.wal"); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	tables, err := ListTables(dir)
+	if err != nil {
+		t.Fatalf("ListTables failed: %v", err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("Expected 1 table, got %d", len(tables))
+	}
+	if got := tables[0]; got.Name != "people" || len(got.Fields) != 2 || got.Fields[1].Name != "name" || got.NumPages != 1 {
+		t.Errorf("Unexpected table info: %+v", got)
+	}
+	if _, err := os.Stat("people.wal"); !os.IsNotExist(err) {
+		t.Errorf("ListTables created a WAL file (stat err: %v)", err)
+	}
+}
+
+func TestSessionsSwitchTablesIndependently(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	newSchema := func(name string) schema.Schema {
+		return schema.Schema{
+			TableName: name,
+			Fields: []schema.Field{
+				{Name: "id", Type: schema.IntType},
+				{Name: "name", Type: schema.StringType},
+			},
+		}
+	}
+	base, err := CreateTable("base.db", newSchema("base"), ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseConfig := NewDatabaseConfig(base, ctx, wg)
+	for _, name := range []string{"left", "right"} {
+		if _, err := CreateTable(name+".db", newSchema(name), ctx, wg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sessions sync.WaitGroup
+	for _, name := range []string{"left", "right"} {
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			session := baseConfig.Clone()
+			if err := commandUse(session, []string{name}, io.Discard); err != nil {
+				t.Errorf("use %s: %v", name, err)
+				return
+			}
+			for i := 1; i <= 50; i++ {
+				if err := commandInsert(session, []string{fmt.Sprint(i), name}, io.Discard); err != nil {
+					t.Errorf("insert into %s: %v", name, err)
+					return
+				}
+				if got := session.ActiveTableName(); got != name {
+					t.Errorf("session on %s switched to %s", name, got)
+					return
+				}
+			}
+		}()
+	}
+	sessions.Wait()
+
+	if got := baseConfig.ActiveTableName(); got != "base" {
+		t.Errorf("Expected the base config to stay on base, got %s", got)
+	}
+	for _, name := range []string{"left", "right"} {
+		ts, err := GetOrOpenTable(name+".db", ctx, wg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := ts.RangeScan(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 50 || records[0]["name"] != name {
+			t.Errorf("Expected 50 rows named %s in %s, got %d", name, name, len(records))
+		}
+	}
+	if n, err := base.Count(); err != nil || n != 0 {
+		t.Errorf("Expected base to stay empty, got %d rows (err %v)", n, err)
+	}
+}
+
+func TestSelectAggregates(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	sch := schema.Schema{
+		TableName: "sales",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "qty", Type: schema.IntType},
+			{Name: "price", Type: schema.FloatType},
+			{Name: "item", Type: schema.StringType},
+		},
+	}
+	ts, err := CreateTable("sales.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewDatabaseConfig(ts, ctx, wg)
+
+	run := func(params ...string) string {
+		t.Helper()
+		var out strings.Builder
+		if err := commandSelect(config, params, &out); err != nil {
+			t.Fatalf("select %v: %v", params, err)
+		}
+		return out.String()
+	}
+
+	if got := run("sum", "qty"); got != "sum(qty): 0\n" {
+		t.Errorf("sum of an empty table: got %q", got)
+	}
+	if got := run("max", "price"); !strings.HasPrefix(got, "max(price): NULL\n") {
+		t.Errorf("max of an empty table: got %q", got)
+	}
+
+	for _, row := range [][]string{{"1", "3", "2.50", "a"}, {"2", "-1", "10.00", "b"}, {"3", "4", "0.25", "c"}} {
+		if err := commandInsert(config, row, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := map[string]string{
+		"sum qty":   "sum(qty): 6\n",
+		"avg qty":   "avg(qty): 2.00\n",
+		"min qty":   "min(qty): -1\n",
+		"max qty":   "max(qty): 4\n",
+		"sum price": "sum(price): 12.75\n",
+		"min price": "min(price): 0.25\n",
+	}
+	for query, want := range tests {
+		if got := run(strings.Fields(query)...); got != want {
+			t.Errorf("select %s: expected %q, got %q", query, want, got)
+		}
+	}
+
+	if err := commandSelect(config, []string{"sum", "item"}, io.Discard); err == nil {
+		t.Error("Expected sum over a string column to fail")
+	}
+	if err := commandSelect(config, []string{"avg", "nope"}, io.Discard); err == nil {
+		t.Error("Expected avg over an unknown field to fail")
+	}
+}
+
+func TestInsertAndUpdateErrorsAreTyped(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	sch := schema.Schema{
+		TableName: "people",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "name", Type: schema.StringType},
+			{Name: "age", Type: schema.IntType},
+		},
+	}
+	ts, err := CreateTable("people.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewDatabaseConfig(ts, ctx, wg)
+
+	for _, cmd := range []func(*DatabaseConfig, []string, io.Writer) error{commandInsert, commandUpdate} {
+		if err := cmd(config, []string{"1", "bob"}, io.Discard); !errors.Is(err, ErrWrongArity) {
+			t.Errorf("Expected ErrWrongArity, got %v", err)
+		}
+		err := cmd(config, []string{"1", "bob", "old"}, io.Discard)
+		var fe *FieldError
+		if !errors.As(err, &fe) || fe.Field != "age" {
+			t.Errorf("Expected a FieldError for age, got %v", err)
+		}
+	}
+}
+
+func TestColumnsFitTheirValues(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	sch := schema.Schema{
+		TableName: "notes",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "body", Type: schema.StringType},
+		},
+	}
+	ts, err := CreateTable("notes.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewDatabaseConfig(ts, ctx, wg)
+	long := strings.Repeat("x", 60)
+	for _, row := range [][]string{{"1", "short"}, {"2", long}} {
+		if err := commandInsert(config, row, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every line of a select has the same width, however long the values
+	checkAligned := func(out string) {
+		t.Helper()
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		for _, line := range lines[1:] {
+			if len(strings.TrimSpace(line)) != len(strings.TrimSpace(lines[0])) {
+				t.Errorf("misaligned output:\n%s", out)
+				return
+			}
+		}
+	}
+
+	var out strings.Builder
+	if err := commandSelect(config, []string{"1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "| id | body  | \n"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("select 1: expected columns sized to the row, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := commandSelect(config, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	checkAligned(out.String())
+	if strings.Contains(out.String(), long) {
+		t.Error("expected the long value to be cut to the column")
+	}
+
+	if err := commandColWidth(config, []string{"8"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := commandSelect(config, []string{"2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	checkAligned(out.String())
+	if !strings.Contains(out.String(), "| xxxxxxx~ |") {
+		t.Errorf("expected body cut to 8 columns, got %q", out.String())
+	}
+	if err := commandColWidth(config, []string{"2"}, io.Discard); err == nil {
+		t.Error("Expected colwidth to reject a width below the minimum")
+	}
+}
+
+func TestHelpListsCommandsInOrder(t *testing.T) {
+	var first strings.Builder
+	if err := commandHelp(nil, nil, &first); err != nil {
+		t.Fatal(err)
+	}
+	// the commands follow the blank line after the banner
+	_, list, _ := strings.Cut(first.String(), "\n\n")
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(list), "\n") {
+		name, _, _ := strings.Cut(line, ": ")
+		names = append(names, name)
+	}
+	if len(names) != len(CommandRegistry) {
+		t.Fatalf("expected %d commands in help, found %d", len(CommandRegistry), len(names))
+	}
+	if !slices.IsSorted(names) {
+		t.Errorf("help commands not in alphabetical order: %v", names)
+	}
+
+	for range 5 {
+		var again strings.Builder
+		if err := commandHelp(nil, nil, &again); err != nil {
+			t.Fatal(err)
+		}
+		if again.String() != first.String() {
+			t.Fatal("help output changed between calls")
+		}
+	}
+}
+
+func TestCreatingAnOpenTableFails(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"dup", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	first := config.TableS
+	if err := commandInsert(config, []string{"1", "kept"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	err := commandCreate(config, []string{"dup", "id:int", "name:string"}, io.Discard)
+	if !errors.Is(err, ErrTableOpen) {
+		t.Fatalf("second create = %v, want ErrTableOpen", err)
+	}
+	if config.TableS != first {
+		t.Error("failed create switched the session's table")
+	}
+
+	// the cache still holds the first store, with its row
+	cached, err := GetOrOpenTable("dup.db", ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != first {
+		t.Error("expected the cache to hold the store the first create made")
+	}
+	if rec, err := cached.Find(1); err != nil || rec["name"] != "kept" {
+		t.Errorf("Find(1) = %v, %v after the failed create", rec, err)
+	}
+}
+
+func TestWALCommandShowsPendingRecords(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range [][]string{{"1", "ann"}, {"2", "bob"}} {
+		if err := commandInsert(config, row, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commandDelete(config, []string{"1"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := commandWAL(config, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || lines[0] != "3 pending WAL records for table people" {
+		t.Fatalf("wal output:\n%s", out.String())
+	}
+	for i, want := range []string{"INSERT     key 1", "INSERT     key 2", "DELETE     key 1"} {
+		if !strings.Contains(lines[i+1], want) {
+			t.Errorf("line %d = %q, want it to contain %q", i+1, lines[i+1], want)
+		}
+	}
+
+	if err := config.TableS.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := commandWAL(config, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "0 pending WAL records for table people\n" {
+		t.Errorf("wal after a checkpoint = %q", got)
+	}
+}
+
+func TestUpdateInsideTransaction(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := commandInsert(config, []string{"1", "ann"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := commandBegin(config, nil, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := commandUpdate(config, []string{"1", "bea"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := config.TableS.Find(1); err != nil || rec["name"] != "ann" {
+		t.Errorf("buffered update already visible: %v, %v", rec, err)
+	}
+	if err := commandCommit(config, nil, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := config.TableS.Find(1); err != nil || rec["name"] != "bea" {
+		t.Errorf("Find(1) after commit = %v, %v", rec, err)
+	}
+}
+
+func TestExplainShowsPlanWithoutRunningIt(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range [][]string{{"1", "ann"}, {"2", "bob"}} {
+		if err := commandInsert(config, row, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		where []string
+		plan  string
+	}{
+		{[]string{"id", "=", "2"}, "Plan: primary key lookup on id = 2\n"},
+		{[]string{"id", ">=", "2"}, "Plan: primary key range scan on id, keys [2, 18446744073709551615]\n"},
+		{[]string{"name", "=", "bob"}, "Plan: full scan, filter name = bob\n"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		params := append([]string{"select", "where"}, tt.where...)
+		if err := commandExplain(config, params, &out); err != nil {
+			t.Fatalf("explain %v: %v", tt.where, err)
+		}
+		if !strings.HasPrefix(out.String(), tt.plan) {
+			t.Errorf("explain %v:\n%s\nwant it to start with %q", tt.where, out.String(), tt.plan)
+		}
+		if !strings.Contains(out.String(), "Estimated pages read: 1 (tree depth 1, ~1 leaves)") {
+			t.Errorf("explain %v estimate:\n%s", tt.where, out.String())
+		}
+	}
+
+	if err := commandExplain(config, []string{"insert", "1"}, io.Discard); err == nil {
+		t.Error("explain of a non-select should fail")
+	}
+}
+
+func TestDropTableNamedBeforeValidation(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	// "select" is a keyword create now rejects
+	sch := schema.Schema{
+		TableName: "select",
+		Fields:    []schema.Field{{Name: "id", Type: schema.IntType}},
+	}
+	bts, err := store.Create("select.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	wg.Wait()
+	if err := bts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandDrop(config, []string{"select"}, io.Discard); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if _, err := os.Stat("select.db"); !os.IsNotExist(err) {
+		t.Errorf("select.db still there after drop (stat err: %v)", err)
+	}
+
+	if err := commandDrop(config, []string{"../select"}, io.Discard); err == nil {
+		t.Error("drop of a path should fail")
+	}
+}
+
+func TestBackupAnnouncesTheBytesItStreams(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := commandInsert(config, []string{"1", "ann"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := commandBackup(config, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	line, err := out.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if _, err := fmt.Sscanf(line, "backup %d bytes\n", &n); err != nil {
+		t.Fatalf("backup header %q: %v", line, err)
+	}
+	if n == 0 || n != out.Len() {
+		t.Errorf("backup announced %d bytes, streamed %d", n, out.Len())
+	}
+}
+
+func TestCreateWithIndexedField(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "email:string!unique@index", "team:string@index"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range [][]string{{"1", "ann@x", "red"}, {"2", "bob@x", "blue"}, {"3", "cy@x", "red"}} {
+		if err := commandInsert(config, row, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	if err := commandDescribe(config, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"email (string) - UNIQUE - INDEXED", "team (string) - INDEXED"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("describe output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := commandExplain(config, []string{"select", "where", "team", "=", "red"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "Plan: secondary index lookup on team = red, 2 keys\n") {
+		t.Errorf("explain output:\n%s", out.String())
+	}
+
+	if err := commandCreate(config, []string{"bad", "id:int@index"}, io.Discard); err == nil {
+		t.Error("Expected an index on the primary key to fail")
+	}
+}
+
+func TestSetAndGetTableOptions(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := commandGet(config, nil, &out); err != nil || out.String() != "No table options set\n" {
+		t.Errorf("get with nothing set = %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := commandSet(config, []string{"maxrecordsize", "64"}, &out); err != nil || out.String() != "maxrecordsize = 64\n" {
+		t.Errorf("set maxrecordsize = %q, %v", out.String(), err)
+	}
+	if err := commandSet(config, []string{"maxrecordsize", "big"}, io.Discard); err == nil {
+		t.Error("set of a non-numeric maxrecordsize should fail")
+	}
+	if err := commandSet(config, []string{"nosuch", "1"}, io.Discard); err == nil {
+		t.Error("set of an unknown option should fail")
+	}
+
+	out.Reset()
+	if err := commandGet(config, []string{"maxrecordsize"}, &out); err != nil || out.String() != "maxrecordsize = 64\n" {
+		t.Errorf("get maxrecordsize = %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := commandGet(config, []string{"growchunk"}, &out); err != nil || out.String() != "growchunk is not set\n" {
+		t.Errorf("get growchunk = %q, %v", out.String(), err)
+	}
+	if err := commandInsert(config, []string{"1", strings.Repeat("x", 100)}, io.Discard); err == nil {
+		t.Error("insert past the maxrecordsize set should fail")
+	}
+
+	out.Reset()
+	if err := commandSet(config, nil, &out); err != nil || !strings.Contains(out.String(), "maxrecordsize: ") {
+		t.Errorf("set with no arguments = %q, %v", out.String(), err)
+	}
+}
+
+func TestStatsLeavesFanoutToItsOwnSubcommand(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+		closeAllTables()
+	}()
+
+	config := NewDatabaseConfig(nil, ctx, wg)
+	if err := commandCreate(config, []string{"people", "id:int", "name:string"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := commandInsert(config, []string{"1", "ann"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := commandStats(config, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Fanout") {
+		t.Errorf("plain stats should not measure fanout:\n%s", out.String())
+	}
+	out.Reset()
+	if err := commandStats(config, []string{"fanout"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Fanout: 0.0 children per internal page, up to 1 records per leaf (sampled)\n"; out.String() != want {
+		t.Errorf("stats fanout = %q, want %q", out.String(), want)
+	}
+	if err := commandStats(config, []string{"fanout", "json"}, io.Discard); err == nil {
+		t.Error("stats fanout json should be a usage error")
+	}
+}
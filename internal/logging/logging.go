@@ -0,0 +1,142 @@
+// Package logging is a minimal leveled logger for the storage layers. Each
+// subsystem ("pager", "wal", "store", ...) gets its own logger whose minimum
+// level can be changed independently, so debug output can be turned on for
+// one layer without drowning in the others.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level: %s", s)
+	}
+}
+
+type Logger interface {
+	Debug(format string, args ...any)
+	Info(format string, args ...any)
+	Warn(format string, args ...any)
+	Error(format string, args ...any)
+}
+
+var (
+	mu           sync.RWMutex
+	out                = log.New(os.Stderr, "", log.LstdFlags)
+	defaultLevel Level = LevelInfo
+	levels             = map[string]Level{}
+)
+
+// SetOutput redirects every subsystem logger.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = log.New(w, "", log.LstdFlags)
+}
+
+// SetLevel sets the minimum level for one subsystem, or for every subsystem
+// without its own setting when subsystem is "".
+func SetLevel(subsystem string, level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	if subsystem == "" {
+		defaultLevel = level
+		return
+	}
+	levels[subsystem] = level
+}
+
+// Configure applies a comma-separated spec such as "debug" or
+// "warn,pager=debug,store=info". A bare level sets the default.
+func Configure(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, levelName, found := strings.Cut(part, "=")
+		if !found {
+			subsystem, levelName = "", part
+		}
+		level, err := ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+		SetLevel(subsystem, level)
+	}
+	return nil
+}
+
+func enabled(subsystem string, level Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	min, ok := levels[subsystem]
+	if !ok {
+		min = defaultLevel
+	}
+	return level >= min
+}
+
+type subsystemLogger struct {
+	name string
+}
+
+// New returns the logger for a subsystem. Levels are looked up on every call,
+// so Configure takes effect for loggers that already exist.
+func New(subsystem string) Logger {
+	return subsystemLogger{name: subsystem}
+}
+
+func (l subsystemLogger) logf(level Level, format string, args ...any) {
+	if !enabled(l.name, level) {
+		return
+	}
+	mu.RLock()
+	logger := out
+	mu.RUnlock()
+	logger.Printf("%-5s [%s] %s", level, l.name, fmt.Sprintf(format, args...))
+}
+
+func (l subsystemLogger) Debug(format string, args ...any) { l.logf(LevelDebug, format, args...) }
+func (l subsystemLogger) Info(format string, args ...any)  { l.logf(LevelInfo, format, args...) }
+func (l subsystemLogger) Warn(format string, args ...any)  { l.logf(LevelWarn, format, args...) }
+func (l subsystemLogger) Error(format string, args ...any) { l.logf(LevelError, format, args...) }
@@ -1,16 +1,20 @@
 package pager
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 )
 
 type DiskManager struct {
-	file   *os.File
+	file   Storage
 	header TableHeader
+	noSync bool // see SetSyncEnabled
+
+	readOnly bool // see SetReadOnly
 }
 
-func NewDiskManager(file *os.File) DiskManager {
+func NewDiskManager(file Storage) DiskManager {
 	return DiskManager{
 		file: file,
 	}
@@ -20,10 +24,30 @@ func (dm *DiskManager) Close() error {
 	return dm.file.Close()
 }
 
-func (dm *DiskManager) SetFile(file *os.File) {
+func (dm *DiskManager) SetFile(file Storage) {
 	dm.file = file
 }
 
+// SetSyncEnabled turns fsync on or off for the table file; it is on by
+// default. Off, writes reach the OS but a power loss can drop them, so
+// it's only for throwaway tables such as in tests and benchmarks. Set it
+// before the table is shared.
+func (dm *DiskManager) SetSyncEnabled(on bool) {
+	dm.noSync = !on
+}
+
+// SetReadOnly marks the table file as opened read-only, as a read replica
+// opens it: page and header writes fail with ErrReadOnly, and the page
+// cache neither flushes on Close nor reopens the file for writing on
+// Reload.
+func (dm *DiskManager) SetReadOnly() {
+	dm.readOnly = true
+}
+
+func (dm *DiskManager) IsReadOnly() bool {
+	return dm.readOnly
+}
+
 func (dm *DiskManager) SetHeader(h TableHeader) {
 	dm.header = h
 }
@@ -42,15 +66,58 @@ func (dm *DiskManager) ReadHeader() error {
 	if err != nil {
 		return fmt.Errorf("failed to deserialize header: %w", err)
 	}
+	if th.FreeListPage != 0 {
+		spilled, err := dm.readFreeList(th.FreeListPage, th.NextPageID)
+		if err != nil {
+			return fmt.Errorf("failed to read free list: %w", err)
+		}
+		th.FreePageIDs = append(spilled, th.FreePageIDs...)
+		th.FreeListPage = 0
+	}
+	if th.free, err = dm.readFreeMap(th); err != nil {
+		return fmt.Errorf("failed to read free map: %w", err)
+	}
+	for _, id := range th.FreePageIDs {
+		th.free.add(id)
+	}
+	th.FreePageIDs = nil
 	dm.header = *th
 	return nil
 }
 
+// ReadTableHeader reads just the header page of a table file, opening it
+// read-only and closing it again.
+func ReadTableHeader(filename string) (*TableHeader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dm := NewDiskManager(file)
+	if err := dm.ReadHeader(); err != nil {
+		return nil, err
+	}
+	return dm.GetHeader(), nil
+}
+
+// WriteHeader writes the header page, after any free map chunks that
+// changed. Saving the map can allocate map pages, moving NextPageID.
 func (dm *DiskManager) WriteHeader() error {
+	if err := dm.saveFreeMap(); err != nil {
+		return err
+	}
 	data, err := dm.header.Serialize()
 	if err != nil {
 		return fmt.Errorf("failed to serialize header: %w", err)
 	}
+	if len(data) > PAGE_SIZE {
+		// never truncate: the cut would fall in the free list or options
+		return fmt.Errorf("header is %d bytes, more than a page", len(data))
+	}
+	if dm.readOnly {
+		return fmt.Errorf("failed to write header to disk: %w", ErrReadOnly)
+	}
 	padded := make([]byte, PAGE_SIZE)
 	copy(padded, data)
 
@@ -59,7 +126,44 @@ func (dm *DiskManager) WriteHeader() error {
 		return fmt.Errorf("failed to write header to disk: %w", err)
 	}
 	// ensure write to disk is completed
-	return dm.file.Sync()
+	return dm.Sync()
+}
+
+// Headers from before the free map spilled a free list too long for the
+// header page to a chain of free pages, each [next:pageIDSize][count:2][ids],
+// next 0 on the last.
+const freeListPageHeader = pageIDSize + 2
+
+// readFreeList follows a spilled free list chain from first and returns
+// its entries in order.
+func (dm *DiskManager) readFreeList(first, nextPageID PageID) ([]PageID, error) {
+	perPage := (PAGE_SIZE - freeListPageHeader) / pageIDSize
+	var ids []PageID
+	for id, hops := first, PageID(0); id != 0; hops++ {
+		if id >= nextPageID || hops >= nextPageID {
+			return nil, fmt.Errorf("free list page %d is out of range or loops", id)
+		}
+		page, err := dm.ReadPage(id)
+		if err != nil {
+			return nil, err
+		}
+		var next PageID
+		n, err := binary.Decode(page.Data[:], binary.LittleEndian, &next)
+		if err != nil {
+			return nil, err
+		}
+		count := int(binary.LittleEndian.Uint16(page.Data[n:]))
+		if count > perPage {
+			return nil, fmt.Errorf("free list page %d claims %d entries, room for %d", id, count, perPage)
+		}
+		entries := make([]PageID, count)
+		if _, err := binary.Decode(page.Data[n+2:], binary.LittleEndian, entries); err != nil {
+			return nil, err
+		}
+		ids = append(ids, entries...)
+		id = next
+	}
+	return ids, nil
 }
 
 func (dm *DiskManager) ReadPage(pageID PageID) (Page, error) {
@@ -75,6 +179,9 @@ func (dm *DiskManager) ReadPage(pageID PageID) (Page, error) {
 }
 
 func (dm *DiskManager) WritePage(page Page) error {
+	if dm.readOnly {
+		return fmt.Errorf("failed to write page %d: %w", page.PageID, ErrReadOnly)
+	}
 	offset := int64(page.PageID) * PAGE_SIZE
 	_, err := dm.file.WriteAt(page.Data[:], offset)
 	if err != nil {
@@ -97,6 +204,40 @@ func (dm *DiskManager) WriteSlottedPage(sp *SlottedPage) error {
 	return dm.WritePage(page)
 }
 
+// Grow extends the file by pages zeroed pages past its current end, so the
+// pages allocated next are written inside the file rather than extending it
+// one page at a time. The file's size is rounded up to whole pages first.
+func (dm *DiskManager) Grow(pages int) error {
+	if pages <= 0 {
+		return nil
+	}
+	if dm.readOnly {
+		return fmt.Errorf("failed to grow file: %w", ErrReadOnly)
+	}
+	onDisk, err := dm.PagesOnDisk()
+	if err != nil {
+		return err
+	}
+	size := (int64(onDisk) + int64(pages)) * PAGE_SIZE
+	if err := dm.file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to grow file to %d bytes: %w", size, err)
+	}
+	return nil
+}
+
+// PagesOnDisk is the number of whole or partial pages the file spans,
+// including the header page and any pages added by Grow.
+func (dm *DiskManager) PagesOnDisk() (PageID, error) {
+	info, err := dm.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return PageID((info.Size() + PAGE_SIZE - 1) / PAGE_SIZE), nil
+}
+
 func (dm *DiskManager) Sync() error {
+	if dm.noSync || dm.readOnly {
+		return nil
+	}
 	return dm.file.Sync()
 }
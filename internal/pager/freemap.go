@@ -0,0 +1,165 @@
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math/bits"
+	"slices"
+)
+
+// Free pages are tracked in a bitmap, bit i set while page i is free.
+// AllocatePage takes the lowest free page, which keeps live pages packed
+// toward the start of the file. On disk the bitmap is cut into page-sized
+// chunks, each written to a map page of its own; TableHeader.FreeMapPages
+// lists them by chunk, 0 for a chunk that has never held a free page.
+// WriteHeader saves the chunks changed since the last write ahead of the
+// header itself.
+//
+// Older headers kept the free list as FreePageIDs, spilling past the
+// header page to a chain (see readFreeList). ReadHeader moves that list
+// into the bitmap, and the next header write leaves it empty.
+
+const (
+	freeMapBits  = PAGE_SIZE * 8 // pages covered by one map page
+	freeMapWords = freeMapBits / 64
+)
+
+type freeMap struct {
+	words []uint64
+	count int
+	low   int          // no word below this has a bit set
+	dirty map[int]bool // chunks changed since they were last written
+}
+
+func newFreeMap(ids []PageID) *freeMap {
+	fm := &freeMap{dirty: make(map[int]bool)}
+	for _, id := range ids {
+		fm.add(id)
+	}
+	return fm
+}
+
+func (fm *freeMap) add(id PageID) {
+	w := int(id / 64)
+	if w >= len(fm.words) {
+		fm.words = append(fm.words, make([]uint64, w+1-len(fm.words))...)
+	}
+	bit := uint64(1) << (id % 64)
+	if fm.words[w]&bit != 0 {
+		return
+	}
+	fm.words[w] |= bit
+	fm.count++
+	fm.low = min(fm.low, w)
+	fm.dirty[w/freeMapWords] = true
+}
+
+func (fm *freeMap) contains(id PageID) bool {
+	w := int(id / 64)
+	return w < len(fm.words) && fm.words[w]&(uint64(1)<<(id%64)) != 0
+}
+
+// take removes and returns the lowest free page.
+func (fm *freeMap) take() (PageID, bool) {
+	if fm.count == 0 {
+		return 0, false
+	}
+	for fm.words[fm.low] == 0 {
+		fm.low++
+	}
+	w := fm.low
+	b := bits.TrailingZeros64(fm.words[w])
+	fm.words[w] &^= uint64(1) << b
+	fm.count--
+	fm.dirty[w/freeMapWords] = true
+	return PageID(w*64 + b), true
+}
+
+// ids lists the free pages in ascending order.
+func (fm *freeMap) ids() []PageID {
+	out := make([]PageID, 0, fm.count)
+	for w := fm.low; w < len(fm.words); w++ {
+		for word := fm.words[w]; word != 0; word &= word - 1 {
+			out = append(out, PageID(w*64+bits.TrailingZeros64(word)))
+		}
+	}
+	return out
+}
+
+// chunk returns the words one map page holds, zero-filled past the end.
+func (fm *freeMap) chunk(i int) []uint64 {
+	out := make([]uint64, freeMapWords)
+	if start := i * freeMapWords; start < len(fm.words) {
+		copy(out, fm.words[start:])
+	}
+	return out
+}
+
+// saveFreeMap writes the map's changed chunks, giving each chunk with free
+// pages its own map page the first time. Map pages come from the end of the
+// file, not the map, so saving never changes what it is saving.
+func (dm *DiskManager) saveFreeMap() error {
+	th := &dm.header
+	if th.free == nil || len(th.free.dirty) == 0 {
+		return nil
+	}
+
+	added := false
+	for _, i := range slices.Sorted(maps.Keys(th.free.dirty)) {
+		words := th.free.chunk(i)
+		if len(th.FreeMapPages) <= i {
+			th.FreeMapPages = append(th.FreeMapPages, make([]PageID, i+1-len(th.FreeMapPages))...)
+		}
+		if th.FreeMapPages[i] == 0 {
+			if !slices.ContainsFunc(words, func(w uint64) bool { return w != 0 }) {
+				continue
+			}
+			th.FreeMapPages[i] = th.NextPageID
+			th.NextPageID++
+			th.NumPages = uint32(th.NextPageID - 1)
+			added = true
+		}
+
+		page := Page{PageID: th.FreeMapPages[i]}
+		for j, w := range words {
+			binary.LittleEndian.PutUint64(page.Data[j*8:], w)
+		}
+		if err := dm.WritePage(page); err != nil {
+			return fmt.Errorf("failed to write free map: %w", err)
+		}
+	}
+	clear(th.free.dirty)
+
+	if added {
+		// new map pages must be on disk before a header pointing to them
+		if err := dm.Sync(); err != nil {
+			return fmt.Errorf("failed to sync free map: %w", err)
+		}
+	}
+	return nil
+}
+
+// readFreeMap loads the map pages th lists.
+func (dm *DiskManager) readFreeMap(th *TableHeader) (*freeMap, error) {
+	fm := newFreeMap(nil)
+	for i, id := range th.FreeMapPages {
+		if id == 0 {
+			continue
+		}
+		if id >= th.NextPageID {
+			return nil, fmt.Errorf("free map page %d is out of range", id)
+		}
+		page, err := dm.ReadPage(id)
+		if err != nil {
+			return nil, err
+		}
+		fm.words = append(fm.words, make([]uint64, (i+1)*freeMapWords-len(fm.words))...)
+		for j := range freeMapWords {
+			w := binary.LittleEndian.Uint64(page.Data[j*8:])
+			fm.words[i*freeMapWords+j] = w
+			fm.count += bits.OnesCount64(w)
+		}
+	}
+	return fm, nil
+}
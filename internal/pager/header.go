@@ -2,9 +2,16 @@ package pager
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"godb/internal/schema"
+	"io"
+	"maps"
+	"math"
+	"slices"
 )
 
 type TableHeader struct {
@@ -14,7 +21,66 @@ type TableHeader struct {
 	NextPageID  PageID
 	NumPages    uint32
 	Schema      schema.Schema
-	FreePageIDs []PageID
+	FreePageIDs []PageID // the free list before the free map; moved there on read
+
+	// fields below are appended after the free list; headers written before
+	// they existed read back as zero (the page is zero-padded)
+	Codec       schema.CodecType
+	TableID     TableID // random identity shared with the table's WAL preamble
+	Compression bool    // deflate large record bodies
+	WALOnly     bool    // inserts only append to the WAL; tree is built on first read
+	OmitKey     bool    // record bodies skip the key column; it is rebuilt from the key prefix
+	FlushWrites bool    // inserts and deletes write their dirty pages before returning
+
+	// CheckpointLSN is the LSN of the last WAL record already reflected in the
+	// pages, 0 for none. It only means something for the current WAL: LSNs
+	// restart after a truncate, so the checkpoint clears it again.
+	CheckpointLSN uint64
+
+	SchemaHash uint64 // Schema.Hash() as of the last header write, 0 on older tables
+	Versioned  bool   // records carry a row version bumped on every update
+	RetainLog  bool   // checkpoints copy the WAL to a retained log before truncating it
+
+	// KeyRange restricts primary keys to [MinKey, MaxKey]; without it the
+	// bounds are ignored and any key goes
+	KeyRange       bool
+	MinKey, MaxKey uint64
+
+	// Forwarding lets an update that outgrows its leaf move the record to
+	// an OVERFLOW page, leaving a forward stub in the leaf instead of
+	// splitting it
+	Forwarding bool
+
+	// Options holds table settings changed after creation (see
+	// BTreeStore.SetOption), by name, as text
+	Options map[string]string
+
+	// FreeListPage is only set on older headers: the first page of a chain
+	// holding the free list entries that didn't fit in the header page.
+	// ReadHeader moves them into the free map along with FreePageIDs.
+	FreeListPage PageID
+
+	// FreeMapPages are the pages holding the free page bitmap, by chunk;
+	// see freeMap
+	FreeMapPages []PageID
+
+	free *freeMap // the free pages, once FreePageIDs has moved here
+}
+
+type TableID [16]byte
+
+func NewTableID() TableID {
+	var id TableID
+	_, _ = rand.Read(id[:]) // crypto/rand never returns an error
+	return id
+}
+
+func (id TableID) IsZero() bool {
+	return id == TableID{}
+}
+
+func (id TableID) String() string {
+	return hex.EncodeToString(id[:])
 }
 
 func DefaultTableHeader(sch schema.Schema) TableHeader {
@@ -25,9 +91,31 @@ func DefaultTableHeader(sch schema.Schema) TableHeader {
 		NextPageID: 2,
 		NumPages:   1,
 		Schema:     sch,
+		TableID:    NewTableID(),
+		SchemaHash: sch.Hash(),
 	}
 }
 
+// freePages returns the free page bitmap, moving FreePageIDs into it the
+// first time.
+func (th *TableHeader) freePages() *freeMap {
+	if th.free == nil {
+		th.free = newFreeMap(th.FreePageIDs)
+		th.FreePageIDs = nil
+	}
+	return th.free
+}
+
+// FreePages lists the free pages in ascending order.
+func (th *TableHeader) FreePages() []PageID {
+	return th.freePages().ids()
+}
+
+// IsFree reports whether page id is free.
+func (th *TableHeader) IsFree(id PageID) bool {
+	return th.freePages().contains(id)
+}
+
 func (th *TableHeader) Serialize() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
@@ -83,6 +171,140 @@ func (th *TableHeader) Serialize() ([]byte, error) {
 			return nil, err
 		}
 	}
+
+	// record codec
+	if err := buf.WriteByte(byte(th.Codec)); err != nil {
+		return nil, err
+	}
+
+	// table identity
+	if _, err := buf.Write(th.TableID[:]); err != nil {
+		return nil, err
+	}
+
+	// compression flag
+	var compression byte
+	if th.Compression {
+		compression = 1
+	}
+	if err := buf.WriteByte(compression); err != nil {
+		return nil, err
+	}
+
+	// wal-only flag
+	var walOnly byte
+	if th.WALOnly {
+		walOnly = 1
+	}
+	if err := buf.WriteByte(walOnly); err != nil {
+		return nil, err
+	}
+
+	// omit-key flag
+	var omitKey byte
+	if th.OmitKey {
+		omitKey = 1
+	}
+	if err := buf.WriteByte(omitKey); err != nil {
+		return nil, err
+	}
+
+	// flush-writes flag
+	var flushWrites byte
+	if th.FlushWrites {
+		flushWrites = 1
+	}
+	if err := buf.WriteByte(flushWrites); err != nil {
+		return nil, err
+	}
+
+	// checkpoint watermark
+	if err := binary.Write(buf, binary.LittleEndian, th.CheckpointLSN); err != nil {
+		return nil, err
+	}
+
+	// schema fingerprint
+	if err := binary.Write(buf, binary.LittleEndian, th.SchemaHash); err != nil {
+		return nil, err
+	}
+
+	// versioned flag
+	var versioned byte
+	if th.Versioned {
+		versioned = 1
+	}
+	if err := buf.WriteByte(versioned); err != nil {
+		return nil, err
+	}
+
+	// retain-log flag
+	var retainLog byte
+	if th.RetainLog {
+		retainLog = 1
+	}
+	if err := buf.WriteByte(retainLog); err != nil {
+		return nil, err
+	}
+
+	// key range
+	var keyRange byte
+	if th.KeyRange {
+		keyRange = 1
+	}
+	if err := buf.WriteByte(keyRange); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, th.MinKey); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, th.MaxKey); err != nil {
+		return nil, err
+	}
+
+	// forwarding flag
+	var forwarding byte
+	if th.Forwarding {
+		forwarding = 1
+	}
+	if err := buf.WriteByte(forwarding); err != nil {
+		return nil, err
+	}
+
+	// options, sorted by name so the header bytes are stable
+	if err := binary.Write(buf, binary.LittleEndian, uint16(len(th.Options))); err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(th.Options)) {
+		value := th.Options[name]
+		if len(name) > math.MaxUint8 || len(value) > math.MaxUint16 {
+			return nil, fmt.Errorf("option %q is too long", name)
+		}
+		if err := buf.WriteByte(byte(len(name))); err != nil {
+			return nil, err
+		}
+		if _, err := buf.WriteString(name); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, uint16(len(value))); err != nil {
+			return nil, err
+		}
+		if _, err := buf.WriteString(value); err != nil {
+			return nil, err
+		}
+	}
+
+	// spilled free list
+	if err := binary.Write(buf, binary.LittleEndian, th.FreeListPage); err != nil {
+		return nil, err
+	}
+
+	// free map pages
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(th.FreeMapPages))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, th.FreeMapPages); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
@@ -143,5 +365,186 @@ func DeserializeTableHeader(data []byte) (*TableHeader, error) {
 		}
 		th.FreePageIDs = append(th.FreePageIDs, pageID)
 	}
+
+	// read record codec (missing on unpadded legacy headers)
+	codec, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.Codec = schema.CodecType(codec)
+
+	// read table identity
+	if _, err := io.ReadFull(r, th.TableID[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+
+	// read compression flag
+	compression, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.Compression = compression != 0
+
+	// read wal-only flag
+	walOnly, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.WALOnly = walOnly != 0
+
+	// read omit-key flag
+	omitKey, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.OmitKey = omitKey != 0
+
+	// read flush-writes flag
+	flushWrites, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.FlushWrites = flushWrites != 0
+
+	// read checkpoint watermark
+	if err := binary.Read(r, binary.LittleEndian, &th.CheckpointLSN); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+
+	// read schema fingerprint
+	if err := binary.Read(r, binary.LittleEndian, &th.SchemaHash); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+
+	// read versioned flag
+	versioned, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.Versioned = versioned != 0
+
+	// read retain-log flag
+	retainLog, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.RetainLog = retainLog != 0
+
+	// read key range
+	keyRange, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.KeyRange = keyRange != 0
+	if err := binary.Read(r, binary.LittleEndian, &th.MinKey); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &th.MaxKey); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+
+	// read forwarding flag
+	forwarding, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	th.Forwarding = forwarding != 0
+
+	// read options
+	var numOptions uint16
+	if err := binary.Read(r, binary.LittleEndian, &numOptions); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	for range numOptions {
+		nameLen, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read option name: %w", err)
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, fmt.Errorf("failed to read option name: %w", err)
+		}
+		var valueLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &valueLen); err != nil {
+			return nil, fmt.Errorf("failed to read option %s: %w", name, err)
+		}
+		value := make([]byte, valueLen)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, fmt.Errorf("failed to read option %s: %w", name, err)
+		}
+		if th.Options == nil {
+			th.Options = make(map[string]string, numOptions)
+		}
+		th.Options[string(name)] = string(value)
+	}
+
+	// read spilled free list head
+	if err := binary.Read(r, binary.LittleEndian, &th.FreeListPage); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+
+	// read free map pages
+	var numMapPages uint32
+	if err := binary.Read(r, binary.LittleEndian, &numMapPages); err != nil {
+		if errors.Is(err, io.EOF) {
+			return th, nil
+		}
+		return nil, err
+	}
+	if int(numMapPages) > r.Len()/pageIDSize {
+		return nil, fmt.Errorf("header lists %d free map pages, more than fit", numMapPages)
+	}
+	th.FreeMapPages = make([]PageID, numMapPages)
+	if err := binary.Read(r, binary.LittleEndian, th.FreeMapPages); err != nil {
+		return nil, fmt.Errorf("failed to read free map pages: %w", err)
+	}
 	return th, nil
 }
@@ -1,29 +1,57 @@
 package pager
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"slices"
+	"unsafe"
 )
 
 var (
 	ErrPageFull       = errors.New("page full")
 	ErrSlotOutOfRange = errors.New("slot out of range")
 	ErrRecordDeleted  = errors.New("record deleted")
+	ErrShortRecord    = errors.New("record too small to contain a key")
 )
 
 const PAGE_SIZE = 4096
 
+// MaxRecordSize is the largest record an empty page can hold: the page less
+// its 13-byte header, one 4-byte slot and the 4-byte checksum trailer.
+const MaxRecordSize = PAGE_SIZE - 13 - 4 - 4
+
 type PageID uint32
 type PageType uint8
 
+// internal records are [key:8][child:pageIDSize]. Both sizes follow the
+// types, so widening PageID only means changing its declaration above.
+const (
+	keySize            = 8
+	pageIDSize         = int(unsafe.Sizeof(PageID(0)))
+	InternalRecordSize = keySize + pageIDSize
+)
+
 const (
 	LEAF PageType = iota
 	INTERNAL
+	OVERFLOW // records moved off their leaf, outside the tree; see TableHeader.Forwarding
 )
 
+func (pt PageType) String() string {
+	switch pt {
+	case LEAF:
+		return "leaf"
+	case INTERNAL:
+		return "internal"
+	case OVERFLOW:
+		return "overflow"
+	default:
+		return fmt.Sprintf("PageType(%d)", uint8(pt))
+	}
+}
+
 type SlottedPage struct {
 	PageID         PageID
 	PageType       PageType
@@ -147,20 +175,36 @@ func NewSlottedPage(pageID PageID, pageType PageType) *SlottedPage {
 	}
 }
 
+// RecordComparator orders two records with equal keys, like bytes.Compare.
+// Pages of trees that allow duplicate keys, such as a secondary index
+// mapping one value to many primary keys, use it to keep ties in a
+// deterministic order.
+type RecordComparator func(a, b []byte) int
+
 func (sp *SlottedPage) InsertRecordSorted(data []byte) (int, error) {
+	return sp.InsertRecordSortedBy(data, nil)
+}
+
+// InsertRecordSortedBy is InsertRecordSorted that places data among records
+// with the same key by cmp, after any it compares equal to. A nil cmp puts
+// it before every record with its key, as InsertRecordSorted does.
+func (sp *SlottedPage) InsertRecordSortedBy(data []byte, cmp RecordComparator) (int, error) {
 	if len(data) < 8 {
-		return -1, errors.New("record too small to contain a key")
+		return -1, ErrShortRecord
 	}
 	key := binary.LittleEndian.Uint64(data[:8])
 
 	insertPos := sp.findInsertionPosition(key)
+	if cmp != nil {
+		insertPos = sp.upperBoundBy(insertPos, key, data, cmp)
+	}
 
 	slotArrayEnd := 13 + (len(sp.Slots)+1)*4
-	newFreePtr := sp.FreeSpacePtr - uint16(len(data))
-
-	if newFreePtr < uint16(slotArrayEnd) {
+	// compare as ints - a record longer than FreeSpacePtr would wrap uint16
+	if int(sp.FreeSpacePtr)-len(data) < slotArrayEnd {
 		return -1, ErrPageFull
 	}
+	newFreePtr := sp.FreeSpacePtr - uint16(len(data))
 
 	slot := Slot{
 		Offset: newFreePtr,
@@ -176,12 +220,16 @@ func (sp *SlottedPage) InsertRecordSorted(data []byte) (int, error) {
 }
 
 func (sp *SlottedPage) InsertRecord(data []byte) (int, error) {
-	slotArrayEnd := 13 + (len(sp.Slots)+1)*4
-	newFreePtr := sp.FreeSpacePtr - uint16(len(data))
+	if len(data) < 8 {
+		return -1, ErrShortRecord
+	}
 
-	if newFreePtr < uint16(slotArrayEnd) {
+	slotArrayEnd := 13 + (len(sp.Slots)+1)*4
+	// compare as ints - a record longer than FreeSpacePtr would wrap uint16
+	if int(sp.FreeSpacePtr)-len(data) < slotArrayEnd {
 		return -1, ErrPageFull
 	}
+	newFreePtr := sp.FreeSpacePtr - uint16(len(data))
 
 	slot := Slot{
 		Offset: newFreePtr,
@@ -225,12 +273,26 @@ func (sp *SlottedPage) DeleteRecord(slotIndex int) error {
 	return sp.Compact()
 }
 
+// GetKey returns the key in a slot, or 0 if the slot is out of range or its
+// record is too short to hold a key. Use KeyAt to tell those cases apart.
 func (sp *SlottedPage) GetKey(slotIndex int) uint64 {
-	if slotIndex >= int(sp.NumSlots) {
+	key, err := sp.KeyAt(slotIndex)
+	if err != nil {
 		return 0
 	}
+	return key
+}
+
+func (sp *SlottedPage) KeyAt(slotIndex int) (uint64, error) {
+	if slotIndex < 0 || slotIndex >= int(sp.NumSlots) || slotIndex >= len(sp.Records) {
+		return 0, ErrSlotOutOfRange
+	}
+	record := sp.Records[slotIndex]
+	if len(record) < 8 {
+		return 0, fmt.Errorf("slot %d (%d bytes): %w", slotIndex, len(record), ErrShortRecord)
+	}
 	// first 8 bytes of record is the key
-	return binary.LittleEndian.Uint64(sp.Records[slotIndex][:8])
+	return binary.LittleEndian.Uint64(record[:8]), nil
 }
 
 func (sp *SlottedPage) findInsertionPosition(key uint64) int {
@@ -248,13 +310,36 @@ func (sp *SlottedPage) findInsertionPosition(key uint64) int {
 	return left
 }
 
+// upperBoundBy returns the first slot from lo whose record sorts after data:
+// a larger key, or the same key and cmp > 0. lo must be key's lower bound.
+func (sp *SlottedPage) upperBoundBy(lo int, key uint64, data []byte, cmp RecordComparator) int {
+	left, right := lo, int(sp.NumSlots)
+	for left < right {
+		mid := (left + right) / 2
+		if sp.GetKey(mid) == key && cmp(sp.Records[mid], data) <= 0 {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	return left
+}
+
+// LowerBound returns the index of the first slot with a key >= key, or
+// NumSlots if every key is smaller.
+func (sp *SlottedPage) LowerBound(key uint64) int {
+	return sp.findInsertionPosition(key)
+}
+
 func (sp *SlottedPage) SearchInternal(key uint64) (PageID, int) {
 	left, right := 0, int(sp.NumSlots)
 	for left < right {
 		mid := (left + right) / 2
 
+		// [separator, child] routes keys below the separator to child; the
+		// separator itself is the first key of the next child
 		midKey := sp.GetKey(mid)
-		if midKey < key {
+		if midKey <= key {
 			left = mid + 1
 		} else {
 			right = mid
@@ -285,19 +370,71 @@ func (sp *SlottedPage) Search(key uint64) (int, bool) {
 	return -1, false
 }
 
-func SerializeInternalRecord(key uint64, childPageID PageID) []byte {
-	buf := new(bytes.Buffer)
+// SearchBy finds the record with data's key that cmp reports equal to data,
+// for pages whose keys may repeat. Search alone can land on any of them.
+func (sp *SlottedPage) SearchBy(data []byte, cmp RecordComparator) (int, bool) {
+	if len(data) < 8 {
+		return -1, false
+	}
+	key := binary.LittleEndian.Uint64(data[:8])
 
-	binary.Write(buf, binary.LittleEndian, key)
-	binary.Write(buf, binary.LittleEndian, childPageID)
+	left, right := sp.findInsertionPosition(key), int(sp.NumSlots)
+	for left < right {
+		mid := (left + right) / 2
+		if sp.GetKey(mid) != key {
+			right = mid
+			continue
+		}
+		switch c := cmp(sp.Records[mid], data); {
+		case c == 0:
+			return mid, true
+		case c < 0:
+			left = mid + 1
+		default:
+			right = mid
+		}
+	}
+	return -1, false
+}
 
-	return buf.Bytes()
+func SerializeInternalRecord(key uint64, childPageID PageID) []byte {
+	data := make([]byte, InternalRecordSize)
+	binary.LittleEndian.PutUint64(data[:keySize], key)
+	putPageID(data[keySize:], childPageID)
+	return data
 }
 
 func DeserializeInternalRecord(data []byte) (uint64, PageID) {
-	key := binary.LittleEndian.Uint64(data[:8])
-	pgid := binary.LittleEndian.Uint32(data[8:])
-	return key, PageID(pgid)
+	key := binary.LittleEndian.Uint64(data[:keySize])
+	return key, getPageID(data[keySize:InternalRecordSize])
+}
+
+// putPageID writes id little-endian in pageIDSize bytes.
+func putPageID(b []byte, id PageID) {
+	for i := range pageIDSize {
+		b[i] = byte(uint64(id) >> (8 * i))
+	}
+}
+
+// getPageID reads a little-endian PageID of pageIDSize bytes.
+func getPageID(b []byte) PageID {
+	var id uint64
+	for i := pageIDSize - 1; i >= 0; i-- {
+		id = id<<8 | uint64(b[i])
+	}
+	return PageID(id)
+}
+
+// Clone returns a deep copy of sp: changing either page's slots or record
+// bytes afterwards leaves the other alone.
+func (sp *SlottedPage) Clone() *SlottedPage {
+	c := *sp
+	c.Slots = slices.Clone(sp.Slots)
+	c.Records = make([][]byte, len(sp.Records))
+	for i, record := range sp.Records {
+		c.Records[i] = slices.Clone(record)
+	}
+	return &c
 }
 
 func (sp *SlottedPage) Compact() error {
@@ -309,11 +446,11 @@ func (sp *SlottedPage) Compact() error {
 		}
 	}
 
-	// reset page to empty
+	// reset page to empty (records end before the checksum trailer)
 	sp.Slots = []Slot{}
 	sp.Records = [][]byte{}
 	sp.NumSlots = 0
-	sp.FreeSpacePtr = PAGE_SIZE
+	sp.FreeSpacePtr = PAGE_SIZE - 4
 
 	// re-insert all active records
 	for _, record := range activeRecords {
@@ -343,7 +480,7 @@ func (sp *SlottedPage) SplitLeaf(newPageID PageID, sequential bool) (*SlottedPag
 
 	newPage := NewSlottedPage(newPageID, sp.PageType)
 	for i := mid; i < sp.NumSlots; i++ {
-		record := sp.Records[i]
+		record := slices.Clone(sp.Records[i])
 		_, err := newPage.InsertRecordSorted(record)
 		if err != nil {
 			return nil, 0, err
@@ -383,7 +520,7 @@ func (sp *SlottedPage) SplitInternal(newPageID PageID, sequential bool) (*Slotte
 	promotedKey := sp.GetKey(int(mid))
 	newPage := NewSlottedPage(newPageID, sp.PageType)
 	for i := mid + 1; i < sp.NumSlots; i++ {
-		record := sp.Records[i]
+		record := slices.Clone(sp.Records[i])
 		_, err := newPage.InsertRecordSorted(record)
 		if err != nil {
 			return nil, 0, err
@@ -424,9 +561,10 @@ func (sp *SlottedPage) MergeLeaf(sibling *SlottedPage) error {
 		return errors.New("pages too large to merge")
 	}
 
-	// copy all records from sibling to this page
-	for i := 0; i < int(sibling.NumSlots); i++ {
-		_, err := sp.InsertRecordSorted(sibling.Records[i])
+	// copy all records from sibling to this page, unshared with it
+	moved := sibling.Clone()
+	for i := 0; i < int(moved.NumSlots); i++ {
+		_, err := sp.InsertRecordSorted(moved.Records[i])
 		if err != nil {
 			return fmt.Errorf("merge leaf: failed to insert record from sibling: %w", err)
 		}
@@ -447,9 +585,10 @@ func (sp *SlottedPage) MergeInternals(sibling *SlottedPage) error {
 		return errors.New("pages too large to merge")
 	}
 
-	// copy all records from sibling to this page
-	for i := 0; i < int(sibling.NumSlots); i++ {
-		_, err := sp.InsertRecordSorted(sibling.Records[i])
+	// copy all records from sibling to this page, unshared with it
+	moved := sibling.Clone()
+	for i := 0; i < int(moved.NumSlots); i++ {
+		_, err := sp.InsertRecordSorted(moved.Records[i])
 		if err != nil {
 			return fmt.Errorf("merge leaf: failed to insert record from sibling: %w", err)
 		}
@@ -3,19 +3,45 @@ package pager
 import (
 	"errors"
 	"fmt"
+	"godb/internal/logging"
 	"godb/internal/schema"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 )
 
 const maxCacheSize = 250
 
+// DefaultGrowChunk is how many pages the data file is extended by at a time.
+const DefaultGrowChunk = 64
+
+// ErrAllPinned is returned when the cache is full and every page in it is
+// pinned, so nothing can be evicted to make room.
+var ErrAllPinned = errors.New("all pages pinned")
+
+// PinnedPolicy is what the cache does when it needs room but every page is
+// pinned. The zero value fails straight away with ErrAllPinned.
+//
+// Retries waits and tries evicting again, Backoff at first and doubling
+// each time, on the chance another operation unpins a page meanwhile.
+// Overflow then caches the page anyway, past capacity, rather than fail;
+// the cache shrinks back as pages are evicted.
+type PinnedPolicy struct {
+	Retries  int
+	Backoff  time.Duration
+	Overflow bool
+}
+
 type CacheRecord struct {
 	id       PageID
 	data     *SlottedPage
 	isDirty  bool
 	pinCount int
 	refBit   bool
+	size     int64 // bytes counted against the cache's byte budget
 }
 
 func NewCacheRecord(sp *SlottedPage) CacheRecord {
@@ -25,6 +51,7 @@ func NewCacheRecord(sp *SlottedPage) CacheRecord {
 		isDirty:  false,
 		pinCount: 0,
 		refBit:   false,
+		size:     PAGE_SIZE,
 	}
 }
 
@@ -35,7 +62,39 @@ type PageCache struct {
 	cache      map[PageID]*CacheRecord
 	header     *TableHeader
 	dm         *DiskManager
+	logger     logging.Logger
+	tempDir    string // for vacuum's temp file; "" means the table's directory
+	growChunk  int    // pages to pre-allocate at a time; 0 lets writes extend the file
+	grownTo    PageID // the file spans pages below this; 0 until first checked
+	pinned     PinnedPolicy
+	maxBytes   int64 // byte budget on top of maxCacheSize pages; 0 means none
+	curBytes   int64 // sum of cached records' sizes
 	mu         sync.Mutex
+
+	// activity counters, guarded by mu
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// CacheStats is a snapshot of the page cache's occupancy and activity.
+type CacheStats struct {
+	Size      int // pages currently cached
+	Capacity  int
+	Bytes     int64 // memory the cached pages account for
+	MaxBytes  int64 // byte budget, 0 if only the page count is capped
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// HitRatio is the fraction of fetches served from the cache, or 0 before any fetch.
+func (cs CacheStats) HitRatio() float64 {
+	total := cs.Hits + cs.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Hits) / float64(total)
 }
 
 func NewPageCache(dm *DiskManager, th *TableHeader) *PageCache {
@@ -46,23 +105,64 @@ func NewPageCache(dm *DiskManager, th *TableHeader) *PageCache {
 		cache:      make(map[PageID]*CacheRecord, maxCacheSize),
 		header:     th,
 		dm:         dm,
+		logger:     logging.New("pager"),
+		growChunk:  DefaultGrowChunk,
 	}
 	//go pc.backgroundFlusher()
 	return &pc
 }
 
+func (pc *PageCache) SetLogger(l logging.Logger) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.logger = l
+}
+
 func (pc *PageCache) AllocatePage() PageID {
-	if len(pc.header.FreePageIDs) > 0 {
-		pageID := pc.header.FreePageIDs[len(pc.header.FreePageIDs)-1]
-		pc.header.FreePageIDs = pc.header.FreePageIDs[:len(pc.header.FreePageIDs)-1]
+	if pageID, ok := pc.header.freePages().take(); ok {
 		return pageID
 	}
 
 	pageID := pc.header.NextPageID
 	pc.header.NextPageID++
+	pc.growFor(pageID)
 	return pageID
 }
 
+// growFor extends the data file by a chunk once id reaches its end. A failed
+// grow is only logged: writing the page extends the file anyway.
+func (pc *PageCache) growFor(id PageID) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.growChunk <= 0 || id < pc.grownTo {
+		return
+	}
+	onDisk, err := pc.dm.PagesOnDisk()
+	if err != nil {
+		pc.logger.Warn("not pre-growing file: %v", err)
+		return
+	}
+	if id >= onDisk {
+		// cover id itself as well as the chunk after it
+		pages := int(id-onDisk) + pc.growChunk
+		if err := pc.dm.Grow(pages); err != nil {
+			pc.logger.Warn("not pre-growing file: %v", err)
+			return
+		}
+		onDisk += PageID(pages)
+	}
+	pc.grownTo = onDisk
+}
+
+// SetGrowChunk sets how many pages the data file is extended by when page
+// allocation reaches its end; 0 turns pre-growing off.
+func (pc *PageCache) SetGrowChunk(pages int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.growChunk = max(pages, 0)
+}
+
 func (pc *PageCache) AddNewPage(sp *SlottedPage) error {
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
@@ -87,14 +187,12 @@ func (pc *PageCache) FreePage(id PageID) {
 	defer pc.mu.Unlock()
 
 	// remove the page from the cache -- forcefully
-	delete(pc.cache, id)
-
-	for i, qid := range pc.clockQueue {
-		if qid == id {
-			pc.clockQueue[i] = 0
-		}
+	if cr, exists := pc.cache[id]; exists {
+		pc.curBytes -= cr.size
+		delete(pc.cache, id)
 	}
-	pc.header.FreePageIDs = append(pc.header.FreePageIDs, id)
+	pc.dropFromClock(id)
+	pc.header.freePages().add(id)
 }
 
 func (pc *PageCache) GetRootPageID() PageID {
@@ -110,7 +208,11 @@ func (pc *PageCache) Fetch(id PageID) (sp *SlottedPage, err error) {
 	defer pc.mu.Unlock()
 
 	cr, exists := pc.cache[id]
-	if !exists {
+	if exists {
+		pc.hits++
+	} else {
+		pc.misses++
+
 		// retrieve page from disk
 		sp, err = pc.dm.ReadSlottedPage(id)
 		if err != nil {
@@ -118,11 +220,17 @@ func (pc *PageCache) Fetch(id PageID) (sp *SlottedPage, err error) {
 		}
 
 		// cache the page
-		if err = pc.CachePage(sp); err != nil {
+		if err = pc.cachePage(sp, true); err != nil {
 			return nil, err
 		}
 
-		cr = pc.cache[id]
+		cr, exists = pc.cache[id]
+		if !exists {
+			// CachePage claimed success but the page isn't there - don't leave
+			// a clock slot pointing at nothing
+			pc.dropFromClock(id)
+			return nil, fmt.Errorf("page %d missing from cache after caching", id)
+		}
 	}
 
 	// Slotted Page found in cache
@@ -131,26 +239,103 @@ func (pc *PageCache) Fetch(id PageID) (sp *SlottedPage, err error) {
 	return cr.data, nil
 }
 
+// CachePage adds sp, as the caller built it, to the cache, evicting pages to
+// make room if need be. Caller must hold mu; a PinnedPolicy with retries
+// releases it while waiting.
 func (pc *PageCache) CachePage(sp *SlottedPage) error {
-	// find empty slot or evict
-	for pc.clockQueue[pc.clockHand] != 0 {
-		fmt.Printf("DEBUG: Clock sweeping (cache %d/%d), need room for page %d\n",
+	return pc.cachePage(sp, false)
+}
+
+// cachePage is CachePage. fromDisk says sp was just read from the file: if
+// mu is released to wait, the page may be fetched, changed and evicted back
+// to disk meanwhile, so it's read again rather than cached stale, and a copy
+// someone else cached meanwhile is used instead. A page the caller built is
+// always cached as it is, so finding another copy of it is an error.
+func (pc *PageCache) cachePage(sp *SlottedPage, fromDisk bool) error {
+	ncr := NewCacheRecord(sp)
+	backoff := pc.pinned.Backoff
+	retries := 0
+	// find empty slot and get under the byte budget, evicting as needed
+	for pc.clockQueue[pc.clockHand] != 0 || pc.overBudget(ncr.size) {
+		pc.logger.Debug("clock sweeping (cache %d/%d), need room for page %d",
 			len(pc.cache), maxCacheSize, sp.PageID)
-		if err := pc.Evict(); err != nil {
-			fmt.Printf("ERROR: flushRecord failed for page %d: %v\n", sp.PageID, err)
+		err := pc.Evict()
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrAllPinned) {
+			pc.logger.Error("eviction failed making room for page %d: %v", sp.PageID, err)
 			return err
 		}
+
+		if retries < pc.pinned.Retries {
+			retries++
+			pc.logger.Debug("all pages pinned, retry %d for page %d in %v", retries, sp.PageID, backoff)
+			pc.mu.Unlock()
+			time.Sleep(backoff)
+			pc.mu.Lock()
+			backoff *= 2
+			if _, exists := pc.cache[sp.PageID]; exists {
+				if !fromDisk {
+					return fmt.Errorf("page %d was cached by another caller while waiting for room", sp.PageID)
+				}
+				// cached by someone else while we waited
+				return nil
+			}
+			if fromDisk {
+				fresh, err := pc.dm.ReadSlottedPage(sp.PageID)
+				if err != nil {
+					return fmt.Errorf("failed to reread slotted page %d: %w", sp.PageID, err)
+				}
+				sp = fresh
+				ncr = NewCacheRecord(sp)
+			}
+			continue
+		}
+		if pc.pinned.Overflow {
+			pc.logger.Warn("all %d cached pages pinned, caching page %d over capacity", len(pc.cache), sp.PageID)
+			if pc.clockQueue[pc.clockHand] != 0 {
+				pc.clockQueue = slices.Insert(pc.clockQueue, pc.clockHand, 0)
+			}
+			break
+		}
+		pc.logger.Error("eviction failed making room for page %d: %v", sp.PageID, err)
+		return err
 	}
 
 	// insert at current position
-	ncr := NewCacheRecord(sp)
 	ncr.refBit = true
 	pc.cache[sp.PageID] = &ncr
+	pc.curBytes += ncr.size
 	pc.clockQueue[pc.clockHand] = sp.PageID
 	pc.advanceClock()
 	return nil
 }
 
+// overBudget reports whether caching size more bytes would go over the byte
+// budget. Caller must hold mu.
+func (pc *PageCache) overBudget(size int64) bool {
+	return pc.maxBytes > 0 && len(pc.cache) > 0 && pc.curBytes+size > pc.maxBytes
+}
+
+// SetMaxBytes caps the memory the cached pages account for, evicting until
+// a new page fits within it; the page count limit still applies. 0, the
+// default, leaves only the page count limit. Lowering it takes effect as
+// pages are next cached.
+func (pc *PageCache) SetMaxBytes(n int64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.maxBytes = max(n, 0)
+}
+
+// SetPinnedPolicy sets what caching a page does when the cache is full of
+// pinned pages; by default it fails with ErrAllPinned.
+func (pc *PageCache) SetPinnedPolicy(p PinnedPolicy) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.pinned = p
+}
+
 func (pc *PageCache) MakeDirty(id PageID) error {
 	cr, exists := pc.cache[id]
 	if !exists {
@@ -166,28 +351,28 @@ func (pc *PageCache) MakeDirty(id PageID) error {
 
 func (pc *PageCache) Evict() error {
 	startPos := pc.clockHand
+	// a full rotation that met no unpinned page means there's no victim;
+	// the hand may start on an empty slot when evicting for the byte budget
+	unpinned := false
 
 	for {
 		// get page at clock hand
 		id := pc.clockQueue[pc.clockHand]
 		cr := pc.cache[id]
 
-		if cr == nil {
-			// stale entry, skip
-			pc.advanceClock()
-			continue
-		}
-
-		if cr.pinCount > 0 {
-			// pinned, skip (but don't clear refBit)
+		if cr == nil || cr.pinCount > 0 {
+			// stale entry or pinned, skip (but don't clear refBit)
 			pc.advanceClock()
 
-			// detect full rotation through all pinned pages
 			if pc.clockHand == startPos {
-				return errors.New("all pages pinned")
+				if !unpinned {
+					return ErrAllPinned
+				}
+				unpinned = false
 			}
 			continue
 		}
+		unpinned = true
 
 		if cr.refBit {
 			// give second chance
@@ -205,14 +390,33 @@ func (pc *PageCache) Evict() error {
 		}
 
 		delete(pc.cache, id)
-		pc.clockQueue[pc.clockHand] = 0
-		fmt.Printf("DEBUG: Successfully evicted page %d, cache now %d/%d\n", id,
+		pc.curBytes -= cr.size
+		if len(pc.clockQueue) > maxCacheSize {
+			// over capacity after an overflow: give the slot up too
+			pc.clockQueue = slices.Delete(pc.clockQueue, pc.clockHand, pc.clockHand+1)
+			if pc.clockHand == len(pc.clockQueue) {
+				pc.clockHand = 0
+			}
+		} else {
+			pc.clockQueue[pc.clockHand] = 0
+		}
+		pc.evictions++
+		pc.logger.Debug("evicted page %d, cache now %d/%d", id,
 			len(pc.cache), maxCacheSize)
 		return nil
 	}
 
 }
 
+// dropFromClock clears any clock queue slots holding id. Caller must hold mu.
+func (pc *PageCache) dropFromClock(id PageID) {
+	for i, qid := range pc.clockQueue {
+		if qid == id {
+			pc.clockQueue[i] = 0
+		}
+	}
+}
+
 func (pc *PageCache) advanceClock() {
 	pc.clockHand = (pc.clockHand + 1) % len(pc.clockQueue)
 }
@@ -257,23 +461,79 @@ func (pc *PageCache) flushBatch(ids []PageID) error {
 	return nil
 }
 
-func (pc *PageCache) FlushAll() error {
+// FlushPage writes a single cached page if it is dirty. Pages that are no
+// longer cached were written when they were evicted, so there is nothing to do.
+func (pc *PageCache) FlushPage(id PageID) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	cr, exists := pc.cache[id]
+	if !exists || !cr.isDirty {
+		return nil
+	}
+	return pc.flushRecord(cr)
+}
+
+// DirtyPages returns the ids of cached pages changed since they were last written.
+func (pc *PageCache) DirtyPages() []PageID {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	var ids []PageID
+	for id, cr := range pc.cache {
+		if cr.isDirty {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SetSyncEnabled turns fsync of the table file on or off; see
+// DiskManager.SetSyncEnabled.
+func (pc *PageCache) SetSyncEnabled(on bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.dm.SetSyncEnabled(on)
+}
+
+// FileName returns the path the table file was opened with, or "" if the
+// table isn't kept in a file.
+func (pc *PageCache) FileName() string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	f, err := pc.dm.tableFile()
+	if err != nil {
+		return ""
+	}
+	return f.Name()
+}
+
+// Sync fsyncs the table file.
+func (pc *PageCache) Sync() error {
+	return pc.dm.Sync()
+}
+
+// FlushAll writes every cached page and the header, then fsyncs.
+// Returns the number of pages written.
+func (pc *PageCache) FlushAll() (int, error) {
+	written := 0
 	for _, cr := range pc.cache {
 		if err := pc.writeRecord(cr); err != nil {
-			return fmt.Errorf("failed to write page %d: %w", cr.id, err)
+			return written, fmt.Errorf("failed to write page %d: %w", cr.id, err)
 		}
+		written++
 	}
 	if err := pc.dm.Sync(); err != nil {
-		return fmt.Errorf("failed to fsync: %w", err)
+		return written, fmt.Errorf("failed to fsync: %w", err)
 	}
 	// also flush the header to disk
 	if err := pc.FlushHeader(); err != nil {
-		return fmt.Errorf("failed to fsync header data: %w", err)
+		return written, fmt.Errorf("failed to fsync header data: %w", err)
 	}
 	for _, cr := range pc.cache {
 		cr.isDirty = false
 	}
-	return nil
+	return written, nil
 }
 
 func (pc *PageCache) Pin(id PageID) {
@@ -300,8 +560,43 @@ func (pc *PageCache) GetHeader() *TableHeader {
 
 func (pc *PageCache) FlushHeader() error {
 	pc.header.NumPages = uint32(pc.header.NextPageID - 1)
+	pc.header.freePages()
+	// normally the cache shares the disk manager's header; copying it onto
+	// itself would race with unlocked reads of fields that never change
+	written := pc.dm.GetHeader()
+	if written == pc.header {
+		return pc.dm.WriteHeader()
+	}
 	pc.dm.SetHeader(*pc.header)
-	return pc.dm.WriteHeader()
+	err := pc.dm.WriteHeader()
+	// pick up any free map pages the write allocated
+	pc.header.NextPageID, pc.header.NumPages = written.NextPageID, written.NumPages
+	pc.header.FreeMapPages = written.FreeMapPages
+	return err
+}
+
+// CopyTo writes the table file as it is on disk, the header page and every
+// allocated page, to w. Pages still dirty in the cache aren't included, so
+// flush first for a consistent copy. The cache lock is held only to read
+// the page count, so fetches carry on while pages are read and written out.
+func (pc *PageCache) CopyTo(w io.Writer) (int64, error) {
+	pc.mu.Lock()
+	end := pc.header.NextPageID
+	pc.mu.Unlock()
+
+	var written int64
+	for id := PageID(0); id < end; id++ {
+		page, err := pc.dm.ReadPage(id)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(page.Data[:])
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("failed to copy page %d: %w", id, err)
+		}
+	}
+	return written, nil
 }
 
 func (pc *PageCache) GetSchema() schema.Schema {
@@ -309,8 +604,13 @@ func (pc *PageCache) GetSchema() schema.Schema {
 }
 
 func (pc *PageCache) Close() error {
+	if pc.dm.readOnly {
+		// nothing was written here; a flush would put stale pages and a
+		// stale header over the writer's
+		return pc.dm.Close()
+	}
 	// flush everything to the disk first
-	if err := pc.FlushAll(); err != nil {
+	if _, err := pc.FlushAll(); err != nil {
 		return fmt.Errorf("failed to flush pages on close: %w", err)
 	}
 	return pc.dm.Close()
@@ -333,9 +633,69 @@ func (pc *PageCache) UpdateFile(file *os.File) error {
 	pc.cache = make(map[PageID]*CacheRecord, maxCacheSize)
 	pc.clockQueue = make([]PageID, maxCacheSize)
 	pc.clockHand = 0
+	pc.curBytes = 0
+	pc.grownTo = 0
 	return nil
 }
 
+// Reload rereads the header and drops every cached page, reopening the
+// table file by name in case another process renamed a new one over it (as
+// vacuum does). It fails if any page is dirty, since those writes would be
+// lost. On error the cache is left as it was.
+func (pc *PageCache) Reload() error {
+	if dirty := pc.DirtyPages(); len(dirty) > 0 {
+		return fmt.Errorf("cannot reload with %d dirty pages", len(dirty))
+	}
+	old, err := pc.dm.tableFile()
+	if err != nil {
+		return fmt.Errorf("cannot reload: %w", err)
+	}
+	flag := os.O_RDWR
+	if pc.dm.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(old.Name(), flag, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen %s: %w", old.Name(), err)
+	}
+	if err := pc.UpdateFile(f); err != nil {
+		pc.dm.SetFile(old)
+		f.Close()
+		return err
+	}
+	return old.Close()
+}
+
+func (pc *PageCache) Stats() CacheStats {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return CacheStats{
+		Size:      len(pc.cache),
+		Capacity:  pc.capacity(),
+		Bytes:     pc.curBytes,
+		MaxBytes:  pc.maxBytes,
+		Hits:      pc.hits,
+		Misses:    pc.misses,
+		Evictions: pc.evictions,
+	}
+}
+
+// Capacity is the maximum number of pages the cache holds before evicting,
+// whichever of the page count and byte budget is tighter.
+func (pc *PageCache) Capacity() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.capacity()
+}
+
+func (pc *PageCache) capacity() int {
+	if pc.maxBytes > 0 {
+		return int(max(min(pc.maxBytes/PAGE_SIZE, maxCacheSize), 1))
+	}
+	return maxCacheSize
+}
+
 func (pc *PageCache) Contains(id PageID) bool {
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
@@ -344,13 +704,35 @@ func (pc *PageCache) Contains(id PageID) bool {
 	return exists
 }
 
-func (pc *PageCache) ReplaceTreeFromPages(pages []*SlottedPage, rootID PageID) error {
-	// phase 3: write all pages to the new file and update header
-	tempFile := pc.GetSchema().TableName + ".db.tmp"
-	f, err := os.Create(tempFile)
+// SetTempDir sets where ReplaceTreeFromPages writes its temporary file. The
+// default, "", uses the table file's own directory. The file is renamed over
+// the table, so dir must be on the same filesystem.
+func (pc *PageCache) SetTempDir(dir string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.tempDir = dir
+}
+
+func (pc *PageCache) ReplaceTreeFromPages(pages []*SlottedPage, rootID PageID) (err error) {
+	// phase 3: write all pages to a temp file and swap it in for the table file
+	table, err := pc.dm.tableFile()
+	if err != nil {
+		return fmt.Errorf("cannot replace tree: %w", err)
+	}
+	origFile := table.Name()
+	pc.mu.Lock()
+	tempDir := pc.tempDir
+	pc.mu.Unlock()
+	if tempDir == "" {
+		tempDir = filepath.Dir(origFile)
+	}
+
+	// unique name, so concurrent vacuums of same-named tables can't collide
+	f, err := os.CreateTemp(tempDir, filepath.Base(origFile)+".*.tmp")
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
+	tempFile := f.Name()
 
 	// Cleanup temp file on error
 	defer func() {
@@ -362,38 +744,44 @@ func (pc *PageCache) ReplaceTreeFromPages(pages []*SlottedPage, rootID PageID) e
 
 	tempDM := NewDiskManager(f)
 
-	// create header pointing to root
-	freshHeader := DefaultTableHeader(pc.GetSchema())
+	// create header pointing to root, carrying over table identity and options
+	freshHeader := *pc.header
+	freshHeader.FreePageIDs = nil
+	freshHeader.FreeMapPages = nil
+	freshHeader.free = nil
 	freshHeader.RootPageID = rootID
 	freshHeader.NextPageID = PageID(len(pages) + 1)
 	freshHeader.NumPages = uint32(len(pages))
 	tempDM.SetHeader(freshHeader)
-	if err := tempDM.WriteHeader(); err != nil {
+	if err = tempDM.WriteHeader(); err != nil {
 		return fmt.Errorf("failed to write temp header: %w", err)
 	}
 
 	// write all pages
 	for _, page := range pages {
-		if err := tempDM.WriteSlottedPage(page); err != nil {
+		if err = tempDM.WriteSlottedPage(page); err != nil {
 			return fmt.Errorf("failed to write page %d to temp file: %w", page.PageID, err)
 		}
 	}
 
 	// sync and close temp file
-	if err := f.Sync(); err != nil {
+	if err = f.Sync(); err != nil {
 		return fmt.Errorf("failed to fsync temp file: %w", err)
 	}
-	if err := f.Close(); err != nil {
+	if err = f.Close(); err != nil {
 		return fmt.Errorf("failed to close temp file: %w", err)
 	}
 
 	// close old file, rename, reopen
-	if err := pc.Close(); err != nil {
+	if err = pc.Close(); err != nil {
 		return fmt.Errorf("failed to close old file before rename: %w", err)
 	}
 
-	origFile := pc.GetSchema().TableName + ".db"
-	if err := os.Rename(tempFile, origFile); err != nil {
+	if err = os.Rename(tempFile, origFile); err != nil {
+		// everything was flushed by Close, so carry on with the old file
+		if old, openErr := os.OpenFile(origFile, os.O_RDWR, 0644); openErr == nil {
+			pc.UpdateFile(old)
+		}
 		return fmt.Errorf("failed to rename temp file to original file: %w", err)
 	}
 
@@ -1,10 +1,13 @@
 package pager
 
 import (
+	"errors"
 	"godb/internal/schema"
 	"os"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Test helpers
@@ -261,6 +264,46 @@ func TestAllocatePageIncrementsNextPageID(t *testing.T) {
 	}
 }
 
+func TestAllocatePageGrowsFileInChunks(t *testing.T) {
+	pc, dm, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	before, err := dm.PagesOnDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := pc.AllocatePage()
+	grown, err := dm.PagesOnDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := first + DefaultGrowChunk; grown != want {
+		t.Fatalf("Expected file to span %d pages after first allocation, got %d (was %d)", want, grown, before)
+	}
+
+	// the rest of the chunk needs no further growth
+	for pc.header.NextPageID < grown {
+		pc.AllocatePage()
+	}
+	if n, _ := dm.PagesOnDisk(); n != grown {
+		t.Errorf("Expected file to stay at %d pages within the chunk, got %d", grown, n)
+	}
+
+	pc.AllocatePage()
+	if n, _ := dm.PagesOnDisk(); n != grown+DefaultGrowChunk {
+		t.Errorf("Expected file to grow to %d pages past the chunk, got %d", grown+DefaultGrowChunk, n)
+	}
+
+	pc.SetGrowChunk(0)
+	for pc.header.NextPageID < grown+DefaultGrowChunk+1 {
+		pc.AllocatePage()
+	}
+	if n, _ := dm.PagesOnDisk(); n != grown+DefaultGrowChunk {
+		t.Errorf("Expected no growth with pre-growing off, file spans %d pages", n)
+	}
+}
+
 func TestFreePageReuse(t *testing.T) {
 	pc, _, filename := createTestPageCache(t)
 	defer cleanupTestFile(filename)
@@ -278,8 +321,79 @@ func TestFreePageReuse(t *testing.T) {
 	}
 
 	// Free list should be empty now
-	if len(pc.header.FreePageIDs) != 0 {
-		t.Errorf("Expected empty free list, got %d pages", len(pc.header.FreePageIDs))
+	if free := pc.header.FreePages(); len(free) != 0 {
+		t.Errorf("Expected empty free list, got %d pages", len(free))
+	}
+}
+
+func TestLongFreeListSurvivesHeaderRoundTrip(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	// far more free ids than the header page holds
+	const n = 5000
+	ids := make([]PageID, n)
+	for i := range ids {
+		ids[i] = pc.AllocatePage()
+	}
+	for _, id := range ids {
+		pc.FreePage(id)
+	}
+	// a page still in use, past the freed ones
+	pc.AllocatePage()
+
+	for _, check := range []string{"spilled", "after reuse"} {
+		if err := pc.FlushHeader(); err != nil {
+			t.Fatalf("%s: FlushHeader failed: %v", check, err)
+		}
+		th, err := ReadTableHeader(filename)
+		if err != nil {
+			t.Fatalf("%s: ReadTableHeader failed: %v", check, err)
+		}
+		if got, want := th.FreePages(), pc.header.FreePages(); !slices.Equal(got, want) {
+			t.Fatalf("%s: read back %d free pages, want %d", check, len(got), len(want))
+		}
+		// hand out most of the list, so the chain shrinks
+		for range n - 100 {
+			pc.AllocatePage()
+		}
+	}
+}
+
+func TestLegacyFreeListMovesToFreeMap(t *testing.T) {
+	pc, dm, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	// a header as written before the free map, listing free pages inline
+	legacy := *pc.header
+	legacy.FreePageIDs = []PageID{7, 3, 5}
+	dm.SetHeader(legacy)
+	if err := dm.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dm.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	th := dm.GetHeader()
+	if len(th.FreePageIDs) != 0 || !slices.Equal(th.FreePages(), []PageID{3, 5, 7}) {
+		t.Fatalf("Expected pages 3, 5, 7 moved to the map, got list %v, map %v", th.FreePageIDs, th.FreePages())
+	}
+
+	// the next write saves the map and empties the list
+	pc = NewPageCache(dm, th)
+	if id := pc.AllocatePage(); id != 3 {
+		t.Errorf("Expected the lowest free page 3, got %d", id)
+	}
+	if err := pc.FlushHeader(); err != nil {
+		t.Fatal(err)
+	}
+	reread, err := ReadTableHeader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reread.FreePages(), []PageID{5, 7}) || len(reread.FreeMapPages) != 1 {
+		t.Errorf("Expected pages 5 and 7 on one map page, got %v on %v", reread.FreePages(), reread.FreeMapPages)
 	}
 }
 
@@ -452,6 +566,165 @@ func TestAllPagesPinnedEvictionFails(t *testing.T) {
 	}
 }
 
+func TestPinnedPolicyRetriesUntilUnpinned(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+	pc.SetPinnedPolicy(PinnedPolicy{Retries: 5, Backoff: 10 * time.Millisecond})
+
+	fillCache(t, pc, maxCacheSize)
+	go func() {
+		time.Sleep(15 * time.Millisecond)
+		pc.UnPin(1)
+	}()
+
+	if _, err := pc.Fetch(PageID(maxCacheSize + 1)); err != nil {
+		t.Fatalf("Expected the fetch to wait for an unpin, got %v", err)
+	}
+	if pc.Contains(1) {
+		t.Error("Expected the unpinned page to be evicted")
+	}
+}
+
+func TestPinnedPolicyRereadsAPageChangedWhileWaiting(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+	pc.SetPinnedPolicy(PinnedPolicy{Retries: 2, Backoff: 200 * time.Millisecond})
+
+	fillCache(t, pc, maxCacheSize)
+	target := PageID(maxCacheSize + 1)
+	done := make(chan *SlottedPage, 1)
+	go func() {
+		sp, err := pc.Fetch(target)
+		if err != nil {
+			t.Errorf("waiting fetch failed: %v", err)
+		}
+		done <- sp
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// while that fetch waits, another caches the page, changes it and has
+	// it evicted back to disk
+	pc.UnPin(1)
+	sp, err := pc.Fetch(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.NextLeaf = 42
+	pc.mu.Lock()
+	pc.MakeDirty(target)
+	pc.mu.Unlock()
+	pc.UnPin(target)
+	if _, err := pc.Fetch(target + 1); err != nil {
+		t.Fatal(err)
+	}
+	if pc.Contains(target) {
+		t.Fatal("Expected the changed page to be evicted")
+	}
+	pc.UnPin(target + 1)
+
+	if sp := <-done; sp != nil && sp.NextLeaf != 42 {
+		t.Errorf("Expected the waiting fetch to see the change, got NextLeaf %d", sp.NextLeaf)
+	}
+}
+
+func TestPinnedPolicyCachesANewPageAsBuilt(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+	pc.SetPinnedPolicy(PinnedPolicy{Retries: 3, Backoff: 20 * time.Millisecond})
+
+	fillCache(t, pc, maxCacheSize)
+	// never written to the file, so rereading it from disk would fail
+	pageID := pc.AllocatePage()
+	sp := NewSlottedPage(pageID, LEAF)
+	sp.NextLeaf = 42
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		pc.UnPin(1)
+	}()
+
+	if err := pc.AddNewPage(sp); err != nil {
+		t.Fatalf("AddNewPage under a retry policy failed: %v", err)
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	cr, exists := pc.cache[pageID]
+	if !exists {
+		t.Fatal("Expected the new page to be cached")
+	}
+	if cr.data != sp {
+		t.Error("Expected the cache to hold the caller's page, not a copy")
+	}
+	if !cr.isDirty || cr.pinCount != 1 {
+		t.Errorf("Expected the new page dirty and pinned once, got dirty %v, pins %d", cr.isDirty, cr.pinCount)
+	}
+}
+
+func TestPinnedPolicyOverflowsThenShrinks(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	fillCache(t, pc, maxCacheSize)
+	if _, err := pc.Fetch(PageID(maxCacheSize + 1)); !errors.Is(err, ErrAllPinned) {
+		t.Fatalf("Expected ErrAllPinned by default, got %v", err)
+	}
+
+	pc.SetPinnedPolicy(PinnedPolicy{Retries: 1, Overflow: true})
+	if _, err := pc.Fetch(PageID(maxCacheSize + 1)); err != nil {
+		t.Fatalf("Expected the fetch to overflow, got %v", err)
+	}
+	if size := pc.Stats().Size; size != maxCacheSize+1 {
+		t.Fatalf("Expected %d cached pages, got %d", maxCacheSize+1, size)
+	}
+
+	// once pages come free, the next miss evicts back down to capacity
+	for i := 1; i <= maxCacheSize+1; i++ {
+		pc.UnPin(PageID(i))
+	}
+	if _, err := pc.Fetch(PageID(maxCacheSize + 2)); err != nil {
+		t.Fatal(err)
+	}
+	pc.UnPin(PageID(maxCacheSize + 2))
+	if size := pc.Stats().Size; size != maxCacheSize {
+		t.Errorf("Expected the cache back at %d pages, got %d", maxCacheSize, size)
+	}
+	if len(pc.clockQueue) != maxCacheSize {
+		t.Errorf("Expected %d clock slots, got %d", maxCacheSize, len(pc.clockQueue))
+	}
+}
+
+func TestMaxBytesEvictsByBudget(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+	pc.SetMaxBytes(10 * PAGE_SIZE)
+
+	for i := 1; i <= 20; i++ {
+		if _, err := pc.Fetch(PageID(i)); err != nil {
+			t.Fatalf("Fetch(%d) failed: %v", i, err)
+		}
+		pc.UnPin(PageID(i))
+	}
+	stats := pc.Stats()
+	if stats.Size != 10 || stats.Bytes != 10*PAGE_SIZE {
+		t.Errorf("Expected 10 pages and %d bytes cached, got %d and %d", 10*PAGE_SIZE, stats.Size, stats.Bytes)
+	}
+	if stats.Capacity != 10 || stats.Evictions != 10 {
+		t.Errorf("Expected capacity 10 and 10 evictions, got %d and %d", stats.Capacity, stats.Evictions)
+	}
+
+	// with the budget full of pinned pages there's nothing to evict
+	for i := 11; i <= 20; i++ {
+		pc.Fetch(PageID(i))
+	}
+	if _, err := pc.Fetch(PageID(21)); !errors.Is(err, ErrAllPinned) {
+		t.Errorf("Expected ErrAllPinned over budget, got %v", err)
+	}
+
+	pc.FreePage(20)
+	if bytes := pc.Stats().Bytes; bytes != 9*PAGE_SIZE {
+		t.Errorf("Expected freeing a page to release its bytes, got %d", bytes)
+	}
+}
+
 // Test correct pattern: unpin immediately in loop
 func TestCorrectUnpinInLoop(t *testing.T) {
 	pc, _, filename := createTestPageCache(t)
@@ -506,3 +779,169 @@ func TestBulkFetchesWithImmediateUnpin(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchReadErrorLeavesNoPhantomEntry(t *testing.T) {
+	pc, dm, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	// corrupt page 5 on disk so its checksum fails
+	page := createTestPage(5, LEAF).Serialize()
+	page.Data[20] ^= 0xFF
+	if err := dm.WritePage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	handBefore := pc.clockHand
+	for _, id := range []PageID{5, PageID(maxCacheSize + 100)} {
+		if _, err := pc.Fetch(id); err == nil {
+			t.Fatalf("Expected Fetch(%d) to fail", id)
+		}
+		if pc.Contains(id) {
+			t.Errorf("Page %d cached after failed read", id)
+		}
+		for i, qid := range pc.clockQueue {
+			if qid == id {
+				t.Errorf("Phantom clock queue entry for page %d at slot %d", id, i)
+			}
+		}
+	}
+	if pc.clockHand != handBefore {
+		t.Errorf("Clock hand moved on failed reads: %d -> %d", handBefore, pc.clockHand)
+	}
+
+	// cache still works afterwards
+	if _, err := pc.Fetch(1); err != nil {
+		t.Fatalf("Fetch after failed reads: %v", err)
+	}
+}
+
+func TestFlushPageWritesOnlyThatPage(t *testing.T) {
+	pc, dm, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	for _, id := range []PageID{1, 2} {
+		sp, err := pc.Fetch(id)
+		if err != nil {
+			t.Fatalf("Failed to fetch page %d: %v", id, err)
+		}
+		record := make([]byte, 16)
+		record[0] = byte(id + 100) // sorts after the page's existing key
+		if _, err := sp.InsertRecord(record); err != nil {
+			t.Fatalf("InsertRecord failed: %v", err)
+		}
+		pc.MakeDirty(id)
+	}
+
+	if err := pc.FlushPage(1); err != nil {
+		t.Fatalf("FlushPage failed: %v", err)
+	}
+	if dirty := pc.DirtyPages(); len(dirty) != 1 || dirty[0] != 2 {
+		t.Errorf("Expected only page 2 to stay dirty, got %v", dirty)
+	}
+
+	onDisk, err := dm.ReadSlottedPage(1)
+	if err != nil {
+		t.Fatalf("ReadSlottedPage failed: %v", err)
+	}
+	if onDisk.NumSlots != 2 {
+		t.Errorf("Expected flushed page 1 on disk with 2 records, got %d", onDisk.NumSlots)
+	}
+	onDisk, err = dm.ReadSlottedPage(2)
+	if err != nil {
+		t.Fatalf("ReadSlottedPage failed: %v", err)
+	}
+	if onDisk.NumSlots != 1 {
+		t.Errorf("Expected page 2 untouched on disk, got %d records", onDisk.NumSlots)
+	}
+
+	// uncached or clean pages are a no-op
+	if err := pc.FlushPage(1); err != nil {
+		t.Errorf("FlushPage on a clean page failed: %v", err)
+	}
+	if err := pc.FlushPage(200); err != nil {
+		t.Errorf("FlushPage on an uncached page failed: %v", err)
+	}
+}
+
+func TestCacheStatsCountsHitsMissesEvictions(t *testing.T) {
+	pc, _, filename := createTestPageCache(t)
+	defer cleanupTestFile(filename)
+
+	// fill the cache with misses, then hit every page once
+	for i := 1; i <= maxCacheSize; i++ {
+		pc.Fetch(PageID(i))
+		pc.UnPin(PageID(i))
+	}
+	for i := 1; i <= maxCacheSize; i++ {
+		pc.Fetch(PageID(i))
+		pc.UnPin(PageID(i))
+	}
+	// one more page forces an eviction
+	pc.Fetch(PageID(maxCacheSize + 1))
+
+	stats := pc.Stats()
+	if stats.Misses != maxCacheSize+1 {
+		t.Errorf("Expected %d misses, got %d", maxCacheSize+1, stats.Misses)
+	}
+	if stats.Hits != maxCacheSize {
+		t.Errorf("Expected %d hits, got %d", maxCacheSize, stats.Hits)
+	}
+	if stats.Evictions != 1 {
+		t.Errorf("Expected 1 eviction, got %d", stats.Evictions)
+	}
+	if stats.Size != maxCacheSize || stats.Capacity != maxCacheSize {
+		t.Errorf("Expected a full cache of %d, got %d/%d", maxCacheSize, stats.Size, stats.Capacity)
+	}
+	if ratio := stats.HitRatio(); ratio < 0.49 || ratio > 0.5 {
+		t.Errorf("Expected hit ratio just under 0.5, got %f", ratio)
+	}
+}
+
+// syncCounter is a file that counts its fsyncs.
+type syncCounter struct {
+	*os.File
+	syncs int
+}
+
+func (sc *syncCounter) Sync() error {
+	sc.syncs++
+	return sc.File.Sync()
+}
+
+func TestSyncCanBeTurnedOff(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "test_sync_*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &syncCounter{File: f}
+	dm := NewDiskManager(sc)
+	dm.SetHeader(createTestHeader())
+	pc := NewPageCache(&dm, dm.GetHeader())
+	defer pc.Close()
+
+	if err := dm.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.syncs == 0 {
+		t.Fatal("expected WriteHeader to fsync by default")
+	}
+
+	pc.SetSyncEnabled(false)
+	before := sc.syncs
+	if err := pc.AddNewPage(createTestPage(1, LEAF)); err != nil {
+		t.Fatal(err)
+	}
+	pc.UnPin(1)
+	if _, err := pc.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.syncs != before {
+		t.Errorf("fsynced %d times with sync off", sc.syncs-before)
+	}
+	if _, err := dm.ReadSlottedPage(1); err != nil {
+		t.Errorf("page not written with sync off: %v", err)
+	}
+}
@@ -1,7 +1,11 @@
 package pager
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"godb/internal/schema"
+	"math"
 	"os"
 	"testing"
 )
@@ -386,6 +390,47 @@ func TestSortedInsert(t *testing.T) {
 	t.Logf("Keys in insertion order: %v", keys)
 }
 
+func TestSortedInsertByOrdersDuplicateKeys(t *testing.T) {
+	// index-style entries: [value key:8][primary key:8], many per value key
+	entry := func(key, pk uint64) []byte {
+		data := make([]byte, 16)
+		binary.LittleEndian.PutUint64(data[:8], key)
+		binary.BigEndian.PutUint64(data[8:], pk) // big-endian so bytes order like numbers
+		return data
+	}
+	cmp := func(a, b []byte) int { return bytes.Compare(a[8:], b[8:]) }
+
+	page := NewSlottedPage(1, LEAF)
+	inserts := [][2]uint64{{7, 30}, {5, 1}, {7, 10}, {9, 2}, {7, 20}, {7, 10}, {5, 0}}
+	for _, in := range inserts {
+		if _, err := page.InsertRecordSortedBy(entry(in[0], in[1]), cmp); err != nil {
+			t.Fatalf("InsertRecordSortedBy(%v) failed: %v", in, err)
+		}
+	}
+
+	want := [][2]uint64{{5, 0}, {5, 1}, {7, 10}, {7, 10}, {7, 20}, {7, 30}, {9, 2}}
+	for i, w := range want {
+		rec := page.Records[i]
+		got := [2]uint64{binary.LittleEndian.Uint64(rec[:8]), binary.BigEndian.Uint64(rec[8:])}
+		if got != w {
+			t.Errorf("slot %d: expected %v, got %v", i, w, got)
+		}
+	}
+
+	if i, found := page.SearchBy(entry(7, 20), cmp); !found || i != 4 {
+		t.Errorf("SearchBy(7, 20) = %d, %v; expected 4, true", i, found)
+	}
+	if i, found := page.SearchBy(entry(5, 1), cmp); !found || i != 1 {
+		t.Errorf("SearchBy(5, 1) = %d, %v; expected 1, true", i, found)
+	}
+	if _, found := page.SearchBy(entry(7, 15), cmp); found {
+		t.Error("SearchBy found an entry that was never inserted")
+	}
+	if _, found := page.SearchBy(entry(8, 10), cmp); found {
+		t.Error("SearchBy found a key that isn't on the page")
+	}
+}
+
 func TestLeafSplit(t *testing.T) {
 	sch := schema.Schema{
 		TableName: "test",
@@ -516,6 +561,30 @@ func TestInternalSplit(t *testing.T) {
 	}
 }
 
+func TestSearchInternalRoutesSeparatorToNextChild(t *testing.T) {
+	// [10, 1] [20, 2] [30, 3] rightmost 4: a separator is the first key of
+	// the child after it, so 10 belongs to 2, not 1
+	page := NewSlottedPage(1, INTERNAL)
+	page.RightmostChild = PageID(4)
+	for i, key := range []uint64{10, 20, 30} {
+		if _, err := page.InsertRecordSorted(SerializeInternalRecord(key, PageID(i+1))); err != nil {
+			t.Fatalf("InsertRecord failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		key  uint64
+		want PageID
+	}{
+		{0, 1}, {9, 1}, {10, 2}, {19, 2}, {20, 3}, {29, 3}, {30, 4}, {1000, 4},
+	}
+	for _, tt := range tests {
+		if got, _ := page.SearchInternal(tt.key); got != tt.want {
+			t.Errorf("SearchInternal(%d) = page %d, want %d", tt.key, got, tt.want)
+		}
+	}
+}
+
 func TestFragmentedMerge(t *testing.T) {
 	sch := schema.Schema{
 		TableName: "test",
@@ -596,3 +665,91 @@ func TestFragmentedMerge(t *testing.T) {
 		}
 	}
 }
+
+func TestShortRecordGuards(t *testing.T) {
+	page := NewSlottedPage(1, LEAF)
+
+	if _, err := page.InsertRecord([]byte{1, 2, 3}); !errors.Is(err, ErrShortRecord) {
+		t.Errorf("InsertRecord: expected ErrShortRecord, got %v", err)
+	}
+	if _, err := page.InsertRecordSorted(nil); !errors.Is(err, ErrShortRecord) {
+		t.Errorf("InsertRecordSorted: expected ErrShortRecord, got %v", err)
+	}
+	if page.NumSlots != 0 {
+		t.Fatalf("Expected no slots after rejected inserts, got %d", page.NumSlots)
+	}
+
+	// simulate a corrupt slot that bypassed the insert guards
+	page.Slots = append(page.Slots, Slot{Offset: PAGE_SIZE - 8, Length: 4})
+	page.Records = append(page.Records, []byte{9, 9, 9, 9})
+	page.NumSlots++
+
+	if key := page.GetKey(0); key != 0 {
+		t.Errorf("GetKey on short record: expected 0, got %d", key)
+	}
+	if _, err := page.KeyAt(0); !errors.Is(err, ErrShortRecord) {
+		t.Errorf("KeyAt on short record: expected ErrShortRecord, got %v", err)
+	}
+	if _, err := page.KeyAt(5); !errors.Is(err, ErrSlotOutOfRange) {
+		t.Errorf("KeyAt out of range: expected ErrSlotOutOfRange, got %v", err)
+	}
+}
+
+func TestCompactKeepsChecksumTrailerClear(t *testing.T) {
+	page := NewSlottedPage(1, LEAF)
+
+	// the first record sits right against the trailer after compaction
+	first := bytes.Repeat([]byte{0xAB}, 32)
+	binary.LittleEndian.PutUint64(first, 1)
+	second := bytes.Repeat([]byte{0xCD}, 32)
+	binary.LittleEndian.PutUint64(second, 2)
+	for _, rec := range [][]byte{first, second} {
+		if _, err := page.InsertRecord(rec); err != nil {
+			t.Fatalf("InsertRecord failed: %v", err)
+		}
+	}
+	if err := page.DeleteRecord(1); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	restored, err := DeserializeSlottedPage(page.Serialize())
+	if err != nil {
+		t.Fatalf("Deserialize failed: %v", err)
+	}
+	got, err := restored.GetRecord(0)
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	if !bytes.Equal(got, first) {
+		t.Errorf("record corrupted by compaction: got %v, want %v", got, first)
+	}
+}
+
+func TestInternalRecordRoundTripMaxPageID(t *testing.T) {
+	maxID := ^PageID(0)
+	data := SerializeInternalRecord(math.MaxUint64, maxID)
+	if len(data) != InternalRecordSize {
+		t.Fatalf("Expected %d byte record, got %d", InternalRecordSize, len(data))
+	}
+
+	key, child := DeserializeInternalRecord(data)
+	if key != math.MaxUint64 {
+		t.Errorf("Expected key %d, got %d", uint64(math.MaxUint64), key)
+	}
+	if child != maxID {
+		t.Errorf("Expected child %d, got %d", maxID, child)
+	}
+
+	// survives a trip through a serialized internal page as well
+	page := NewSlottedPage(1, INTERNAL)
+	if _, err := page.InsertRecordSorted(data); err != nil {
+		t.Fatalf("InsertRecordSorted failed: %v", err)
+	}
+	restored, err := DeserializeSlottedPage(page.Serialize())
+	if err != nil {
+		t.Fatalf("DeserializeSlottedPage failed: %v", err)
+	}
+	if _, got := DeserializeInternalRecord(restored.Records[0]); got != maxID {
+		t.Errorf("Expected child %d after page round trip, got %d", maxID, got)
+	}
+}
@@ -0,0 +1,82 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/logging"
+	"io"
+	"os"
+)
+
+// RetainedLog is an append-only copy of a table's INSERT and DELETE records,
+// kept across checkpoints so the table's history can be read back in write
+// order. It uses the WAL's preamble and record format, with LSNs that are
+// offsets into the log itself. The preamble's schema hash is always 0: the
+// log outlives renames, which change the hash.
+type RetainedLog struct {
+	wm *WALManager // file and identity only, there is no writer goroutine
+}
+
+func OpenRetainedLog(filename string, tableID TableID) (*RetainedLog, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wm := &WALManager{file: f, tableID: tableID, logger: logging.New("wal")}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := wm.readPreamble(io.NewSectionReader(f, 0, info.Size())); err != nil && !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &RetainedLog{wm: wm}, nil
+}
+
+// Append writes the INSERT and DELETE records among records, in order, and
+// syncs. records itself is left alone.
+func (rl *RetainedLog) Append(records []WALRecord) error {
+	kept := make([]WALRecord, 0, len(records))
+	for _, record := range records {
+		if record.Action == INSERT || record.Action == DELETE {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	if err := rl.wm.writeRecords(kept); err != nil {
+		return fmt.Errorf("retained log: %w", err)
+	}
+	return nil
+}
+
+// Records reads the whole log, oldest first.
+func (rl *RetainedLog) Records() ([]WALRecord, error) {
+	return rl.wm.Snapshot()
+}
+
+// NextLSN is the LSN the next appended record will get.
+func (rl *RetainedLog) NextLSN() (LSN, error) {
+	size, err := rl.wm.getCurrentOffset()
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return LSN(walPreambleSize), nil
+	}
+	return LSN(size), nil
+}
+
+// SetSyncEnabled turns fsync after each Append on or off; see
+// WALManager.SetSyncEnabled.
+func (rl *RetainedLog) SetSyncEnabled(on bool) {
+	rl.wm.SetSyncEnabled(on)
+}
+
+func (rl *RetainedLog) Close() error {
+	return rl.wm.file.Close()
+}
@@ -0,0 +1,91 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Storage is what a DiskManager keeps a table's pages in. *os.File is the
+// usual one; anything else that can read, write and report its size at an
+// offset works too, so a table can live in memory or behind a network
+// store. Vacuum and Reload replace the table file by name, so they need an
+// *os.File.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Close() error
+}
+
+// ErrReadOnly is returned by writes to a table opened with ReaderStorage,
+// or whose DiskManager is SetReadOnly.
+var ErrReadOnly = errors.New("table storage is read-only")
+
+// ReaderStorage serves a table of size bytes from r, e.g. a section of a
+// larger archive or an object fetched from remote storage. Reads work as
+// they do on a file; writes, including those a page cache makes to flush
+// dirty pages or the header, fail with ErrReadOnly. Close closes r if it
+// is an io.Closer.
+func ReaderStorage(r io.ReaderAt, size int64) Storage {
+	return &readerStorage{r: r, size: size}
+}
+
+type readerStorage struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (rs *readerStorage) ReadAt(p []byte, off int64) (int, error) {
+	return rs.r.ReadAt(p, off)
+}
+
+func (rs *readerStorage) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (rs *readerStorage) Truncate(size int64) error {
+	return ErrReadOnly
+}
+
+// Sync has nothing to flush.
+func (rs *readerStorage) Sync() error {
+	return nil
+}
+
+func (rs *readerStorage) Stat() (os.FileInfo, error) {
+	return readerInfo{size: rs.size}, nil
+}
+
+func (rs *readerStorage) Close() error {
+	if c, ok := rs.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type readerInfo struct {
+	size int64
+}
+
+func (ri readerInfo) Name() string       { return "" }
+func (ri readerInfo) Size() int64        { return ri.size }
+func (ri readerInfo) Mode() fs.FileMode  { return 0444 }
+func (ri readerInfo) ModTime() time.Time { return time.Time{} }
+func (ri readerInfo) IsDir() bool        { return false }
+func (ri readerInfo) Sys() any           { return nil }
+
+// tableFile returns the storage as the table file it must be for
+// operations that reopen or replace the file by name.
+func (dm *DiskManager) tableFile() (*os.File, error) {
+	f, ok := dm.file.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("table storage is %T, not a file", dm.file)
+	}
+	return f, nil
+}
@@ -6,21 +6,50 @@ import (
 	"errors"
 	"fmt"
 	"godb/internal/encoding"
+	"godb/internal/logging"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 type WALRequest struct {
 	Records []WALRecord
+	Run     func() error // work other than an append, e.g. Compact; Records is ignored
 	Done    chan error
 }
 
 type WALManager struct {
-	file        *os.File
-	RequestChan chan WALRequest
+	file       *os.File
+	tableID    TableID
+	schemaHash atomic.Uint64
+	requests   chan WALRequest
+	stopped    chan struct{} // closed once the writer goroutine has exited
+	logger     logging.Logger
+	noSync     atomic.Bool // see SetSyncEnabled
 }
 
+// Every WAL starts with a preamble naming the table it belongs to:
+// [magic "GDWL":4][version:1][tableID:16][schemaHash:8]. It is rewritten
+// after each truncate, before the first record.
+const (
+	walMagic         = "GDWL"
+	walFormatVersion = 1
+	walPreambleSize  = 4 + 1 + 16 + 8
+)
+
+var ErrWALMismatch = errors.New("not a valid WAL for this table")
+
+// ErrWALSchemaChanged is the ErrWALMismatch for a WAL whose preamble names
+// another schema than the table's. The schema hash can only change while
+// the WAL is empty (see SetSchemaHash), so every record in a WAL was written
+// under the schema its preamble names, and replaying them under another
+// would decode their bytes with the wrong fields.
+var ErrWALSchemaChanged = errors.New("WAL was written under a different schema")
+
+var ErrWALClosed = errors.New("WAL writer shutting down")
+
 type LSN uint64
 
 type WalAction uint8
@@ -35,6 +64,25 @@ const (
 	CREATE_TABLE // not implemented yet
 )
 
+func (a WalAction) String() string {
+	switch a {
+	case INSERT:
+		return "INSERT"
+	case DELETE:
+		return "DELETE"
+	case UPDATE:
+		return "UPDATE"
+	case VACUUM:
+		return "VACUUM"
+	case CHECKPOINT:
+		return "CHECKPOINT"
+	case CREATE_TABLE:
+		return "CREATE_TABLE"
+	default:
+		return fmt.Sprintf("WalAction(%d)", uint8(a))
+	}
+}
+
 type WALRecord struct {
 	Lsn          LSN
 	Action       WalAction
@@ -45,45 +93,221 @@ type WALRecord struct {
 	NextPageID   uint32
 }
 
-func NewWalManager(filename string, ctx context.Context, wg *sync.WaitGroup) (*WALManager, error) {
-	// this has issues on ctrl-c termination
-
+// NewWalManager opens (or creates) the WAL for the table with tableID and
+// schemaHash. An existing WAL must start with a preamble for that table, or
+// opening fails with ErrWALMismatch.
+func NewWalManager(filename string, tableID TableID, schemaHash uint64, ctx context.Context, wg *sync.WaitGroup) (*WALManager, error) {
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
 
 	wm := &WALManager{
-		file:        f,
-		RequestChan: make(chan WALRequest, 100),
+		file:     f,
+		tableID:  tableID,
+		requests: make(chan WALRequest, 100),
+		stopped:  make(chan struct{}),
+		logger:   logging.New("wal"),
+	}
+	wm.schemaHash.Store(schemaHash)
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := wm.readPreamble(io.NewSectionReader(f, 0, info.Size())); err != nil && !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer close(wm.stopped)
 		for {
 			select {
 			case <-ctx.Done():
-				// context cancelled, drain remaining requets then exit
-				close(wm.RequestChan)
-				for req := range wm.RequestChan {
-					req.Done <- fmt.Errorf("WAL writer shutting down")
-				}
+				// the request channel is never closed, so late senders can't
+				// panic; they see stopped instead (see Submit)
+				wm.rejectQueued(filename)
 				return
-			case req, ok := <-wm.RequestChan:
-				if !ok {
-					return // channel closed
+			case req := <-wm.requests:
+				if req.Run != nil {
+					req.Done <- req.Run()
+				} else {
+					req.Done <- wm.writeRecords(req.Records)
 				}
-				// write all records in the request
-				err := wm.writeRecords(req.Records)
-				req.Done <- err
 			}
 		}
 	}()
 	return wm, nil
 }
 
+// SetSchemaHash changes the schema hash written in future preambles, for a
+// table whose schema changed. It fails unless the WAL is empty, e.g. just
+// after a checkpoint, and expects no appends while it runs.
+func (wm *WALManager) SetSchemaHash(hash uint64) error {
+	size, err := wm.getCurrentOffset()
+	if err != nil {
+		return fmt.Errorf("failed to get WAL offset: %w", err)
+	}
+	if size > 0 {
+		return errors.New("the schema can't change while the WAL holds records; checkpoint first")
+	}
+	wm.schemaHash.Store(hash)
+	return nil
+}
+
+// SetSyncEnabled turns fsync after each batch on or off; it is on by
+// default. Off, Submit returns once records reach the OS, so a power loss
+// can drop committed writes: only for tests and benchmarks.
+func (wm *WALManager) SetSyncEnabled(on bool) {
+	wm.noSync.Store(!on)
+}
+
+// SetLogger replaces the WAL's logger. Call it before the WAL is shared.
+func (wm *WALManager) SetLogger(l logging.Logger) {
+	wm.logger = l
+}
+
+// Submit queues records for the writer goroutine and waits until they have
+// been written and synced as one batch. Once the writer has shut down it
+// returns ErrWALClosed.
+func (wm *WALManager) Submit(records []WALRecord) error {
+	return wm.send(WALRequest{Records: records})
+}
+
+func (wm *WALManager) send(req WALRequest) error {
+	done := make(chan error, 1)
+	req.Done = done
+	select {
+	case wm.requests <- req:
+	case <-wm.stopped:
+		return ErrWALClosed
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-wm.stopped:
+		// the writer may have answered just before it stopped
+		select {
+		case err := <-done:
+			return err
+		default:
+			return ErrWALClosed
+		}
+	}
+}
+
+// Compact rewrites the WAL keeping only what CompactRecords keeps. It runs
+// on the writer goroutine, so no append lands halfway, and renames a synced
+// copy over the old file. Returns the number of records dropped.
+func (wm *WALManager) Compact() (int, error) {
+	dropped := 0
+	err := wm.send(WALRequest{Run: func() error {
+		var err error
+		dropped, err = wm.compact()
+		return err
+	}})
+	return dropped, err
+}
+
+func (wm *WALManager) compact() (int, error) {
+	records, err := wm.Snapshot()
+	if err != nil {
+		return 0, fmt.Errorf("compact: failed to read WAL: %w", err)
+	}
+	compacted := CompactRecords(records)
+	dropped := len(records) - len(compacted)
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	name := wm.file.Name()
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.compact")
+	if err != nil {
+		return 0, fmt.Errorf("compact: failed to create temp file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	old := wm.file
+	wm.file = tmp
+	err = wm.writeRecords(compacted)
+	wm.file = old
+	if err != nil {
+		return 0, fmt.Errorf("compact: %w", err)
+	}
+
+	// open the copy before the rename, so there's no window where the
+	// WAL name points at a file we can't append to
+	f, err := os.OpenFile(tmp.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("compact: failed to reopen WAL: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("compact: failed to replace WAL: %w", err)
+	}
+	old.Close()
+	wm.file = f
+	return dropped, nil
+}
+
+// CompactRecords keeps the last INSERT or DELETE for each key, in the order
+// those last operations were logged, and drops CHECKPOINT and VACUUM markers.
+// Replaying the result gives the same table as replaying records, provided
+// replay treats an INSERT as an upsert and a DELETE of a missing key as a
+// no-op. Other actions are kept as they are.
+func CompactRecords(records []WALRecord) []WALRecord {
+	last := make(map[WalKey]int)
+	for i, record := range records {
+		if record.Action == INSERT || record.Action == DELETE {
+			last[record.Key] = i
+		}
+	}
+
+	compacted := make([]WALRecord, 0, len(last))
+	for i, record := range records {
+		switch record.Action {
+		case INSERT, DELETE:
+			if last[record.Key] == i {
+				compacted = append(compacted, record)
+			}
+		case CHECKPOINT, VACUUM:
+			// markers, no table state
+		default:
+			compacted = append(compacted, record)
+		}
+	}
+	return compacted
+}
+
+func (wm *WALManager) rejectQueued(filename string) {
+	rejected := 0
+	for {
+		select {
+		case req := <-wm.requests:
+			req.Done <- ErrWALClosed
+			rejected++
+		default:
+			wm.logger.Debug("WAL writer for %s shutting down, rejected %d queued requests", filename, rejected)
+			return
+		}
+	}
+}
+
 func (wm *WALManager) writeRecords(records []WALRecord) error {
+	if err := wm.writePreambleIfEmpty(); err != nil {
+		return err
+	}
+
 	for i := range records {
 		fileOffset, err := wm.getCurrentOffset()
 		if err != nil {
@@ -101,19 +325,94 @@ func (wm *WALManager) writeRecords(records []WALRecord) error {
 			return fmt.Errorf("failed to write WAL record to disk: %w", err)
 		}
 	}
+	if wm.noSync.Load() {
+		return nil
+	}
 	return wm.file.Sync()
 }
 
+func (wm *WALManager) writePreambleIfEmpty() error {
+	size, err := wm.getCurrentOffset()
+	if err != nil {
+		return fmt.Errorf("failed to get WAL offset: %w", err)
+	}
+	if size > 0 {
+		return nil
+	}
+
+	buf := make([]byte, walPreambleSize)
+	copy(buf[0:4], walMagic)
+	buf[4] = walFormatVersion
+	copy(buf[5:21], wm.tableID[:])
+	binary.LittleEndian.PutUint64(buf[21:], wm.schemaHash.Load())
+	if _, err := wm.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write WAL preamble: %w", err)
+	}
+	return nil
+}
+
+// readPreamble positions r at the first record, validating that the WAL
+// belongs to this table. An empty WAL returns io.EOF.
+func (wm *WALManager) readPreamble(r io.ReadSeeker) error {
+	buf := make([]byte, walPreambleSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err // io.EOF for an empty WAL
+	}
+
+	if n < 4 || string(buf[0:4]) != walMagic {
+		return fmt.Errorf("%w: missing WAL header", ErrWALMismatch)
+	}
+	if n < walPreambleSize {
+		return fmt.Errorf("%w: WAL header truncated (%d of %d bytes)", ErrWALMismatch, n, walPreambleSize)
+	}
+	if buf[4] != walFormatVersion {
+		return fmt.Errorf("%w: unsupported WAL format version %d", ErrWALMismatch, buf[4])
+	}
+
+	var id TableID
+	copy(id[:], buf[5:21])
+	if id != wm.tableID {
+		return fmt.Errorf("%w: WAL table %s, header table %s", ErrWALMismatch, id, wm.tableID)
+	}
+	if hash, want := binary.LittleEndian.Uint64(buf[21:]), wm.schemaHash.Load(); hash != want {
+		return fmt.Errorf("%w: %w: WAL schema hash %016x, table schema hash %016x", ErrWALMismatch, ErrWALSchemaChanged, hash, want)
+	}
+	return nil
+}
+
 func (wm *WALManager) ReadAll() ([]WALRecord, error) {
 	_, err := wm.file.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
+	return wm.readRecords(wm.file)
+}
+
+// Snapshot reads every record currently in the WAL using positional reads,
+// so unlike ReadAll it leaves the shared file offset alone. An empty WAL
+// yields no records rather than io.EOF.
+func (wm *WALManager) Snapshot() ([]WALRecord, error) {
+	info, err := wm.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	records, err := wm.readRecords(io.NewSectionReader(wm.file, 0, info.Size()))
+	if errors.Is(err, io.EOF) {
+		return []WALRecord{}, nil
+	}
+	return records, err
+}
+
+func (wm *WALManager) readRecords(r io.ReadSeeker) ([]WALRecord, error) {
+	if err := wm.readPreamble(r); err != nil {
+		return nil, err
+	}
 
 	records := []WALRecord{}
 
 	for {
-		record, err := wm.Deserialize()
+		record, err := deserializeRecord(r)
 		if err != nil {
 			// Check if it's EOF (wrapped or unwrapped)
 			if errors.Is(err, io.EOF) {
@@ -144,12 +443,16 @@ func (wr *WALRecord) Serialize() ([]byte, error) {
 }
 
 func (wm *WALManager) Deserialize() (*WALRecord, error) {
-	lsn, err := encoding.ReadInt64(wm.file)
+	return deserializeRecord(wm.file)
+}
+
+func deserializeRecord(r io.Reader) (*WALRecord, error) {
+	lsn, err := encoding.ReadInt64(r)
 	if err != nil {
 		return nil, err
 	}
 	actionBytes := make([]byte, 1)
-	_, err = wm.file.Read(actionBytes)
+	_, err = io.ReadFull(r, actionBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -157,15 +460,15 @@ func (wm *WALManager) Deserialize() (*WALRecord, error) {
 
 	switch action {
 	case INSERT:
-		return DeserializeInsert(wm.file, lsn, action)
+		return DeserializeInsert(r, lsn, action)
 	case DELETE:
-		return DeserializeDelete(wm.file, lsn, action)
+		return DeserializeDelete(r, lsn, action)
 	case UPDATE:
-		return DeserializeUpdate(wm.file, lsn, action)
+		return DeserializeUpdate(r, lsn, action)
 	case VACUUM:
-		return DeserializeVacuum(wm.file, lsn, action)
+		return DeserializeVacuum(r, lsn, action)
 	case CHECKPOINT:
-		return DeserializeCheckpoint(wm.file, lsn, action)
+		return DeserializeCheckpoint(r, lsn, action)
 	default:
 		return nil, fmt.Errorf("record type unsupported: %d", action)
 	}
@@ -325,14 +628,7 @@ func (w *WALManager) LogInsert(key uint64, record []byte) error {
 		RecordBytes:  record,
 	}
 
-	done := make(chan error, 1)
-
-	w.RequestChan <- WALRequest{
-		Records: []WALRecord{wr},
-		Done:    done,
-	}
-	// block until writer responds
-	return <-done
+	return w.Submit([]WALRecord{wr})
 }
 
 func (w *WALManager) LogDelete(key uint64) error {
@@ -343,13 +639,7 @@ func (w *WALManager) LogDelete(key uint64) error {
 		Key:    WalKey(key),
 	}
 
-	done := make(chan error, 1)
-
-	w.RequestChan <- WALRequest{
-		Records: []WALRecord{wr},
-		Done:    done,
-	}
-	return <-done
+	return w.Submit([]WALRecord{wr})
 }
 
 func (w *WALManager) LogUpdate(key uint64, record []byte) error {
@@ -362,31 +652,24 @@ func (w *WALManager) LogUpdate(key uint64, record []byte) error {
 		RecordBytes:  record,
 	}
 
-	done := make(chan error, 1)
-
-	w.RequestChan <- WALRequest{
-		Records: []WALRecord{wr},
-		Done:    done,
-	}
-	return <-done
+	return w.Submit([]WALRecord{wr})
 }
 
-func (w *WALManager) LogCheckpoint(rootPageID, nextPageID uint32) error {
+// LogCheckpoint writes a CHECKPOINT marker and returns the LSN it was written at.
+func (w *WALManager) LogCheckpoint(rootPageID, nextPageID uint32) (LSN, error) {
 
-	wr := WALRecord{
+	records := []WALRecord{{
 		//lsn:          LSN(fileOffset), <-- handle this only on flushes
 		Action:     CHECKPOINT,
 		RootPageID: rootPageID,
 		NextPageID: nextPageID,
-	}
-
-	done := make(chan error, 1)
+	}}
 
-	w.RequestChan <- WALRequest{
-		Records: []WALRecord{wr},
-		Done:    done,
+	// the writer fills in Lsn on the submitted slice
+	if err := w.Submit(records); err != nil {
+		return 0, err
 	}
-	return <-done
+	return records[0].Lsn, nil
 }
 
 func (w *WALManager) LogVacuum(rootPageID, nextPageID uint32) error {
@@ -398,13 +681,7 @@ func (w *WALManager) LogVacuum(rootPageID, nextPageID uint32) error {
 		NextPageID: nextPageID,
 	}
 
-	done := make(chan error, 1)
-
-	w.RequestChan <- WALRequest{
-		Records: []WALRecord{wr},
-		Done:    done,
-	}
-	return <-done
+	return w.Submit([]WALRecord{wr})
 }
 
 func (w *WALManager) getCurrentOffset() (uint64, error) {
@@ -415,6 +692,64 @@ func (w *WALManager) getCurrentOffset() (uint64, error) {
 	return uint64(info.Size()), nil
 }
 
+// Size is the current WAL file size in bytes, preamble included.
+func (w *WALManager) Size() (int64, error) {
+	size, err := w.getCurrentOffset()
+	return int64(size), err
+}
+
+// HasPendingRecords reports whether the WAL holds records not yet checkpointed.
+func (w *WALManager) HasPendingRecords() (bool, error) {
+	size, err := w.getCurrentOffset()
+	if err != nil {
+		return false, err
+	}
+	return size > walPreambleSize, nil
+}
+
 func (w *WALManager) Truncate() error {
 	return w.file.Truncate(0)
 }
+
+// Archive copies the WAL, preamble included, to a new file at path and
+// syncs it, so a following Truncate doesn't lose the records. Like
+// Truncate, it expects no appends while it runs.
+func (w *WALManager) Archive(path string) error {
+	size, err := w.getCurrentOffset()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(w.file, 0, int64(size))); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to copy WAL to %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// ReadArchivedWAL reads the records of a WAL copied by Archive. Like the
+// live WAL, it must belong to the table with tableID and schemaHash.
+func ReadArchivedWAL(filename string, tableID TableID, schemaHash uint64) ([]WALRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wm := &WALManager{file: f, tableID: tableID, logger: logging.New("wal")}
+	wm.schemaHash.Store(schemaHash)
+	records, err := wm.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return records, nil
+}
@@ -2,7 +2,12 @@ package pager
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"godb/internal/encoding"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -213,3 +218,131 @@ func TestSerializeDeserializeVacuum(t *testing.T) {
 		t.Errorf("nextPageID mismatch: got %d, want %d", result.NextPageID, original.NextPageID)
 	}
 }
+
+const testSchemaHash = 0x5eed
+
+func createTestWAL(t *testing.T, filename string, id TableID) (*WALManager, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wm, err := NewWalManager(filename, id, testSchemaHash, ctx, &wg)
+	if err != nil {
+		t.Fatalf("NewWalManager failed: %v", err)
+	}
+	return wm, func() {
+		cancel()
+		wg.Wait()
+		wm.file.Close()
+	}
+}
+
+func TestWALRejectsForeignTable(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ident.wal")
+
+	owner := NewTableID()
+	wm, stop := createTestWAL(t, filename, owner)
+	if err := wm.LogInsert(7, []byte("payload!")); err != nil {
+		t.Fatalf("LogInsert failed: %v", err)
+	}
+	records, err := wm.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll by owner failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Key != 7 {
+		t.Fatalf("expected 1 record with key 7, got %+v", records)
+	}
+	stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	if _, err := NewWalManager(filename, NewTableID(), testSchemaHash, ctx, &wg); !errors.Is(err, ErrWALMismatch) {
+		t.Errorf("expected ErrWALMismatch for another table's WAL, got %v", err)
+	}
+	if _, err := NewWalManager(filename, owner, testSchemaHash+1, ctx, &wg); !errors.Is(err, ErrWALMismatch) {
+		t.Errorf("expected ErrWALMismatch for a different schema hash, got %v", err)
+	}
+}
+
+func TestWALRejectsFileWithoutHeader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "legacy.wal")
+
+	wr := &WALRecord{Action: DELETE, Key: WalKey(3)}
+	data, _ := wr.Serialize()
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	_, err := NewWalManager(filename, NewTableID(), testSchemaHash, ctx, &wg)
+	if !errors.Is(err, ErrWALMismatch) {
+		t.Fatalf("expected ErrWALMismatch for a WAL without a header, got %v", err)
+	}
+}
+
+func TestWALCompactKeepsLastOpPerKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.wal")
+
+	wm, stop := createTestWAL(t, filename, NewTableID())
+	defer stop()
+	// key 1: insert, delete, insert; key 2: insert, delete; key 3: insert
+	steps := []func() error{
+		func() error { return wm.LogInsert(1, []byte("one-v1..")) },
+		func() error { return wm.LogInsert(2, []byte("two-v1..")) },
+		func() error { return wm.LogDelete(1) },
+		func() error { _, err := wm.LogCheckpoint(1, 2); return err },
+		func() error { return wm.LogInsert(3, []byte("three...")) },
+		func() error { return wm.LogInsert(1, []byte("one-v2..")) },
+		func() error { return wm.LogDelete(2) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dropped, err := wm.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if dropped != 4 {
+		t.Errorf("expected 4 records dropped, got %d", dropped)
+	}
+
+	records, err := wm.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll after compact failed: %v", err)
+	}
+	want := []struct {
+		action WalAction
+		key    WalKey
+		body   string
+	}{
+		{INSERT, 3, "three..."},
+		{INSERT, 1, "one-v2.."},
+		{DELETE, 2, ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %+v", len(want), records)
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Action != w.action || r.Key != w.key || string(r.RecordBytes) != w.body {
+			t.Errorf("record %d: expected %v %d %q, got %v %d %q", i, w.action, w.key, w.body, r.Action, r.Key, r.RecordBytes)
+		}
+	}
+
+	// appends after the swap land in the compacted file
+	if err := wm.LogInsert(4, []byte("four....")); err != nil {
+		t.Fatalf("LogInsert after compact failed: %v", err)
+	}
+	records, err = wm.ReadAll()
+	if err != nil || len(records) != 4 || records[3].Key != 4 {
+		t.Fatalf("expected the new record after the compacted ones, got %+v (err=%v)", records, err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(filename), "*.compact"))
+	if len(leftovers) > 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
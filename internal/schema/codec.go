@@ -0,0 +1,191 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Codec converts a Record to and from the bytes stored in a leaf slot.
+// Every codec must write the primary key as an 8-byte little-endian prefix
+// so the pager can order records without decoding the body.
+type Codec interface {
+	Encode(s Schema, rec Record) ([]byte, error)
+	Decode(s Schema, data []byte) (uint64, Record, error)
+}
+
+type CodecType uint8
+
+const (
+	BinaryCodecType CodecType = iota
+	JSONCodecType
+)
+
+func ParseCodecType(s string) (CodecType, error) {
+	switch s {
+	case "binary":
+		return BinaryCodecType, nil
+	case "json":
+		return JSONCodecType, nil
+	default:
+		return 0, fmt.Errorf("unknown codec: %s", s)
+	}
+}
+
+func (ct CodecType) String() string {
+	switch ct {
+	case BinaryCodecType:
+		return "binary"
+	case JSONCodecType:
+		return "json"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(ct))
+	}
+}
+
+func CodecFor(ct CodecType) (Codec, error) {
+	switch ct {
+	case BinaryCodecType:
+		return BinaryCodec{}, nil
+	case JSONCodecType:
+		return JSONCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec: %v", ct)
+	}
+}
+
+// WithoutKeyColumn returns a variant of c that leaves the key column out of
+// the record body and rebuilds it from the 8-byte key prefix on decode.
+func WithoutKeyColumn(c Codec) (Codec, error) {
+	switch c.(type) {
+	case BinaryCodec:
+		return BinaryCodec{OmitKey: true}, nil
+	case JSONCodec:
+		return JSONCodec{OmitKey: true}, nil
+	default:
+		return nil, fmt.Errorf("codec %T cannot omit the key column", c)
+	}
+}
+
+// BinaryCodec is the original fixed-layout record format.
+type BinaryCodec struct {
+	OmitKey bool // key column lives only in the 8-byte prefix
+}
+
+func (c BinaryCodec) Encode(s Schema, rec Record) ([]byte, error) {
+	return s.serializeRecord(rec, c.OmitKey)
+}
+
+func (c BinaryCodec) Decode(s Schema, data []byte) (uint64, Record, error) {
+	return s.deserializeRecord(data, c.OmitKey)
+}
+
+// JSONCodec stores the record body as a JSON object after the key prefix.
+// Larger than binary, but readable with a hex dump and tolerant of field order.
+type JSONCodec struct {
+	OmitKey bool // key column lives only in the 8-byte prefix
+}
+
+func (c JSONCodec) Encode(s Schema, rec Record) ([]byte, error) {
+	key, err := s.ExtractPrimaryKey(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make(map[string]any, len(s.Fields))
+	for i, field := range s.Fields {
+		if i == 0 && c.OmitKey {
+			continue
+		}
+		val, ok := rec[field.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing field: %s", field.Name)
+		}
+		if field.Type == DateType {
+			// dates are held as unix seconds in memory, keep them readable on disk
+			v, ok := val.(int64)
+			if !ok {
+				return nil, fmt.Errorf("field %s: expected date as int64, got %T", field.Name, val)
+			}
+			val = time.Unix(v, 0).UTC().Format("2006-01-02")
+		}
+		body[field.Name] = val
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, key); err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(buf).Encode(body); err != nil {
+		return nil, fmt.Errorf("json codec: failed to encode record: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c JSONCodec) Decode(s Schema, data []byte) (uint64, Record, error) {
+	if len(data) < 8 {
+		return 0, nil, fmt.Errorf("json codec: record too short (%d bytes)", len(data))
+	}
+	key := binary.LittleEndian.Uint64(data[:8])
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data[8:], &body); err != nil {
+		return 0, nil, fmt.Errorf("json codec: failed to decode record: %w", err)
+	}
+
+	rec := make(Record)
+	for i, field := range s.Fields {
+		if i == 0 && c.OmitKey {
+			val, err := keyValue(field, key)
+			if err != nil {
+				return 0, nil, fmt.Errorf("json codec: %w", err)
+			}
+			rec[field.Name] = val
+			continue
+		}
+		raw, ok := body[field.Name]
+		if !ok {
+			return 0, nil, fmt.Errorf("json codec: missing field: %s", field.Name)
+		}
+		val, err := decodeJSONValue(raw, field.Type)
+		if err != nil {
+			return 0, nil, fmt.Errorf("json codec: field %s: %w", field.Name, err)
+		}
+		rec[field.Name] = val
+	}
+	return key, rec, nil
+}
+
+func decodeJSONValue(raw json.RawMessage, fieldType FieldType) (any, error) {
+	switch fieldType {
+	case IntType:
+		var v int32
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case StringType:
+		var v string
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case BoolType:
+		var v bool
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case FloatType:
+		var v float64
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case DateType:
+		// matches the binary codec, which also decodes dates to YYYY-MM-DD
+		var v string
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case BigIntType:
+		var v int64
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	default:
+		return nil, fmt.Errorf("unsupported type: %v", fieldType)
+	}
+}
@@ -0,0 +1,97 @@
+package schema
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// CompressThreshold is the body size (after the key prefix) above which
+// CompressedCodec tries to deflate a record.
+const CompressThreshold = 128
+
+const (
+	bodyRaw byte = iota
+	bodyDeflate
+)
+
+// CompressedCodec wraps another codec, deflating large record bodies.
+// Layout: [key:8][flag:1][body]; the key prefix is never compressed so
+// the pager can still read it with GetKey.
+type CompressedCodec struct {
+	Inner Codec
+}
+
+func (cc CompressedCodec) Encode(s Schema, rec Record) ([]byte, error) {
+	data, err := cc.Inner.Encode(s, rec)
+	if err != nil {
+		return nil, err
+	}
+	return compressBody(data)
+}
+
+func (cc CompressedCodec) Decode(s Schema, data []byte) (uint64, Record, error) {
+	raw, err := decompressBody(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return cc.Inner.Decode(s, raw)
+}
+
+func compressBody(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("compress: record too short (%d bytes)", len(data))
+	}
+	key, body := data[:8], data[8:]
+
+	out := new(bytes.Buffer)
+	out.Write(key)
+
+	if len(body) > CompressThreshold {
+		deflated := new(bytes.Buffer)
+		fw, err := flate.NewWriter(deflated, flate.BestSpeed)
+		if err != nil {
+			return nil, fmt.Errorf("compress: %w", err)
+		}
+		if _, err := fw.Write(body); err != nil {
+			return nil, fmt.Errorf("compress: %w", err)
+		}
+		if err := fw.Close(); err != nil {
+			return nil, fmt.Errorf("compress: %w", err)
+		}
+
+		// only keep the compressed form if it actually saved space
+		if deflated.Len() < len(body) {
+			out.WriteByte(bodyDeflate)
+			out.Write(deflated.Bytes())
+			return out.Bytes(), nil
+		}
+	}
+
+	out.WriteByte(bodyRaw)
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+func decompressBody(data []byte) ([]byte, error) {
+	if len(data) < 9 {
+		return nil, fmt.Errorf("decompress: record too short (%d bytes)", len(data))
+	}
+	key, flag, body := data[:8], data[8], data[9:]
+
+	switch flag {
+	case bodyRaw:
+		return append(append([]byte{}, key...), body...), nil
+	case bodyDeflate:
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		inflated, err := io.ReadAll(fr)
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+		return append(append([]byte{}, key...), inflated...), nil
+	default:
+		return nil, fmt.Errorf("decompress: unknown body flag %d", flag)
+	}
+}
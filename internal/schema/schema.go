@@ -2,12 +2,15 @@ package schema
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"godb/internal/encoding"
 	"io"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +22,7 @@ const (
 	BoolType
 	FloatType
 	DateType
+	BigIntType
 )
 
 func ParseFieldType(s string) (FieldType, error) {
@@ -33,12 +37,67 @@ func ParseFieldType(s string) (FieldType, error) {
 		return FloatType, nil
 	case "date":
 		return DateType, nil
+	case "bigint":
+		return BigIntType, nil
 	default:
 		return 0, fmt.Errorf("unknown type: %s", s)
 	}
 }
 
+var ErrInvalidName = errors.New("invalid name")
+
+const maxNameLength = 64
+
+// reservedNames can't name a table or field: CLI query keywords, which
+// would read ambiguously in "select where <field>" or "order by <field>".
+// Names starting with an underscore are reserved for hidden columns such
+// as VersionField.
+var reservedNames = map[string]bool{
+	"select": true, "where": true, "order": true, "by": true, "asc": true, "desc": true,
+	"and": true, "or": true, "not": true, "null": true, "tolerant": true,
+}
+
+// ValidateName checks s can name a table or field: a letter followed by
+// up to 63 letters, digits or underscores, and not a reserved word (in any
+// case). Table names become file names, so this also keeps out path
+// separators and extensions like ".db".
+func ValidateName(s string) error {
+	if s == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidName)
+	}
+	if len(s) > maxNameLength {
+		return fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidName, s, maxNameLength)
+	}
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case (r >= '0' && r <= '9' || r == '_') && i > 0:
+		default:
+			return fmt.Errorf("%w: %q must be a letter followed by letters, digits or underscores", ErrInvalidName, s)
+		}
+	}
+	if reservedNames[strings.ToLower(s)] {
+		return fmt.Errorf("%w: %q is a reserved word", ErrInvalidName, s)
+	}
+	return nil
+}
+
+// ErrNonFiniteFloat is returned for a float value that is NaN or ±Inf. They
+// don't order (NaN != NaN) and print inconsistently, so they're rejected
+// unless a ValueOptions allows them.
+var ErrNonFiniteFloat = errors.New("float is NaN or infinite")
+
+// ValueOptions loosens the checks in ParseValueWith and ValidateWith.
+type ValueOptions struct {
+	AllowNonFinite bool // accept NaN, +Inf and -Inf float values
+}
+
+// ParseValue parses s as a value of fieldType with the default ValueOptions.
 func ParseValue(s string, fieldType FieldType) (any, error) {
+	return ParseValueWith(s, fieldType, ValueOptions{})
+}
+
+func ParseValueWith(s string, fieldType FieldType, opts ValueOptions) (any, error) {
 	switch fieldType {
 	case IntType:
 		val, err := strconv.Atoi(s)
@@ -59,6 +118,9 @@ func ParseValue(s string, fieldType FieldType) (any, error) {
 		if err != nil {
 			return nil, err
 		}
+		if !opts.AllowNonFinite && !isFinite(val) {
+			return nil, fmt.Errorf("%q: %w", s, ErrNonFiniteFloat)
+		}
 		return val, nil
 	case DateType:
 		t, err := time.Parse("2006-01-02", s)
@@ -67,14 +129,96 @@ func ParseValue(s string, fieldType FieldType) (any, error) {
 			return nil, err
 		}
 		return val, nil
+	case BigIntType:
+		val, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return val, nil
 	default:
 		return nil, fmt.Errorf("unsupported type: %v", fieldType)
 	}
 }
 
 type Field struct {
-	Name string
-	Type FieldType
+	Name    string
+	Type    FieldType
+	Unique  bool   // no two records may share a value (primary key is always unique)
+	Check   *Check // rule every value must satisfy, nil for none
+	System  bool   // filled in by the store, e.g. CreatedAtField; clients can't set it
+	Indexed bool   // the store keeps a secondary index on it
+}
+
+// fieldUniqueFlag, fieldCheckFlag, fieldSystemFlag and fieldIndexedFlag are
+// or-ed into the serialized type byte. Types are small enumerations, so the
+// high bits are free and older schemas read back as not unique, unchecked,
+// not system and not indexed.
+const (
+	fieldUniqueFlag  byte = 0x80
+	fieldCheckFlag   byte = 0x40
+	fieldSystemFlag  byte = 0x20
+	fieldIndexedFlag byte = 0x10
+)
+
+// ErrConstraintViolation is returned for a value that fails its field's Check.
+var ErrConstraintViolation = errors.New("constraint violation")
+
+// Check is a CHECK-like rule on a numeric field, e.g. age >= 0: every value
+// must compare to Value as Op says.
+type Check struct {
+	Op    string // =, !=, <, <=, >, >=
+	Value any    // typed as ParseValue returns it for the field
+}
+
+func (c Check) String() string {
+	return fmt.Sprintf("%s %v", c.Op, c.Value)
+}
+
+// ParseCheck parses a rule written as an operator and a literal, e.g.
+// ">=0", for a field of fieldType. Only int, bigint and float fields take one.
+func ParseCheck(s string, fieldType FieldType) (*Check, error) {
+	switch fieldType {
+	case IntType, BigIntType, FloatType:
+	default:
+		return nil, errors.New("checks are only supported on int, bigint and float fields")
+	}
+	// two-character operators first, so ">=" isn't read as ">" then "=0"
+	for _, op := range []string{">=", "<=", "!=", "=", "<", ">"} {
+		literal, ok := strings.CutPrefix(s, op)
+		if !ok {
+			continue
+		}
+		value, err := ParseValue(literal, fieldType)
+		if err != nil {
+			return nil, fmt.Errorf("check %q: %w", s, err)
+		}
+		return &Check{Op: op, Value: value}, nil
+	}
+	return nil, fmt.Errorf("check %q must start with one of =, !=, <, <=, >, >=", s)
+}
+
+// allows reports whether v passes the check.
+func (c Check) allows(v any) (bool, error) {
+	n, err := CompareValues(v, c.Value)
+	if err != nil {
+		return false, err
+	}
+	switch c.Op {
+	case "=":
+		return n == 0, nil
+	case "!=":
+		return n != 0, nil
+	case "<":
+		return n < 0, nil
+	case "<=":
+		return n <= 0, nil
+	case ">":
+		return n > 0, nil
+	case ">=":
+		return n >= 0, nil
+	default:
+		return false, fmt.Errorf("unknown operator: %s", c.Op)
+	}
 }
 
 type Schema struct {
@@ -90,6 +234,49 @@ func (s Schema) GetFieldNames() []string {
 	return names
 }
 
+// UniqueFields returns the non-key fields marked unique.
+func (s Schema) UniqueFields() []Field {
+	var unique []Field
+	for i, field := range s.Fields {
+		if i > 0 && field.Unique {
+			unique = append(unique, field)
+		}
+	}
+	return unique
+}
+
+// IndexedFields returns the fields marked for a secondary index.
+func (s Schema) IndexedFields() []Field {
+	var indexed []Field
+	for _, field := range s.Fields {
+		if field.Indexed {
+			indexed = append(indexed, field)
+		}
+	}
+	return indexed
+}
+
+func (s Schema) HasField(name string) bool {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderedValues returns rec's values in Fields order, e.g. for printing
+// columns or writing CSV. Fields have no null values, so a field missing
+// from rec (which Validate would reject) is nil in its place; fields rec
+// has that the schema doesn't are left out.
+func (s Schema) OrderedValues(rec Record) []any {
+	values := make([]any, len(s.Fields))
+	for i, field := range s.Fields {
+		values[i] = rec[field.Name]
+	}
+	return values
+}
+
 func (s *Schema) Serialize() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
@@ -107,15 +294,47 @@ func (s *Schema) Serialize() ([]byte, error) {
 		if err := encoding.WriteString(buf, field.Name); err != nil {
 			return nil, err
 		}
-		// field type
-		if _, err := buf.Write([]byte{byte(field.Type)}); err != nil {
+		// field type + flags
+		typeByte := byte(field.Type)
+		if field.Unique {
+			typeByte |= fieldUniqueFlag
+		}
+		if field.Check != nil {
+			typeByte |= fieldCheckFlag
+		}
+		if field.System {
+			typeByte |= fieldSystemFlag
+		}
+		if field.Indexed {
+			typeByte |= fieldIndexedFlag
+		}
+		if _, err := buf.Write([]byte{typeByte}); err != nil {
 			return nil, err
 		}
+		// check operator and literal, as text
+		if field.Check != nil {
+			if err := encoding.WriteString(buf, field.Check.Op); err != nil {
+				return nil, err
+			}
+			if err := encoding.WriteString(buf, fmt.Sprint(field.Check.Value)); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return buf.Bytes(), nil
 }
 
+// Hash is a stable 64-bit fingerprint of the table name and each field's
+// name, type and flags. Serialize walks the ordered Fields slice, so the same
+// schema hashes the same on every run.
+func (s Schema) Hash() uint64 {
+	data, _ := s.Serialize() // writes to a bytes.Buffer never fail
+	h1 := uint64(encoding.MurmurHash3(data, 0))
+	h2 := uint64(encoding.MurmurHash3(data, 1))
+	return (h1 << 32) | h2
+}
+
 func Deserialize(r io.Reader) (Schema, error) {
 	sch := Schema{}
 
@@ -147,39 +366,126 @@ func Deserialize(r io.Reader) (Schema, error) {
 		}
 
 		sch.Fields[i] = Field{
-			Name: fieldName,
-			Type: FieldType(typeByte[0]),
+			Name:    fieldName,
+			Type:    FieldType(typeByte[0] &^ (fieldUniqueFlag | fieldCheckFlag | fieldSystemFlag | fieldIndexedFlag)),
+			Unique:  typeByte[0]&fieldUniqueFlag != 0,
+			System:  typeByte[0]&fieldSystemFlag != 0,
+			Indexed: typeByte[0]&fieldIndexedFlag != 0,
+		}
+		if typeByte[0]&fieldCheckFlag != 0 {
+			op, err := encoding.ReadString(r)
+			if err != nil {
+				return Schema{}, err
+			}
+			literal, err := encoding.ReadString(r)
+			if err != nil {
+				return Schema{}, err
+			}
+			check, err := ParseCheck(op+literal, sch.Fields[i].Type)
+			if err != nil {
+				return Schema{}, fmt.Errorf("field %s: %w", fieldName, err)
+			}
+			sch.Fields[i].Check = check
 		}
 	}
 
 	return sch, nil
 }
 
+// Validate checks rec has every field of the schema, that its float values
+// are finite and that each value passes its field's Check, with the default
+// ValueOptions.
+func (s Schema) Validate(rec Record) error {
+	return s.ValidateWith(rec, ValueOptions{})
+}
+
+func (s Schema) ValidateWith(rec Record, opts ValueOptions) error {
+	for _, field := range s.Fields {
+		val, ok := rec[field.Name]
+		if !ok {
+			return fmt.Errorf("missing field: %s", field.Name)
+		}
+		if field.Check != nil {
+			pass, err := field.Check.allows(val)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+			if !pass {
+				return fmt.Errorf("field %s is %v, must be %s: %w", field.Name, val, field.Check, ErrConstraintViolation)
+			}
+		}
+		if field.Type != FloatType {
+			continue
+		}
+		f, ok := val.(float64)
+		if !ok {
+			return fmt.Errorf("field %s: expected float64, got %T", field.Name, val)
+		}
+		if !opts.AllowNonFinite && !isFinite(f) {
+			return fmt.Errorf("field %s is %v: %w", field.Name, f, ErrNonFiniteFloat)
+		}
+	}
+	return nil
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// MaxRecordSize is the largest binary encoding of a record of this schema,
+// key prefix included. bounded is false when a string field has no limit.
+func (s Schema) MaxRecordSize() (size int, bounded bool) {
+	size = 8
+	for _, field := range s.Fields {
+		switch field.Type {
+		case IntType:
+			size += 4
+		case BoolType:
+			size += 1
+		case FloatType, DateType, BigIntType:
+			size += 8
+		default:
+			return 0, false
+		}
+	}
+	return size, true
+}
+
 func (s *Schema) SerializeRecord(rec Record) ([]byte, error) {
+	return s.serializeRecord(rec, false)
+}
+
+func (s *Schema) DeserializeRecord(data []byte) (uint64, Record, error) {
+	return s.deserializeRecord(data, false)
+}
+
+// serializeRecord writes the 8-byte key prefix followed by the field values.
+// With omitKey the key column is left out of the body, since the prefix
+// already holds it; deserializeRecord rebuilds it from there.
+func (s *Schema) serializeRecord(rec Record, omitKey bool) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
 	// first field is always the key
 	keyField := s.Fields[0]
-	keyVal, ok := rec[keyField.Name]
-	if !ok {
+	if _, ok := rec[keyField.Name]; !ok {
 		return nil, fmt.Errorf("missing the key field: %s", keyField.Name)
 	}
 
 	// write key as uint64
-	var key uint64
-	switch v := keyVal.(type) {
-	case int32:
-		key = uint64(v)
-	default:
-		return nil, fmt.Errorf("key must be int32 for now")
+	key, err := s.ExtractPrimaryKey(rec)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := binary.Write(buf, binary.LittleEndian, key); err != nil {
 		return nil, err
 	}
 
-	// write all fields (including key again for complete record)
-	for _, field := range s.Fields {
+	// write all fields (the key again too, unless it is omitted)
+	for i, field := range s.Fields {
+		if i == 0 && omitKey {
+			continue
+		}
 		val, ok := rec[field.Name]
 		if !ok {
 			return nil, fmt.Errorf("missing field: %s", field.Name)
@@ -193,7 +499,7 @@ func (s *Schema) SerializeRecord(rec Record) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (s *Schema) DeserializeRecord(data []byte) (uint64, Record, error) {
+func (s *Schema) deserializeRecord(data []byte, omitKey bool) (uint64, Record, error) {
 	r := bytes.NewReader(data)
 
 	// read key
@@ -204,7 +510,15 @@ func (s *Schema) DeserializeRecord(data []byte) (uint64, Record, error) {
 
 	// read all fields
 	rec := make(Record)
-	for _, field := range s.Fields {
+	for i, field := range s.Fields {
+		if i == 0 && omitKey {
+			val, err := keyValue(field, key)
+			if err != nil {
+				return 0, nil, err
+			}
+			rec[field.Name] = val
+			continue
+		}
 		val, err := readFieldValue(r, field.Type)
 		if err != nil {
 			return 0, nil, err
@@ -215,6 +529,24 @@ func (s *Schema) DeserializeRecord(data []byte) (uint64, Record, error) {
 	return key, rec, nil
 }
 
+// keyValue converts a uint64 key prefix back into the key column's value.
+func keyValue(field Field, key uint64) (any, error) {
+	switch field.Type {
+	case IntType:
+		if key > math.MaxInt32 {
+			return nil, fmt.Errorf("key %d overflows int column %s", key, field.Name)
+		}
+		return int32(key), nil
+	case BigIntType:
+		if key > math.MaxInt64 {
+			return nil, fmt.Errorf("key %d overflows bigint column %s", key, field.Name)
+		}
+		return int64(key), nil
+	default:
+		return nil, fmt.Errorf("primary key %s must be int or bigint", field.Name)
+	}
+}
+
 type Record map[string]any
 
 func writeFieldValue(w io.Writer, fieldType FieldType, value any) error {
@@ -244,6 +576,9 @@ func writeFieldValue(w io.Writer, fieldType FieldType, value any) error {
 	case DateType:
 		v := value.(int64)
 		return encoding.WriteInt64(w, v)
+	case BigIntType:
+		v := value.(int64)
+		return encoding.WriteInt64(w, v)
 	default:
 		return fmt.Errorf("unsupported type: %v", fieldType)
 	}
@@ -269,6 +604,8 @@ func readFieldValue(r io.Reader, fieldType FieldType) (any, error) {
 		}
 		t := time.Unix(unixTimestamp, 0)
 		return t.UTC().Format("2006-01-02"), nil
+	case BigIntType:
+		return encoding.ReadInt64(r)
 	default:
 		return nil, fmt.Errorf("unsupported type: %v", fieldType)
 	}
@@ -279,13 +616,66 @@ func (s *Schema) ExtractPrimaryKey(record Record) (uint64, error) {
 		return 0, errors.New("schema has no fields")
 	}
 
+	// keys are uint64 in the tree and WAL; int and bigint columns both widen to it
 	firstField := s.Fields[0]
-	id, ok := record[firstField.Name].(int32)
-	if !ok {
-		return 0, fmt.Errorf("primary key %s must be int32", firstField.Name)
+	var id int64
+	switch v := record[firstField.Name].(type) {
+	case int32:
+		id = int64(v)
+	case int64:
+		id = v
+	default:
+		return 0, fmt.Errorf("primary key %s must be int or bigint", firstField.Name)
 	}
 	if id < 0 {
 		return 0, fmt.Errorf("primary key cannot be negative: %d", id)
 	}
 	return uint64(id), nil
 }
+
+// CompareValues orders two decoded field values of the same type, returning
+// -1, 0 or 1. Dates decode to YYYY-MM-DD strings, which sort correctly as text.
+func CompareValues(a, b any) (int, error) {
+	switch av := a.(type) {
+	case int32:
+		bv, ok := b.(int32)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		return cmp.Compare(av, bv), nil
+	case int64:
+		bv, ok := b.(int64)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		return cmp.Compare(av, bv), nil
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		return cmp.Compare(av, bv), nil
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		return strings.Compare(av, bv), nil
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		// false sorts before true
+		switch {
+		case av == bv:
+			return 0, nil
+		case !av:
+			return -1, nil
+		default:
+			return 1, nil
+		}
+	default:
+		return 0, fmt.Errorf("unsupported type for comparison: %T", a)
+	}
+}
@@ -0,0 +1,150 @@
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseValueRejectsNonFiniteFloats(t *testing.T) {
+	for _, s := range []string{"NaN", "nan", "Inf", "+Inf", "-Inf", "infinity", "1e400"} {
+		if _, err := ParseValue(s, FloatType); err == nil {
+			t.Errorf("ParseValue(%q) accepted a non-finite float", s)
+		}
+		val, err := ParseValueWith(s, FloatType, ValueOptions{AllowNonFinite: true})
+		if s == "1e400" {
+			// out of range is a parse error either way
+			if err == nil {
+				t.Errorf("ParseValueWith(%q) accepted an out-of-range float: %v", s, val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseValueWith(%q) with AllowNonFinite failed: %v", s, err)
+		}
+	}
+	if _, err := ParseValue("NaN", FloatType); !errors.Is(err, ErrNonFiniteFloat) {
+		t.Errorf("Expected ErrNonFiniteFloat for NaN, got %v", err)
+	}
+	if val, err := ParseValue("2.5", FloatType); err != nil || val != 2.5 {
+		t.Errorf("ParseValue(\"2.5\") = %v, %v", val, err)
+	}
+}
+
+func TestValidateRejectsNonFiniteFloats(t *testing.T) {
+	sch := Schema{
+		TableName: "readings",
+		Fields: []Field{
+			{Name: "id", Type: IntType},
+			{Name: "value", Type: FloatType},
+		},
+	}
+
+	if err := sch.Validate(Record{"id": int32(1), "value": 1.5}); err != nil {
+		t.Errorf("Validate rejected a finite float: %v", err)
+	}
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		rec := Record{"id": int32(1), "value": f}
+		if err := sch.Validate(rec); !errors.Is(err, ErrNonFiniteFloat) {
+			t.Errorf("Validate(%v): expected ErrNonFiniteFloat, got %v", f, err)
+		}
+		if err := sch.ValidateWith(rec, ValueOptions{AllowNonFinite: true}); err != nil {
+			t.Errorf("ValidateWith(%v) with AllowNonFinite failed: %v", f, err)
+		}
+	}
+	if err := sch.Validate(Record{"id": int32(1)}); err == nil {
+		t.Error("Validate accepted a record missing a field")
+	}
+	if err := sch.Validate(Record{"id": int32(1), "value": "1.5"}); err == nil {
+		t.Error("Validate accepted a string in a float field")
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"users", "Order_Items", "t1", "a", "x_2_y", strings.Repeat("n", 64)} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("ValidateName(%q) rejected a valid name: %v", name, err)
+		}
+	}
+	rejected := []string{
+		"", "1users", "_version", "_hidden", "users.db", "../users", "a/b", `a\b`,
+		"first name", "naïve", "where", "ORDER", "Select", strings.Repeat("n", 65),
+	}
+	for _, name := range rejected {
+		if err := ValidateName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("ValidateName(%q) = %v, expected ErrInvalidName", name, err)
+		}
+	}
+}
+
+func TestChecksValidateAndSurviveSerialization(t *testing.T) {
+	age, err := ParseCheck(">=0", IntType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	price, err := ParseCheck(">0.5", FloatType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch := Schema{
+		TableName: "items",
+		Fields: []Field{
+			{Name: "id", Type: IntType},
+			{Name: "age", Type: IntType, Check: age, Indexed: true},
+			{Name: "price", Type: FloatType, Check: price, Unique: true},
+		},
+	}
+
+	data, err := sch.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := Deserialize(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Deserialize failed: %v", err)
+	}
+	if back.Hash() != sch.Hash() || !back.Fields[2].Unique || back.Fields[0].Check != nil ||
+		!back.Fields[1].Indexed || back.Fields[1].Type != IntType || back.Fields[2].Indexed {
+		t.Fatalf("Schema changed in a round trip: %+v", back.Fields)
+	}
+
+	if err := back.Validate(Record{"id": int32(1), "age": int32(0), "price": 0.75}); err != nil {
+		t.Errorf("Validate rejected a record passing its checks: %v", err)
+	}
+	err = back.Validate(Record{"id": int32(1), "age": int32(-1), "price": 0.75})
+	if !errors.Is(err, ErrConstraintViolation) || !strings.Contains(err.Error(), "age") || !strings.Contains(err.Error(), ">= 0") {
+		t.Errorf("Expected a violation naming age and >= 0, got %v", err)
+	}
+	if err := back.Validate(Record{"id": int32(1), "age": int32(3), "price": 0.5}); !errors.Is(err, ErrConstraintViolation) {
+		t.Errorf("Expected a violation for price 0.5, got %v", err)
+	}
+
+	for _, bad := range []struct {
+		rule string
+		typ  FieldType
+	}{{"0", IntType}, {">=x", IntType}, {"=a", StringType}, {">1.5", IntType}} {
+		if _, err := ParseCheck(bad.rule, bad.typ); err == nil {
+			t.Errorf("ParseCheck(%q) accepted a bad rule", bad.rule)
+		}
+	}
+}
+
+func TestOrderedValuesFollowFieldOrder(t *testing.T) {
+	sch := Schema{Fields: []Field{
+		{Name: "id", Type: IntType},
+		{Name: "name", Type: StringType},
+		{Name: "price", Type: FloatType},
+	}}
+
+	got := sch.OrderedValues(Record{"price": 2.5, "id": int32(7), "name": "bolt", "extra": true})
+	if want := []any{int32(7), "bolt", 2.5}; !slices.Equal(got, want) {
+		t.Errorf("OrderedValues = %v, want %v", got, want)
+	}
+	got = sch.OrderedValues(Record{"id": int32(7)})
+	if want := []any{int32(7), nil, nil}; !slices.Equal(got, want) {
+		t.Errorf("OrderedValues with missing fields = %v, want %v", got, want)
+	}
+}
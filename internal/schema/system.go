@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CreatedAtField is the system field holding when a record was inserted,
+// in Unix seconds. Unlike VersionField it is a schema field, added by
+// WithCreatedAt: it is stored, printed and queried like any other.
+const CreatedAtField = "_created_at"
+
+// ErrSystemField is returned for a record that sets a system field itself.
+var ErrSystemField = errors.New("system field is set by the store")
+
+// WithCreatedAt returns s with a CreatedAtField system field appended.
+func (s Schema) WithCreatedAt() (Schema, error) {
+	if s.HasField(CreatedAtField) {
+		return Schema{}, fmt.Errorf("schema already has a %s field", CreatedAtField)
+	}
+	out := s
+	out.Fields = append(s.Fields[:len(s.Fields):len(s.Fields)], Field{Name: CreatedAtField, Type: BigIntType, System: true})
+	return out, nil
+}
+
+// HasCreatedAt reports whether s has the CreatedAtField system field.
+func (s Schema) HasCreatedAt() bool {
+	for _, field := range s.Fields {
+		if field.Name == CreatedAtField && field.System {
+			return true
+		}
+	}
+	return false
+}
+
+// UserFields returns the fields a client gives values for, in order: every
+// field but the system ones.
+func (s Schema) UserFields() []Field {
+	fields := make([]Field, 0, len(s.Fields))
+	for _, field := range s.Fields {
+		if !field.System {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// CheckNoSystemFields returns ErrSystemField if rec sets a system field.
+func (s Schema) CheckNoSystemFields(rec Record) error {
+	for _, field := range s.Fields {
+		if _, ok := rec[field.Name]; ok && field.System {
+			return fmt.Errorf("field %s: %w", field.Name, ErrSystemField)
+		}
+	}
+	return nil
+}
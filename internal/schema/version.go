@@ -0,0 +1,57 @@
+package schema
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// VersionField is the record entry holding a versioned table's row version.
+// It is not a schema field: it never prints and isn't given on insert.
+const VersionField = "_version"
+
+// VersionedCodec wraps another codec, storing a row version after the key
+// prefix. Layout: [key:8][version:8][body]. A record without a VersionField
+// entry encodes as version 1.
+type VersionedCodec struct {
+	Inner Codec
+}
+
+func (vc VersionedCodec) Encode(s Schema, rec Record) ([]byte, error) {
+	version := uint64(1)
+	if v, ok := rec[VersionField]; ok {
+		u, ok := v.(uint64)
+		if !ok {
+			return nil, fmt.Errorf("version: expected uint64, got %T", v)
+		}
+		version = u
+	}
+
+	data, err := vc.Inner.Encode(s, rec)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("version: record too short (%d bytes)", len(data))
+	}
+	out := make([]byte, len(data)+8)
+	copy(out, data[:8])
+	binary.LittleEndian.PutUint64(out[8:16], version)
+	copy(out[16:], data[8:])
+	return out, nil
+}
+
+func (vc VersionedCodec) Decode(s Schema, data []byte) (uint64, Record, error) {
+	if len(data) < 16 {
+		return 0, nil, fmt.Errorf("version: record too short (%d bytes)", len(data))
+	}
+	inner := make([]byte, 0, len(data)-8)
+	inner = append(inner, data[:8]...)
+	inner = append(inner, data[16:]...)
+
+	key, rec, err := vc.Inner.Decode(s, inner)
+	if err != nil {
+		return 0, nil, err
+	}
+	rec[VersionField] = binary.LittleEndian.Uint64(data[8:16])
+	return key, rec, nil
+}
@@ -3,8 +3,11 @@ package store
 import (
 	"context"
 	"fmt"
+	"godb/internal/pager"
 	"godb/internal/schema"
+	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -21,6 +24,54 @@ func benchSchema() schema.Schema {
 	}
 }
 
+// idNameSchema is a two-field table schema: id int, name string.
+func idNameSchema(table string) schema.Schema {
+	return schema.Schema{
+		TableName: table,
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "name", Type: schema.StringType},
+		},
+	}
+}
+
+// newStoreForTest creates a BTreeStore, without the background checkpointer
+// unless opts sets a CheckpointInterval and with fsync off, so benchmarks
+// measure only the operations under test. cleanup closes the store, stops
+// the WAL writer goroutine and removes the table and WAL files.
+func newStoreForTest(tb testing.TB, filename string, opts StoreOptions) (*BTreeStore, func()) {
+	tb.Helper()
+	return newSchemaStoreForTest(tb, filename, benchSchema(), opts)
+}
+
+// newSchemaStoreForTest is newStoreForTest for a table with schema sch.
+func newSchemaStoreForTest(tb testing.TB, filename string, sch schema.Schema, opts StoreOptions) (*BTreeStore, func()) {
+	tb.Helper()
+	os.Remove(filename)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	if opts.CheckpointInterval == 0 {
+		opts.CheckpointInterval = NoCheckpointer
+	}
+	store, err := CreateWithOptions(filename, sch, opts, ctx, wg)
+	if err != nil {
+		cancel()
+		tb.Fatal(err)
+	}
+	store.SetSyncEnabled(false)
+
+	cleanup := func() {
+		store.Close()
+		cancel()
+		wg.Wait()
+		os.Remove(filename)
+		os.Remove(strings.TrimSuffix(filename, ".db") + ".wal")
+	}
+	return store, cleanup
+}
+
 // Helper to create test record
 func benchRecord(id int) schema.Record {
 	return schema.Record{
@@ -58,25 +109,85 @@ func BenchmarkTableStoreInsert_10000(b *testing.B) {
 	benchTableStoreInsert(b, 10000)
 }
 
-func benchBTreeInsert(b *testing.B, n int) {
+func BenchmarkBTreeInsertWALOnly_1000(b *testing.B) {
+	benchBTreeInsertWithOptions(b, 1000, StoreOptions{WALOnly: true})
+}
+
+// writing every insert through to the file, with and without pre-growing it
+func BenchmarkBTreeInsertFlushWrites_10000(b *testing.B) {
+	benchBTreeInsertGrow(b, 10000, pager.DefaultGrowChunk)
+}
+
+func BenchmarkBTreeInsertFlushWritesNoGrow_10000(b *testing.B) {
+	benchBTreeInsertGrow(b, 10000, 0)
+}
+
+// ascending keys take the append path into the leaf; shuffled ones search
+func BenchmarkBTreeInsertSequential_10000(b *testing.B) {
+	benchBTreeInsertKeys(b, 10000, false)
+}
+
+func BenchmarkBTreeInsertRandom_10000(b *testing.B) {
+	benchBTreeInsertKeys(b, 10000, true)
+}
+
+func benchBTreeInsertKeys(b *testing.B, n int, shuffle bool) {
+	keys := make([]int, n)
+	for j := range keys {
+		keys[j] = j
+	}
+	if shuffle {
+		rand.New(rand.NewSource(1)).Shuffle(n, func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	}
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		filename := fmt.Sprintf("/tmp/bench_btree_insert_%d.db", i)
-		defer os.Remove(filename)
+		store, cleanup := newStoreForTest(b, fmt.Sprintf("/tmp/bench_btree_keys_%d.db", i), StoreOptions{})
 
-		store, err := CreateBTreeStore(filename, benchSchema(), context.Background(), &sync.WaitGroup{})
-		if err != nil {
-			b.Fatal(err)
+		b.StartTimer()
+		for _, j := range keys {
+			if _, err := store.Insert(benchRecord(j)); err != nil {
+				b.Fatal(err)
+			}
 		}
-		defer store.Close()
+		b.StopTimer()
+		cleanup()
+	}
+}
+
+func benchBTreeInsertGrow(b *testing.B, n, chunk int) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store, cleanup := newStoreForTest(b, fmt.Sprintf("/tmp/bench_btree_grow_%d.db", i), StoreOptions{FlushWrites: true})
+		store.SetGrowChunk(chunk)
 
 		b.StartTimer()
 		for j := 0; j < n; j++ {
-			if err := store.Insert(benchRecord(j)); err != nil {
+			if _, err := store.Insert(benchRecord(j)); err != nil {
 				b.Fatal(err)
 			}
 		}
 		b.StopTimer()
+		cleanup()
+	}
+}
+
+func benchBTreeInsert(b *testing.B, n int) {
+	benchBTreeInsertWithOptions(b, n, StoreOptions{})
+}
+
+func benchBTreeInsertWithOptions(b *testing.B, n int, opts StoreOptions) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store, cleanup := newStoreForTest(b, fmt.Sprintf("/tmp/bench_btree_insert_%d.db", i), opts)
+
+		b.StartTimer()
+		for j := 0; j < n; j++ {
+			if _, err := store.Insert(benchRecord(j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		cleanup()
 	}
 }
 
@@ -131,18 +242,12 @@ func BenchmarkTableStoreFind_10000(b *testing.B) {
 }
 
 func benchBTreeFind(b *testing.B, n int) {
-	filename := "/tmp/bench_btree_find.db"
-	defer os.Remove(filename)
-
-	store, err := CreateBTreeStore(filename, benchSchema(), context.Background(), &sync.WaitGroup{})
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer store.Close()
+	store, cleanup := newStoreForTest(b, "/tmp/bench_btree_find.db", StoreOptions{})
+	defer cleanup()
 
 	// Populate with n records
 	for j := 0; j < n; j++ {
-		if err := store.Insert(benchRecord(j)); err != nil {
+		if _, err := store.Insert(benchRecord(j)); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -150,7 +255,7 @@ func benchBTreeFind(b *testing.B, n int) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		// Search for middle record
-		_, err := store.Find(n / 2)
+		_, err := store.Find(uint64(n / 2))
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -177,7 +282,7 @@ func benchTableStoreFind(b *testing.B, n int) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		// Search for middle record
-		_, err := store.Find(n / 2)
+		_, err := store.Find(uint64(n / 2))
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -213,18 +318,12 @@ func BenchmarkTableStoreScanAll_10000(b *testing.B) {
 }
 
 func benchBTreeScanAll(b *testing.B, n int) {
-	filename := "/tmp/bench_btree_scan.db"
-	defer os.Remove(filename)
-
-	store, err := CreateBTreeStore(filename, benchSchema(), context.Background(), &sync.WaitGroup{})
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer store.Close()
+	store, cleanup := newStoreForTest(b, "/tmp/bench_btree_scan.db", StoreOptions{})
+	defer cleanup()
 
 	// Populate with n records
 	for j := 0; j < n; j++ {
-		if err := store.Insert(benchRecord(j)); err != nil {
+		if _, err := store.Insert(benchRecord(j)); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -279,18 +378,11 @@ func BenchmarkBTreeDelete_1000(b *testing.B) {
 func benchBTreeDelete(b *testing.B, n int) {
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		filename := fmt.Sprintf("/tmp/bench_btree_delete_%d.db", i)
-		defer os.Remove(filename)
-
-		store, err := CreateBTreeStore(filename, benchSchema(), context.Background(), &sync.WaitGroup{})
-		if err != nil {
-			b.Fatal(err)
-		}
-		defer store.Close()
+		store, cleanup := newStoreForTest(b, fmt.Sprintf("/tmp/bench_btree_delete_%d.db", i), StoreOptions{})
 
 		// Populate with n records
 		for j := 0; j < n; j++ {
-			if err := store.Insert(benchRecord(j)); err != nil {
+			if _, err := store.Insert(benchRecord(j)); err != nil {
 				b.Fatal(err)
 			}
 		}
@@ -298,11 +390,12 @@ func benchBTreeDelete(b *testing.B, n int) {
 		b.StartTimer()
 		// Delete every other record
 		for j := 0; j < n; j += 2 {
-			if err := store.Delete(uint64(j)); err != nil {
+			if _, err := store.Delete(uint64(j)); err != nil {
 				b.Fatal(err)
 			}
 		}
 		b.StopTimer()
+		cleanup()
 	}
 }
 
@@ -319,24 +412,18 @@ func BenchmarkTableStoreMixed_1000(b *testing.B) {
 }
 
 func benchBTreeMixed(b *testing.B, n int) {
-	filename := "/tmp/bench_btree_mixed.db"
-	defer os.Remove(filename)
-
-	store, err := CreateBTreeStore(filename, benchSchema(), context.Background(), &sync.WaitGroup{})
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer store.Close()
+	store, cleanup := newStoreForTest(b, "/tmp/bench_btree_mixed.db", StoreOptions{})
+	defer cleanup()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		// Insert
-		if err := store.Insert(benchRecord(i)); err != nil {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
 			b.Fatal(err)
 		}
 		// Find
 		if i > 0 {
-			_, err := store.Find(i - 1)
+			_, err := store.Find(uint64(i - 1))
 			if err != nil {
 				b.Fatal(err)
 			}
@@ -366,7 +453,7 @@ func benchTableStoreMixed(b *testing.B, n int) {
 		}
 		// Find
 		if i > 0 {
-			_, err := store.Find(i - 1)
+			_, err := store.Find(uint64(i - 1))
 			if err != nil {
 				b.Fatal(err)
 			}
@@ -374,3 +461,45 @@ func benchTableStoreMixed(b *testing.B, n int) {
 		// TableStore doesn't support delete
 	}
 }
+
+// ====================
+// Compression Benchmarks
+// ====================
+
+// text-heavy rows: the name field is long and repetitive, like free-form notes
+func benchTextRecord(id int) schema.Record {
+	return schema.Record{
+		"id":    int32(id),
+		"name":  fmt.Sprintf("record_%d: ", id) + strings.Repeat("lorem ipsum dolor sit amet ", 20),
+		"value": float64(id) * 3.14,
+	}
+}
+
+func BenchmarkBTreeInsertText_500(b *testing.B) {
+	benchBTreeInsertText(b, 500, false)
+}
+
+func BenchmarkBTreeInsertTextCompressed_500(b *testing.B) {
+	benchBTreeInsertText(b, 500, true)
+}
+
+func benchBTreeInsertText(b *testing.B, n int, compress bool) {
+	var pages uint32
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store, cleanup := newStoreForTest(b, fmt.Sprintf("/tmp/bench_btree_text_%d.db", i), StoreOptions{Compress: compress})
+
+		b.StartTimer()
+		for j := 0; j < n; j++ {
+			if _, err := store.Insert(benchTextRecord(j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		pages = store.NumPages()
+		cleanup()
+	}
+	// page utilization: fewer pages for the same rows means denser leaves
+	b.ReportMetric(float64(pages), "pages")
+	b.ReportMetric(float64(n)/float64(pages), "rows/page")
+}
@@ -1,327 +1,2147 @@
 package store
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"godb/internal/btree"
+	"godb/internal/logging"
 	"godb/internal/pager"
 	"godb/internal/schema"
 	"io"
-	"log"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type BTreeStore struct {
 	bt         *btree.BTree
 	wal        *pager.WALManager
+	rlog       *pager.RetainedLog // nil unless the table retains its log
 	tableBloom *BloomFilter
+	negCache   *NegativeCache
+	indexes    *indexSet // nil unless the schema has Indexed fields
+
+	// WAL-only tables: the WAL holds records not yet replayed into the tree
+	walPending bool
+
+	replica bool // opened by OpenReplica: no WAL, and writes fail with ErrReplica
+
+	archiveDir string // copy the WAL here before each truncate; see SetWALArchiveDir
+
+	maxResultRows atomic.Int64 // 0 means DefaultMaxResultRows; see SetMaxResultRows
+
+	snapshotReads bool                         // retake snapshot at each checkpoint
+	snapshot      atomic.Pointer[readSnapshot] // nil unless snapshotReads; see FindSnapshot
 
 	wg  *sync.WaitGroup
 	ctx context.Context
 
-	mu sync.RWMutex
+	logger logging.Logger
+
+	mu       sync.RWMutex
+	vacuumMu sync.Mutex // one Vacuum at a time; see Vacuum
+}
+
+// storeLog is the default store logger, also used before a store exists.
+var storeLog = logging.New("store")
+
+// Table files are made with Create (fails if the file exists), reopened
+// with Open (fails if it doesn't) or either with OpenOrCreate.
+
+// Open opens an existing table, replaying its WAL. A missing file fails
+// with an error wrapping os.ErrNotExist.
+func Open(filename string, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
+	return OpenWithOptions(filename, StoreOptions{}, ctx, wg)
+}
+
+// OpenWithOptions is Open with opts' runtime settings, such as
+// CheckpointInterval. The persisted settings are read from the header, so
+// the rest of opts is ignored.
+func OpenWithOptions(filename string, opts StoreOptions, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
+	interval, err := opts.checkpointInterval()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	dm := &pager.DiskManager{}
+	dm.SetFile(file)
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s is empty, not a table file", filename)
+	}
+	if err := dm.ReadHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := dm.GetHeader()
+	if name := filepath.Base(strings.TrimSuffix(filename, ".db")); header.Schema.TableName != name {
+		// copied, or renamed outside Rename: the header keeps its name, since
+		// the schema hash a pending WAL is checked against covers it
+		storeLog.Info("table file %s has header name %q", filename, header.Schema.TableName)
+	}
+	if header.SchemaHash == 0 {
+		// table predates schema hashes
+		header.SchemaHash = header.Schema.Hash()
+		if err := dm.WriteHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if header.TableID.IsZero() {
+		// table predates identities - assign one so future WALs can be checked
+		header.TableID = pager.NewTableID()
+		if err := dm.WriteHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	walFileName := strings.TrimSuffix(filename, ".db") + ".wal"
+	wm, err := pager.NewWalManager(walFileName, header.TableID, header.SchemaHash, ctx, wg)
+	if errors.Is(err, pager.ErrWALSchemaChanged) {
+		// refuse rather than replay records against the wrong fields
+		file.Close()
+		return nil, fmt.Errorf("%s was written under another schema than %s has now, so its records can't be recovered; restore the schema to recover them, or move the WAL aside to drop them: %w", walFileName, filename, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bt := btree.NewBTree(dm, header)
+	bts := &BTreeStore{bt: bt, wal: wm, ctx: ctx, wg: wg, negCache: NewNegativeCache(defaultNegativeCacheSize), logger: storeLog}
+	if err := bts.openRetainedLog(filename, header); err != nil {
+		return nil, err
+	}
+
+	if header.WALOnly {
+		// leave the WAL alone until a read needs the tree
+		pending, err := wm.HasPendingRecords()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat WAL: %w", err)
+		}
+		bts.walPending = pending
+	} else {
+		// Replay WAL to recover any uncommitted operations
+		if err := bts.Recover(); err != nil {
+			return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+		}
+	}
+
+	if err := bts.rebuildBloomFilter(); err != nil {
+		return nil, err
+	}
+	if err := bts.rebuildIndexes(); err != nil {
+		return nil, err
+	}
+	if err := bts.applyOptions(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		wg.Add(1)
+		go bts.startCheckpointer(interval)
+	}
+	return bts, nil
+}
+
+const (
+	// DefaultCheckpointInterval is how often Open and Create checkpoint.
+	DefaultCheckpointInterval = 30 * time.Second
+	// MinCheckpointInterval is the shortest CheckpointInterval allowed.
+	MinCheckpointInterval = 100 * time.Millisecond
+	// NoCheckpointer, as a CheckpointInterval, turns the background
+	// checkpointer off.
+	NoCheckpointer time.Duration = -1
+)
+
+// StoreOptions configures a table at creation time. Persisted settings are
+// written to the header; opening an existing table reads them back from there.
+type StoreOptions struct {
+	Codec       schema.CodecType
+	Compress    bool // deflate record bodies larger than schema.CompressThreshold
+	WALOnly     bool // append inserts to the WAL only; see ScanWAL
+	OmitKey     bool // store the key only in the 8-byte prefix, not again in the body
+	FlushWrites bool // write dirty pages on every insert/delete, not just the WAL
+	Versioned   bool // keep a row version for UpdateIfVersion; not with WALOnly
+	RetainLog   bool // keep every insert/delete in <table>.log for ScanByLSN
+	CreatedAt   bool // add a schema.CreatedAtField system field, stamped on insert
+
+	// KeyRange restricts primary keys to [MinKey, MaxKey], e.g. for one shard
+	// of a table split across files. Without it any key goes.
+	KeyRange       bool
+	MinKey, MaxKey uint64
+
+	// Forwarding moves a record that an update grows past its leaf's free
+	// space to an overflow page, instead of splitting the leaf; Vacuum
+	// brings forwarded records back. Costs a byte per record.
+	Forwarding bool
+
+	// runtime only, not persisted
+
+	// CheckpointInterval is how often the background checkpointer runs. Zero
+	// means DefaultCheckpointInterval; a negative interval, e.g.
+	// NoCheckpointer, turns it off, leaving checkpoints to Checkpoint and the
+	// caller's Close.
+	CheckpointInterval time.Duration
+}
+
+// checkpointInterval is how often the background checkpointer runs under
+// opts, or 0 if it doesn't.
+func (opts StoreOptions) checkpointInterval() (time.Duration, error) {
+	switch {
+	case opts.CheckpointInterval == 0:
+		return DefaultCheckpointInterval, nil
+	case opts.CheckpointInterval < 0:
+		return 0, nil
+	case opts.CheckpointInterval < MinCheckpointInterval:
+		return 0, fmt.Errorf("checkpoint interval %v is below the minimum of %v", opts.CheckpointInterval, MinCheckpointInterval)
+	}
+	return opts.CheckpointInterval, nil
+}
+
+// Create makes a new table with the default options. It fails if filename
+// already holds a table.
+func Create(filename string, sch schema.Schema, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
+	return CreateWithOptions(filename, sch, StoreOptions{}, ctx, wg)
+}
+
+// OpenOrCreate opens filename if it holds a table, checking its schema is
+// sch, or creates it with sch otherwise.
+func OpenOrCreate(filename string, sch schema.Schema, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
+	if stat, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) || (err == nil && stat.Size() == 0) {
+		return Create(filename, sch, ctx, wg)
+	}
+	bts, err := Open(filename, ctx, wg)
+	if err != nil {
+		return nil, err
+	}
+	if bts.SchemaHash() != sch.Hash() {
+		bts.Close()
+		return nil, fmt.Errorf("table %s exists with a different schema", filename)
+	}
+	return bts, nil
+}
+
+func CreateWithOptions(filename string, sch schema.Schema, opts StoreOptions, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
+	if _, err := schema.CodecFor(opts.Codec); err != nil {
+		return nil, err
+	}
+	if opts.CreatedAt {
+		var err error
+		if sch, err = sch.WithCreatedAt(); err != nil {
+			return nil, err
+		}
+	}
+	limit := pager.MaxRecordSize
+	if opts.Forwarding {
+		limit-- // the tag byte
+	}
+	if size, bounded := sch.MaxRecordSize(); bounded && opts.Codec == schema.BinaryCodecType && !opts.Compress && size > limit {
+		return nil, fmt.Errorf("records of this schema take %d bytes, limit is %d: %w", size, limit, btree.ErrRecordTooLarge)
+	}
+	if opts.Versioned && opts.WALOnly {
+		// versions are read back from the tree, which a wal-only table defers
+		return nil, errors.New("a versioned table can't be wal-only")
+	}
+	if opts.Forwarding && opts.WALOnly {
+		// wal-only updates never touch a leaf
+		return nil, errors.New("a forwarding table can't be wal-only")
+	}
+	for i, field := range sch.Fields {
+		if !field.Indexed {
+			continue
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("field %s is the primary key, which needs no index", field.Name)
+		}
+		if opts.WALOnly {
+			// indexes are built from the tree, which a wal-only table defers
+			return nil, fmt.Errorf("field %s: a wal-only table can't have indexes", field.Name)
+		}
+	}
+	if opts.KeyRange && opts.MinKey > opts.MaxKey {
+		return nil, fmt.Errorf("key range [%d, %d] is empty", opts.MinKey, opts.MaxKey)
+	}
+	interval, err := opts.checkpointInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	dm := &pager.DiskManager{}
+	dm.SetFile(file)
+	stat, _ := file.Stat()
+
+	if stat.Size() == 0 {
+		header := pager.DefaultTableHeader(sch)
+		header.Codec = opts.Codec
+		header.Compression = opts.Compress
+		header.WALOnly = opts.WALOnly
+		header.OmitKey = opts.OmitKey
+		header.FlushWrites = opts.FlushWrites
+		header.Versioned = opts.Versioned
+		header.RetainLog = opts.RetainLog
+		header.KeyRange = opts.KeyRange
+		header.MinKey, header.MaxKey = opts.MinKey, opts.MaxKey
+		header.Forwarding = opts.Forwarding
+		dm.SetHeader(header)
+		dm.WriteHeader()
+		rootPage := pager.NewSlottedPage(1, pager.LEAF)
+		dm.WriteSlottedPage(rootPage)
+	} else {
+		file.Close()
+		return nil, fmt.Errorf("file already exists: %s", filename)
+	}
+
+	header := dm.GetHeader()
+
+	// a WAL left behind by a dropped table of the same name can't belong to this one
+	walFileName := strings.TrimSuffix(filename, ".db") + ".wal"
+	if err := os.Remove(walFileName); err == nil {
+		storeLog.Info("removed stale WAL %s while creating %s", walFileName, filename)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale WAL %s: %w", walFileName, err)
+	}
+
+	logFileName := strings.TrimSuffix(filename, ".db") + ".log"
+	if err := os.Remove(logFileName); err == nil {
+		storeLog.Info("removed stale retained log %s while creating %s", logFileName, filename)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale retained log %s: %w", logFileName, err)
+	}
+
+	wm, err := pager.NewWalManager(walFileName, header.TableID, header.SchemaHash, ctx, wg)
+	if err != nil {
+		return nil, err
+	}
+
+	bt := btree.NewBTree(dm, header)
+	bts := &BTreeStore{bt: bt, wal: wm, ctx: ctx, wg: wg, negCache: NewNegativeCache(defaultNegativeCacheSize), logger: storeLog}
+	if err := bts.openRetainedLog(filename, header); err != nil {
+		return nil, err
+	}
+
+	// Replay WAL to recover any uncommitted operations
+	if err := bts.Recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+	}
+
+	if err := bts.rebuildBloomFilter(); err != nil {
+		return nil, err
+	}
+	if err := bts.rebuildIndexes(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		wg.Add(1)
+		go bts.startCheckpointer(interval)
+	}
+	return bts, nil
+}
+
+// SetLogger replaces the logger used by the store, its page cache and its WAL.
+func (bts *BTreeStore) SetLogger(l logging.Logger) {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	bts.logger = l
+	bts.bt.SetLogger(l)
+	if bts.wal != nil {
+		bts.wal.SetLogger(l)
+	}
+}
+
+func (bts *BTreeStore) getLogger() logging.Logger {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.logger
+}
+
+func (bts *BTreeStore) startCheckpointer(interval time.Duration) {
+	defer bts.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := bts.Checkpoint(); err != nil {
+				bts.getLogger().Error("background checkpoint failed: %v", err)
+			} else {
+				bts.getLogger().Debug("background checkpoint complete")
+			}
+		case <-bts.ctx.Done():
+			if err := bts.Checkpoint(); err != nil {
+				bts.getLogger().Error("final checkpoint failed: %v", err)
+			} else {
+				bts.getLogger().Debug("final checkpoint complete")
+			}
+			return
+		}
+	}
+}
+
+// ConflictPolicy decides what Insert does when the primary key already exists.
+type ConflictPolicy uint8
+
+const (
+	ConflictError   ConflictPolicy = iota // reject the insert (default)
+	ConflictIgnore                        // keep the existing row, skip the insert
+	ConflictReplace                       // overwrite the existing row
+)
+
+type InsertOptions struct {
+	OnConflict ConflictPolicy
+}
+
+// InsertResult reports what an insert actually did.
+type InsertResult uint8
+
+const (
+	Inserted InsertResult = iota
+	Ignored
+	Replaced
+)
+
+// RowsAffected is 0 for an ignored insert and 1 otherwise.
+func (r InsertResult) RowsAffected() int {
+	if r == Ignored {
+		return 0
+	}
+	return 1
+}
+
+// Insert adds record and returns the number of rows affected (1 on success).
+func (bts *BTreeStore) Insert(record schema.Record) (int, error) {
+	result, err := bts.InsertWithOptions(record, InsertOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (bts *BTreeStore) InsertWithOptions(record schema.Record, opts InsertOptions) (InsertResult, error) {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	key, err := bts.bt.ExtractPrimaryKey(record)
+	if err != nil {
+		return Inserted, fmt.Errorf("insert: failed to extract primary key from table '%s': %w", bts.Schema().TableName, err)
+	}
+	if err := bts.checkKeyRange(key); err != nil {
+		return Inserted, fmt.Errorf("insert: %w", err)
+	}
+	if record, err = bts.stampCreatedAt(record); err != nil {
+		return Inserted, fmt.Errorf("insert: %w", err)
+	}
+	if bts.bt.IsVersioned() {
+		record = withVersion(record, 1)
+	}
+
+	data, err := bts.bt.SerializeRecord(record)
+	if err != nil {
+		return Inserted, fmt.Errorf("insert: failed to serialize record: %w", err)
+	}
+
+	if bts.bt.IsWALOnly() {
+		if opts.OnConflict == ConflictError && len(bts.Schema().UniqueFields()) == 0 {
+			// no tree to check against - a duplicate key is last-write-wins on replay
+			if err := bts.LogInsert(key, data); err != nil {
+				return Inserted, fmt.Errorf("insert: failed to log WAL insert: %w", err)
+			}
+			bts.walPending = true
+			return Inserted, nil
+		}
+		// ignore, replace and unique fields have to see the stored rows, so build the tree
+		if err := bts.materialize(); err != nil {
+			return Inserted, fmt.Errorf("insert: %w", err)
+		}
+	}
+
+	if err := bts.checkUnique(key, record); err != nil {
+		return Inserted, fmt.Errorf("insert: %w", err)
+	}
+
+	// check for a conflict before anything reaches the WAL, so a rejected
+	// insert can't be replayed on recovery
+	exists, err := bts.exists(key)
+	if err != nil {
+		return Inserted, fmt.Errorf("insert: failed to check key %d: %w", key, err)
+	}
+
+	result := Inserted
+	if exists {
+		switch opts.OnConflict {
+		case ConflictIgnore:
+			return Ignored, nil
+		case ConflictReplace:
+			result = Replaced
+		default:
+			return Inserted, fmt.Errorf("insert: key %d: %w", key, btree.ErrDuplicateKey)
+		}
+	}
+
+	if result == Replaced {
+		if bts.bt.IsVersioned() {
+			// a replace is an update as far as the version goes
+			version, _, err := bts.storedVersion(key)
+			if err != nil {
+				return Inserted, fmt.Errorf("insert: failed to read version of key %d: %w", key, err)
+			}
+			if data, err = bts.bt.SerializeRecord(withVersion(record, version+1)); err != nil {
+				return Inserted, fmt.Errorf("insert: failed to serialize record: %w", err)
+			}
+		}
+		if err := bts.replace(key, data); err != nil {
+			return Inserted, fmt.Errorf("insert: %w", err)
+		}
+		return Replaced, nil
+	}
+
+	if err := bts.LogInsert(key, data); err != nil {
+		return Inserted, fmt.Errorf("insert: failed to log WAL insert: %w", err)
+	}
+
+	if bts.tableBloom != nil {
+		bts.tableBloom.Add(key)
+	}
+	bts.negCache.Remove(key)
+
+	if err := bts.bt.Insert(key, data); err != nil {
+		return Inserted, err
+	}
+	return Inserted, nil
+}
+
+// ErrKeyOutOfRange is returned for a key outside the table's declared key range.
+var ErrKeyOutOfRange = errors.New("key out of range")
+
+// KeyRange returns the table's declared key bounds; ok is false when any key goes.
+func (bts *BTreeStore) KeyRange() (minKey, maxKey uint64, ok bool) {
+	return bts.bt.KeyRange()
+}
+
+func (bts *BTreeStore) checkKeyRange(key uint64) error {
+	minKey, maxKey, ok := bts.bt.KeyRange()
+	if ok && (key < minKey || key > maxKey) {
+		return fmt.Errorf("key %d outside [%d, %d]: %w", key, minKey, maxKey, ErrKeyOutOfRange)
+	}
+	return nil
+}
+
+// replace swaps the existing record for key with data: DELETE then INSERT,
+// logged as one batch. Caller holds the lock and has checked the key exists.
+func (bts *BTreeStore) replace(key uint64, data []byte) error {
+	if err := bts.logBatch(replaceRecords(key, data)); err != nil {
+		return fmt.Errorf("failed to log WAL replace: %w", err)
+	}
+	if err := bts.bt.Update(key, data); err != nil {
+		return fmt.Errorf("failed to replace record %d: %w", key, err)
+	}
+	return nil
+}
+
+func replaceRecords(key uint64, data []byte) []pager.WALRecord {
+	return []pager.WALRecord{
+		{Action: pager.DELETE, Key: pager.WalKey(key)},
+		{Action: pager.INSERT, Key: pager.WalKey(key), RecordBytes: data, RecordLength: uint32(len(data))},
+	}
+}
+
+// RowsUnknown is the row count Delete and Update return on a WAL-only
+// table, which can't tell whether the key exists without building the tree.
+const RowsUnknown = -1
+
+// Update overwrites the record with record's primary key and returns the
+// number of rows affected: 0 if there is no such record, or RowsUnknown on
+// a WAL-only table.
+func (bts *BTreeStore) Update(record schema.Record) (int, error) {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	return bts.update(record, nil)
+}
+
+var ErrVersionConflict = errors.New("version conflict")
+
+// UpdateIfVersion is Update for versioned tables that only applies if the
+// stored row is still at version expected, failing with ErrVersionConflict
+// otherwise. The row is written at expected+1.
+func (bts *BTreeStore) UpdateIfVersion(record schema.Record, expected uint64) (int, error) {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	if !bts.bt.IsVersioned() {
+		return 0, fmt.Errorf("update: table '%s' is not versioned", bts.Schema().TableName)
+	}
+	return bts.update(record, &expected)
+}
+
+// update replaces the row with record's key, checking its version against
+// expected when that is set. Caller must hold lock.
+func (bts *BTreeStore) update(record schema.Record, expected *uint64) (int, error) {
+	key, err := bts.bt.ExtractPrimaryKey(record)
+	if err != nil {
+		return 0, fmt.Errorf("update: failed to extract primary key from table '%s': %w", bts.Schema().TableName, err)
+	}
+
+	if bts.bt.IsWALOnly() && len(bts.Schema().UniqueFields()) > 0 {
+		// unique fields are checked against the stored rows, so build the tree
+		if err := bts.materialize(); err != nil {
+			return 0, fmt.Errorf("update: %w", err)
+		}
+	} else if bts.bt.IsWALOnly() {
+		// the row may not exist, so this can be an insert
+		if err := bts.checkKeyRange(key); err != nil {
+			return 0, fmt.Errorf("update: %w", err)
+		}
+		// nor can its insert time be read back, so it starts again
+		if record, err = bts.stampCreatedAt(record); err != nil {
+			return 0, fmt.Errorf("update: %w", err)
+		}
+		data, err := bts.bt.SerializeRecord(record)
+		if err != nil {
+			return 0, fmt.Errorf("update: failed to serialize record: %w", err)
+		}
+		if err := bts.logBatch(replaceRecords(key, data)); err != nil {
+			return 0, fmt.Errorf("update: failed to log WAL replace: %w", err)
+		}
+		bts.walPending = true
+		return RowsUnknown, nil
+	}
+
+	if bts.bt.IsVersioned() {
+		version, found, err := bts.storedVersion(key)
+		if err != nil {
+			return 0, fmt.Errorf("update: failed to read version of key %d: %w", key, err)
+		}
+		if !found {
+			return 0, nil
+		}
+		if expected != nil && version != *expected {
+			return 0, fmt.Errorf("update: key %d is at version %d, expected %d: %w", key, version, *expected, ErrVersionConflict)
+		}
+		record = withVersion(record, version+1)
+	} else {
+		exists, err := bts.exists(key)
+		if err != nil {
+			return 0, fmt.Errorf("update: failed to check key %d: %w", key, err)
+		}
+		if !exists {
+			return 0, nil
+		}
+	}
+	if record, err = bts.carryCreatedAt(key, record); err != nil {
+		return 0, fmt.Errorf("update: %w", err)
+	}
+
+	data, err := bts.bt.SerializeRecord(record)
+	if err != nil {
+		return 0, fmt.Errorf("update: failed to serialize record: %w", err)
+	}
+	if err := bts.checkUnique(key, record); err != nil {
+		return 0, fmt.Errorf("update: %w", err)
+	}
+	if err := bts.replace(key, data); err != nil {
+		return 0, fmt.Errorf("update: %w", err)
+	}
+	return 1, nil
+}
+
+// storedVersion reads the row version of key on a versioned table. Caller
+// must hold lock.
+func (bts *BTreeStore) storedVersion(key uint64) (uint64, bool, error) {
+	data, found, err := bts.bt.Search(key)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	_, rec, err := bts.bt.DeserializeRecord(data)
+	if err != nil {
+		return 0, false, err
+	}
+	return rec[schema.VersionField].(uint64), true, nil
+}
+
+// withVersion returns a shallow copy of record stamped with version, so
+// the caller's map is left alone.
+func withVersion(record schema.Record, version uint64) schema.Record {
+	out := make(schema.Record, len(record)+1)
+	for k, v := range record {
+		out[k] = v
+	}
+	out[schema.VersionField] = version
+	return out
+}
+
+// stampCreatedAt returns a shallow copy of record with the insert time
+// set, on a table with a schema.CreatedAtField; other tables get record
+// back as is. Either way a record that sets a system field is rejected.
+func (bts *BTreeStore) stampCreatedAt(record schema.Record) (schema.Record, error) {
+	sch := bts.Schema()
+	if err := sch.CheckNoSystemFields(record); err != nil {
+		return nil, err
+	}
+	if !sch.HasCreatedAt() {
+		return record, nil
+	}
+	return withCreatedAt(record, time.Now().Unix()), nil
+}
+
+// carryCreatedAt is stampCreatedAt for an update: record keeps the insert
+// time of the stored row with its key, or gets now if there is none.
+// Caller must hold lock.
+func (bts *BTreeStore) carryCreatedAt(key uint64, record schema.Record) (schema.Record, error) {
+	sch := bts.Schema()
+	if err := sch.CheckNoSystemFields(record); err != nil {
+		return nil, err
+	}
+	if !sch.HasCreatedAt() {
+		return record, nil
+	}
+	data, found, err := bts.bt.Search(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %d: %w", key, err)
+	}
+	if !found {
+		return withCreatedAt(record, time.Now().Unix()), nil
+	}
+	_, stored, err := bts.bt.DeserializeRecord(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %d: %w", key, err)
+	}
+	createdAt, ok := stored[schema.CreatedAtField].(int64)
+	if !ok {
+		return nil, fmt.Errorf("key %d has %s %v, expected an int64", key, schema.CreatedAtField, stored[schema.CreatedAtField])
+	}
+	return withCreatedAt(record, createdAt), nil
+}
+
+func withCreatedAt(record schema.Record, createdAt int64) schema.Record {
+	out := make(schema.Record, len(record)+1)
+	for k, v := range record {
+		out[k] = v
+	}
+	out[schema.CreatedAtField] = createdAt
+	return out
+}
+
+var ErrUniqueViolation = errors.New("unique constraint violation")
+
+// CheckUnique reports an ErrUniqueViolation if another record (different key)
+// already holds a value of one of record's unique fields.
+func (bts *BTreeStore) CheckUnique(record schema.Record) error {
+	key, err := bts.bt.ExtractPrimaryKey(record)
+	if err != nil {
+		return err
+	}
+	if err := bts.ensureMaterialized(); err != nil {
+		return err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.checkUnique(key, record)
+}
+
+// checkUnique scans the table for a clash on any unique field. There are no
+// secondary indexes, so this is a full scan - only paid by schemas with unique
+// fields. Caller must hold lock.
+func (bts *BTreeStore) checkUnique(key uint64, record schema.Record) error {
+	unique := bts.Schema().UniqueFields()
+	if len(unique) == 0 {
+		return nil
+	}
+
+	var violation error
+	err := bts.bt.RangeScanFunc(0, math.MaxUint64, func(otherKey uint64, data []byte) error {
+		if otherKey == key {
+			return nil // the row being replaced
+		}
+		_, other, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return err
+		}
+		for _, field := range unique {
+			if other[field.Name] == record[field.Name] {
+				violation = fmt.Errorf("%w: field %s value %v already used by key %d", ErrUniqueViolation, field.Name, record[field.Name], otherKey)
+				return btree.ErrStopScan
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return violation
+}
+
+// checkBatchUnique is checkUnique for a transaction: each unique value the
+// batch leaves behind must be unused by the other records in the batch and
+// by the rows of the table it doesn't replace or delete. Caller must hold lock.
+func (bts *BTreeStore) checkBatchUnique(batch []pager.WALRecord) error {
+	unique := bts.Schema().UniqueFields()
+	if len(unique) == 0 {
+		return nil
+	}
+
+	// the last image of each key the batch touches; nil if it's deleted
+	final := make(map[uint64]schema.Record)
+	var order []uint64
+	for _, record := range batch {
+		key := uint64(record.Key)
+		if _, ok := final[key]; !ok {
+			order = append(order, key)
+		}
+		switch record.Action {
+		case pager.INSERT:
+			_, rec, err := bts.bt.DeserializeRecord(record.RecordBytes)
+			if err != nil {
+				return fmt.Errorf("failed to decode key %d: %w", key, err)
+			}
+			final[key] = rec
+		case pager.DELETE:
+			final[key] = nil
+		}
+	}
+
+	claimed := make(map[string]map[any]uint64, len(unique))
+	for _, field := range unique {
+		claimed[field.Name] = make(map[any]uint64)
+	}
+	for _, key := range order {
+		rec := final[key]
+		if rec == nil {
+			continue
+		}
+		for _, field := range unique {
+			if other, ok := claimed[field.Name][rec[field.Name]]; ok {
+				return fmt.Errorf("%w: field %s value %v used by keys %d and %d in the same transaction", ErrUniqueViolation, field.Name, rec[field.Name], other, key)
+			}
+			claimed[field.Name][rec[field.Name]] = key
+		}
+	}
+
+	var violation error
+	err := bts.bt.RangeScanFunc(0, math.MaxUint64, func(otherKey uint64, data []byte) error {
+		if _, ok := final[otherKey]; ok {
+			return nil // replaced or deleted by the batch
+		}
+		_, other, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return err
+		}
+		for _, field := range unique {
+			if key, ok := claimed[field.Name][other[field.Name]]; ok {
+				violation = fmt.Errorf("%w: field %s value %v for key %d already used by key %d", ErrUniqueViolation, field.Name, other[field.Name], key, otherKey)
+				return btree.ErrStopScan
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return violation
+}
+
+// Exists reports whether a record with the given key is in the table.
+func (bts *BTreeStore) Exists(key uint64) (bool, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return false, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.exists(key)
+}
+
+// exists checks bloom filter, negative cache, then the tree. Caller must hold lock.
+func (bts *BTreeStore) exists(key uint64) (bool, error) {
+	if bts.tableBloom != nil && !bts.tableBloom.MayContain(key) {
+		return false, nil
+	}
+	if bts.negCache.Contains(key) {
+		return false, nil
+	}
+	_, found, err := bts.bt.Search(key)
+	return found, err
+}
+
+// Delete removes the record with key and returns the number of rows
+// affected: 0 if there is no such record, or RowsUnknown on a WAL-only table.
+func (bts *BTreeStore) Delete(key uint64) (int, error) {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	if bts.bt.IsWALOnly() {
+		if err := bts.LogDelete(key); err != nil {
+			return 0, fmt.Errorf("delete: failed to log WAL delete: %w", err)
+		}
+		bts.walPending = true
+		return RowsUnknown, nil
+	}
+
+	// check first so a missing key never reaches the WAL
+	exists, err := bts.exists(key)
+	if err != nil {
+		return 0, fmt.Errorf("delete: failed to check key %d: %w", key, err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	if err := bts.LogDelete(key); err != nil {
+		return 0, fmt.Errorf("delete: failed to log WAL delete: %w", err)
+	}
+	if err := bts.bt.Delete(key); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// ErrKeyNotFound is returned by DeleteReturning for a key with no record.
+var ErrKeyNotFound = errors.New("record not found")
+
+// DeleteReturning is Delete that also returns the removed record, finding
+// and removing it in one descent under one lock. A missing key fails with
+// ErrKeyNotFound. Not for WAL-only tables, which don't read the tree on
+// writes.
+func (bts *BTreeStore) DeleteReturning(key uint64) (schema.Record, error) {
+	if bts.bt.IsWALOnly() {
+		return nil, errors.New("delete: returning the record needs a tree; this table is wal-only")
+	}
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	if bts.tableBloom != nil && !bts.tableBloom.MayContain(key) {
+		return nil, fmt.Errorf("delete: key %d: %w", key, ErrKeyNotFound)
+	}
+	// the WAL record goes in once the key is known to exist, so a missing
+	// key never reaches the WAL
+	data, found, err := bts.bt.DeleteReturning(key, func() error { return bts.LogDelete(key) })
+	if err != nil {
+		return nil, fmt.Errorf("delete: key %d: %w", key, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("delete: key %d: %w", key, ErrKeyNotFound)
+	}
+	_, record, err := bts.bt.DeserializeRecord(data)
+	if err != nil {
+		return nil, fmt.Errorf("delete: key %d was removed but can't be decoded: %w", key, err)
+	}
+	return record, nil
+}
+
+func (bts *BTreeStore) Find(key uint64) (schema.Record, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return nil, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	if bts.tableBloom != nil && !bts.tableBloom.MayContain(key) {
+		// key definitely not in table
+		return nil, fmt.Errorf("record %d not found", key)
+	}
+
+	if bts.negCache.Contains(key) {
+		// bloom filter false positive we've already paid a tree search for
+		return nil, fmt.Errorf("record %d not found", key)
+	}
+
+	data, found, err := bts.bt.Search(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		bts.negCache.Add(key)
+		return nil, fmt.Errorf("record %d not found", key)
+	}
+	_, result, err := bts.bt.DeserializeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Next returns the record with the smallest key greater than afterKey, and
+// false if there is none. Stepping with the last key seen pages through the
+// table in key order.
+func (bts *BTreeStore) Next(afterKey uint64) (schema.Record, bool, error) {
+	if afterKey == math.MaxUint64 {
+		return nil, false, nil
+	}
+	return bts.seekOne(afterKey+1, true)
+}
+
+// Prev returns the record with the largest key less than beforeKey, and
+// false if there is none.
+func (bts *BTreeStore) Prev(beforeKey uint64) (schema.Record, bool, error) {
+	if beforeKey == 0 {
+		return nil, false, nil
+	}
+	return bts.seekOne(beforeKey-1, false)
+}
+
+// seekOne reads the first record at or after key (forward) or at or before it.
+func (bts *BTreeStore) seekOne(key uint64, forward bool) (schema.Record, bool, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return nil, false, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	found, err := bts.bt.SeekAndScan(key, forward, 1)
+	if err != nil || len(found) == 0 {
+		return nil, false, err
+	}
+	_, result, err := bts.bt.DeserializeRecord(found[0])
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+func (bts *BTreeStore) RangeScan(startKey, endKey uint64) ([]schema.Record, error) {
+	return bts.RangeScanCtx(context.Background(), startKey, endKey)
+}
+
+// RangeScanCtx is RangeScan that gives up with ctx.Err() once ctx is cancelled.
+func (bts *BTreeStore) RangeScanCtx(ctx context.Context, startKey, endKey uint64) ([]schema.Record, error) {
+	return bts.rangeScanEx(ctx, startKey, endKey, true, true)
+}
+
+// RangeScanEx is RangeScan with each end of the range inclusive or exclusive.
+// RangeScanEx(last, math.MaxUint64, false, true) returns everything after last.
+// A range holding no keys returns an empty slice, not an error.
+func (bts *BTreeStore) RangeScanEx(startKey, endKey uint64, includeStart, includeEnd bool) ([]schema.Record, error) {
+	return bts.rangeScanEx(context.Background(), startKey, endKey, includeStart, includeEnd)
+}
+
+func (bts *BTreeStore) rangeScanEx(ctx context.Context, startKey, endKey uint64, includeStart, includeEnd bool) ([]schema.Record, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return nil, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	limit := bts.resultLimit()
+	var results [][]byte
+	err := bts.bt.RangeScanExCtx(ctx, startKey, endKey, includeStart, includeEnd, func(key uint64, data []byte) error {
+		if len(results) == limit {
+			return bts.tooLarge(startKey, endKey)
+		}
+		results = append(results, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]schema.Record, 0, len(results))
+	for _, data := range results {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		_, rec, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// ScanPrefix returns the records whose keys, written in decimal, start with
+// prefix (see btree.BTree.PrefixScan), in key order. Like RangeScan it fails
+// with ErrResultTooLarge past the result cap.
+func (bts *BTreeStore) ScanPrefix(prefix string) ([]schema.Record, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return nil, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	limit := bts.resultLimit()
+	var results [][]byte
+	err := bts.bt.PrefixScanFunc(prefix, func(key uint64, data []byte) error {
+		if len(results) == limit {
+			return fmt.Errorf("scan of keys with prefix %q has more than %d records: %w", prefix, limit, ErrResultTooLarge)
+		}
+		results = append(results, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]schema.Record, 0, len(results))
+	for _, data := range results {
+		_, rec, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// KeyRecord is a record along with its primary key.
+type KeyRecord struct {
+	Key    uint64
+	Record schema.Record
+}
+
+// RangeScanKV is RangeScan returning each record's key with it, read from
+// the leaf rather than the record.
+func (bts *BTreeStore) RangeScanKV(startKey, endKey uint64) ([]KeyRecord, error) {
+	limit := bts.resultLimit()
+	var results []KeyRecord
+	err := bts.rangeScanKeyed(context.Background(), startKey, endKey, true, true, func(key uint64, rec schema.Record) error {
+		if len(results) == limit {
+			return bts.tooLarge(startKey, endKey)
+		}
+		results = append(results, KeyRecord{Key: key, Record: rec})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (bts *BTreeStore) rangeScanKeyed(ctx context.Context, startKey, endKey uint64, includeStart, includeEnd bool, fn func(uint64, schema.Record) error) error {
+	if err := bts.ensureMaterialized(); err != nil {
+		return err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	return bts.bt.RangeScanExCtx(ctx, startKey, endKey, includeStart, includeEnd, func(key uint64, data []byte) error {
+		_, rec, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return err
+		}
+		return fn(key, rec)
+	})
+}
+
+// RangeScanFunc streams records in [startKey, endKey] to fn without materializing
+// the full result. The read lock is held for the whole scan, so fn must not call
+// back into the store or block; return btree.ErrStopScan to end early. Use
+// RangeScanChunks when fn writes to a client.
+func (bts *BTreeStore) RangeScanFunc(startKey, endKey uint64, fn func(schema.Record) error) error {
+	return bts.RangeScanFuncCtx(context.Background(), startKey, endKey, fn)
+}
+
+// RangeScanFuncCtx is RangeScanFunc that stops with ctx.Err() once ctx is cancelled.
+func (bts *BTreeStore) RangeScanFuncCtx(ctx context.Context, startKey, endKey uint64, fn func(schema.Record) error) error {
+	return bts.RangeScanExFuncCtx(ctx, startKey, endKey, true, true, fn)
+}
+
+// RangeScanExFuncCtx is RangeScanFuncCtx with each end of the range inclusive or exclusive.
+func (bts *BTreeStore) RangeScanExFuncCtx(ctx context.Context, startKey, endKey uint64, includeStart, includeEnd bool, fn func(schema.Record) error) error {
+	return bts.rangeScanKeyed(ctx, startKey, endKey, includeStart, includeEnd, func(_ uint64, rec schema.Record) error {
+		return fn(rec)
+	})
+}
+
+// RangeScanChunks is RangeScanExFuncCtx for callers that do slow work with
+// the records, like writing them to a client. It copies up to chunkRows
+// records out under the read lock, releases the lock and the leaf, calls fn
+// with them, then seeks past the last key for the next chunk. Writes can
+// land between chunks, so the scan is not a point-in-time view.
+func (bts *BTreeStore) RangeScanChunks(ctx context.Context, startKey, endKey uint64, includeStart, includeEnd bool, chunkRows int, fn func([]schema.Record) error) error {
+	chunkRows = max(chunkRows, 1)
+	for {
+		chunk := make([]schema.Record, 0, chunkRows)
+		var lastKey uint64
+		err := bts.rangeScanKeyed(ctx, startKey, endKey, includeStart, includeEnd, func(key uint64, rec schema.Record) error {
+			chunk = append(chunk, rec)
+			lastKey = key
+			if len(chunk) == chunkRows {
+				return btree.ErrStopScan
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(chunk) > 0 {
+			if err := fn(chunk); err != nil {
+				if errors.Is(err, btree.ErrStopScan) {
+					return nil
+				}
+				return err
+			}
+		}
+		if len(chunk) < chunkRows || lastKey == endKey {
+			return nil
+		}
+		startKey, includeStart = lastKey, false
+	}
+}
+
+// ScanTolerant calls fn for every record in key order like RangeScanFunc,
+// but logs and skips records that fail to decode instead of stopping, so
+// what's still readable in a damaged table can be recovered. It returns how
+// many records were skipped.
+func (bts *BTreeStore) ScanTolerant(fn func(schema.Record) error) (int, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return 0, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	skipped := 0
+	err := bts.bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		_, rec, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			skipped++
+			bts.logger.Warn("scan: skipping unreadable record for key %d (%d bytes): %v", key, len(data), err)
+			return nil
+		}
+		return fn(rec)
+	})
+	return skipped, err
+}
+
+// Vacuum rebuilds the table into a compact new file and swaps it in. The
+// rebuild holds only the read lock, so reads carry on against the current
+// tree while writers wait. Writers that get in after it, before the swap
+// takes the write lock, are carried over: their keys are tracked, and
+// each one's latest state is read from the old tree and replayed into the
+// new one. As with any RWMutex, a waiting writer also holds back readers
+// that arrive after it.
+func (bts *BTreeStore) Vacuum() error {
+	if bts.replica {
+		return fmt.Errorf("vacuum: %w", ErrReplica)
+	}
+	if err := bts.ensureMaterialized(); err != nil {
+		return err
+	}
+	bts.vacuumMu.Lock()
+	defer bts.vacuumMu.Unlock()
+
+	bts.mu.RLock()
+	bts.bt.TrackChanges()
+	pages, rootID, err := bts.bt.BulkLoad()
+	bts.mu.RUnlock()
+
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	changed := bts.bt.TakeChanges()
+	if err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+
+	redo := make([]pager.WALRecord, 0, len(changed))
+	for _, key := range changed {
+		data, found, err := bts.bt.Search(key)
+		if err != nil {
+			return fmt.Errorf("vacuum: failed to read key %d written during the rebuild: %w", key, err)
+		}
+		if !found {
+			redo = append(redo, pager.WALRecord{Action: pager.DELETE, Key: pager.WalKey(key)})
+			continue
+		}
+		redo = append(redo, pager.WALRecord{Action: pager.INSERT, Key: pager.WalKey(key), RecordBytes: slices.Clone(data)})
+	}
+
+	if err := bts.LogVacuum(); err != nil {
+		return fmt.Errorf("vacuum: failed to log WAL vacuum: %w", err)
+	}
+	if err := bts.bt.ReplaceTree(pages, rootID); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	for _, record := range redo {
+		if err := bts.replay(record); err != nil {
+			return fmt.Errorf("vacuum: %w", err)
+		}
+	}
+	bts.negCache.Clear()
+
+	// Rebuild bloom filter after vacuum to remove false positives from deletes
+	return bts.rebuildBloomFilter()
+}
+
+// SetVacuumTempDir overrides where Vacuum stages the rebuilt table file. It
+// defaults to the table's own directory and must be on the same filesystem.
+func (bts *BTreeStore) SetVacuumTempDir(dir string) {
+	bts.bt.SetVacuumTempDir(dir)
+}
+
+// SetGrowChunk sets how many pages the table file grows by at once when
+// inserts need new pages, pager.DefaultGrowChunk by default; 0 lets every
+// new page extend the file as it is written.
+func (bts *BTreeStore) SetGrowChunk(pages int) {
+	bts.bt.SetGrowChunk(pages)
+}
+
+// SetSyncEnabled turns fsync on or off for the table file, its WAL and any
+// retained log; it is on by default. With it off, a crash of the process
+// loses nothing but a power loss can lose committed writes, so it's only
+// for throwaway tables, e.g. to keep fsync out of tests and benchmarks.
+func (bts *BTreeStore) SetSyncEnabled(on bool) {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	bts.bt.SetSyncEnabled(on)
+	if bts.wal != nil {
+		bts.wal.SetSyncEnabled(on)
+	}
+	if bts.rlog != nil {
+		bts.rlog.SetSyncEnabled(on)
+	}
+}
+
+// SetCacheMaxBytes bounds the memory the table's page cache holds, evicting
+// by bytes as well as by page count. 0, the default, caps the page count only.
+func (bts *BTreeStore) SetCacheMaxBytes(n int64) {
+	bts.bt.SetCacheMaxBytes(n)
+}
+
+// SetPinnedPolicy lets operations that find the page cache full of pinned
+// pages wait for a page to come free, or run over capacity, instead of
+// failing with pager.ErrAllPinned.
+func (bts *BTreeStore) SetPinnedPolicy(p pager.PinnedPolicy) {
+	bts.bt.SetPinnedPolicy(p)
+}
+
+// SetAllowNonFinite lets inserts and updates store NaN and ±Inf float
+// values. By default they fail with schema.ErrNonFiniteFloat.
+func (bts *BTreeStore) SetAllowNonFinite(allow bool) {
+	bts.bt.SetAllowNonFinite(allow)
+}
+
+// SetMaxRecordSize caps the encoded record size below the page limit,
+// pager.MaxRecordSize; 0 restores it. Larger records fail with
+// btree.ErrRecordTooLarge before they are logged.
+func (bts *BTreeStore) SetMaxRecordSize(n int) error {
+	return bts.bt.SetMaxRecordSize(n)
+}
+
+// SetMaxDepth caps how many levels a lookup descends before failing with
+// btree.ErrTreeTooDeep, btree.DefaultMaxDepth by default; 0 restores it.
+func (bts *BTreeStore) SetMaxDepth(n int) error {
+	return bts.bt.SetMaxDepth(n)
+}
+
+// DefaultMaxResultRows is how many records a scan that returns a slice,
+// such as RangeScan or ScanAll, collects before failing with
+// ErrResultTooLarge.
+const DefaultMaxResultRows = 1_000_000
+
+// ErrResultTooLarge is returned by a scan whose result would pass the row
+// limit. Stream it with RangeScanFunc instead, or take it a key range at a
+// time.
+var ErrResultTooLarge = errors.New("result too large; scan in pages or stream it")
+
+// SetMaxResultRows caps how many records RangeScan, RangeScanEx,
+// RangeScanKV, ScanAll and Query return, DefaultMaxResultRows by default; 0
+// restores the default. Streaming scans have no cap.
+func (bts *BTreeStore) SetMaxResultRows(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max result rows must not be negative, got %d", n)
+	}
+	bts.maxResultRows.Store(int64(n))
+	return nil
+}
+
+func (bts *BTreeStore) resultLimit() int {
+	if n := bts.maxResultRows.Load(); n > 0 {
+		return int(n)
+	}
+	return DefaultMaxResultRows
+}
+
+func (bts *BTreeStore) tooLarge(startKey, endKey uint64) error {
+	return fmt.Errorf("scan of keys %d to %d has more than %d records: %w", startKey, endKey, bts.resultLimit(), ErrResultTooLarge)
+}
+
+// VacuumEstimate reports the current file size and the size a vacuum would
+// leave, without writing anything.
+func (bts *BTreeStore) VacuumEstimate() (currentBytes, estimatedBytes uint64, err error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return 0, 0, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.bt.VacuumEstimate()
+}
+
+func (bts *BTreeStore) ScanAll() ([]schema.Record, error) {
+	return bts.RangeScan(0, math.MaxUint64)
+}
+func (bts *BTreeStore) Close() error {
+	if bts.rlog != nil {
+		if err := bts.rlog.Close(); err != nil {
+			return err
+		}
+	}
+	return bts.bt.Close()
+}
+
+// Rename moves the table to newName: <name>.db and <name>.wal are renamed in
+// their directory and the header's table name updated. The WAL is
+// checkpointed (emptied) first. Renaming the .db file is the commit point; if
+// we crash after it but before the header write, the table opens under its
+// old header name, and renaming it to newName again just updates the header.
+// Open descriptors follow a rename, so the store stays usable without reopening.
+func (bts *BTreeStore) Rename(newName string) error {
+	if newName == "" || strings.ContainsAny(newName, `/\`) {
+		return fmt.Errorf("rename: invalid table name %q", newName)
+	}
+
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	oldName := bts.bt.GetSchema().TableName
+	if newName == oldName {
+		return nil
+	}
+
+	// empty the WAL under the lock, so nothing is logged under the old
+	// schema hash between the checkpoint and the rename
+	if bts.bt.IsWALOnly() {
+		// pending records live only in the WAL; build the tree so checkpoint can empty it
+		if err := bts.materialize(); err != nil {
+			return fmt.Errorf("rename: %w", err)
+		}
+	}
+	if _, err := bts.checkpoint(); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	// the files move within the directory they were opened from, whatever
+	// the working directory is now
+	oldDB := bts.bt.FileName()
+	if oldDB == "" {
+		return errors.New("rename: table is not stored in a file")
+	}
+	oldBase := strings.TrimSuffix(oldDB, ".db")
+	newBase := filepath.Join(filepath.Dir(oldDB), newName)
+	newDB := newBase + ".db"
+	oldWAL, newWAL := oldBase+".wal", newBase+".wal"
+	oldLog, newLog := oldBase+".log", newBase+".log"
+
+	// a file already named newName (e.g. after an interrupted rename) only
+	// needs its header updated
+	if newDB != oldDB {
+		if err := renameTableFiles([][2]string{{oldWAL, newWAL}, {oldLog, newLog}, {oldDB, newDB}}); err != nil {
+			return fmt.Errorf("rename: %w", err)
+		}
+	}
+	if err := bts.bt.SetTableName(newName); err != nil {
+		return fmt.Errorf("rename: failed to update header (reopen %s to repair): %w", newDB, err)
+	}
+	if err := bts.wal.SetSchemaHash(bts.bt.SchemaHash()); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// renameTableFiles renames each [old, new] pair, the table file last, and
+// puts them all back if one fails. The WAL and log may not exist.
+func renameTableFiles(pairs [][2]string) error {
+	for _, pair := range pairs {
+		if _, err := os.Stat(pair[1]); err == nil {
+			return fmt.Errorf("%s already exists", pair[1])
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat %s: %w", pair[1], err)
+		}
+	}
+
+	// WAL first - it's empty after the checkpoint, so losing the race here is harmless
+	for i, pair := range pairs {
+		err := os.Rename(pair[0], pair[1])
+		if err == nil || (os.IsNotExist(err) && i < len(pairs)-1) {
+			continue
+		}
+		// put the others back so the old name stays consistent
+		for _, done := range pairs[:i] {
+			os.Rename(done[1], done[0])
+		}
+		return fmt.Errorf("failed to rename %s: %w", pair[0], err)
+	}
+	return nil
+}
+
+func (bts *BTreeStore) Schema() schema.Schema {
+	return bts.bt.GetSchema()
+}
+
+// SchemaHash fingerprints the table's schema (see schema.Schema.Hash), so
+// clients can check they agree on it before bulk operations.
+func (bts *BTreeStore) SchemaHash() uint64 {
+	return bts.bt.SchemaHash()
+}
+
+// TableID is the table's identity, stamped on its WAL and archived WALs.
+func (bts *BTreeStore) TableID() pager.TableID {
+	return bts.bt.TableID()
+}
+
+func (bts *BTreeStore) Codec() schema.CodecType {
+	return bts.bt.GetCodec()
+}
+
+func (bts *BTreeStore) IsWALOnly() bool {
+	return bts.bt.IsWALOnly()
+}
+
+func (bts *BTreeStore) IsCompressed() bool {
+	return bts.bt.IsCompressed()
+}
+
+func (bts *BTreeStore) FlushesWrites() bool {
+	return bts.bt.FlushesWrites()
+}
+
+func (bts *BTreeStore) OmitsKey() bool {
+	return bts.bt.OmitsKey()
+}
+
+func (bts *BTreeStore) IsVersioned() bool {
+	return bts.bt.IsVersioned()
+}
+
+func (bts *BTreeStore) ForwardsUpdates() bool {
+	return bts.bt.IsForwarding()
+}
+
+// NumPages is the number of data pages allocated so far (excluding the header).
+func (bts *BTreeStore) NumPages() uint32 {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.bt.NumPages()
+}
+
+// CompactPage packs a single page's live records together, a cheap alternative
+// to a full vacuum for one fragmented page. Returns the bytes of free space gained.
+func (bts *BTreeStore) CompactPage(id pager.PageID) (int, error) {
+	if bts.replica {
+		return 0, ErrReplica
+	}
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	return bts.bt.CompactPage(id)
+}
+
+// PathStep is one page a lookup reads on its way down to a key's leaf.
+type PathStep struct {
+	PageID pager.PageID
+	Type   pager.PageType
+	Keys   int
+}
+
+// PathTo returns the pages from the root to the leaf that holds key, or
+// would if it were inserted.
+func (bts *BTreeStore) PathTo(key uint64) ([]PathStep, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return nil, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	ids, err := bts.bt.PathTo(key)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]PathStep, len(ids))
+	for i, id := range ids {
+		pageType, keys, err := bts.bt.PageSummary(id)
+		if err != nil {
+			return nil, err
+		}
+		path[i] = PathStep{PageID: id, Type: pageType, Keys: keys}
+	}
+	return path, nil
+}
+
+// Fanout reports the tree's effective order: the mean children per internal
+// page and the fullest leaf's record count, from a sample of leaves. Together
+// with the record size they decide the tree's depth, and so lookup cost.
+func (bts *BTreeStore) Fanout() (avgInternalChildren float64, maxLeafRecords int, err error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return 0, 0, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.bt.Fanout()
+}
+
+// warmupLeaves is how many leaves (from the left) Warmup preloads after the internals.
+const warmupLeaves = 32
+
+// Warmup preloads the tree's internal pages and first few leaves into the page
+// cache so early queries don't pay for cold reads.
+func (bts *BTreeStore) Warmup() error {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	_, err := bts.bt.Warmup(warmupLeaves)
+	return err
+}
+
+// Count returns the number of records in the table (full leaf scan).
+func (bts *BTreeStore) Count() (int, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return 0, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.bt.Count()
+}
+
+// PendingWAL returns the records that would be replayed after a crash: the
+// WAL is emptied on every checkpoint, so that's everything in it.
+func (bts *BTreeStore) PendingWAL() ([]pager.WALRecord, error) {
+	// the read lock keeps a checkpoint from truncating mid-read
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	if bts.replica {
+		return nil, nil
+	}
+	records, err := bts.wal.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL: %w", err)
+	}
+	return records, nil
+}
+
+// HasPendingWAL reports whether the WAL has records since the last checkpoint.
+func (bts *BTreeStore) HasPendingWAL() (bool, error) {
+	if bts.replica {
+		return false, nil
+	}
+	return bts.wal.HasPendingRecords()
+}
+
+func (bts *BTreeStore) Stats() string {
+	return bts.bt.Stats()
+}
+
+// CacheStats reports the page cache's counters. The cache guards them with its
+// own mutex, so this doesn't take the store lock.
+func (bts *BTreeStore) CacheStats() pager.CacheStats {
+	return bts.bt.CacheStats()
+}
+
+// FreePages returns a snapshot of the page IDs waiting to be reused by AllocatePage.
+func (bts *BTreeStore) FreePages() []pager.PageID {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.bt.FreePages()
+}
+
+func (bts *BTreeStore) ExtractPrimaryKey(record schema.Record) (uint64, error) {
+	return bts.bt.ExtractPrimaryKey(record)
+}
+
+func (bts *BTreeStore) Recover() error {
+	records, err := bts.wal.ReadAll()
+	if err != nil {
+		// If WAL is empty or doesn't exist, nothing to recover
+		if errors.Is(err, io.EOF) {
+			bts.logger.Debug("WAL recovery: WAL file is empty or doesn't exist (EOF)")
+			return bts.clearCheckpointLSN()
+		}
+		return fmt.Errorf("recovery: failed to read WAL: %w", err)
+	}
+
+	// No records to recover
+	if len(records) == 0 {
+		bts.logger.Debug("WAL recovery: no records found in WAL")
+		// a checkpoint truncated the WAL but stopped before clearing its watermark
+		return bts.clearCheckpointLSN()
+	}
+
+	// records at or below the watermark were flushed by a checkpoint that
+	// didn't get to truncate the WAL; replaying them would fail or double-apply
+	watermark := bts.bt.CheckpointLSN()
+	skipped := 0
+	for _, record := range records {
+		if watermark == 0 || uint64(record.Lsn) > watermark {
+			break
+		}
+		skipped++
+	}
+	if skipped > 0 {
+		bts.logger.Info("WAL recovery: skipping %d records at or below checkpoint LSN %d", skipped, watermark)
+	}
+	records = records[skipped:]
+
+	if len(records) == 0 {
+		return nil
+	}
+	// only the last operation on each key matters, and replay() doesn't
+	// care which of them the pages already reflect
+	compacted := pager.CompactRecords(records)
+	bts.logger.Info("WAL recovery: found %d records to replay (%d after compaction)", len(records), len(compacted))
+
+	// that leaves one record per key, so they can go in any order: the
+	// deletes together, then the rest in key order, which walks the leaves
+	// once instead of jumping between them
+	start := time.Now()
+	var deletes []uint64
+	var rest []pager.WALRecord
+	for _, record := range compacted {
+		if record.Action == pager.DELETE {
+			deletes = append(deletes, uint64(record.Key))
+		} else {
+			rest = append(rest, record)
+		}
+	}
+	slices.SortFunc(rest, func(a, b pager.WALRecord) int { return cmp.Compare(a.Key, b.Key) })
+
+	if err := bts.replayDeletes(deletes); err != nil {
+		return fmt.Errorf("recovery: %w", err)
+	}
+	for i, record := range rest {
+		if err := bts.replay(record); err != nil {
+			return fmt.Errorf("recovery: %w", err)
+		}
+		if done := len(deletes) + i + 1; done%recoveryProgressEvery == 0 {
+			bts.logger.Info("WAL recovery: replayed %d of %d records (%v)", done, len(compacted), time.Since(start).Round(time.Millisecond))
+		}
+	}
+	bts.logger.Info("WAL recovery: replayed %d records in %v", len(compacted), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// recoveryProgressEvery is how many replayed records Recover logs progress after.
+const recoveryProgressEvery = 10000
+
+// replayDeletes replays DELETE records for keys in one DeleteBatch, skipping
+// keys already gone. Caller must hold lock.
+func (bts *BTreeStore) replayDeletes(keys []uint64) error {
+	present := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		found, err := bts.exists(key)
+		if err != nil {
+			return fmt.Errorf("failed to check key %d: %w", key, err)
+		}
+		if found {
+			present = append(present, key)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+	if err := bts.bt.DeleteBatch(present); err != nil {
+		return fmt.Errorf("failed to replay %d DELETEs: %w", len(present), err)
+	}
+	bts.logger.Info("WAL recovery: replayed %d deletes", len(present))
+	return nil
+}
+
+// replay applies one WAL record idempotently: an INSERT overwrites any row
+// with its key (or is skipped if the row already matches), and a DELETE of a
+// missing key is a no-op. Caller must hold lock.
+func (bts *BTreeStore) replay(record pager.WALRecord) error {
+	key := uint64(record.Key)
+	switch record.Action {
+	case pager.INSERT:
+		data, found, err := bts.bt.Search(key)
+		if err != nil {
+			return fmt.Errorf("failed to check key %d: %w", key, err)
+		}
+		if found && bytes.Equal(data, record.RecordBytes) {
+			return nil
+		}
+		if found {
+			if err := bts.bt.Delete(key); err != nil {
+				return fmt.Errorf("failed to replay INSERT for key %d: %w", key, err)
+			}
+		}
+		if err := bts.bt.Insert(key, record.RecordBytes); err != nil {
+			return fmt.Errorf("failed to replay INSERT for key %d: %w", key, err)
+		}
+		if bts.tableBloom != nil {
+			bts.tableBloom.Add(key)
+		}
+		bts.negCache.Remove(key)
+	case pager.DELETE:
+		found, err := bts.exists(key)
+		if err != nil {
+			return fmt.Errorf("failed to check key %d: %w", key, err)
+		}
+		if found {
+			if err := bts.bt.Delete(key); err != nil {
+				return fmt.Errorf("failed to replay DELETE for key %d: %w", key, err)
+			}
+		}
+	case pager.CHECKPOINT, pager.VACUUM:
+		// markers only
+	default:
+		return fmt.Errorf("unsupported action: %v", record.Action)
+	}
+	return nil
 }
 
-func NewBTreeStore(filename string, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
+// ConsistencyCheck is a health check for the table as a whole: the header
+// and tree must pass BTree.Verify, the WAL must be readable, and the tree
+// must already reflect the last operation on every key the WAL still holds.
+// WAL-only tables are exempt from that last part, since their tree lags
+// the WAL by design. Returns the first problem found.
+func (bts *BTreeStore) ConsistencyCheck() error {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	if err := bts.bt.Verify(); err != nil {
+		return fmt.Errorf("consistency: %w", err)
+	}
+	if bts.replica {
+		return nil
 	}
 
-	walFileName := strings.TrimSuffix(filename, ".db") + ".wal"
-	wm, err := pager.NewWalManager(walFileName, ctx, wg)
+	records, err := bts.wal.Snapshot()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("consistency: failed to read WAL: %w", err)
 	}
-
-	dm := &pager.DiskManager{}
-	dm.SetFile(file)
-	stat, _ := file.Stat()
-	if stat.Size() == 0 {
-		sch := schema.Schema{
-			TableName: "table",
-			Fields: []schema.Field{
-				{Name: "id", Type: schema.IntType},
-				{Name: "name", Type: schema.StringType},
-				{Name: "age", Type: schema.IntType},
-			},
-		}
-		dm.SetHeader(pager.DefaultTableHeader(sch))
-		dm.WriteHeader()
-		rootPage := pager.NewSlottedPage(1, pager.LEAF)
-		dm.WriteSlottedPage(rootPage)
-	} else {
-		err = dm.ReadHeader()
+	if bts.bt.IsWALOnly() {
+		return nil
+	}
+	for _, record := range pager.CompactRecords(records) {
+		key := uint64(record.Key)
+		data, found, err := bts.bt.Search(key)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("consistency: failed to look up key %d: %w", key, err)
+		}
+		switch record.Action {
+		case pager.INSERT:
+			if !found || !bytes.Equal(data, record.RecordBytes) {
+				return fmt.Errorf("consistency: WAL INSERT at LSN %d for key %d is not in the tree", record.Lsn, key)
+			}
+		case pager.DELETE:
+			if found {
+				return fmt.Errorf("consistency: WAL DELETE at LSN %d for key %d, but the key is still in the tree", record.Lsn, key)
+			}
 		}
 	}
+	return nil
+}
 
-	header := dm.GetHeader()
-	bt := btree.NewBTree(dm, header)
-	bts := &BTreeStore{bt: bt, wal: wm, ctx: ctx, wg: wg}
-
-	// Replay WAL to recover any uncommitted operations
-	if err := bts.Recover(); err != nil {
-		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+// SyncHeader writes the header (root page, page count, free pages) and
+// fsyncs the table file, e.g. before a backup. Unlike Checkpoint it leaves
+// cached pages and the WAL alone, so the header may name pages only the
+// WAL can rebuild yet.
+func (bts *BTreeStore) SyncHeader() error {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	if err := bts.bt.SyncHeader(); err != nil {
+		return fmt.Errorf("sync header: %w", err)
 	}
+	return nil
+}
 
-	if err := bts.rebuildBloomFilter(); err != nil {
-		return nil, err
-	}
+// CheckpointStats describes the work done by a checkpoint.
+type CheckpointStats struct {
+	PagesFlushed int
+	WALSize      int64 // after truncation, normally 0
+	WALCompacted int   // records dropped by compacting a WAL that was kept
+}
 
-	wg.Add(1)
-	go bts.startCheckpointer()
-	return bts, nil
+func (bts *BTreeStore) Checkpoint() error {
+	_, err := bts.CheckpointWithStats()
+	return err
 }
 
-func CreateBTreeStore(filename string, sch schema.Schema, ctx context.Context, wg *sync.WaitGroup) (*BTreeStore, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+func (bts *BTreeStore) CheckpointWithStats() (CheckpointStats, error) {
+	bts.mu.Lock()
+	stats, err := bts.checkpoint()
+	bts.mu.Unlock()
 	if err != nil {
-		return nil, err
+		return stats, err
 	}
-
-	walFileName := strings.TrimSuffix(filename, ".db") + ".wal"
-	wm, err := pager.NewWalManager(walFileName, ctx, wg)
-	if err != nil {
-		return nil, err
+	if err := bts.refreshSnapshot(); err != nil {
+		return stats, fmt.Errorf("checkpoint: %w", err)
 	}
+	return stats, nil
+}
 
-	dm := &pager.DiskManager{}
-	dm.SetFile(file)
-	stat, _ := file.Stat()
-
-	if stat.Size() == 0 {
-		dm.SetHeader(pager.DefaultTableHeader(sch))
-		dm.WriteHeader()
-		rootPage := pager.NewSlottedPage(1, pager.LEAF)
-		dm.WriteSlottedPage(rootPage)
-	} else {
-		return nil, fmt.Errorf("file already exists: %s", filename)
+// checkpoint flushes the pages and empties the WAL. Caller must hold mu.
+func (bts *BTreeStore) checkpoint() (CheckpointStats, error) {
+	var stats CheckpointStats
+	if bts.replica {
+		return stats, fmt.Errorf("checkpoint: %w", ErrReplica)
 	}
 
-	header := dm.GetHeader()
-	bt := btree.NewBTree(dm, header)
-	bts := &BTreeStore{bt: bt, wal: wm, ctx: ctx, wg: wg}
+	if bts.walPending {
+		// the WAL is the only copy of a WAL-only table's pending records,
+		// so it can't be truncated - but superseded records can go, unless
+		// they are history still to be retained
+		if bts.rlog == nil {
+			dropped, err := bts.wal.Compact()
+			if err != nil && !errors.Is(err, pager.ErrWALClosed) {
+				return stats, fmt.Errorf("checkpoint: %w", err)
+			}
+			stats.WALCompacted = dropped
+		}
+		size, err := bts.wal.Size()
+		stats.WALSize = size
+		return stats, err
+	}
 
-	// Replay WAL to recover any uncommitted operations (if WAL exists)
-	if err := bts.Recover(); err != nil {
-		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+	if err := bts.retainWAL(); err != nil {
+		return stats, fmt.Errorf("checkpoint: %w", err)
+	}
+	// checked ahead of the CHECKPOINT marker, which alone isn't worth archiving
+	hadRecords, err := bts.wal.HasPendingRecords()
+	if err != nil {
+		return stats, fmt.Errorf("checkpoint: failed to stat WAL: %w", err)
+	}
+	flushed, err := bts.checkpointPages()
+	stats.PagesFlushed = flushed
+	if err != nil {
+		return stats, err
 	}
 
-	if err := bts.rebuildBloomFilter(); err != nil {
-		return nil, err
+	if err := bts.archiveWAL(hadRecords); err != nil {
+		return stats, fmt.Errorf("checkpoint: %w", err)
 	}
 
-	wg.Add(1)
-	go bts.startCheckpointer()
-	return bts, nil
+	// Sync to ensure pages are durable
+	// Now safe to truncate WAL
+	if err := bts.wal.Truncate(); err != nil {
+		return stats, fmt.Errorf("checkpoint: failed to truncate WAL: %w", err)
+	}
+	if err := bts.clearCheckpointLSN(); err != nil {
+		return stats, fmt.Errorf("checkpoint: %w", err)
+	}
+	stats.WALSize, err = bts.wal.Size()
+	if err != nil {
+		return stats, fmt.Errorf("checkpoint: failed to stat WAL: %w", err)
+	}
+	return stats, nil
 }
 
-func (bts *BTreeStore) startCheckpointer() {
-	defer bts.wg.Done()
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			if err := bts.Checkpoint(); err != nil {
-				log.Printf("Backgound checkpoint failed: %v", err)
-			}
-			fmt.Printf("DEBUG: checkpoint hit at %v\n", time.Now().UTC())
-		case <-bts.ctx.Done():
-			if err := bts.Checkpoint(); err != nil {
-				log.Printf("Backgound checkpoint failed: %v", err)
-			}
-			fmt.Printf("DEBUG: checkpoint hit at %v\n", time.Now().UTC())
-			return
+// SetWALArchiveDir turns on WAL archiving: each checkpoint copies the WAL
+// to a file in dir before truncating it, named for the table, the time and
+// the checkpoint's LSN, e.g. users-20250102T150405.000000000-lsn4096.wal.
+// Read one back with pager.ReadArchivedWAL, passing TableID and SchemaHash
+// (as of the checkpoint; a rename changes the hash). "" turns archiving off, the
+// default. It isn't persisted, so set it again after each Open.
+func (bts *BTreeStore) SetWALArchiveDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create WAL archive directory: %w", err)
 		}
 	}
-}
-
-func (bts *BTreeStore) Insert(record schema.Record) error {
 	bts.mu.Lock()
 	defer bts.mu.Unlock()
+	bts.archiveDir = dir
+	return nil
+}
 
-	key, err := bts.bt.ExtractPrimaryKey(record)
-	if err != nil {
-		return fmt.Errorf("insert: failed to extract primary key from table '%s': %w", bts.Schema().TableName, err)
+// archiveWAL copies the WAL into the archive directory, if there is one,
+// ahead of a truncate; hadRecords is whether it held records before the
+// checkpoint's marker. A failed copy fails the checkpoint, leaving the WAL
+// in place. Caller must hold mu.
+func (bts *BTreeStore) archiveWAL(hadRecords bool) error {
+	if bts.archiveDir == "" || !hadRecords {
+		return nil
 	}
+	name := fmt.Sprintf("%s-%s-lsn%d.wal", bts.Schema().TableName,
+		time.Now().UTC().Format("20060102T150405.000000000"), bts.bt.CheckpointLSN())
+	if err := bts.wal.Archive(filepath.Join(bts.archiveDir, name)); err != nil {
+		return fmt.Errorf("failed to archive WAL: %w", err)
+	}
+	return nil
+}
 
-	data, err := bts.bt.SerializeRecord(record)
+func (bts *BTreeStore) openRetainedLog(filename string, header *pager.TableHeader) error {
+	if !header.RetainLog {
+		return nil
+	}
+	rlog, err := pager.OpenRetainedLog(strings.TrimSuffix(filename, ".db")+".log", header.TableID)
 	if err != nil {
-		return fmt.Errorf("insert: failed to serialize record: %w", err)
+		return fmt.Errorf("failed to open retained log: %w", err)
 	}
+	bts.rlog = rlog
+	return nil
+}
 
-	if err := bts.LogInsert(key, data); err != nil {
-		return fmt.Errorf("insert: failed to log WAL insert: %w", err)
+// retainWAL copies the WAL's records to the retained log ahead of a truncate.
+// Records at or below the checkpoint watermark were copied by the checkpoint
+// that set it. A crash between this append and the header write repeats the
+// batch on the next checkpoint, so the log holds every record at least once.
+// Caller must hold mu.
+func (bts *BTreeStore) retainWAL() error {
+	if bts.rlog == nil {
+		return nil
 	}
-
-	if bts.tableBloom != nil {
-		bts.tableBloom.Add(key)
+	records, err := bts.pendingRecords()
+	if err != nil {
+		return fmt.Errorf("failed to read WAL: %w", err)
 	}
-
-	return bts.bt.Insert(key, data)
+	return bts.rlog.Append(records)
 }
 
-func (bts *BTreeStore) Delete(key uint64) error {
-	bts.mu.Lock()
-	defer bts.mu.Unlock()
-	if err := bts.LogDelete(key); err != nil {
-		return fmt.Errorf("delete: failed to log WAL delete: %w", err)
+// pendingRecords reads the WAL records above the checkpoint watermark.
+// Caller must hold mu.
+func (bts *BTreeStore) pendingRecords() ([]pager.WALRecord, error) {
+	records, err := bts.wal.Snapshot()
+	if err != nil {
+		return nil, err
 	}
-	return bts.bt.Delete(key)
+	watermark := bts.bt.CheckpointLSN()
+	skipped := 0
+	for skipped < len(records) && watermark != 0 && uint64(records[skipped].Lsn) <= watermark {
+		skipped++
+	}
+	return records[skipped:], nil
 }
 
-func (bts *BTreeStore) Find(key int) (schema.Record, error) {
+// ScanByLSN calls fn for every insert and delete the table has logged, in
+// the order they were written: first the retained log, then records still
+// in the WAL. Lsn is the record's offset in the retained log; records not
+// yet copied there get the offset they will be copied to. Only tables
+// created with RetainLog keep their history past a checkpoint. Returning
+// btree.ErrStopScan from fn ends the scan early without error.
+func (bts *BTreeStore) ScanByLSN(fn func(pager.WALRecord) error) error {
 	bts.mu.RLock()
 	defer bts.mu.RUnlock()
 
-	if bts.tableBloom != nil && !bts.tableBloom.MayContain(uint64(key)) {
-		// key definitely not in table
-		return nil, fmt.Errorf("record %d not found", key)
+	if bts.rlog == nil {
+		return fmt.Errorf("scanbylsn: table '%s' does not retain its log", bts.Schema().TableName)
 	}
-
-	data, found, err := bts.bt.Search(uint64(key))
+	retained, err := bts.rlog.Records()
 	if err != nil {
-		return nil, err
-	}
-	if !found {
-		return nil, fmt.Errorf("record %d not found", key)
+		return fmt.Errorf("scanbylsn: failed to read retained log: %w", err)
 	}
-	_, result, err := bts.bt.DeserializeRecord(data)
+	pending, err := bts.pendingRecords()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("scanbylsn: failed to read WAL: %w", err)
 	}
-	return result, nil
-}
-
-func (bts *BTreeStore) RangeScan(startKey, endKey uint64) ([]schema.Record, error) {
-	bts.mu.RLock()
-	defer bts.mu.RUnlock()
-
-	results, err := bts.bt.RangeScan(startKey, endKey)
+	next, err := bts.rlog.NextLSN()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("scanbylsn: %w", err)
 	}
 
-	records := make([]schema.Record, 0, len(results))
-	for _, data := range results {
-		_, rec, err := bts.bt.DeserializeRecord(data)
+	records := retained
+	for _, record := range pending {
+		if record.Action != pager.INSERT && record.Action != pager.DELETE {
+			continue
+		}
+		data, err := record.Serialize()
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("scanbylsn: %w", err)
 		}
-		records = append(records, rec)
+		record.Lsn = next
+		next += pager.LSN(len(data))
+		records = append(records, record)
 	}
 
-	return records, nil
-}
-
-func (bts *BTreeStore) Vacuum() error {
-	if err := bts.LogVacuum(); err != nil {
-		return fmt.Errorf("vacuum: failed to log WAL vacuum: %w", err)
-	}
-	if err := bts.bt.Vacuum(); err != nil {
-		return err
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			if errors.Is(err, btree.ErrStopScan) {
+				return nil
+			}
+			return err
+		}
 	}
-
-	// Rebuild bloom filter after vacuum to remove false positives from deletes
-	return bts.rebuildBloomFilter()
-}
-
-func (bts *BTreeStore) ScanAll() ([]schema.Record, error) {
-	return bts.RangeScan(0, math.MaxUint64)
-}
-func (bts *BTreeStore) Close() error {
-	return bts.bt.Close()
+	return nil
 }
 
-func (bts *BTreeStore) Schema() schema.Schema {
-	return bts.bt.GetSchema()
+func (bts *BTreeStore) RetainsLog() bool {
+	return bts.rlog != nil
 }
 
-func (bts *BTreeStore) Stats() string {
-	return bts.bt.Stats()
-}
+// checkpointPages logs a CHECKPOINT marker and flushes every page, with the
+// header recording the marker's LSN as the recovery watermark. Should the WAL
+// then survive (a crash before the truncate), Recover skips what it covers.
+// Caller must hold mu.
+func (bts *BTreeStore) checkpointPages() (int, error) {
+	// At shutdown the WAL writer may already have stopped; nothing can
+	// append after that, so the watermark is whatever the WAL ends with.
+	lsn, err := bts.LogCheckpoint()
+	if errors.Is(err, pager.ErrWALClosed) {
+		lsn, err = bts.lastWALLSN()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("checkpoint: failed to log checkpoint in WAL: %w", err)
+	}
 
-func (bts *BTreeStore) ExtractPrimaryKey(record schema.Record) (uint64, error) {
-	return bts.bt.ExtractPrimaryKey(record)
+	bts.bt.SetCheckpointLSN(uint64(lsn))
+	flushed, err := bts.bt.Checkpoint()
+	if err != nil {
+		return flushed, fmt.Errorf("checkpoint: failed to flush pages: %w", err)
+	}
+	return flushed, nil
 }
 
-func (bts *BTreeStore) Recover() error {
-	records, err := bts.wal.ReadAll()
-	if err != nil {
-		// If WAL is empty or doesn't exist, nothing to recover
-		if errors.Is(err, io.EOF) {
-			log.Printf("WAL recovery: WAL file is empty or doesn't exist (EOF)")
-			return nil
-		}
-		return fmt.Errorf("recovery: failed to read WAL: %w", err)
+func (bts *BTreeStore) lastWALLSN() (pager.LSN, error) {
+	records, err := bts.wal.Snapshot()
+	if err != nil || len(records) == 0 {
+		return 0, err
 	}
+	return records[len(records)-1].Lsn, nil
+}
 
-	// No records to recover
-	if len(records) == 0 {
-		log.Printf("WAL recovery: No records found in WAL")
+// clearCheckpointLSN drops the watermark once the WAL it refers to is gone,
+// before any new record can reuse its LSNs.
+func (bts *BTreeStore) clearCheckpointLSN() error {
+	if bts.bt.CheckpointLSN() == 0 {
 		return nil
 	}
-
-	log.Printf("WAL recovery: Found %d records to replay", len(records))
-	for _, record := range records {
-		switch record.Action {
-		case pager.INSERT:
-			if err := bts.bt.Insert(uint64(record.Key), record.RecordBytes); err != nil {
-				return fmt.Errorf("recovery: failed to replay INSERT for key %d: %w", record.Key, err)
-			}
-		case pager.DELETE:
-			if err := bts.bt.Delete(uint64(record.Key)); err != nil {
-				return fmt.Errorf("recovery: failed to replay DELETE for key %d: %w", record.Key, err)
-			}
-		default:
-			return fmt.Errorf("unsupported action: %v", record.Action)
-		}
+	bts.bt.SetCheckpointLSN(0)
+	if err := bts.bt.FlushHeader(); err != nil {
+		return fmt.Errorf("failed to clear checkpoint LSN: %w", err)
 	}
 	return nil
 }
 
-func (bts *BTreeStore) Checkpoint() error {
+func (bts *BTreeStore) Commit(txnBuffer []pager.WALRecord) error {
+	if bts.replica {
+		return fmt.Errorf("commit: %w", ErrReplica)
+	}
 	bts.mu.Lock()
 	defer bts.mu.Unlock()
 
-	// Write checkpoint START marker
-	if err := bts.LogCheckpoint(); err != nil {
-		return fmt.Errorf("checkpoint: failed to log checkpoint in WAL: %w", err)
+	// 1. Check unique fields against the table and the rest of the batch,
+	// since either may have changed since the records were prepared
+	unique := len(bts.Schema().UniqueFields()) > 0
+	if unique && bts.bt.IsWALOnly() {
+		if err := bts.materialize(); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
 	}
-
-	// Flush pages
-	if err := bts.bt.Checkpoint(); err != nil {
-		return fmt.Errorf("checkpoint: failed to flush pages: %w", err)
+	if err := bts.checkBatchUnique(txnBuffer); err != nil {
+		return fmt.Errorf("commit: %w", err)
 	}
 
-	// Sync to ensure pages are durable
-	// Now safe to truncate WAL
-	return bts.wal.Truncate()
-}
-
-func (bts *BTreeStore) Commit(txnBuffer []pager.WALRecord) error {
-	// 1. Log actions
-	done := make(chan error, 1)
-	bts.wal.RequestChan <- pager.WALRequest{
-		Records: txnBuffer,
-		Done:    done,
-	}
-	if err := <-done; err != nil {
+	// 2. Log actions
+	if err := bts.wal.Submit(txnBuffer); err != nil {
 		return fmt.Errorf("commit - received error from wal buffer: %w", err)
 	}
 
+	if bts.bt.IsWALOnly() && !unique {
+		bts.walPending = true
+		return nil
+	}
+
 	// 3. now apply all operations to the tree
 	for _, record := range txnBuffer {
 		switch record.Action {
 		case pager.INSERT:
+			if bts.tableBloom != nil {
+				bts.tableBloom.Add(uint64(record.Key))
+			}
+			bts.negCache.Remove(uint64(record.Key))
 			if err := bts.bt.Insert(uint64(record.Key), record.RecordBytes); err != nil {
 				return fmt.Errorf("commit: failed to INSERT key %d: %w", record.Key, err)
 			}
@@ -330,7 +2150,7 @@ func (bts *BTreeStore) Commit(txnBuffer []pager.WALRecord) error {
 				return fmt.Errorf("commit: failed to DELETE key %d: %w", record.Key, err)
 			}
 		case pager.CHECKPOINT:
-			if err := bts.bt.Checkpoint(); err != nil {
+			if _, err := bts.bt.Checkpoint(); err != nil {
 				return fmt.Errorf("commit: failed to log checkpoint in WAL: %w", err)
 			}
 		case pager.VACUUM:
@@ -345,16 +2165,33 @@ func (bts *BTreeStore) Commit(txnBuffer []pager.WALRecord) error {
 }
 
 func (bts *BTreeStore) PrepareInsert(record schema.Record) (pager.WALRecord, error) {
+	record, err := bts.stampCreatedAt(record)
+	if err != nil {
+		return pager.WALRecord{}, err
+	}
+	return bts.prepareInsert(record)
+}
+
+func (bts *BTreeStore) prepareInsert(record schema.Record) (pager.WALRecord, error) {
 	key, err := bts.bt.ExtractPrimaryKey(record)
 	if err != nil {
 		return pager.WALRecord{}, fmt.Errorf("failed to extract primary key for table '%s': %w", bts.Schema().TableName, err)
 	}
+	if err := bts.checkKeyRange(key); err != nil {
+		return pager.WALRecord{}, err
+	}
 
 	data, err := bts.bt.SerializeRecord(record)
 	if err != nil {
 		return pager.WALRecord{}, fmt.Errorf("failed to serialized record: %w", err)
 	}
 
+	// checked against the table as of now to fail early; Commit checks
+	// again, against the rest of the transaction too
+	if err := bts.CheckUnique(record); err != nil {
+		return pager.WALRecord{}, err
+	}
+
 	return pager.WALRecord{
 		Action:       pager.INSERT,
 		Key:          pager.WalKey(key),
@@ -363,6 +2200,39 @@ func (bts *BTreeStore) PrepareInsert(record schema.Record) (pager.WALRecord, err
 	}, nil
 }
 
+// PrepareUpdate is PrepareInsert for the new image of an existing row: it
+// keeps the stored row's insert time, and on a versioned table it carries
+// the stored version plus one.
+func (bts *BTreeStore) PrepareUpdate(record schema.Record) (pager.WALRecord, error) {
+	key, err := bts.bt.ExtractPrimaryKey(record)
+	if err != nil {
+		return pager.WALRecord{}, fmt.Errorf("failed to extract primary key for table '%s': %w", bts.Schema().TableName, err)
+	}
+	if bts.bt.IsWALOnly() {
+		// the stored row can't be read back, as in update
+		return bts.PrepareInsert(record)
+	}
+
+	bts.mu.RLock()
+	record, err = bts.carryCreatedAt(key, record)
+	var version uint64
+	var found bool
+	if err == nil && bts.bt.IsVersioned() {
+		version, found, err = bts.storedVersion(key)
+		if err != nil {
+			err = fmt.Errorf("failed to read version of key %d: %w", key, err)
+		}
+	}
+	bts.mu.RUnlock()
+	if err != nil {
+		return pager.WALRecord{}, err
+	}
+	if found {
+		record = withVersion(record, version+1)
+	}
+	return bts.prepareInsert(record)
+}
+
 func (bts *BTreeStore) PrepareDelete(key uint64) (pager.WALRecord, error) {
 
 	return pager.WALRecord{
@@ -371,15 +2241,22 @@ func (bts *BTreeStore) PrepareDelete(key uint64) (pager.WALRecord, error) {
 	}, nil
 }
 
-func (bts *BTreeStore) LogCheckpoint() error {
+func (bts *BTreeStore) LogCheckpoint() (pager.LSN, error) {
+	if bts.replica {
+		return 0, ErrReplica
+	}
 	rpi, npi := bts.bt.GetWalMetadata()
-	if err := bts.wal.LogCheckpoint(rpi, npi); err != nil {
-		return fmt.Errorf("failed to log WAL checkpoint: %w", err)
+	lsn, err := bts.wal.LogCheckpoint(rpi, npi)
+	if err != nil {
+		return 0, fmt.Errorf("failed to log WAL checkpoint: %w", err)
 	}
-	return nil
+	return lsn, nil
 }
 
 func (bts *BTreeStore) LogVacuum() error {
+	if bts.replica {
+		return ErrReplica
+	}
 	rpi, npi := bts.bt.GetWalMetadata()
 	if err := bts.wal.LogVacuum(rpi, npi); err != nil {
 		return fmt.Errorf("failed to log WAL vacuum: %w", err)
@@ -387,7 +2264,17 @@ func (bts *BTreeStore) LogVacuum() error {
 	return nil
 }
 
+func (bts *BTreeStore) logBatch(records []pager.WALRecord) error {
+	if bts.replica {
+		return ErrReplica
+	}
+	return bts.wal.Submit(records)
+}
+
 func (bts *BTreeStore) LogInsert(key uint64, recordBytes []byte) error {
+	if bts.replica {
+		return ErrReplica
+	}
 	if err := bts.wal.LogInsert(key, recordBytes); err != nil {
 		return fmt.Errorf("failed to log WAL insert: %w", err)
 	}
@@ -395,6 +2282,9 @@ func (bts *BTreeStore) LogInsert(key uint64, recordBytes []byte) error {
 }
 
 func (bts *BTreeStore) LogDelete(key uint64) error {
+	if bts.replica {
+		return ErrReplica
+	}
 	if err := bts.wal.LogDelete(key); err != nil {
 		return fmt.Errorf("failed to log WAL delete: %w", err)
 	}
@@ -402,6 +2292,9 @@ func (bts *BTreeStore) LogDelete(key uint64) error {
 }
 
 func (bts *BTreeStore) LogUpdate(key uint64, recordBytes []byte) error {
+	if bts.replica {
+		return ErrReplica
+	}
 	if err := bts.wal.LogUpdate(key, recordBytes); err != nil {
 		return fmt.Errorf("failed to log WAL update: %w", err)
 	}
@@ -412,13 +2305,19 @@ func (bts *BTreeStore) rebuildBloomFilter() error {
 	// Count existing records to size bloom filter appropriately
 	// NOTE: caller must hold lock
 
-	records, err := bts.ScanAll()
+	// read keys straight from the tree - a WAL-only table's pending
+	// records are added to the filter when they're replayed
+	var keys []uint64
+	err := bts.bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
 	// Create bloom filter sized for current data + growth
-	numKeys := len(records) * 2 // 2x for growth headroom
+	numKeys := len(keys) * 2 // 2x for growth headroom
 	if numKeys == 0 {
 		numKeys = 1000
 	}
@@ -430,11 +2329,7 @@ func (bts *BTreeStore) rebuildBloomFilter() error {
 	bts.tableBloom = NewBloomFilter(numBits, numHashes)
 
 	// Add all existing keys
-	for _, record := range records {
-		key, err := bts.bt.ExtractPrimaryKey(record)
-		if err != nil {
-			return err
-		}
+	for _, key := range keys {
 		bts.tableBloom.Add(key)
 	}
 
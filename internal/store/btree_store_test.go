@@ -0,0 +1,2231 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"godb/internal/btree"
+	"godb/internal/pager"
+	"godb/internal/schema"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBigIntKeySurvivesWALRecovery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "big.db")
+	sch := schema.Schema{
+		TableName: "big",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.BigIntType},
+			{Name: "name", Type: schema.StringType},
+		},
+	}
+	const bigKey = int64(math.MaxUint32) + 42
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	store, err := CreateWithOptions(filename, sch, StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Insert(schema.Record{"id": bigKey, "name": "far"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	// simulate a crash: stop the WAL writer without flushing pages or checkpointing
+	cancel()
+	wg.Wait()
+	if pending, err := store.HasPendingWAL(); err != nil || !pending {
+		t.Fatalf("expected the insert to be in the WAL, pending=%v err=%v", pending, err)
+	}
+
+	// the reopened store's context is never cancelled: its final checkpoint
+	// would race the WAL writer's shutdown
+	recovered, err := Open(filename, context.Background(), &sync.WaitGroup{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer recovered.Close()
+
+	rec, err := recovered.Find(uint64(bigKey))
+	if err != nil {
+		t.Fatalf("Find after recovery failed: %v", err)
+	}
+	if rec["id"] != bigKey || rec["name"] != "far" {
+		t.Errorf("recovered record = %v, want id=%d name=far", rec, bigKey)
+	}
+
+	// the key must not have been truncated to its low 32 bits
+	if _, err := recovered.Find(42); err == nil {
+		t.Error("key was truncated to 32 bits")
+	}
+}
+
+func TestRecoverySkipsRecordsBelowCheckpointLSN(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ckpt.db")
+	sch := idNameSchema("ckpt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	store, err := CreateWithOptions(filename, sch, StoreOptions{}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(1); i <= 3; i++ {
+		if _, err := store.Insert(schema.Record{"id": i, "name": "before"}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	// simulate a crash after the checkpoint flushed pages but before it truncated the WAL
+	store.mu.Lock()
+	_, err = store.checkpointPages()
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatalf("checkpointPages failed: %v", err)
+	}
+	if _, err := store.Insert(schema.Record{"id": int32(4), "name": "after"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	cancel()
+	wg.Wait()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	wg = &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	recovered, err := Open(filename, ctx, wg)
+	if err != nil {
+		t.Fatalf("reopen replayed already-flushed records: %v", err)
+	}
+	defer recovered.Close()
+
+	for i := uint64(1); i <= 4; i++ {
+		if _, err := recovered.Find(i); err != nil {
+			t.Errorf("Find(%d) after recovery failed: %v", i, err)
+		}
+	}
+	if n, err := recovered.Count(); err != nil || n != 4 {
+		t.Errorf("Expected 4 records after recovery, got %d (err=%v)", n, err)
+	}
+
+	// a completed checkpoint truncates the WAL and drops the watermark with it
+	if err := recovered.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if lsn := recovered.bt.CheckpointLSN(); lsn != 0 {
+		t.Errorf("Expected checkpoint LSN cleared after truncate, got %d", lsn)
+	}
+}
+
+func TestSchemaHashStoredInHeader(t *testing.T) {
+	t.Chdir(t.TempDir())
+	sch := schema.Schema{
+		TableName: "hashed",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "email", Type: schema.StringType, Unique: true},
+		},
+	}
+
+	// pinned so a change to the hash or to Serialize is caught
+	const want = uint64(0xce8340050aa7da4f)
+	if got := sch.Hash(); got != want {
+		t.Errorf("Hash() = %#x, want %#x", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	var reopened *BTreeStore
+	defer func() {
+		// the checkpointer's final checkpoint must run before the file closes
+		cancel()
+		wg.Wait()
+		if reopened != nil {
+			reopened.Close()
+		}
+	}()
+	store, err := CreateWithOptions("hashed.db", sch, StoreOptions{}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SchemaHash() != sch.Hash() {
+		t.Errorf("SchemaHash() = %#x, want %#x", store.SchemaHash(), sch.Hash())
+	}
+
+	if err := store.Rename("renamed"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	renamed := sch
+	renamed.TableName = "renamed"
+	if store.SchemaHash() != renamed.Hash() || renamed.Hash() == sch.Hash() {
+		t.Errorf("Expected the hash to follow the rename, got %#x", store.SchemaHash())
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err = Open("renamed.db", ctx, wg)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if reopened.SchemaHash() != renamed.Hash() {
+		t.Errorf("SchemaHash() after reopen = %#x, want %#x", reopened.SchemaHash(), renamed.Hash())
+	}
+}
+
+func TestVacuumOutsideWorkingDirectory(t *testing.T) {
+	cwd := t.TempDir()
+	t.Chdir(cwd)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "remote.db")
+	sch := idNameSchema("remote")
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{})
+	defer cleanup()
+	for i := int32(1); i <= 50; i++ {
+		if _, err := store.Insert(schema.Record{"id": i, "name": "row"}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	// a temp dir that can't be written fails cleanly and leaves the table usable
+	store.SetVacuumTempDir(filepath.Join(dir, "missing"))
+	if err := store.Vacuum(); err == nil {
+		t.Error("Expected vacuum to fail with a missing temp dir")
+	}
+	if _, err := store.Find(7); err != nil {
+		t.Errorf("Find after failed vacuum: %v", err)
+	}
+
+	store.SetVacuumTempDir("")
+	if err := store.Vacuum(); err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	if n, err := store.Count(); err != nil || n != 50 {
+		t.Errorf("Expected 50 records after vacuum, got %d (err=%v)", n, err)
+	}
+
+	for _, d := range []string{cwd, dir} {
+		leftovers, _ := filepath.Glob(filepath.Join(d, "*.tmp"))
+		if len(leftovers) > 0 {
+			t.Errorf("Temp files left behind in %s: %v", d, leftovers)
+		}
+	}
+}
+
+func TestUpdateIfVersion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "versioned.db")
+	sch := idNameSchema("versioned")
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{Versioned: true})
+	defer cleanup()
+	if _, err := store.Insert(schema.Record{"id": int32(1), "name": "a"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	version := func() uint64 {
+		t.Helper()
+		rec, err := store.Find(1)
+		if err != nil {
+			t.Fatalf("Find failed: %v", err)
+		}
+		return rec[schema.VersionField].(uint64)
+	}
+	if v := version(); v != 1 {
+		t.Fatalf("Expected a new row at version 1, got %d", v)
+	}
+
+	if n, err := store.UpdateIfVersion(schema.Record{"id": int32(1), "name": "b"}, 1); err != nil || n != 1 {
+		t.Fatalf("UpdateIfVersion at the current version: n=%d err=%v", n, err)
+	}
+	if v := version(); v != 2 {
+		t.Errorf("Expected version 2 after update, got %d", v)
+	}
+
+	// a writer still holding version 1 loses
+	_, err := store.UpdateIfVersion(schema.Record{"id": int32(1), "name": "stale"}, 1)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Expected ErrVersionConflict, got %v", err)
+	}
+	if rec, _ := store.Find(1); rec["name"] != "b" {
+		t.Errorf("Conflicting update was applied: %v", rec)
+	}
+
+	// plain updates bump the version too
+	if _, err := store.Update(schema.Record{"id": int32(1), "name": "c"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if v := version(); v != 3 {
+		t.Errorf("Expected version 3 after plain update, got %d", v)
+	}
+	if n, err := store.UpdateIfVersion(schema.Record{"id": int32(2), "name": "x"}, 1); err != nil || n != 0 {
+		t.Errorf("Expected 0 rows for a missing key, got n=%d err=%v", n, err)
+	}
+}
+
+func TestConsistencyCheck(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "verify.db")
+	sch := idNameSchema("verify")
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{})
+	defer cleanup()
+	for i := int32(1); i <= 300; i++ {
+		if _, err := store.Insert(schema.Record{"id": i, "name": "row"}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if _, err := store.Delete(42); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.ConsistencyCheck(); err != nil {
+		t.Fatalf("ConsistencyCheck with pending WAL failed: %v", err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ConsistencyCheck(); err != nil {
+		t.Fatalf("ConsistencyCheck after checkpoint failed: %v", err)
+	}
+
+	// a logged insert the tree never saw
+	data, err := store.bt.SerializeRecord(schema.Record{"id": int32(42), "name": "lost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LogInsert(42, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ConsistencyCheck(); err == nil {
+		t.Error("Expected ConsistencyCheck to report a WAL insert missing from the tree")
+	}
+}
+
+func TestOpenCreateSemantics(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	sch := idNameSchema("people")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if _, err := Open("people.db", ctx, wg); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected Open of a missing table to fail with ErrNotExist, got %v", err)
+	}
+	if _, err := os.Stat("people.db"); !os.IsNotExist(err) {
+		t.Fatalf("Open created a table file (stat err: %v)", err)
+	}
+
+	created, err := OpenOrCreate("people.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatalf("OpenOrCreate of a missing table failed: %v", err)
+	}
+	if _, err := created.Insert(schema.Record{"id": int32(1), "name": "ann"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := created.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create("people.db", sch, ctx, wg); err == nil {
+		t.Error("Expected Create of an existing table to fail")
+	}
+
+	opened, err := OpenOrCreate("people.db", sch, ctx, wg)
+	if err != nil {
+		t.Fatalf("OpenOrCreate of an existing table failed: %v", err)
+	}
+	if rec, err := opened.Find(1); err != nil || rec["name"] != "ann" {
+		t.Errorf("Expected the existing row back, got %v (err=%v)", rec, err)
+	}
+
+	other := sch
+	other.Fields = []schema.Field{{Name: "id", Type: schema.IntType}}
+	if _, err := OpenOrCreate("people.db", other, ctx, wg); err == nil {
+		t.Error("Expected OpenOrCreate with a different schema to fail")
+	}
+}
+
+func TestCheckpointArchivesWAL(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	sch := idNameSchema("events")
+
+	store, cleanup := newSchemaStoreForTest(t, filepath.Join(dir, "events.db"), sch, StoreOptions{})
+	defer cleanup()
+	defer store.Close()
+	if err := store.SetWALArchiveDir(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int32{1, 2} {
+		if _, err := store.Insert(schema.Record{"id": id, "name": "e"}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// nothing new to archive
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(archive, "events-*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 archived WALs, got %v", files)
+	}
+	var actions [][]pager.WalAction
+	for _, f := range files {
+		records, err := pager.ReadArchivedWAL(f, store.TableID(), store.SchemaHash())
+		if err != nil {
+			t.Fatalf("ReadArchivedWAL(%s) failed: %v", f, err)
+		}
+		var got []pager.WalAction
+		for _, rec := range records {
+			got = append(got, rec.Action)
+		}
+		actions = append(actions, got)
+	}
+	want := [][]pager.WalAction{
+		{pager.INSERT, pager.INSERT, pager.CHECKPOINT},
+		{pager.DELETE, pager.CHECKPOINT},
+	}
+	if !slices.EqualFunc(actions, want, slices.Equal[[]pager.WalAction]) {
+		t.Errorf("Expected archived actions %v, got %v", want, actions)
+	}
+
+	// off again: the WAL is truncated without a copy
+	if err := store.SetWALArchiveDir(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(2); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(archive, "*.wal")); len(files) != 2 {
+		t.Errorf("Expected no new archive with archiving off, got %v", files)
+	}
+}
+
+func TestScanByLSNAcrossCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events.db")
+	sch := idNameSchema("events")
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{RetainLog: true})
+	defer cleanup()
+
+	// written out of key order, with checkpoints in between
+	for _, id := range []int32{5, 1, 3} {
+		if _, err := store.Insert(schema.Record{"id": id, "name": "e"}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Insert(schema.Record{"id": int32(2), "name": "e"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	type event struct {
+		action pager.WalAction
+		key    pager.WalKey
+	}
+	want := []event{{pager.INSERT, 5}, {pager.INSERT, 1}, {pager.INSERT, 3}, {pager.DELETE, 1}, {pager.INSERT, 2}}
+	var got []event
+	var lastLSN pager.LSN
+	err := store.ScanByLSN(func(rec pager.WALRecord) error {
+		if rec.Lsn <= lastLSN {
+			t.Errorf("LSN %d not above %d", rec.Lsn, lastLSN)
+		}
+		lastLSN = rec.Lsn
+		got = append(got, event{rec.Action, rec.Key})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanByLSN failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestRangeScanExBounds(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bounds.db")
+	sch := idNameSchema("bounds")
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{})
+	defer cleanup()
+	// enough rows to span several leaves
+	for i := 1; i <= 500; i++ {
+		if _, err := store.Insert(schema.Record{"id": int32(i), "name": "row-padding-to-fill-pages"}); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		start, end               uint64
+		includeStart, includeEnd bool
+		first, last, count       int
+	}{
+		{10, 20, true, true, 10, 20, 11},
+		{10, 20, false, true, 11, 20, 10},
+		{10, 20, true, false, 10, 19, 10},
+		{10, 20, false, false, 11, 19, 9},
+		{490, math.MaxUint64, false, true, 491, 500, 10},
+		{5, 5, true, true, 5, 5, 1},
+		{5, 5, false, true, 0, 0, 0},
+		{5, 5, true, false, 0, 0, 0},
+		{5, 6, false, false, 0, 0, 0},
+		{20, 10, true, true, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		records, err := store.RangeScanEx(tt.start, tt.end, tt.includeStart, tt.includeEnd)
+		if err != nil {
+			t.Errorf("RangeScanEx(%d, %d, %v, %v) failed: %v", tt.start, tt.end, tt.includeStart, tt.includeEnd, err)
+			continue
+		}
+		if len(records) != tt.count {
+			t.Errorf("RangeScanEx(%d, %d, %v, %v): expected %d records, got %d", tt.start, tt.end, tt.includeStart, tt.includeEnd, tt.count, len(records))
+			continue
+		}
+		if tt.count == 0 {
+			continue
+		}
+		if first, last := records[0]["id"].(int32), records[len(records)-1]["id"].(int32); int(first) != tt.first || int(last) != tt.last {
+			t.Errorf("RangeScanEx(%d, %d, %v, %v): expected ids %d-%d, got %d-%d", tt.start, tt.end, tt.includeStart, tt.includeEnd, tt.first, tt.last, first, last)
+		}
+	}
+}
+
+func TestQueryPicksPlanByField(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "people.db")
+	sch := schema.Schema{
+		TableName: "people",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "age", Type: schema.IntType},
+		},
+	}
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{})
+	defer cleanup()
+	for i := 1; i <= 20; i++ {
+		if _, err := store.Insert(schema.Record{"id": int32(i), "age": int32(100 - i)}); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		field, op string
+		value     int32
+		strategy  QueryStrategy
+		count     int
+	}{
+		{"id", "=", 5, PointLookup, 1},
+		{"id", "=", 50, PointLookup, 0},
+		{"id", ">", 15, KeyRangeScan, 5},
+		{"id", "<=", 3, KeyRangeScan, 3},
+		{"id", "!=", 1, FullScan, 19},
+		{"id", ">", -1, KeyRangeScan, 20},
+		{"id", ">=", -5, KeyRangeScan, 20},
+		{"id", "<", -1, KeyRangeScan, 0},
+		{"id", "=", -1, KeyRangeScan, 0},
+		{"age", ">=", 95, FullScan, 5},
+		{"age", "=", 90, FullScan, 1},
+	}
+	for _, tt := range tests {
+		records, plan, err := store.Query(tt.field, tt.op, tt.value)
+		if err != nil {
+			t.Errorf("Query(%s %s %d) failed: %v", tt.field, tt.op, tt.value, err)
+			continue
+		}
+		if plan.Strategy != tt.strategy {
+			t.Errorf("Query(%s %s %d): expected %v, got %v", tt.field, tt.op, tt.value, tt.strategy, plan.Strategy)
+		}
+		if len(records) != tt.count {
+			t.Errorf("Query(%s %s %d): expected %d records, got %d", tt.field, tt.op, tt.value, tt.count, len(records))
+		}
+	}
+
+	if _, _, err := store.Query("missing", "=", int32(1)); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+	if _, _, err := store.Query("age", "~", int32(1)); err == nil {
+		t.Error("Expected an error for an unknown operator")
+	}
+}
+
+func TestShapeEstimatesLeavesAndPages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "shape.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+	for i := 1; i <= 5000; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	shape, err := store.Shape()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shape.Depth < 2 || shape.MinKey != 1 || shape.MaxKey != 5000 || shape.Empty {
+		t.Fatalf("unexpected shape %+v", shape)
+	}
+
+	leaves := 0
+	for id := pager.PageID(1); id < pager.PageID(store.bt.NumPages()); id++ {
+		if typ, _, err := store.bt.PageSummary(id); err == nil && typ == pager.LEAF {
+			leaves++
+		}
+	}
+	if shape.Leaves < leaves*9/10 || shape.Leaves > leaves*11/10 {
+		t.Errorf("estimated %d leaves, tree has %d", shape.Leaves, leaves)
+	}
+
+	point, _ := store.Plan("id", "=", int32(10))
+	if got := shape.EstimatePages(point); got != shape.Depth {
+		t.Errorf("point lookup estimate = %d, want the depth %d", got, shape.Depth)
+	}
+	full, _ := store.Plan("name", "=", "x")
+	if got := shape.EstimatePages(full); got != shape.Depth-1+shape.Leaves {
+		t.Errorf("full scan estimate = %d, want %d", got, shape.Depth-1+shape.Leaves)
+	}
+	half, _ := store.Plan("id", ">", int32(2500))
+	want := shape.Depth - 1 + shape.Leaves/2
+	if got := shape.EstimatePages(half); got < want-1 || got > want+1 {
+		t.Errorf("half range estimate = %d, want about %d", got, want)
+	}
+	none, _ := store.Plan("id", ">", int32(9000))
+	if got := shape.EstimatePages(none); got != shape.Depth {
+		t.Errorf("range past the last key estimate = %d, want %d", got, shape.Depth)
+	}
+
+	// a root, 10 internal pages and 100 leaves
+	if got := estimateLeaves(111, 3, 10); got != 100 {
+		t.Errorf("estimateLeaves(111, 3, 10) = %d, want 100", got)
+	}
+}
+
+func TestScanTolerantSkipsCorruptRecords(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "damaged.db")
+	sch := idNameSchema("damaged")
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{})
+	defer cleanup()
+	for _, id := range []int32{1, 2, 4, 5} {
+		if _, err := store.Insert(schema.Record{"id": id, "name": "ok"}); err != nil {
+			t.Fatalf("Insert %d failed: %v", id, err)
+		}
+	}
+	// key 3 holds a body too short to decode
+	if err := store.bt.Insert(3, []byte{3, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.RangeScan(0, math.MaxUint64); err == nil {
+		t.Fatal("Expected the strict scan to fail on the corrupt record")
+	}
+
+	var ids []int32
+	skipped, err := store.ScanTolerant(func(rec schema.Record) error {
+		ids = append(ids, rec["id"].(int32))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanTolerant failed: %v", err)
+	}
+	if skipped != 1 {
+		t.Errorf("Expected 1 skipped record, got %d", skipped)
+	}
+	if len(ids) != 4 || ids[0] != 1 || ids[2] != 4 || ids[3] != 5 {
+		t.Errorf("Expected ids [1 2 4 5], got %v", ids)
+	}
+}
+
+func TestInsertRejectsKeyOutsideRange(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "shard.db")
+	sch := idNameSchema("shard")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	opts := StoreOptions{KeyRange: true, MinKey: 100, MaxKey: 199}
+	store, err := CreateWithOptions(filename, sch, opts, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int32{100, 150, 199} {
+		if _, err := store.Insert(schema.Record{"id": id, "name": "in"}); err != nil {
+			t.Errorf("Insert %d failed: %v", id, err)
+		}
+	}
+	for _, id := range []int32{0, 99, 200} {
+		if _, err := store.Insert(schema.Record{"id": id, "name": "out"}); !errors.Is(err, ErrKeyOutOfRange) {
+			t.Errorf("Insert %d: expected ErrKeyOutOfRange, got %v", id, err)
+		}
+		if _, err := store.PrepareInsert(schema.Record{"id": id, "name": "out"}); !errors.Is(err, ErrKeyOutOfRange) {
+			t.Errorf("PrepareInsert %d: expected ErrKeyOutOfRange, got %v", id, err)
+		}
+	}
+
+	// the bounds are persisted in the header
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = Open(filename, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if minKey, maxKey, ok := store.KeyRange(); !ok || minKey != 100 || maxKey != 199 {
+		t.Errorf("Expected key range [100, 199] after reopen, got [%d, %d] (set: %v)", minKey, maxKey, ok)
+	}
+	if _, err := store.Insert(schema.Record{"id": int32(500), "name": "out"}); !errors.Is(err, ErrKeyOutOfRange) {
+		t.Errorf("Insert after reopen: expected ErrKeyOutOfRange, got %v", err)
+	}
+
+	if _, err := CreateWithOptions(filepath.Join(t.TempDir(), "empty.db"), sch, StoreOptions{KeyRange: true, MinKey: 5, MaxKey: 4}, ctx, wg); err == nil {
+		t.Error("Expected an error for an empty key range")
+	}
+}
+
+func TestMergeTables(t *testing.T) {
+	dir := t.TempDir()
+	fields := []schema.Field{
+		{Name: "id", Type: schema.IntType},
+		{Name: "name", Type: schema.StringType},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	create := func(name string, fields []schema.Field, ids ...int) string {
+		t.Helper()
+		filename := filepath.Join(dir, name+".db")
+		store, err := CreateWithOptions(filename, schema.Schema{TableName: name, Fields: fields}, StoreOptions{}, ctx, wg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if _, err := store.Insert(schema.Record{"id": int32(id), "name": "row-padding-to-fill-pages"}); err != nil {
+				t.Fatalf("Insert %d into %s failed: %v", id, name, err)
+			}
+		}
+		// the WAL is left pending, so merging must replay it
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	// interleaved keys, enough to span several leaves each
+	var evens, odds []int
+	for i := 0; i < 600; i++ {
+		if i%2 == 0 {
+			evens = append(evens, i)
+		} else {
+			odds = append(odds, i)
+		}
+	}
+	a := create("jan", fields, evens...)
+	b := create("feb", fields, odds...)
+	dst := filepath.Join(dir, "q1.db")
+	if err := MergeTables(dst, a, b); err != nil {
+		t.Fatalf("MergeTables failed: %v", err)
+	}
+
+	merged, err := Open(dst, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	if err := merged.ConsistencyCheck(); err != nil {
+		t.Errorf("Merged table is inconsistent: %v", err)
+	}
+	records, err := merged.RangeScan(0, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 600 {
+		t.Fatalf("Expected 600 merged records, got %d", len(records))
+	}
+	for i, rec := range records {
+		if rec["id"].(int32) != int32(i) {
+			t.Fatalf("Expected id %d at position %d, got %v", i, i, rec["id"])
+		}
+	}
+	if name := merged.Schema().TableName; name != "q1" {
+		t.Errorf("Expected merged table name q1, got %s", name)
+	}
+
+	// a key in both sources
+	c := create("mar", fields, 10, 1000)
+	if err := MergeTables(filepath.Join(dir, "dup.db"), a, c); !errors.Is(err, btree.ErrDuplicateKey) {
+		t.Errorf("Expected ErrDuplicateKey, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dup.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected a failed merge to remove its output (stat err: %v)", err)
+	}
+
+	other := create("apr", []schema.Field{{Name: "id", Type: schema.IntType}, {Name: "age", Type: schema.IntType}})
+	if err := MergeTables(filepath.Join(dir, "bad.db"), a, other); err == nil {
+		t.Error("Expected an error merging tables with different schemas")
+	}
+}
+
+func TestMergeTablesKeepsSrcAOptions(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	create := func(name string, opts StoreOptions, options map[string]string, ids ...int) string {
+		t.Helper()
+		filename := filepath.Join(dir, name+".db")
+		store, err := CreateWithOptions(filename, benchSchema(), opts, ctx, wg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if _, err := store.Insert(benchRecord(id)); err != nil {
+				t.Fatalf("Insert %d into %s failed: %v", id, name, err)
+			}
+		}
+		for option, value := range options {
+			if err := store.SetOption(option, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	ranged := StoreOptions{KeyRange: true, MinKey: 1, MaxKey: 100, RetainLog: true, CheckpointInterval: NoCheckpointer}
+	a := create("low", ranged, map[string]string{"maxrecordsize": "200"}, 1, 2, 3)
+	b := create("mid", StoreOptions{CheckpointInterval: NoCheckpointer}, nil, 50, 60)
+	dst := filepath.Join(dir, "merged.db")
+	if err := MergeTables(dst, a, b); err != nil {
+		t.Fatalf("MergeTables failed: %v", err)
+	}
+
+	merged, err := OpenWithOptions(dst, StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	if minKey, maxKey, ok := merged.KeyRange(); !ok || minKey != 1 || maxKey != 100 {
+		t.Errorf("Merged key range = [%d, %d] (%v), want [1, 100]", minKey, maxKey, ok)
+	}
+	if _, err := merged.Insert(benchRecord(101)); !errors.Is(err, ErrKeyOutOfRange) {
+		t.Errorf("Expected the merged table to reject key 101, got %v", err)
+	}
+	if !merged.RetainsLog() {
+		t.Error("Expected the merged table to retain its log")
+	}
+	if v, ok, err := merged.Option("maxrecordsize"); err != nil || !ok || v != "200" {
+		t.Errorf("Merged maxrecordsize = %q (%v, %v), want 200", v, ok, err)
+	}
+
+	c := create("high", StoreOptions{CheckpointInterval: NoCheckpointer}, nil, 99, 150)
+	if err := MergeTables(filepath.Join(dir, "out.db"), a, c); !errors.Is(err, ErrKeyOutOfRange) {
+		t.Errorf("Expected a key past srcA's range to fail the merge, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected a refused merge to leave no output (stat err: %v)", err)
+	}
+}
+
+func TestKeyHistogram(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys.db")
+	sch := schema.Schema{
+		TableName: "keys",
+		Fields:    []schema.Field{{Name: "id", Type: schema.IntType}},
+	}
+
+	store, cleanup := newSchemaStoreForTest(t, filename, sch, StoreOptions{})
+	defer cleanup()
+
+	if counts, err := store.KeyHistogram(4); err != nil || len(counts) != 4 || counts[0] != 0 {
+		t.Errorf("Expected 4 empty bins for an empty table, got %v (err %v)", counts, err)
+	}
+
+	// keys 0-99 dense, plus a few stragglers up to 399
+	for i := 0; i < 100; i++ {
+		if _, err := store.Insert(schema.Record{"id": int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []int32{150, 250, 399} {
+		if _, err := store.Insert(schema.Record{"id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := store.KeyHistogram(4)
+	if err != nil {
+		t.Fatalf("KeyHistogram failed: %v", err)
+	}
+	if want := []int{100, 1, 1, 1}; !slices.Equal(counts, want) {
+		t.Errorf("Expected %v, got %v", want, counts)
+	}
+
+	// a span narrower than the bucket count gets one bin per key value
+	h, err := store.KeyDistribution(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Counts) != 400 {
+		t.Errorf("Expected 400 bins for keys 0-399, got %d", len(h.Counts))
+	}
+	if lo, hi := h.Bucket(len(h.Counts) - 1); lo != 399 || hi != 399 {
+		t.Errorf("Expected the last bin to be 399-399, got %d-%d", lo, hi)
+	}
+
+	if _, err := store.KeyHistogram(0); err == nil {
+		t.Error("Expected an error for 0 buckets")
+	}
+}
+
+func TestFindSnapshotReadsLastCheckpointWithoutLock(t *testing.T) {
+	store, cleanup := newStoreForTest(t, filepath.Join(t.TempDir(), "snap.db"), StoreOptions{})
+	defer cleanup()
+
+	if _, err := store.FindSnapshot(1); !errors.Is(err, ErrSnapshotReadsOff) {
+		t.Fatalf("Expected ErrSnapshotReadsOff before enabling, got %v", err)
+	}
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetSnapshotReads(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Insert(benchRecord(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, err := store.FindSnapshot(1); err != nil || rec["id"] != int32(1) {
+		t.Errorf("Expected key 1 in the first snapshot, got %v (err %v)", rec, err)
+	}
+	if _, err := store.FindSnapshot(2); err == nil {
+		t.Error("Expected key 2, inserted after the snapshot, to be missing")
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindSnapshot(2); err != nil {
+		t.Errorf("Expected key 2 after a checkpoint, got %v", err)
+	}
+
+	// the copy is taken under the read lock, so a reader doesn't hold it up
+	store.mu.RLock()
+	done := make(chan error, 1)
+	go func() { done <- store.refreshSnapshot() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("refreshSnapshot under a held read lock failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("refreshSnapshot blocked behind a reader")
+	}
+	store.mu.RUnlock()
+
+	// a writer holding the lock doesn't block snapshot readers
+	store.mu.Lock()
+	go func() {
+		_, err := store.FindSnapshot(2)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("FindSnapshot under a held write lock failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("FindSnapshot blocked behind the write lock")
+	}
+	store.mu.Unlock()
+
+	if err := store.SetSnapshotReads(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindSnapshot(1); !errors.Is(err, ErrSnapshotReadsOff) {
+		t.Errorf("Expected ErrSnapshotReadsOff after disabling, got %v", err)
+	}
+}
+
+func TestBackupReopensWithSameRecords(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, src, StoreOptions{})
+	defer cleanup()
+
+	// enough records for a few levels, all still in the WAL and cache
+	for i := 1; i <= 500; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	var announced int64
+	err := store.Backup(&buf, func(size int64) error {
+		announced = size
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if buf.Len()%pager.PAGE_SIZE != 0 {
+		t.Fatalf("Backup is %d bytes, not whole pages", buf.Len())
+	}
+	if announced != int64(buf.Len()) {
+		t.Fatalf("Backup announced %d bytes, wrote %d", announced, buf.Len())
+	}
+	// writes after the backup aren't in it
+	if _, err := store.Insert(benchRecord(501)); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "bench.db")
+	if err := os.WriteFile(dst, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	restored, err := Open(dst, ctx, wg)
+	if err != nil {
+		t.Fatalf("Open backup failed: %v", err)
+	}
+	defer restored.Close()
+
+	if n, err := restored.Count(); err != nil || n != 500 {
+		t.Fatalf("Expected 500 records in the backup, got %d (%v)", n, err)
+	}
+	rec, err := restored.Find(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["name"] != "record_250" {
+		t.Fatalf("Expected record_250, got %v", rec["name"])
+	}
+	if err := restored.ConsistencyCheck(); err != nil {
+		t.Fatalf("Backup is inconsistent: %v", err)
+	}
+}
+
+func TestNextAndPrevStepAcrossLeaves(t *testing.T) {
+	store, cleanup := newStoreForTest(t, filepath.Join(t.TempDir(), "step.db"), StoreOptions{})
+	defer cleanup()
+
+	// even keys only, over enough leaves that steps cross leaf boundaries
+	for i := 2; i <= 1000; i += 2 {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []uint64
+	for after := uint64(0); ; {
+		rec, found, err := store.Next(after)
+		if err != nil {
+			t.Fatalf("Next(%d) failed: %v", after, err)
+		}
+		if !found {
+			break
+		}
+		after = uint64(rec["id"].(int32))
+		keys = append(keys, after)
+	}
+	if len(keys) != 500 || keys[0] != 2 || keys[499] != 1000 {
+		t.Fatalf("Expected Next to step through keys 2..1000, got %d keys", len(keys))
+	}
+
+	for _, tc := range []struct {
+		key     uint64
+		next    uint64
+		prev    uint64
+		hasPrev bool
+		hasNext bool
+	}{
+		{key: 0, next: 2, hasNext: true},
+		{key: 2, next: 4, hasNext: true},
+		{key: 501, next: 502, prev: 500, hasNext: true, hasPrev: true},
+		{key: 1000, prev: 998, hasPrev: true},
+		{key: math.MaxUint64, prev: 1000, hasPrev: true},
+	} {
+		rec, found, err := store.Next(tc.key)
+		if err != nil || found != tc.hasNext || (found && uint64(rec["id"].(int32)) != tc.next) {
+			t.Errorf("Next(%d) = %v, %v, %v; want %d, %v", tc.key, rec["id"], found, err, tc.next, tc.hasNext)
+		}
+		rec, found, err = store.Prev(tc.key)
+		if err != nil || found != tc.hasPrev || (found && uint64(rec["id"].(int32)) != tc.prev) {
+			t.Errorf("Prev(%d) = %v, %v, %v; want %d, %v", tc.key, rec["id"], found, err, tc.prev, tc.hasPrev)
+		}
+	}
+}
+
+func TestRangeScanKVReturnsKeys(t *testing.T) {
+	store, cleanup := newStoreForTest(t, filepath.Join(t.TempDir(), "kv.db"), StoreOptions{OmitKey: true})
+	defer cleanup()
+
+	for i := 1; i <= 300; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kvs, err := store.RangeScanKV(100, 199)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 100 {
+		t.Fatalf("Expected 100 records, got %d", len(kvs))
+	}
+	for i, kv := range kvs {
+		if kv.Key != uint64(100+i) || kv.Record["id"] != int32(kv.Key) {
+			t.Fatalf("Entry %d: key %d with record id %v", i, kv.Key, kv.Record["id"])
+		}
+	}
+}
+
+func TestSetOptionRollsBackWhenTheHeaderCantBeWritten(t *testing.T) {
+	store, cleanup := newStoreForTest(t, filepath.Join(t.TempDir(), "opts.db"), StoreOptions{})
+	defer cleanup()
+
+	// a valid value, but too long for the header page
+	huge := strings.Repeat("0", pager.PAGE_SIZE) + "64"
+	if err := store.SetOption("maxrecordsize", huge); err == nil {
+		t.Fatal("Expected a header past a page to fail")
+	}
+	if _, ok, _ := store.Option("maxrecordsize"); ok {
+		t.Error("Expected the failed option not to be left in the header")
+	}
+	rec := benchRecord(1)
+	rec["name"] = strings.Repeat("x", 100)
+	if _, err := store.Insert(rec); err != nil {
+		t.Errorf("Expected the old record size limit back, got %v", err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Errorf("Expected the header to write after the failed option, got %v", err)
+	}
+}
+
+func TestSetOptionPersistsAcrossOpen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "opts.db")
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	store, err := CreateWithOptions(filename, benchSchema(), StoreOptions{}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetOption("nosuch", "1"); err == nil {
+		t.Error("Expected an unknown option to fail")
+	}
+	if err := store.SetOption("maxrecordsize", "big"); err == nil {
+		t.Error("Expected a non-numeric maxrecordsize to fail")
+	}
+	if _, ok, _ := store.Option("maxrecordsize"); ok {
+		t.Error("Expected a rejected value not to be stored")
+	}
+	if err := store.SetOption("maxrecordsize", "64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetOption("allownonfinite", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(filename, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := store.Options(); got["maxrecordsize"] != "64" || got["allownonfinite"] != "true" {
+		t.Fatalf("Expected both options back after reopening, got %v", got)
+	}
+	rec := benchRecord(1)
+	rec["name"] = strings.Repeat("x", 100)
+	if _, err := store.Insert(rec); !errors.Is(err, btree.ErrRecordTooLarge) {
+		t.Errorf("Expected the reopened table to apply maxrecordsize, got %v", err)
+	}
+}
+
+func TestRefreshSnapshotFollowsAnotherWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	writer, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+
+	for i := 1; i <= 300; i++ {
+		if _, err := writer.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenReplica(filename)
+	if err != nil {
+		t.Fatalf("OpenReplica failed: %v", err)
+	}
+	defer reader.Close()
+
+	for i := 301; i <= 600; i++ {
+		if _, err := writer.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// vacuum renames a new file over the one the reader has open
+	if err := writer.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := reader.Count(); err != nil || n != 300 {
+		t.Fatalf("Expected the reader to still see 300 records, got %d (%v)", n, err)
+	}
+	if err := reader.RefreshSnapshot(); err != nil {
+		t.Fatalf("RefreshSnapshot failed: %v", err)
+	}
+	if n, err := reader.Count(); err != nil || n != 600 {
+		t.Fatalf("Expected 600 records after refresh, got %d (%v)", n, err)
+	}
+	rec, err := reader.Find(550)
+	if err != nil {
+		t.Fatalf("Find after refresh: %v", err)
+	}
+	if rec["id"] != int32(550) {
+		t.Errorf("Expected record 550, got %v", rec)
+	}
+}
+
+func TestReplicaNeverWritesTheWritersFiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	writer, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+
+	for i := 1; i <= 300; i++ {
+		if _, err := writer.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenReplica(filename)
+	if err != nil {
+		t.Fatalf("OpenReplica failed: %v", err)
+	}
+	if _, err := reader.Count(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Insert(benchRecord(1000)); !errors.Is(err, ErrReplica) {
+		t.Errorf("Expected insert on a replica to fail with ErrReplica, got %v", err)
+	}
+	if _, err := reader.Delete(1); !errors.Is(err, ErrReplica) {
+		t.Errorf("Expected delete on a replica to fail with ErrReplica, got %v", err)
+	}
+	if err := reader.Checkpoint(); !errors.Is(err, ErrReplica) {
+		t.Errorf("Expected checkpoint on a replica to fail with ErrReplica, got %v", err)
+	}
+
+	// the writer moves on, leaving records in its WAL
+	for i := 301; i <= 600; i++ {
+		if _, err := writer.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 601; i <= 650; i++ {
+		if _, err := writer.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walName := strings.TrimSuffix(filename, ".db") + ".wal"
+	walBefore, err := os.ReadFile(walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// closing a replica that never refreshed must not put its stale view
+	// over the writer's
+	if err := reader.Close(); err != nil {
+		t.Fatalf("Close replica failed: %v", err)
+	}
+	if walAfter, err := os.ReadFile(walName); err != nil || !bytes.Equal(walBefore, walAfter) {
+		t.Errorf("Expected the replica to leave the writer's WAL alone (%v)", err)
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := OpenReplica(filename)
+	if err != nil {
+		t.Fatalf("OpenReplica failed: %v", err)
+	}
+	defer again.Close()
+	if n, err := again.Count(); err != nil || n != 650 {
+		t.Errorf("Expected the file to hold all 650 records, got %d (%v)", n, err)
+	}
+	if err := again.ConsistencyCheck(); err != nil {
+		t.Errorf("Table damaged by the replica: %v", err)
+	}
+}
+
+func TestVacuumKeepsWritesMadeDuringIt(t *testing.T) {
+	store, cleanup := newStoreForTest(t, filepath.Join(t.TempDir(), "bench.db"), StoreOptions{})
+	defer cleanup()
+
+	want := make(map[uint64]bool)
+	for i := 1; i <= 2000; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+		want[uint64(i)] = true
+	}
+	// leave the vacuum something to compact
+	for i := 2; i <= 2000; i += 2 {
+		if _, err := store.Delete(uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, uint64(i))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for range 5 {
+			if err := store.Vacuum(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// write until the vacuums finish: new keys, and deletes of old ones
+	next := 2001
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Vacuum failed: %v", err)
+			}
+			running = false
+		default:
+			if _, err := store.Insert(benchRecord(next)); err != nil {
+				t.Fatal(err)
+			}
+			want[uint64(next)] = true
+			if old := uint64(next - 2000); want[old] {
+				if _, err := store.Delete(old); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, old)
+			}
+			next++
+		}
+	}
+
+	if n, err := store.Count(); err != nil || n != len(want) {
+		t.Fatalf("Expected %d records after vacuuming, got %d (%v)", len(want), n, err)
+	}
+	for key := range want {
+		if _, err := store.Find(key); err != nil {
+			t.Fatalf("Record %d written around the vacuum is missing: %v", key, err)
+		}
+	}
+	if err := store.ConsistencyCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckpointIntervalCheckpointsInBackground(t *testing.T) {
+	for _, tt := range []struct {
+		interval, want time.Duration
+		wantErr        bool
+	}{
+		{0, DefaultCheckpointInterval, false},
+		{NoCheckpointer, 0, false},
+		{-time.Second, 0, false},
+		{time.Millisecond, 0, true},
+		{MinCheckpointInterval, MinCheckpointInterval, false},
+	} {
+		got, err := StoreOptions{CheckpointInterval: tt.interval}.checkpointInterval()
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("CheckpointInterval %v: got %v, %v; want %v, error %v", tt.interval, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	if _, err := CreateWithOptions(filepath.Join(dir, "fast.db"), benchSchema(), StoreOptions{CheckpointInterval: time.Millisecond}, ctx, wg); err == nil {
+		t.Fatal("CreateWithOptions accepted an interval below the minimum")
+	}
+
+	filename := filepath.Join(dir, "bench.db")
+	store, err := CreateWithOptions(filename, benchSchema(), StoreOptions{CheckpointInterval: MinCheckpointInterval}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCheckpoint := func(store *BTreeStore, id int) {
+		t.Helper()
+		if _, err := store.Insert(benchRecord(id)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pending, err := store.HasPendingWAL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pending {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the background checkpointer never emptied the WAL")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForCheckpoint(store, 1)
+
+	cancel()
+	wg.Wait()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the interval isn't persisted: a reopen takes its own
+	ctx, cancel = context.WithCancel(context.Background())
+	wg = &sync.WaitGroup{}
+	if _, err := OpenWithOptions(filename, StoreOptions{CheckpointInterval: time.Millisecond}, ctx, wg); err == nil {
+		t.Fatal("OpenWithOptions accepted an interval below the minimum")
+	}
+	store, err = OpenWithOptions(filename, StoreOptions{CheckpointInterval: MinCheckpointInterval}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCheckpoint(store, 2)
+
+	cancel()
+	wg.Wait()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitialLoadFillsAnEmptyTable(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+
+	if err := store.InitialLoad([]schema.Record{benchRecord(2), benchRecord(1)}); err == nil {
+		t.Fatal("InitialLoad accepted records out of key order")
+	}
+
+	const n = 3000
+	records := make([]schema.Record, n)
+	for i := range records {
+		records[i] = benchRecord(i + 1)
+	}
+	if err := store.InitialLoad(records); err != nil {
+		t.Fatalf("InitialLoad failed: %v", err)
+	}
+	if count, err := store.Count(); err != nil || count != n {
+		t.Fatalf("Count = %d, %v; want %d", count, err, n)
+	}
+	for _, id := range []int{1, n / 2, n} {
+		rec, err := store.Find(uint64(id))
+		if err != nil || rec["name"] != benchRecord(id)["name"] {
+			t.Errorf("Find(%d) = %v, %v", id, rec, err)
+		}
+	}
+	if err := store.ConsistencyCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InitialLoad([]schema.Record{benchRecord(n + 1)}); !errors.Is(err, ErrTableNotEmpty) {
+		t.Errorf("Expected ErrTableNotEmpty loading into a full table, got %v", err)
+	}
+	if _, err := store.Insert(benchRecord(n + 1)); err != nil {
+		t.Errorf("Insert after the load failed: %v", err)
+	}
+}
+
+func TestDeleteReturningGivesBackTheRecord(t *testing.T) {
+	for _, opts := range []StoreOptions{{}, {Forwarding: true}} {
+		filename := filepath.Join(t.TempDir(), "bench.db")
+		store, cleanup := newStoreForTest(t, filename, opts)
+		for i := 1; i <= 200; i++ {
+			if _, err := store.Insert(benchRecord(i)); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+		}
+
+		rec, err := store.DeleteReturning(42)
+		if err != nil {
+			t.Fatalf("DeleteReturning failed: %v", err)
+		}
+		if rec["id"] != int32(42) || rec["name"] != "record_42" {
+			t.Errorf("DeleteReturning(42) = %v", rec)
+		}
+		if _, err := store.Find(42); err == nil {
+			t.Error("Find still sees the deleted record")
+		}
+		if _, err := store.DeleteReturning(42); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound deleting it again, got %v", err)
+		}
+		if err := store.ConsistencyCheck(); err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+	}
+}
+
+func TestRecoveryRefusesWALFromAnotherSchema(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	store, err := CreateWithOptions(filename, benchSchema(), StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	// crash with the insert only in the WAL
+	cancel()
+	wg.Wait()
+	store.Close()
+
+	// change the schema behind the WAL's back, as an ADD COLUMN would
+	setFields := func(fields []schema.Field) {
+		t.Helper()
+		f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		dm := pager.NewDiskManager(f)
+		if err := dm.ReadHeader(); err != nil {
+			t.Fatal(err)
+		}
+		h := dm.GetHeader()
+		h.Schema.Fields = fields
+		h.SchemaHash = h.Schema.Hash()
+		if err := dm.WriteHeader(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original := benchSchema().Fields
+	setFields(append(slices.Clone(original), schema.Field{Name: "note", Type: schema.StringType}))
+
+	if _, err := Open(filename, context.Background(), &sync.WaitGroup{}); !errors.Is(err, pager.ErrWALSchemaChanged) {
+		t.Fatalf("Expected ErrWALSchemaChanged opening under a new schema, got %v", err)
+	}
+
+	// the refusal left the WAL alone, so the old schema still recovers it
+	setFields(original)
+	recovered, err := Open(filename, context.Background(), &sync.WaitGroup{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer recovered.Close()
+	if _, err := recovered.Find(1); err != nil {
+		t.Errorf("Find after recovery failed: %v", err)
+	}
+}
+
+func TestRecoveryReplaysALargeWAL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("logs and recovers 100k records")
+	}
+	const n = 100000
+	filename := filepath.Join(t.TempDir(), "bench.db")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	store, err := CreateWithOptions(filename, benchSchema(), StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys past n are in the tree, on disk, for the WAL's deletes to remove
+	for i := n + 1; i <= n+1000; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatalf("Insert(%d) failed: %v", i, err)
+		}
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	// simulate a crash between logging writes and applying them: they go
+	// to the WAL only, as Commit logs them before touching the tree
+	var txn []pager.WALRecord
+	for i := 1; i <= n; i++ {
+		rec, err := store.PrepareInsert(benchRecord(i))
+		if err != nil {
+			t.Fatalf("PrepareInsert(%d) failed: %v", i, err)
+		}
+		txn = append(txn, rec)
+		if len(txn) == 10000 {
+			if err := store.logBatch(txn); err != nil {
+				t.Fatalf("logBatch failed: %v", err)
+			}
+			txn = nil
+		}
+	}
+	for i := n + 1; i <= n+500; i++ {
+		rec, err := store.PrepareDelete(uint64(i))
+		if err != nil {
+			t.Fatalf("PrepareDelete(%d) failed: %v", i, err)
+		}
+		txn = append(txn, rec)
+	}
+	if err := store.logBatch(txn); err != nil {
+		t.Fatalf("logBatch failed: %v", err)
+	}
+	walSize, err := store.wal.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	wg.Wait()
+	// every page was flushed by the checkpoint, so closing writes nothing new
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	wg = &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	start := time.Now()
+	recovered, err := OpenWithOptions(filename, StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	t.Logf("recovered %d records in %v", n+500, time.Since(start))
+	defer recovered.Close()
+
+	if count, err := recovered.Count(); err != nil || count != n+500 {
+		t.Errorf("Count() after recovery = %d (err=%v), want %d", count, err, n+500)
+	}
+	for _, key := range []uint64{1, n / 2, n, n + 501} {
+		if _, err := recovered.Find(key); err != nil {
+			t.Errorf("Find(%d) after recovery failed: %v", key, err)
+		}
+	}
+	if _, err := recovered.Find(n + 1); err == nil {
+		t.Errorf("deleted key %d came back after recovery", n+1)
+	}
+	// replay goes straight to the tree; logging it again would grow the WAL
+	if size, err := recovered.wal.Size(); err != nil || size != walSize {
+		t.Errorf("WAL size after recovery = %d (err=%v), want %d", size, err, walSize)
+	}
+}
+
+func TestCreatedAtIsStampedOnInsert(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{CreatedAt: true})
+	defer cleanup()
+
+	before := time.Now().Unix()
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	rec, err := store.Find(1)
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	createdAt, ok := rec[schema.CreatedAtField].(int64)
+	if !ok || createdAt < before || createdAt > time.Now().Unix() {
+		t.Fatalf("%s = %v, want the insert time", schema.CreatedAtField, rec[schema.CreatedAtField])
+	}
+
+	// clients can't set it, on insert or update
+	forged := benchRecord(2)
+	forged[schema.CreatedAtField] = int64(1)
+	if _, err := store.Insert(forged); !errors.Is(err, schema.ErrSystemField) {
+		t.Errorf("Insert setting %s = %v, want ErrSystemField", schema.CreatedAtField, err)
+	}
+	forged["id"] = int32(1)
+	if _, err := store.Update(forged); !errors.Is(err, schema.ErrSystemField) {
+		t.Errorf("Update setting %s = %v, want ErrSystemField", schema.CreatedAtField, err)
+	}
+
+	// an update keeps the insert time, here one from long ago
+	store.mu.Lock()
+	stamped := withCreatedAt(benchRecord(3), 1000)
+	data, err := store.bt.SerializeRecord(stamped)
+	if err == nil {
+		err = store.bt.Insert(3, data)
+	}
+	if store.tableBloom != nil {
+		store.tableBloom.Add(3)
+	}
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := benchRecord(3)
+	updated["name"] = "renamed"
+	if n, err := store.Update(updated); err != nil || n != 1 {
+		t.Fatalf("Update = %d, %v", n, err)
+	}
+	if rec, err := store.Find(3); err != nil || rec[schema.CreatedAtField] != int64(1000) || rec["name"] != "renamed" {
+		t.Errorf("after update, record 3 = %v (err=%v), want %s kept at 1000", rec, err, schema.CreatedAtField)
+	}
+
+	// the field stays a system field in the saved schema
+	header, err := pager.ReadTableHeader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Schema.HasCreatedAt() {
+		t.Errorf("saved schema %v has no system %s field", header.Schema.Fields, schema.CreatedAtField)
+	}
+}
+
+func TestScansStopAtTheResultCap(t *testing.T) {
+	store, cleanup := newStoreForTest(t, filepath.Join(t.TempDir(), "bench.db"), StoreOptions{})
+	defer cleanup()
+	for i := 1; i <= 20; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	if err := store.SetMaxResultRows(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ScanAll(); !errors.Is(err, ErrResultTooLarge) {
+		t.Errorf("ScanAll of 20 records with a cap of 10 = %v, want ErrResultTooLarge", err)
+	}
+	if _, err := store.RangeScanKV(1, 11); !errors.Is(err, ErrResultTooLarge) {
+		t.Errorf("RangeScanKV of 11 records = %v, want ErrResultTooLarge", err)
+	}
+	if _, _, err := store.Query("value", ">", float64(0)); !errors.Is(err, ErrResultTooLarge) {
+		t.Errorf("Query matching 20 records = %v, want ErrResultTooLarge", err)
+	}
+	// prefix 1 is keys 1 and 10-19
+	if _, err := store.ScanPrefix("1"); !errors.Is(err, ErrResultTooLarge) {
+		t.Errorf("ScanPrefix matching 11 records = %v, want ErrResultTooLarge", err)
+	}
+	if _, err := store.ScanPrefix(""); !errors.Is(err, ErrResultTooLarge) {
+		t.Errorf("ScanPrefix of every record = %v, want ErrResultTooLarge", err)
+	}
+	if records, err := store.ScanPrefix("2"); err != nil || len(records) != 2 {
+		t.Errorf("ScanPrefix under the cap = %d records, %v", len(records), err)
+	}
+	if records, err := store.RangeScan(1, 10); err != nil || len(records) != 10 {
+		t.Errorf("RangeScan of exactly the cap = %d records, %v", len(records), err)
+	}
+	streamed := 0
+	if err := store.RangeScanFunc(0, math.MaxUint64, func(schema.Record) error { streamed++; return nil }); err != nil || streamed != 20 {
+		t.Errorf("RangeScanFunc streamed %d records (err=%v), want all 20", streamed, err)
+	}
+
+	if err := store.SetMaxResultRows(-1); err == nil {
+		t.Error("Expected a negative cap to be rejected")
+	}
+	if err := store.SetMaxResultRows(0); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := store.ScanAll(); err != nil || len(records) != 20 {
+		t.Errorf("ScanAll under the default cap = %d records, %v", len(records), err)
+	}
+}
+
+func TestInsertInvalidatesCachedMiss(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+	for i := 1; i <= 100; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	// make 500 a bloom false positive so the miss goes to the negative cache
+	if store.tableBloom != nil {
+		store.tableBloom.Add(500)
+	}
+	if _, err := store.Find(500); err == nil {
+		t.Fatal("Find(500) found a record that was never inserted")
+	}
+	if !store.negCache.Contains(500) {
+		t.Fatal("Find(500) did not cache the miss")
+	}
+
+	if _, err := store.Insert(benchRecord(500)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	rec, err := store.Find(500)
+	if err != nil {
+		t.Fatalf("Find after insert: %v", err)
+	}
+	if rec["name"] != "record_500" {
+		t.Errorf("Find(500) = %v", rec)
+	}
+}
+
+func TestRangeScanChunksReleasesTheLockBetweenChunks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+	for i := 1; i <= 250; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	var sizes []int
+	var ids []int32
+	err := store.RangeScanChunks(context.Background(), 1, 250, true, true, 100, func(records []schema.Record) error {
+		sizes = append(sizes, len(records))
+		for _, rec := range records {
+			ids = append(ids, rec["id"].(int32))
+		}
+		// would deadlock if the scan still held the read lock
+		_, err := store.Insert(benchRecord(1000 + len(sizes)))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RangeScanChunks failed: %v", err)
+	}
+	if !slices.Equal(sizes, []int{100, 100, 50}) {
+		t.Errorf("chunk sizes = %v, want [100 100 50]", sizes)
+	}
+	if len(ids) != 250 || ids[0] != 1 || ids[249] != 250 || !slices.IsSorted(ids) {
+		t.Errorf("scanned %d ids, want 1..250 in order", len(ids))
+	}
+}
+
+func TestWALOnlyInsertHonoursConflictPolicy(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{WALOnly: true})
+	defer cleanup()
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	changed := benchRecord(1)
+	changed["name"] = "changed"
+	result, err := store.InsertWithOptions(changed, InsertOptions{OnConflict: ConflictIgnore})
+	if err != nil || result != Ignored {
+		t.Fatalf("insert ignore = %v, %v; want Ignored", result, err)
+	}
+	if rec, err := store.Find(1); err != nil || rec["name"] != "record_1" {
+		t.Errorf("Find(1) after insert ignore = %v, %v", rec, err)
+	}
+
+	result, err = store.InsertWithOptions(changed, InsertOptions{OnConflict: ConflictReplace})
+	if err != nil || result != Replaced {
+		t.Fatalf("insert replace = %v, %v; want Replaced", result, err)
+	}
+	if rec, err := store.Find(1); err != nil || rec["name"] != "changed" {
+		t.Errorf("Find(1) after insert replace = %v, %v", rec, err)
+	}
+}
+
+func TestRenameOutsideWorkingDirectory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	dir := t.TempDir()
+	store, cleanup := newStoreForTest(t, filepath.Join(dir, "bench.db"), StoreOptions{})
+	defer cleanup()
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	if err := store.Rename("moved"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved.db")); err != nil {
+		t.Errorf("table file not renamed in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bench.db")); !os.IsNotExist(err) {
+		t.Errorf("old table file still there: %v", err)
+	}
+	if _, err := os.Stat("moved.db"); !os.IsNotExist(err) {
+		t.Error("table file was moved into the working directory")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(filepath.Join(dir, "moved.db"), context.Background(), &sync.WaitGroup{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Schema().TableName != "moved" {
+		t.Errorf("TableName = %q, want moved", reopened.Schema().TableName)
+	}
+	if _, err := reopened.Find(1); err != nil {
+		t.Errorf("Find after rename failed: %v", err)
+	}
+}
+
+func TestOpenCopiedTableRecoversItsWAL(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "bench.db")
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	store, err := CreateWithOptions(filename, benchSchema(), StoreOptions{}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	// crash with the insert only in the WAL
+	cancel()
+	wg.Wait()
+	store.Close()
+
+	for _, ext := range []string{".db", ".wal"} {
+		data, err := os.ReadFile(filepath.Join(dir, "bench"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "copy"+ext), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copied, err := Open(filepath.Join(dir, "copy.db"), context.Background(), &sync.WaitGroup{})
+	if err != nil {
+		t.Fatalf("Open of the copy failed: %v", err)
+	}
+	defer copied.Close()
+	if copied.Schema().TableName != "bench" {
+		t.Errorf("Open rewrote the header name to %q", copied.Schema().TableName)
+	}
+	if _, err := copied.Find(1); err != nil {
+		t.Errorf("Find after recovering the copy failed: %v", err)
+	}
+}
+
+// uniqueNameSchema is benchSchema with name unique.
+func uniqueNameSchema() schema.Schema {
+	sch := benchSchema()
+	sch.Fields = slices.Clone(sch.Fields)
+	sch.Fields[1].Unique = true
+	return sch
+}
+
+func TestUniqueEnforcedOnWALOnlyTables(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newSchemaStoreForTest(t, filename, uniqueNameSchema(), StoreOptions{WALOnly: true})
+	defer cleanup()
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	clash := benchRecord(2)
+	clash["name"] = "record_1"
+	if _, err := store.Insert(clash); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Insert of a duplicate name = %v, want ErrUniqueViolation", err)
+	}
+	if _, err := store.Insert(benchRecord(2)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if _, err := store.Update(clash); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Update to a duplicate name = %v, want ErrUniqueViolation", err)
+	}
+	if rec, err := store.Find(2); err != nil || rec["name"] != "record_2" {
+		t.Errorf("Find(2) = %v, %v", rec, err)
+	}
+}
+
+func TestCommitChecksUniqueAgainstTableAndBatch(t *testing.T) {
+	for _, opts := range []StoreOptions{{}, {WALOnly: true}} {
+		filename := filepath.Join(t.TempDir(), "bench.db")
+		store, cleanup := newSchemaStoreForTest(t, filename, uniqueNameSchema(), opts)
+		if _, err := store.Insert(benchRecord(1)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		prepare := func(id int, name string) pager.WALRecord {
+			t.Helper()
+			rec := benchRecord(id)
+			rec["name"] = name
+			wr, err := store.PrepareInsert(rec)
+			if err != nil {
+				t.Fatalf("PrepareInsert(%d) failed: %v", id, err)
+			}
+			return wr
+		}
+
+		// two rows of one transaction can't share a value
+		batch := []pager.WALRecord{prepare(2, "same"), prepare(3, "same")}
+		if err := store.Commit(batch); !errors.Is(err, ErrUniqueViolation) {
+			t.Errorf("%+v: Commit of a clashing batch = %v, want ErrUniqueViolation", opts, err)
+		}
+
+		// nor take one inserted after it was prepared
+		batch = []pager.WALRecord{prepare(4, "late")}
+		late := benchRecord(5)
+		late["name"] = "late"
+		if _, err := store.Insert(late); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if err := store.Commit(batch); !errors.Is(err, ErrUniqueViolation) {
+			t.Errorf("%+v: Commit after a concurrent insert = %v, want ErrUniqueViolation", opts, err)
+		}
+
+		// but a value freed in the same transaction can be reused
+		del, err := store.PrepareDelete(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := benchRecord(6)
+		rec["name"] = "record_1"
+		data, err := store.bt.SerializeRecord(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reuse := pager.WALRecord{Action: pager.INSERT, Key: 6, RecordBytes: data, RecordLength: uint32(len(data))}
+		if err := store.Commit([]pager.WALRecord{del, reuse}); err != nil {
+			t.Errorf("%+v: Commit reusing a deleted value failed: %v", opts, err)
+		}
+
+		for _, key := range []uint64{2, 3, 4} {
+			if _, err := store.Find(key); err == nil {
+				t.Errorf("%+v: rejected commit left key %d behind", opts, key)
+			}
+		}
+		if got, err := store.Find(6); err != nil || got["name"] != "record_1" {
+			t.Errorf("%+v: Find(6) = %v, %v", opts, got, err)
+		}
+		cleanup()
+	}
+}
+
+func TestDeleteAndUpdateCountRows(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+	if _, err := store.Insert(benchRecord(1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	if n, err := store.Update(benchRecord(2)); err != nil || n != 0 {
+		t.Errorf("Update of a missing key = %d, %v; want 0", n, err)
+	}
+	if _, err := store.Find(2); err == nil {
+		t.Error("Update of a missing key inserted it")
+	}
+	if n, err := store.Delete(2); err != nil || n != 0 {
+		t.Errorf("Delete of a missing key = %d, %v; want 0", n, err)
+	}
+	if n, err := store.Update(benchRecord(1)); err != nil || n != 1 {
+		t.Errorf("Update of key 1 = %d, %v; want 1", n, err)
+	}
+	if n, err := store.Delete(1); err != nil || n != 1 {
+		t.Errorf("Delete of key 1 = %d, %v; want 1", n, err)
+	}
+}
+
+func TestWALOnlyDeleteAndUpdateCountsAreUnknown(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{WALOnly: true})
+	defer cleanup()
+
+	if n, err := store.Update(benchRecord(1)); err != nil || n != RowsUnknown {
+		t.Errorf("WAL-only Update = %d, %v; want RowsUnknown", n, err)
+	}
+	if n, err := store.Delete(2); err != nil || n != RowsUnknown {
+		t.Errorf("WAL-only Delete = %d, %v; want RowsUnknown", n, err)
+	}
+}
+
+func TestPendingWALListsRecordsSinceCheckpoint(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bench.db")
+	store, cleanup := newStoreForTest(t, filename, StoreOptions{})
+	defer cleanup()
+	for i := 1; i <= 2; i++ {
+		if _, err := store.Insert(benchRecord(i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if _, err := store.Delete(1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	records, err := store.PendingWAL()
+	if err != nil {
+		t.Fatalf("PendingWAL failed: %v", err)
+	}
+	var got []string
+	for _, rec := range records {
+		got = append(got, rec.Action.String()+" "+strconv.Itoa(int(rec.Key)))
+	}
+	if want := []string{"INSERT 1", "INSERT 2", "DELETE 1"}; !slices.Equal(got, want) {
+		t.Errorf("PendingWAL = %v, want %v", got, want)
+	}
+	if pending, err := store.HasPendingWAL(); err != nil || !pending {
+		t.Errorf("HasPendingWAL = %v, %v before a checkpoint", pending, err)
+	}
+
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := store.PendingWAL(); err != nil || len(records) != 0 {
+		t.Errorf("PendingWAL after a checkpoint = %d records, %v", len(records), err)
+	}
+	if pending, err := store.HasPendingWAL(); err != nil || pending {
+		t.Errorf("HasPendingWAL = %v, %v after a checkpoint", pending, err)
+	}
+}
+
+func TestIndexedFieldLookupsFollowWritesAndReopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "people.db")
+	sch := schema.Schema{
+		TableName: "people",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.IntType},
+			{Name: "team", Type: schema.StringType, Indexed: true},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if _, err := CreateWithOptions(filepath.Join(t.TempDir(), "bad.db"), schema.Schema{
+		TableName: "bad",
+		Fields:    []schema.Field{{Name: "id", Type: schema.IntType, Indexed: true}},
+	}, StoreOptions{}, ctx, wg); err == nil {
+		t.Error("Expected an index on the primary key to fail")
+	}
+	if _, err := CreateWithOptions(filepath.Join(t.TempDir(), "bad.db"), sch, StoreOptions{WALOnly: true}, ctx, wg); err == nil {
+		t.Error("Expected an index on a wal-only table to fail")
+	}
+
+	store, err := CreateWithOptions(filename, sch, StoreOptions{}, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 50; i++ {
+		if _, err := store.Insert(schema.Record{"id": int32(i), "team": "t" + strconv.Itoa(i%5)}); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+
+	expect := func(team string, keys ...int32) {
+		t.Helper()
+		records, plan, err := store.Query("team", "=", team)
+		if err != nil {
+			t.Fatalf("Query team = %s failed: %v", team, err)
+		}
+		if plan.Strategy != IndexLookup || plan.IndexKeys != len(keys) {
+			t.Errorf("team = %s planned as %s", team, plan)
+		}
+		var got []int32
+		for _, rec := range records {
+			if rec["team"] != team {
+				t.Errorf("team = %s returned %v", team, rec)
+			}
+			got = append(got, rec["id"].(int32))
+		}
+		if !slices.Equal(got, keys) {
+			t.Errorf("team = %s returned keys %v, want %v", team, got, keys)
+		}
+	}
+	expect("t3", 3, 8, 13, 18, 23, 28, 33, 38, 43, 48)
+	expect("none")
+
+	if _, err := store.Update(schema.Record{"id": int32(3), "team": "t4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Insert(schema.Record{"id": int32(51), "team": "t3"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("t3", 13, 18, 23, 28, 33, 38, 43, 48, 51)
+	expect("t4", 3, 4, 9, 14, 19, 24, 29, 34, 39, 44, 49)
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = Open(filename, ctx, wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !store.Schema().Fields[1].Indexed {
+		t.Fatal("Expected the index to be recorded in the header")
+	}
+	expect("t3", 13, 18, 23, 28, 33, 38, 43, 48, 51)
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"godb/internal/schema"
+	"math"
+	"slices"
+	"sync"
+)
+
+// Secondary indexes map the values of a field marked Indexed to the keys of
+// the records holding them, so Query answers "field = value" without a full
+// scan. The schema in the header records which fields are indexed; the
+// indexes themselves are kept in memory, built from the tree on open.
+//
+// The tree tells the store the keys each write touches (BTree.OnChange).
+// Those are only marked stale; a lookup rereads them from the tree first.
+
+// secondaryIndex is one field's index.
+type secondaryIndex struct {
+	keys   map[any][]uint64 // value -> keys of the records holding it, sorted
+	values map[uint64]any   // key -> its record's value
+}
+
+func newSecondaryIndex() *secondaryIndex {
+	return &secondaryIndex{keys: make(map[any][]uint64), values: make(map[uint64]any)}
+}
+
+func (si *secondaryIndex) add(key uint64, value any) {
+	si.remove(key)
+	keys := si.keys[value]
+	i, _ := slices.BinarySearch(keys, key)
+	si.keys[value] = slices.Insert(keys, i, key)
+	si.values[key] = value
+}
+
+func (si *secondaryIndex) remove(key uint64) {
+	value, ok := si.values[key]
+	if !ok {
+		return
+	}
+	keys := si.keys[value]
+	if i, found := slices.BinarySearch(keys, key); found {
+		keys = slices.Delete(keys, i, i+1)
+	}
+	if len(keys) == 0 {
+		delete(si.keys, value)
+	} else {
+		si.keys[value] = keys
+	}
+	delete(si.values, key)
+}
+
+// indexSet is a table's secondary indexes. byField is fixed once built;
+// mu guards the indexes' contents and stale.
+type indexSet struct {
+	mu      sync.Mutex
+	byField map[string]*secondaryIndex
+	stale   map[uint64]bool // keys written since they were last indexed
+}
+
+func (is *indexSet) markStale(keys ...uint64) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for _, key := range keys {
+		is.stale[key] = true
+	}
+}
+
+// index adds rec, stored under key, to every index. Caller must hold is.mu.
+func (is *indexSet) index(key uint64, rec schema.Record) {
+	for field, si := range is.byField {
+		si.add(key, rec[field])
+	}
+}
+
+// rebuildIndexes builds the schema's secondary indexes from the tree, and
+// has the tree report the keys later writes touch. Caller must hold lock.
+func (bts *BTreeStore) rebuildIndexes() error {
+	indexed := bts.bt.GetSchema().IndexedFields()
+	if len(indexed) == 0 {
+		bts.indexes = nil
+		bts.bt.OnChange(nil)
+		return nil
+	}
+
+	is := &indexSet{byField: make(map[string]*secondaryIndex, len(indexed)), stale: make(map[uint64]bool)}
+	for _, field := range indexed {
+		is.byField[field.Name] = newSecondaryIndex()
+	}
+	err := bts.bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		_, rec, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return fmt.Errorf("failed to index key %d: %w", key, err)
+		}
+		is.index(key, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bts.indexes = is
+	bts.bt.OnChange(is.markStale)
+	return nil
+}
+
+// indexLookup returns the keys of the records whose field holds value, in
+// key order, from field's secondary index. Caller must hold lock, for
+// reading at least.
+func (bts *BTreeStore) indexLookup(field string, value any) ([]uint64, error) {
+	is := bts.indexes
+	if is == nil || is.byField[field] == nil {
+		return nil, fmt.Errorf("field %s is not indexed", field)
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	for key := range is.stale {
+		data, found, err := bts.bt.Search(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reindex key %d: %w", key, err)
+		}
+		for _, si := range is.byField {
+			si.remove(key)
+		}
+		if found {
+			_, rec, err := bts.bt.DeserializeRecord(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to reindex key %d: %w", key, err)
+			}
+			is.index(key, rec)
+		}
+		delete(is.stale, key)
+	}
+	return slices.Clone(is.byField[field].keys[value]), nil
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/schema"
+)
+
+var ErrTableNotEmpty = errors.New("table is not empty")
+
+// InitialLoad fills an empty table from records, which must be in strictly
+// ascending key order, e.g. to migrate a table in. Records are checked as
+// Insert checks them, but don't go through the WAL or the tree one at a
+// time: leaves are packed in order and the new file is swapped in as Vacuum
+// does, so the load is all or nothing. The retained log (RetainLog) doesn't
+// see loaded records. Fails with ErrTableNotEmpty unless the table is empty.
+func (bts *BTreeStore) InitialLoad(records []schema.Record) error {
+	if bts.replica {
+		return fmt.Errorf("initial load: %w", ErrReplica)
+	}
+	if bts.bt.IsWALOnly() {
+		return errors.New("initial load: a wal-only table has no tree to load")
+	}
+	bts.vacuumMu.Lock()
+	defer bts.vacuumMu.Unlock()
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	count, err := bts.bt.Count()
+	if err != nil {
+		return fmt.Errorf("initial load: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("initial load: table '%s' has %d records: %w", bts.Schema().TableName, count, ErrTableNotEmpty)
+	}
+
+	unique := bts.Schema().UniqueFields()
+	seen := make([]map[any]uint64, len(unique))
+	for i := range seen {
+		seen[i] = make(map[any]uint64)
+	}
+
+	data := make([][]byte, len(records))
+	var prev uint64
+	for i, record := range records {
+		key, err := bts.bt.ExtractPrimaryKey(record)
+		if err != nil {
+			return fmt.Errorf("initial load: record %d: %w", i, err)
+		}
+		if i > 0 && key <= prev {
+			return fmt.Errorf("initial load: record %d has key %d after key %d; records must be sorted by key", i, key, prev)
+		}
+		prev = key
+		if err := bts.checkKeyRange(key); err != nil {
+			return fmt.Errorf("initial load: record %d: %w", i, err)
+		}
+		if record, err = bts.stampCreatedAt(record); err != nil {
+			return fmt.Errorf("initial load: record %d: %w", i, err)
+		}
+		for j, field := range unique {
+			if other, ok := seen[j][record[field.Name]]; ok {
+				return fmt.Errorf("initial load: %w: field %s value %v already used by key %d", ErrUniqueViolation, field.Name, record[field.Name], other)
+			}
+			seen[j][record[field.Name]] = key
+		}
+		if bts.bt.IsVersioned() {
+			record = withVersion(record, 1)
+		}
+		if data[i], err = bts.bt.SerializeRecord(record); err != nil {
+			return fmt.Errorf("initial load: record %d: %w", i, err)
+		}
+	}
+
+	// the WAL may still hold the writes that emptied the table; flush them
+	// so recovery can't replay them over the loaded tree
+	if _, err := bts.checkpoint(); err != nil {
+		return fmt.Errorf("initial load: %w", err)
+	}
+	if err := bts.bt.LoadSorted(data); err != nil {
+		return fmt.Errorf("initial load: %w", err)
+	}
+	bts.negCache.Clear()
+	if err := bts.rebuildBloomFilter(); err != nil {
+		return fmt.Errorf("initial load: %w", err)
+	}
+	if err := bts.rebuildIndexes(); err != nil {
+		return fmt.Errorf("initial load: %w", err)
+	}
+	if bts.snapshotReads {
+		if err := bts.takeSnapshot(); err != nil {
+			return fmt.Errorf("initial load: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"godb/internal/btree"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MergeTables creates dst holding every record of srcA and srcB, e.g. to
+// combine time-partitioned tables. The sources must have the same fields
+// (their table names may differ) and the same record format, and no key may
+// be in both. dst gets srcA's options: its record format, key range, retained
+// log and the table options set on it (see SetOption). A srcB key outside
+// srcA's key range fails the merge. The sources are left unchanged.
+//
+// The sources are opened here, so they must not be open elsewhere.
+func MergeTables(dst, srcA, srcB string) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// nothing here outlives the merge, so no background checkpoints
+	a, err := OpenWithOptions(srcA, StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		return fmt.Errorf("merge: failed to open %s: %w", srcA, err)
+	}
+	defer a.Close()
+	b, err := OpenWithOptions(srcB, StoreOptions{CheckpointInterval: NoCheckpointer}, ctx, wg)
+	if err != nil {
+		return fmt.Errorf("merge: failed to open %s: %w", srcB, err)
+	}
+	defer b.Close()
+
+	if err := checkMergeable(a, b); err != nil {
+		return fmt.Errorf("merge: %s and %s: %w", srcA, srcB, err)
+	}
+	// WAL-only sources build their trees now
+	if err := a.ensureMaterialized(); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	if err := b.ensureMaterialized(); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+
+	sch := a.Schema()
+	sch.TableName = filepath.Base(strings.TrimSuffix(dst, ".db"))
+	opts := StoreOptions{
+		Codec:       a.Codec(),
+		Compress:    a.IsCompressed(),
+		OmitKey:     a.OmitsKey(),
+		FlushWrites: a.FlushesWrites(),
+		Versioned:   a.IsVersioned(),
+		Forwarding:  a.ForwardsUpdates(),
+		RetainLog:   a.RetainsLog(),
+
+		CheckpointInterval: NoCheckpointer,
+	}
+	opts.MinKey, opts.MaxKey, opts.KeyRange = a.KeyRange()
+	if opts.KeyRange {
+		shape, err := b.Shape()
+		if err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+		if !shape.Empty && (shape.MinKey < opts.MinKey || shape.MaxKey > opts.MaxKey) {
+			return fmt.Errorf("merge: %s has keys outside %s's range [%d, %d]: %w", srcB, srcA, opts.MinKey, opts.MaxKey, ErrKeyOutOfRange)
+		}
+	}
+	d, err := CreateWithOptions(dst, sch, opts, ctx, wg)
+	if err != nil {
+		return fmt.Errorf("merge: failed to create %s: %w", dst, err)
+	}
+	defer func() {
+		if closeErr := d.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("merge: failed to close %s: %w", dst, closeErr)
+		}
+		if err != nil {
+			os.Remove(dst)
+			os.Remove(strings.TrimSuffix(dst, ".db") + ".wal")
+			os.Remove(strings.TrimSuffix(dst, ".db") + ".log")
+		}
+	}()
+	for name, value := range a.Options() {
+		if _, ok := tableOptions[name]; !ok {
+			continue // Open ignores it on srcA too
+		}
+		if err := d.SetOption(name, value); err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+	}
+
+	a.mu.RLock()
+	b.mu.RLock()
+	pages, rootID, err := btree.MergeBulkLoad(a.bt, b.bt)
+	b.mu.RUnlock()
+	a.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.bt.ReplaceTree(pages, rootID); err != nil {
+		return fmt.Errorf("merge: failed to write %s: %w", dst, err)
+	}
+	if err := d.rebuildBloomFilter(); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	if err := d.rebuildIndexes(); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	return nil
+}
+
+// checkMergeable rejects tables whose records can't share one tree: their
+// fields differ, or their records are encoded differently.
+func checkMergeable(a, b *BTreeStore) error {
+	sa, sb := a.Schema(), b.Schema()
+	sa.TableName, sb.TableName = "", ""
+	if sa.Hash() != sb.Hash() {
+		return errors.New("schemas differ")
+	}
+	if a.Codec() != b.Codec() || a.IsCompressed() != b.IsCompressed() || a.OmitsKey() != b.OmitsKey() ||
+		a.IsVersioned() != b.IsVersioned() || a.ForwardsUpdates() != b.ForwardsUpdates() {
+		return errors.New("record formats differ (codec, compress, omitkey, versioned or forwarding)")
+	}
+	return nil
+}
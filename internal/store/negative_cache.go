@@ -0,0 +1,70 @@
+package store
+
+import "sync"
+
+const defaultNegativeCacheSize = 1024
+
+// NegativeCache remembers keys recently confirmed absent by a full tree search,
+// so repeated probes for a missing key that slips past the bloom filter are O(1).
+// Entries are evicted FIFO once the cache is full.
+type NegativeCache struct {
+	capacity int
+	keys     map[uint64]struct{}
+	order    []uint64 // ring buffer of inserted keys, oldest at head
+	head     int
+	mu       sync.Mutex
+}
+
+func NewNegativeCache(capacity int) *NegativeCache {
+	if capacity <= 0 {
+		capacity = defaultNegativeCacheSize
+	}
+	return &NegativeCache{
+		capacity: capacity,
+		keys:     make(map[uint64]struct{}, capacity),
+		order:    make([]uint64, 0, capacity),
+	}
+}
+
+func (nc *NegativeCache) Contains(key uint64) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	_, ok := nc.keys[key]
+	return ok
+}
+
+func (nc *NegativeCache) Add(key uint64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if _, ok := nc.keys[key]; ok {
+		return
+	}
+
+	if len(nc.order) < nc.capacity {
+		nc.order = append(nc.order, key)
+	} else {
+		// full - overwrite the oldest entry
+		delete(nc.keys, nc.order[nc.head])
+		nc.order[nc.head] = key
+		nc.head = (nc.head + 1) % nc.capacity
+	}
+	nc.keys[key] = struct{}{}
+}
+
+// Remove invalidates a key, e.g. because it was just inserted.
+// The ring slot is left in place; when it's overwritten it may evict a re-added
+// copy of the key early, which only costs a cache miss.
+func (nc *NegativeCache) Remove(key uint64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.keys, key)
+}
+
+func (nc *NegativeCache) Clear() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.keys = make(map[uint64]struct{}, nc.capacity)
+	nc.order = nc.order[:0]
+	nc.head = 0
+}
@@ -0,0 +1,74 @@
+package store
+
+import "testing"
+
+func TestNegativeCacheAddRemoveClear(t *testing.T) {
+	nc := NewNegativeCache(4)
+	nc.Add(1)
+	nc.Add(2)
+	if !nc.Contains(1) || !nc.Contains(2) {
+		t.Fatal("added keys should be cached")
+	}
+	if nc.Contains(3) {
+		t.Error("key 3 was never added")
+	}
+
+	nc.Remove(1)
+	if nc.Contains(1) {
+		t.Error("removed key still cached")
+	}
+	if !nc.Contains(2) {
+		t.Error("removing 1 dropped 2")
+	}
+
+	nc.Clear()
+	if nc.Contains(2) {
+		t.Error("Clear left key 2 cached")
+	}
+	nc.Add(5)
+	if !nc.Contains(5) {
+		t.Error("cache unusable after Clear")
+	}
+}
+
+func TestNegativeCacheEvictsOldestFirst(t *testing.T) {
+	nc := NewNegativeCache(3)
+	for key := uint64(1); key <= 3; key++ {
+		nc.Add(key)
+	}
+	nc.Add(2) // already cached: must not take another slot
+
+	nc.Add(4)
+	if nc.Contains(1) {
+		t.Error("oldest key 1 should have been evicted")
+	}
+	for _, key := range []uint64{2, 3, 4} {
+		if !nc.Contains(key) {
+			t.Errorf("key %d evicted early", key)
+		}
+	}
+
+	nc.Add(5)
+	nc.Add(6)
+	if nc.Contains(2) || nc.Contains(3) {
+		t.Error("keys 2 and 3 should have been evicted in order")
+	}
+	for _, key := range []uint64{4, 5, 6} {
+		if !nc.Contains(key) {
+			t.Errorf("key %d evicted early", key)
+		}
+	}
+}
+
+func TestNegativeCacheDefaultCapacity(t *testing.T) {
+	nc := NewNegativeCache(0)
+	for key := uint64(0); key <= defaultNegativeCacheSize; key++ {
+		nc.Add(key)
+	}
+	if nc.Contains(0) {
+		t.Error("key 0 should be evicted once the default capacity is exceeded")
+	}
+	if !nc.Contains(1) || !nc.Contains(defaultNegativeCacheSize) {
+		t.Error("keys within the default capacity were evicted")
+	}
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Table options are settings that can change after a table is created.
+// SetOption applies one and keeps it in the header, so Open applies it
+// again; settings fixed at creation stay in StoreOptions.
+
+type tableOption struct {
+	usage string
+	unset string // the value in effect when the option was never set
+	apply func(bts *BTreeStore, value string) error
+}
+
+var tableOptions = map[string]tableOption{
+	"growchunk": {"pages to grow the file by at once (0 = page at a time)", "0", func(bts *BTreeStore, value string) error {
+		n, err := parseOptionInt(value)
+		if err != nil {
+			return err
+		}
+		bts.SetGrowChunk(n)
+		return nil
+	}},
+	"cachebytes": {"page cache byte budget (0 = page count only)", "0", func(bts *BTreeStore, value string) error {
+		n, err := parseOptionInt(value)
+		if err != nil {
+			return err
+		}
+		bts.SetCacheMaxBytes(int64(n))
+		return nil
+	}},
+	"maxrecordsize": {"largest encoded record in bytes (0 = page limit)", "0", func(bts *BTreeStore, value string) error {
+		n, err := parseOptionInt(value)
+		if err != nil {
+			return err
+		}
+		return bts.SetMaxRecordSize(n)
+	}},
+	"allownonfinite": {"store NaN and ±Inf floats (true/false)", "false", func(bts *BTreeStore, value string) error {
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		bts.SetAllowNonFinite(on)
+		return nil
+	}},
+	"snapshotreads": {"serve FindSnapshot from each checkpoint (true/false)", "false", func(bts *BTreeStore, value string) error {
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		return bts.SetSnapshotReads(on)
+	}},
+}
+
+func parseOptionInt(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%d is negative", n)
+	}
+	return n, nil
+}
+
+// OptionNames lists the options SetOption accepts, sorted, with a line on each.
+func OptionNames() []string {
+	names := slices.Sorted(maps.Keys(tableOptions))
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s: %s", name, tableOptions[name].usage)
+	}
+	return names
+}
+
+// SetOption applies a table option and persists it in the header. If the
+// header can't be written, the option is put back as it was.
+func (bts *BTreeStore) SetOption(name, value string) error {
+	opt, ok := tableOptions[name]
+	if !ok {
+		return fmt.Errorf("unknown option: %s", name)
+	}
+	if bts.replica {
+		return fmt.Errorf("option %s: %w", name, ErrReplica)
+	}
+	prev, ok, _ := bts.Option(name)
+	if !ok {
+		prev = opt.unset
+	}
+	if err := opt.apply(bts, value); err != nil {
+		return fmt.Errorf("option %s: invalid value %q: %w", name, value, err)
+	}
+
+	bts.mu.Lock()
+	err := bts.bt.SetOption(name, value)
+	bts.mu.Unlock()
+	if err != nil {
+		if undoErr := opt.apply(bts, prev); undoErr != nil {
+			return fmt.Errorf("option %s: failed to write header: %w (and failed to restore %q: %v)", name, err, prev, undoErr)
+		}
+		return fmt.Errorf("option %s: failed to write header: %w", name, err)
+	}
+	return nil
+}
+
+// Option returns a table option's persisted value, and false if it was
+// never set.
+func (bts *BTreeStore) Option(name string) (string, bool, error) {
+	if _, ok := tableOptions[name]; !ok {
+		return "", false, fmt.Errorf("unknown option: %s", name)
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	value, ok := bts.bt.Options()[name]
+	return value, ok, nil
+}
+
+// Options returns every table option set on this table.
+func (bts *BTreeStore) Options() map[string]string {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	return bts.bt.Options()
+}
+
+// applyOptions applies the options persisted in the header, on Open.
+func (bts *BTreeStore) applyOptions() error {
+	for name, value := range bts.bt.Options() {
+		opt, ok := tableOptions[name]
+		if !ok {
+			bts.logger.Warn("ignoring unknown table option %s", name)
+			continue
+		}
+		if err := opt.apply(bts, value); err != nil {
+			return fmt.Errorf("option %s: %w", name, err)
+		}
+	}
+	return nil
+}
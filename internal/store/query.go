@@ -0,0 +1,403 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"godb/internal/schema"
+	"math"
+	"time"
+)
+
+// A tiny planner for single-predicate queries, "<field> <op> <value>".
+// Predicates on the primary key walk only the keys they can match, and
+// "field = value" on an indexed field reads just the keys its secondary
+// index holds for value; anything else is a full scan that filters each record.
+
+type QueryStrategy int
+
+const (
+	PointLookup  QueryStrategy = iota // key = v
+	KeyRangeScan                      // key <, <=, >, >= v
+	FullScan                          // any other field, or key != v
+	IndexLookup                       // indexed field = v
+)
+
+func (qs QueryStrategy) String() string {
+	switch qs {
+	case PointLookup:
+		return "primary key lookup"
+	case KeyRangeScan:
+		return "primary key range scan"
+	case FullScan:
+		return "full scan"
+	case IndexLookup:
+		return "secondary index lookup"
+	default:
+		return fmt.Sprintf("QueryStrategy(%d)", int(qs))
+	}
+}
+
+// QueryPlan is how Query will answer a predicate. For PointLookup and
+// KeyRangeScan, the keys read are Start to End with the given bounds. For
+// IndexLookup, IndexKeys is how many keys the index held for Value when
+// the plan was made.
+type QueryPlan struct {
+	Strategy QueryStrategy
+	Field    string
+	Op       string
+	Value    any
+
+	Start, End               uint64
+	IncludeStart, IncludeEnd bool
+
+	IndexKeys int
+}
+
+func (qp QueryPlan) String() string {
+	switch qp.Strategy {
+	case PointLookup:
+		return fmt.Sprintf("%s on %s = %d", qp.Strategy, qp.Field, qp.Start)
+	case KeyRangeScan:
+		lo, hi := "[", "]"
+		if !qp.IncludeStart {
+			lo = "("
+		}
+		if !qp.IncludeEnd {
+			hi = ")"
+		}
+		return fmt.Sprintf("%s on %s, keys %s%d, %d%s", qp.Strategy, qp.Field, lo, qp.Start, qp.End, hi)
+	case IndexLookup:
+		return fmt.Sprintf("%s on %s = %v, %d keys", qp.Strategy, qp.Field, qp.Value, qp.IndexKeys)
+	default:
+		return fmt.Sprintf("%s, filter %s %s %v", qp.Strategy, qp.Field, qp.Op, qp.Value)
+	}
+}
+
+// Plan picks a strategy for "field op value" without running it. op is one
+// of =, !=, <, <=, >, >=; value is typed as schema.ParseValue returns it.
+func (bts *BTreeStore) Plan(field, op string, value any) (QueryPlan, error) {
+	sch := bts.Schema()
+	idx := -1
+	for i, f := range sch.Fields {
+		if f.Name == field {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return QueryPlan{}, fmt.Errorf("unknown field: %s", field)
+	}
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=":
+	default:
+		return QueryPlan{}, fmt.Errorf("unknown operator: %s", op)
+	}
+
+	// dates parse to unix seconds but decode to YYYY-MM-DD, so compare as decoded
+	if v, ok := value.(int64); ok && sch.Fields[idx].Type == schema.DateType {
+		value = time.Unix(v, 0).UTC().Format("2006-01-02")
+	}
+
+	plan := QueryPlan{Strategy: FullScan, Field: field, Op: op, Value: value}
+	if idx != 0 && op == "=" && sch.Fields[idx].Indexed {
+		bts.mu.RLock()
+		keys, err := bts.indexLookup(field, value)
+		bts.mu.RUnlock()
+		if err != nil {
+			return QueryPlan{}, err
+		}
+		plan.Strategy, plan.IndexKeys = IndexLookup, len(keys)
+		return plan, nil
+	}
+	if idx != 0 || op == "!=" {
+		return plan, nil
+	}
+
+	plan.Strategy = KeyRangeScan
+	plan.Start, plan.End = 0, math.MaxUint64
+	plan.IncludeStart, plan.IncludeEnd = true, true
+
+	// no key is negative: a negative bound keeps every key or none of them
+	if isNegative(value) {
+		if op == "=" || op == "<" || op == "<=" {
+			plan.End, plan.IncludeStart, plan.IncludeEnd = 0, false, false
+		}
+		return plan, nil
+	}
+
+	key, err := sch.ExtractPrimaryKey(schema.Record{field: value})
+	if err != nil {
+		return QueryPlan{}, err
+	}
+	switch op {
+	case "=":
+		plan.Strategy = PointLookup
+		plan.Start, plan.End = key, key
+	case "<":
+		plan.End, plan.IncludeEnd = key, false
+	case "<=":
+		plan.End = key
+	case ">":
+		plan.Start, plan.IncludeStart = key, false
+	case ">=":
+		plan.Start = key
+	}
+	return plan, nil
+}
+
+func isNegative(value any) bool {
+	switch v := value.(type) {
+	case int32:
+		return v < 0
+	case int64:
+		return v < 0
+	}
+	return false
+}
+
+// Query returns the records matching "field op value", in key order, along
+// with the plan used to find them.
+func (bts *BTreeStore) Query(field, op string, value any) ([]schema.Record, QueryPlan, error) {
+	plan, err := bts.Plan(field, op, value)
+	if err != nil {
+		return nil, QueryPlan{}, err
+	}
+	records, err := bts.Execute(plan)
+	return records, plan, err
+}
+
+// Execute runs a plan from Plan.
+func (bts *BTreeStore) Execute(plan QueryPlan) ([]schema.Record, error) {
+	switch plan.Strategy {
+	case PointLookup, KeyRangeScan:
+		return bts.RangeScanEx(plan.Start, plan.End, plan.IncludeStart, plan.IncludeEnd)
+	case IndexLookup:
+		return bts.executeIndexLookup(plan)
+	}
+
+	limit := bts.resultLimit()
+	var results []schema.Record
+	err := bts.RangeScanFunc(0, math.MaxUint64, func(rec schema.Record) error {
+		match, err := plan.Matches(rec)
+		if err != nil {
+			return err
+		}
+		if match {
+			if len(results) == limit {
+				return bts.tooLarge(0, math.MaxUint64)
+			}
+			results = append(results, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// executeIndexLookup reads the records plan's index holds for its value.
+func (bts *BTreeStore) executeIndexLookup(plan QueryPlan) ([]schema.Record, error) {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	keys, err := bts.indexLookup(plan.Field, plan.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > bts.resultLimit() {
+		return nil, fmt.Errorf("lookup of %s = %v has more than %d records: %w", plan.Field, plan.Value, bts.resultLimit(), ErrResultTooLarge)
+	}
+	results := make([]schema.Record, 0, len(keys))
+	for _, key := range keys {
+		data, found, err := bts.bt.Search(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("index on %s holds key %d, which isn't in the table", plan.Field, key)
+		}
+		_, rec, err := bts.bt.DeserializeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, rec)
+	}
+	return results, nil
+}
+
+// Matches reports whether rec satisfies the plan's predicate.
+func (qp QueryPlan) Matches(rec schema.Record) (bool, error) {
+	c, err := schema.CompareValues(rec[qp.Field], qp.Value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", qp.Field, err)
+	}
+	switch qp.Op {
+	case "=":
+		return c == 0, nil
+	case "!=":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	default:
+		return false, fmt.Errorf("unknown operator: %s", qp.Op)
+	}
+}
+
+// TreeShape is what the planner knows about a table's size, enough to
+// estimate the pages a plan reads without running it.
+type TreeShape struct {
+	Depth          int // levels from the root to a leaf
+	Leaves         int // estimated from the live page count and the mean fanout
+	MinKey, MaxKey uint64
+	Empty          bool
+}
+
+// Shape reads the tree's depth, page counts, fanout and smallest and
+// largest keys. Besides the paths Fanout samples, it touches one
+// root-to-leaf path per end of the key range.
+func (bts *BTreeStore) Shape() (TreeShape, error) {
+	if err := bts.ensureMaterialized(); err != nil {
+		return TreeShape{}, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	shape := TreeShape{Depth: bts.bt.GetDepth()}
+	live := int(bts.bt.NumPages()) - len(bts.bt.FreePages())
+	children, _, err := bts.bt.Fanout()
+	if err != nil {
+		return TreeShape{}, err
+	}
+	shape.Leaves = estimateLeaves(live, shape.Depth, children)
+
+	minKey, maxKey, ok, err := bts.keySpan()
+	if err != nil {
+		return TreeShape{}, err
+	}
+	shape.MinKey, shape.MaxKey, shape.Empty = minKey, maxKey, !ok
+	return shape, nil
+}
+
+// estimateLeaves splits live pages between the leaf level and the levels
+// above it. With fanout f each level holds 1/f as many pages as the one
+// below, so live = leaves * (1 + 1/f + ... + 1/f^(depth-1)).
+func estimateLeaves(live, depth int, fanout float64) int {
+	if depth <= 1 || fanout <= 1 {
+		return 1
+	}
+	perLeaf, level := 1.0, 1.0
+	for range depth - 1 {
+		level /= fanout
+		perLeaf += level
+	}
+	return max(int(math.Round(float64(live)/perLeaf)), 1)
+}
+
+// keySpan returns the smallest and largest keys in the tree; ok is false
+// when it's empty. Caller must hold lock.
+func (bts *BTreeStore) keySpan() (minKey, maxKey uint64, ok bool, err error) {
+	first, err := bts.bt.SeekAndScan(0, true, 1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	last, err := bts.bt.SeekAndScan(math.MaxUint64, false, 1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if len(first) == 0 || len(last) == 0 {
+		return 0, 0, false, nil
+	}
+	return binary.LittleEndian.Uint64(first[0][:8]), binary.LittleEndian.Uint64(last[0][:8]), true, nil
+}
+
+// EstimatePages guesses how many pages running plan reads, assuming keys
+// are spread evenly over the leaves between MinKey and MaxKey.
+func (ts TreeShape) EstimatePages(plan QueryPlan) int {
+	switch plan.Strategy {
+	case PointLookup:
+		return ts.Depth
+	case IndexLookup:
+		// the index is in memory; each key it holds is a root-to-leaf descent
+		return ts.Depth * plan.IndexKeys
+	case KeyRangeScan:
+		if ts.Empty {
+			return ts.Depth
+		}
+		lo, hi := max(plan.Start, ts.MinKey), min(plan.End, ts.MaxKey)
+		if lo > hi {
+			return ts.Depth
+		}
+		span := float64(ts.MaxKey-ts.MinKey) + 1
+		leaves := int(math.Ceil(float64(ts.Leaves) * (float64(hi-lo) + 1) / span))
+		return ts.Depth - 1 + max(leaves, 1)
+	default:
+		return ts.Depth - 1 + ts.Leaves
+	}
+}
+
+// KeyHistogram counts the table's keys in up to buckets equal-width bins
+// spanning its smallest to largest key; fewer when the span doesn't divide
+// into that many. Keys are read straight from the leaves, so no record is decoded.
+func (bts *BTreeStore) KeyHistogram(buckets int) ([]int, error) {
+	h, err := bts.KeyDistribution(buckets)
+	if err != nil {
+		return nil, err
+	}
+	return h.Counts, nil
+}
+
+// Histogram is KeyHistogram's counts along with the key span they cover.
+type Histogram struct {
+	Counts         []int
+	MinKey, MaxKey uint64
+	width          uint64
+}
+
+// Bucket returns the keys bin i covers, inclusive.
+func (h Histogram) Bucket(i int) (lo, hi uint64) {
+	lo = h.MinKey + uint64(i)*h.width
+	hi = min(lo+h.width-1, h.MaxKey)
+	return lo, hi
+}
+
+func (bts *BTreeStore) KeyDistribution(buckets int) (Histogram, error) {
+	if buckets < 1 {
+		return Histogram{}, fmt.Errorf("histogram needs at least 1 bucket, got %d", buckets)
+	}
+	if err := bts.ensureMaterialized(); err != nil {
+		return Histogram{}, err
+	}
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+
+	h := Histogram{Counts: make([]int, buckets), width: 1}
+	minKey, maxKey, ok, err := bts.keySpan()
+	if err != nil {
+		return Histogram{}, err
+	}
+	if !ok {
+		return h, nil
+	}
+	h.MinKey, h.MaxKey = minKey, maxKey
+	// round the width up so buckets bins cover every key, then drop bins
+	// that would start past MaxKey (keys stop at MaxInt64, so n can't overflow)
+	n := maxKey - minKey + 1
+	h.width = (n + uint64(buckets) - 1) / uint64(buckets)
+	h.Counts = h.Counts[:(n+h.width-1)/h.width]
+
+	err = bts.bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		h.Counts[(key-h.MinKey)/h.width]++
+		return nil
+	})
+	if err != nil {
+		return Histogram{}, err
+	}
+	return h, nil
+}
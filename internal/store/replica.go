@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/btree"
+	"godb/internal/pager"
+	"os"
+)
+
+// A read replica is a store opened with OpenReplica on a table file that
+// another process writes. It reads the file as the writer last left it on
+// disk, so it calls RefreshSnapshot, e.g. on a timer, to pick up the
+// writer's checkpoints.
+//
+// A replica's view is stale by up to the writer's checkpoint interval plus
+// however long ago the replica last refreshed. Writes still in the
+// writer's WAL are never seen. Between checkpoints the writer's cache may
+// also evict dirty pages to the file, so a refresh can see some writes
+// ahead of their checkpoint.
+//
+// The replica opens the file read-only and has no WAL and no checkpointer,
+// so it never touches the writer's files: its writes fail with ErrReplica,
+// and Close flushes nothing.
+
+// ErrReplica is returned by writes to a store opened with OpenReplica.
+var ErrReplica = errors.New("table is a read replica")
+
+// OpenReplica opens filename read-only as a read replica. WAL-only tables
+// can't be replicated, since their records live in the writer's WAL.
+func OpenReplica(filename string) (*BTreeStore, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	dm := &pager.DiskManager{}
+	dm.SetFile(file)
+	dm.SetReadOnly()
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s is empty, not a table file", filename)
+	}
+	if err := dm.ReadHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	header := dm.GetHeader()
+	if header.WALOnly {
+		file.Close()
+		return nil, fmt.Errorf("%s is a wal-only table, which a replica can't read", filename)
+	}
+	if header.SchemaHash == 0 {
+		// table predates schema hashes; the writer adds one when it opens it
+		header.SchemaHash = header.Schema.Hash()
+	}
+
+	bts := &BTreeStore{bt: btree.NewBTree(dm, header), replica: true, negCache: NewNegativeCache(defaultNegativeCacheSize), logger: storeLog}
+	if err := bts.rebuildBloomFilter(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := bts.rebuildIndexes(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := bts.applyOptions(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return bts, nil
+}
+
+// RefreshSnapshot rereads the table's header and drops the page cache,
+// so reads see the file as it is now, including a new root or a file
+// vacuum put in place. The bloom filter, negative cache and secondary
+// indexes are rebuilt to match, and a snapshot for FindSnapshot is
+// retaken if those are on.
+// It fails if this store has written pages it hasn't flushed yet.
+func (bts *BTreeStore) RefreshSnapshot() error {
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	if err := bts.bt.Reload(); err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	bts.negCache.Clear()
+	if err := bts.rebuildBloomFilter(); err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if err := bts.rebuildIndexes(); err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if bts.snapshotReads {
+		if err := bts.takeSnapshot(); err != nil {
+			return fmt.Errorf("refresh: %w", err)
+		}
+	}
+	return nil
+}
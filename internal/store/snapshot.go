@@ -0,0 +1,115 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/schema"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Snapshot reads answer point lookups from an immutable copy of the table
+// taken at each checkpoint, so they take no lock at all: readers don't
+// wait for each other or for a writer holding mu. The tree itself is
+// updated in place, so it can't be read without the lock.
+//
+// A snapshot read sees every write committed before the last checkpoint.
+// It never sees part of a batch or transaction, since the copy is taken
+// under mu's read lock, right after the checkpoint lets go of the write
+// lock. It can be stale by up to the checkpoint interval, and it misses
+// the reader's own writes until the next Checkpoint. The copy holds every
+// record, so it costs as much memory as the table's data, and writers wait
+// while it's taken.
+
+var ErrSnapshotReadsOff = errors.New("snapshot reads are not enabled")
+
+// readSnapshot is the table's keys and stored records at one checkpoint.
+// It is never modified after it's published.
+type readSnapshot struct {
+	keys    []uint64
+	records [][]byte
+	takenAt time.Time
+}
+
+func (rs *readSnapshot) find(key uint64) ([]byte, bool) {
+	i := sort.Search(len(rs.keys), func(i int) bool { return rs.keys[i] >= key })
+	if i == len(rs.keys) || rs.keys[i] != key {
+		return nil, false
+	}
+	return rs.records[i], true
+}
+
+// SetSnapshotReads turns snapshot reads (FindSnapshot) on or off. Turning
+// them on takes the first snapshot right away; each checkpoint replaces it.
+// Not for WAL-only tables, whose checkpoints don't build the tree.
+func (bts *BTreeStore) SetSnapshotReads(on bool) error {
+	if on && bts.bt.IsWALOnly() {
+		return errors.New("snapshot reads need a tree; this table is wal-only")
+	}
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+
+	bts.snapshotReads = on
+	if !on {
+		bts.snapshot.Store(nil)
+		return nil
+	}
+	return bts.takeSnapshot()
+}
+
+// refreshSnapshot retakes the snapshot, if snapshot reads are on, under
+// the read lock. Caller must not hold lock.
+func (bts *BTreeStore) refreshSnapshot() error {
+	bts.mu.RLock()
+	defer bts.mu.RUnlock()
+	if !bts.snapshotReads {
+		return nil
+	}
+	return bts.takeSnapshot()
+}
+
+// takeSnapshot copies the tree's records into a new snapshot and publishes
+// it. Caller must hold lock, for reading at least.
+func (bts *BTreeStore) takeSnapshot() error {
+	rs := &readSnapshot{takenAt: time.Now()}
+	err := bts.bt.RangeScanFunc(0, math.MaxUint64, func(key uint64, data []byte) error {
+		rs.keys = append(rs.keys, key)
+		rs.records = append(rs.records, slices.Clone(data))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to take read snapshot: %w", err)
+	}
+	bts.snapshot.Store(rs)
+	return nil
+}
+
+// FindSnapshot is Find against the last checkpoint's snapshot, without
+// taking the store lock. It fails with ErrSnapshotReadsOff unless
+// SetSnapshotReads is on.
+func (bts *BTreeStore) FindSnapshot(key uint64) (schema.Record, error) {
+	rs := bts.snapshot.Load()
+	if rs == nil {
+		return nil, ErrSnapshotReadsOff
+	}
+	data, found := rs.find(key)
+	if !found {
+		return nil, fmt.Errorf("record %d not found", key)
+	}
+	_, result, err := bts.bt.DeserializeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SnapshotTime is when the snapshot FindSnapshot reads was taken, or the
+// zero time if snapshot reads are off.
+func (bts *BTreeStore) SnapshotTime() time.Time {
+	if rs := bts.snapshot.Load(); rs != nil {
+		return rs.takenAt
+	}
+	return time.Time{}
+}
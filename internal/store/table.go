@@ -2,12 +2,14 @@ package store
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"godb/internal/encoding"
 	"godb/internal/schema"
 	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 type TableStore struct {
@@ -154,7 +156,7 @@ func (ts *TableStore) WriteSchema() error {
 	return nil
 }
 
-func (ts *TableStore) Find(id int) (schema.Record, error) {
+func (ts *TableStore) Find(id uint64) (schema.Record, error) {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 	if _, err := ts.File.Seek(ts.HeaderSize, io.SeekStart); err != nil {
@@ -169,7 +171,7 @@ func (ts *TableStore) Find(id int) (schema.Record, error) {
 
 		for _, field := range ts.Schema.Fields {
 			value, err := readValue(ts.File, field.Type)
-			if err == io.EOF {
+			if errors.Is(err, io.EOF) {
 				if !found {
 					return nil, fmt.Errorf("key not found: %d", id)
 				}
@@ -181,7 +183,11 @@ func (ts *TableStore) Find(id int) (schema.Record, error) {
 			record[field.Name] = value
 		}
 
-		if record["id"].(int32) == int32(id) {
+		key, err := ts.Schema.ExtractPrimaryKey(record)
+		if err != nil {
+			return nil, err
+		}
+		if key == id {
 			latestRecord = record
 			found = true
 		}
@@ -195,7 +201,7 @@ func (ts *TableStore) ScanAll() ([]schema.Record, error) {
 		return nil, err
 	}
 
-	recordMap := make(map[int32]schema.Record)
+	recordMap := make(map[uint64]schema.Record)
 
 	for {
 		record := make(schema.Record)
@@ -203,7 +209,7 @@ func (ts *TableStore) ScanAll() ([]schema.Record, error) {
 		// try to read all fields for this record
 		for _, field := range ts.Schema.Fields {
 			value, err := readValue(ts.File, field.Type)
-			if err == io.EOF {
+			if errors.Is(err, io.EOF) {
 				// end of file - return what we have
 				uniqueRecords := make([]schema.Record, 0, len(recordMap))
 				for _, rec := range recordMap {
@@ -217,8 +223,11 @@ func (ts *TableStore) ScanAll() ([]schema.Record, error) {
 			record[field.Name] = value
 		}
 
-		id := record["id"].(int32)
-		recordMap[id] = record
+		key, err := ts.Schema.ExtractPrimaryKey(record)
+		if err != nil {
+			return nil, err
+		}
+		recordMap[key] = record
 	}
 }
 
@@ -270,6 +279,10 @@ func writeValue(w io.Writer, fieldType schema.FieldType, value any) error {
 	case schema.FloatType:
 		f := value.(float64)
 		return encoding.WriteFloat64(w, f)
+	case schema.DateType, schema.BigIntType:
+		// dates are unix seconds, as schema encodes them
+		v := value.(int64)
+		return encoding.WriteInt64(w, v)
 	default:
 		return fmt.Errorf("unsupported type: %v", fieldType)
 	}
@@ -293,6 +306,14 @@ func readValue(r io.Reader, fieldType schema.FieldType) (any, error) {
 		return buf[0] != 0, nil
 	case schema.FloatType:
 		return encoding.ReadFloat64(r)
+	case schema.DateType:
+		unixTimestamp, err := encoding.ReadInt64(r)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(unixTimestamp, 0).UTC().Format("2006-01-02"), nil
+	case schema.BigIntType:
+		return encoding.ReadInt64(r)
 	default:
 		return nil, fmt.Errorf("unsupported type: %v", fieldType)
 	}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"godb/internal/schema"
+	"math"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTableStoreRoundTripsEveryColumnType(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "orders.tbl")
+	sch := schema.Schema{
+		TableName: "orders",
+		Fields: []schema.Field{
+			{Name: "order_no", Type: schema.BigIntType},
+			{Name: "placed", Type: schema.DateType},
+			{Name: "total", Type: schema.FloatType},
+			{Name: "qty", Type: schema.IntType},
+			{Name: "paid", Type: schema.BoolType},
+			{Name: "note", Type: schema.StringType},
+		},
+	}
+	day := func(s string) int64 {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Unix()
+	}
+	const bigKey = int64(math.MaxUint32) + 7
+
+	ts, err := CreateTableStore(filename, sch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []schema.Record{
+		{"order_no": bigKey, "placed": day("2024-02-29"), "total": 19.5, "qty": int32(2), "paid": false, "note": "first"},
+		{"order_no": int64(3), "placed": day("1999-12-31"), "total": -0.25, "qty": int32(-1), "paid": true, "note": ""},
+		// a later record for the same key replaces the first
+		{"order_no": bigKey, "placed": day("2024-03-01"), "total": 21.75, "qty": int32(3), "paid": true, "note": "second"},
+	} {
+		if err := ts.Insert(rec); err != nil {
+			t.Fatalf("Insert(%v) failed: %v", rec, err)
+		}
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen, so the schema comes back from the file too
+	ts, err = NewTableStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if !reflect.DeepEqual(ts.Schema, sch) {
+		t.Fatalf("Schema after reopen = %+v, want %+v", ts.Schema, sch)
+	}
+
+	// dates read back as YYYY-MM-DD, as the binary codec decodes them
+	want := map[uint64]schema.Record{
+		uint64(bigKey): {"order_no": bigKey, "placed": "2024-03-01", "total": 21.75, "qty": int32(3), "paid": true, "note": "second"},
+		3:              {"order_no": int64(3), "placed": "1999-12-31", "total": -0.25, "qty": int32(-1), "paid": true, "note": ""},
+	}
+	for key, rec := range want {
+		got, err := ts.Find(key)
+		if err != nil {
+			t.Fatalf("Find(%d) failed: %v", key, err)
+		}
+		if !reflect.DeepEqual(got, rec) {
+			t.Errorf("Find(%d) = %v, want %v", key, got, rec)
+		}
+	}
+	if _, err := ts.Find(4); err == nil {
+		t.Error("Find of a missing key succeeded")
+	}
+
+	all, err := ts.ScanAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(want) {
+		t.Fatalf("ScanAll returned %d records, want %d", len(all), len(want))
+	}
+	keys := make([]uint64, 0, len(all))
+	for _, rec := range all {
+		key, err := sch.ExtractPrimaryKey(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rec, want[key]) {
+			t.Errorf("ScanAll record %d = %v, want %v", key, rec, want[key])
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, []uint64{3, uint64(bigKey)}) {
+		t.Errorf("ScanAll keys = %v", keys)
+	}
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/btree"
+	"godb/internal/pager"
+	"io"
+)
+
+// A WAL-only table appends inserts and deletes to the WAL and nothing else.
+// The tree is built the first time a read needs it: the WAL is replayed,
+// flushed and truncated, and later writes start a new pending WAL.
+// Tables that are only ever scanned with ScanWAL never build a tree at all.
+
+// ScanWAL calls fn for every WAL record, oldest first, without touching the tree.
+// A checkpoint compacts the pending WAL, leaving only the last record per key.
+// Returning btree.ErrStopScan from fn ends the scan early without error.
+func (bts *BTreeStore) ScanWAL(fn func(pager.WALRecord) error) error {
+	records, err := bts.PendingWAL()
+	if err != nil {
+		return fmt.Errorf("scanwal: %w", err)
+	}
+
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			if errors.Is(err, btree.ErrStopScan) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureMaterialized builds a WAL-only table's tree if records are pending.
+// Only the read lock is taken when nothing is, so reads don't serialize.
+func (bts *BTreeStore) ensureMaterialized() error {
+	if !bts.bt.IsWALOnly() {
+		return nil
+	}
+	bts.mu.RLock()
+	pending := bts.walPending
+	bts.mu.RUnlock()
+	if !pending {
+		return nil
+	}
+	bts.mu.Lock()
+	defer bts.mu.Unlock()
+	return bts.materialize()
+}
+
+// materialize replays a WAL-only table's pending records into the tree, then
+// checkpoints so they aren't replayed twice. Caller must hold lock.
+func (bts *BTreeStore) materialize() error {
+	if !bts.walPending {
+		return nil
+	}
+
+	records, err := bts.wal.ReadAll()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("materialize: failed to read WAL: %w", err)
+	}
+
+	for _, record := range pager.CompactRecords(records) {
+		if err := bts.replay(record); err != nil {
+			return fmt.Errorf("materialize: %w", err)
+		}
+	}
+
+	if err := bts.retainWAL(); err != nil {
+		return fmt.Errorf("materialize: %w", err)
+	}
+	if _, err := bts.bt.Checkpoint(); err != nil {
+		return fmt.Errorf("materialize: failed to flush pages: %w", err)
+	}
+	if err := bts.wal.Truncate(); err != nil {
+		return fmt.Errorf("materialize: failed to truncate WAL: %w", err)
+	}
+	bts.walPending = false
+	return nil
+}